@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/middleware"
+	"url-shortener/storage"
+)
+
+// Abuse report categories.
+const (
+	ReportPhishing = "phishing"
+	ReportSpam     = "spam"
+	ReportMalware  = "malware"
+	ReportOther    = "other"
+)
+
+// Report states. A report starts pending and is resolved by an admin
+// action: approve (the link is fine), ignore (the report is not
+// actionable) or takedown (the link is disabled).
+const (
+	ReportPending   = "pending"
+	ReportApproved  = "approved"
+	ReportIgnored   = "ignored"
+	ReportTakenDown = "taken_down"
+)
+
+const maxReportComment = 1000
+
+var ErrReportNotFound = errors.New("report not found")
+
+// AbuseReport is an end user's complaint about a short link.
+type AbuseReport struct {
+	ID         string     `json:"id"`
+	StorageKey string     `json:"storage_key"`
+	ShortCode  string     `json:"short_code"`
+	Tenant     string     `json:"tenant,omitempty"`
+	LongURL    string     `json:"long_url"`
+	Category   string     `json:"category"`
+	Comment    string     `json:"comment,omitempty"`
+	ReporterIP string     `json:"reporter_ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Status     string     `json:"status"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	ResolvedBy string     `json:"resolved_by,omitempty"`
+}
+
+// ReportStore queues abuse reports for review.
+type ReportStore interface {
+	Add(ctx context.Context, r *AbuseReport) error
+	Get(ctx context.Context, id string) (*AbuseReport, error)
+	// List returns reports with status (all if empty), oldest first.
+	List(ctx context.Context, status string) ([]*AbuseReport, error)
+	Save(ctx context.Context, r *AbuseReport) error
+}
+
+type memoryReports struct {
+	mu      sync.Mutex
+	reports map[string]*AbuseReport
+}
+
+func newMemoryReports() *memoryReports {
+	return &memoryReports{reports: make(map[string]*AbuseReport)}
+}
+
+func (m *memoryReports) Add(ctx context.Context, r *AbuseReport) error {
+	return m.Save(ctx, r)
+}
+
+func (m *memoryReports) Get(_ context.Context, id string) (*AbuseReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.reports[id]
+	if !ok {
+		return nil, ErrReportNotFound
+	}
+	c := *r
+	return &c, nil
+}
+
+func (m *memoryReports) List(_ context.Context, status string) ([]*AbuseReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []*AbuseReport{}
+	for _, r := range m.reports {
+		if status == "" || r.Status == status {
+			c := *r
+			out = append(out, &c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (m *memoryReports) Save(_ context.Context, r *AbuseReport) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *r
+	m.reports[r.ID] = &c
+	return nil
+}
+
+// redisReports keeps reports in the hash prefix+"reports", indexed by
+// creation time in the sorted set prefix+"reports:by_time".
+type redisReports struct {
+	client *redis.Client
+	prefix string
+}
+
+func (r *redisReports) key() string      { return r.prefix + "reports" }
+func (r *redisReports) indexKey() string { return r.prefix + "reports:by_time" }
+
+func (r *redisReports) Add(ctx context.Context, rep *AbuseReport) error {
+	b, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	pipe := r.client.TxPipeline()
+	pipe.HSet(ctx, r.key(), rep.ID, b)
+	pipe.ZAdd(ctx, r.indexKey(), redis.Z{Score: float64(rep.CreatedAt.UnixMilli()), Member: rep.ID})
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (r *redisReports) Get(ctx context.Context, id string) (*AbuseReport, error) {
+	b, err := r.client.HGet(ctx, r.key(), id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrReportNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rep AbuseReport
+	if err := json.Unmarshal(b, &rep); err != nil {
+		return nil, err
+	}
+	return &rep, nil
+}
+
+func (r *redisReports) List(ctx context.Context, status string) ([]*AbuseReport, error) {
+	ids, err := r.client.ZRange(ctx, r.indexKey(), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := []*AbuseReport{}
+	if len(ids) == 0 {
+		return out, nil
+	}
+	raw, err := r.client.HMGet(ctx, r.key(), ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range raw {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var rep AbuseReport
+		if err := json.Unmarshal([]byte(s), &rep); err != nil {
+			continue
+		}
+		if status == "" || rep.Status == status {
+			out = append(out, &rep)
+		}
+	}
+	return out, nil
+}
+
+func (r *redisReports) Save(ctx context.Context, rep *AbuseReport) error {
+	b, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	return r.client.HSet(ctx, r.key(), rep.ID, b).Err()
+}
+
+// reportHandler serves POST /report/{code}, open to anyone. When captcha
+// is set, a valid captcha_token is required; verifier outages fail closed
+// since the endpoint is unauthenticated.
+func reportHandler(store *Store, reports ReportStore, captcha Captcha) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Category     string `json:"category"`
+			Comment      string `json:"comment,omitempty"`
+			CaptchaToken string `json:"captcha_token,omitempty"`
+		}
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		switch req.Category {
+		case ReportPhishing, ReportSpam, ReportMalware, ReportOther:
+		default:
+			writeAPIError(w, r, fieldError("category", "category must be phishing, spam, malware or other"))
+			return
+		}
+		if len([]rune(req.Comment)) > maxReportComment {
+			writeAPIError(w, r, fieldError("comment", fmt.Sprintf("comment must be at most %d characters", maxReportComment)))
+			return
+		}
+		ip := middleware.ClientIP(r)
+		if captcha != nil && !checkCaptcha(w, r, captcha, req.CaptchaToken) {
+			return
+		}
+		code := codeVar(r)
+		link, err := store.Get(r.Context(), code)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		id := make([]byte, 8)
+		_, _ = rand.Read(id)
+		rep := &AbuseReport{
+			ID:         hex.EncodeToString(id),
+			StorageKey: link.Key(),
+			ShortCode:  link.ShortCode,
+			Tenant:     link.Tenant,
+			LongURL:    link.LongURL,
+			Category:   req.Category,
+			Comment:    req.Comment,
+			ReporterIP: ip,
+			CreatedAt:  store.now(),
+			Status:     ReportPending,
+		}
+		if err := reports.Add(r.Context(), rep); err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		metricAbuseReports.Add(1)
+		logrus.WithFields(logrus.Fields{
+			"action":     "abuse_report",
+			"report_id":  rep.ID,
+			"short_code": rep.ShortCode,
+			"category":   rep.Category,
+		}).Info("abuse report received")
+		writeJSON(w, http.StatusAccepted, map[string]string{"id": rep.ID, "status": rep.Status})
+	}
+}
+
+// listReportsHandler serves GET /api/admin/reports, pending reports
+// unless ?status= asks for another state or "all", oldest first and a
+// page at a time.
+func listReportsHandler(reports ReportStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, after, apiErr := pageParams(r.URL.Query())
+		if apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		status := r.URL.Query().Get("status")
+		switch status {
+		case "":
+			status = ReportPending
+		case "all":
+			status = ""
+		case ReportPending, ReportApproved, ReportIgnored, ReportTakenDown:
+		default:
+			writeAPIError(w, r, fieldError("status", "status must be pending, approved, ignored, taken_down or all"))
+			return
+		}
+		list, err := reports.List(r.Context(), status)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		list, next := pageOf(list, (*AbuseReport).position, oldestFirst, after, limit)
+		writeJSON(w, http.StatusOK, withNext(map[string]interface{}{"reports": list}, next))
+	}
+}
+
+// position is the report's place in the queue.
+func (r *AbuseReport) position() storage.Position {
+	return storage.Position{CreatedAt: r.CreatedAt, Key: r.ID}
+}
+
+// resolveReportHandler serves POST /api/admin/reports/{id}/{action}.
+// takedown disables the link, resolves every other pending report about
+// it and tells the owner; the optional body {"reason": "..."} is passed on.
+func resolveReportHandler(store *Store, reports ReportStore, notifier *Notifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		var status string
+		switch vars["action"] {
+		case "approve":
+			status = ReportApproved
+		case "ignore":
+			status = ReportIgnored
+		case "takedown":
+			status = ReportTakenDown
+		default:
+			httpError(w, r, http.StatusNotFound, ErrCodeNotFound, "unknown report action")
+			return
+		}
+		var req struct {
+			Reason string `json:"reason,omitempty"`
+		}
+		if r.ContentLength != 0 {
+			if apiErr := decodeJSON(r, &req); apiErr != nil {
+				writeAPIError(w, r, apiErr)
+				return
+			}
+		}
+		rep, err := reports.Get(r.Context(), vars["id"])
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		if rep.Status != ReportPending {
+			httpError(w, r, http.StatusConflict, ErrCodeConflict, "report was already resolved as "+rep.Status)
+			return
+		}
+		admin := ownerFrom(r.Context())
+		if status == ReportTakenDown {
+			reason := req.Reason
+			if reason == "" {
+				reason = rep.Category
+			}
+			link, err := store.TakeDown(r.Context(), rep.StorageKey, reason)
+			if err != nil {
+				writeAPIError(w, r, apiErrorFrom(err))
+				return
+			}
+			if link.Owner != "" {
+				notifier.sendTakedownNotice(notifier.Prefs(link.Owner), link, store.shortURL(link), reason)
+			}
+			if err := resolveReports(r.Context(), reports, rep.StorageKey, rep.ID, admin); err != nil {
+				logrus.WithError(err).Warn("resolving related abuse reports failed")
+			}
+		}
+		now := store.now()
+		rep.Status, rep.ResolvedAt, rep.ResolvedBy = status, &now, admin
+		if err := reports.Save(r.Context(), rep); err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"action":     "abuse_review",
+			"report_id":  rep.ID,
+			"short_code": rep.ShortCode,
+			"status":     status,
+			"admin":      admin,
+		}).Info("abuse report resolved")
+		writeJSON(w, http.StatusOK, rep)
+	}
+}
+
+// resolveReports marks the other pending reports about key as taken down.
+func resolveReports(ctx context.Context, reports ReportStore, key, except, admin string) error {
+	pending, err := reports.List(ctx, ReportPending)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, p := range pending {
+		if p.StorageKey != key || p.ID == except {
+			continue
+		}
+		p.Status, p.ResolvedAt, p.ResolvedBy = ReportTakenDown, &now, admin
+		if err := reports.Save(ctx, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TakeDown disables the link stored under key: it stays reserved and
+// visible to its owner but no longer redirects.
+func (s *Store) TakeDown(ctx context.Context, key, reason string) (*Link, error) {
+	now := s.now()
+	l, err := s.backend.Update(ctx, key, func(l *Link) error {
+		l.TakenDownAt = &now
+		l.TakedownReason = reason
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"action":      "takedown",
+		"storage_key": key,
+		"reason":      reason,
+	}).Warn("link taken down")
+	return l, nil
+}
+
+type takedownEvent struct {
+	Event     string    `json:"event"`
+	ShortCode string    `json:"short_code"`
+	ShortURL  string    `json:"short_url"`
+	LongURL   string    `json:"long_url"`
+	Owner     string    `json:"owner"`
+	Reason    string    `json:"reason"`
+	At        time.Time `json:"at"`
+}
+
+// sendTakedownNotice goes out on every channel the owner configured, even
+// without expiry notices enabled: a takedown is never routine.
+func (n *Notifier) sendTakedownNotice(p NotificationPrefs, l *Link, shortURL, reason string) {
+	ev := takedownEvent{
+		Event:     "link.taken_down",
+		ShortCode: l.ShortCode,
+		ShortURL:  shortURL,
+		LongURL:   l.LongURL,
+		Owner:     l.Owner,
+		Reason:    reason,
+		At:        *l.TakenDownAt,
+	}
+	text := fmt.Sprintf("Short link %s (→ %s) was disabled after an abuse report: %s.", ev.ShortURL, ev.LongURL, reason)
+	log := logrus.WithFields(logrus.Fields{"action": "takedown_notice", "short_code": l.ShortCode, "owner": l.Owner})
+	if n.deliver(l.Owner, p, ev, "Short link "+l.ShortCode+" was disabled", text, log) == nil {
+		log.Info("takedown notice sent")
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"url-shortener/middleware"
+)
+
+// AccessLogConfig sends the access log somewhere other than the
+// application log. With no sink set, requests are logged through logrus
+// as before.
+type AccessLogConfig struct {
+	Sink string // ACCESS_LOG_SINK: stdout, file, syslog or http
+
+	File string // ACCESS_LOG_FILE, for the file sink; rotated like LOG_FILE
+
+	// SyslogAddr (ACCESS_LOG_SYSLOG_ADDR) is where the syslog sink sends
+	// RFC 5424 messages, as udp://host:port, tcp://host:port or
+	// unix:///dev/log.
+	SyslogAddr string
+
+	// HTTPURL (ACCESS_LOG_HTTP_URL) receives batches from the http sink,
+	// shaped by HTTPFormat (ACCESS_LOG_HTTP_FORMAT): ndjson, loki (the
+	// push API) or elasticsearch (the _bulk API).
+	HTTPURL    string
+	HTTPFormat string
+	HTTPAuth   string // ACCESS_LOG_HTTP_AUTH, sent as the Authorization header
+
+	Buffer        int           // ACCESS_LOG_BUFFER entries held before new ones are dropped
+	BatchSize     int           // ACCESS_LOG_BATCH_SIZE entries written at once
+	FlushInterval time.Duration // ACCESS_LOG_FLUSH_INTERVAL between writes of a partial batch
+}
+
+// AccessLogWriter writes batches of access log entries to one sink.
+type AccessLogWriter interface {
+	Write(ctx context.Context, batch []*middleware.AccessEntry) error
+	Close() error
+}
+
+// newAccessLogWriter builds the sink cfg asks for, or returns nil if it
+// asks for none. log is the application log settings, whose rotation the
+// file sink shares.
+func newAccessLogWriter(cfg AccessLogConfig, log LogConfig) (AccessLogWriter, error) {
+	switch cfg.Sink {
+	case "":
+		return nil, nil
+	case "stdout":
+		return &lineWriter{out: os.Stdout}, nil
+	case "file":
+		if cfg.File == "" {
+			return nil, fmt.Errorf("ACCESS_LOG_SINK=file requires ACCESS_LOG_FILE")
+		}
+		return &lineWriter{out: &lumberjack.Logger{
+			Filename:   cfg.File,
+			MaxSize:    log.MaxSizeMB,
+			MaxBackups: log.MaxBackups,
+			MaxAge:     log.MaxAgeDays,
+			Compress:   true,
+		}}, nil
+	case "syslog":
+		return newSyslogWriter(cfg.SyslogAddr)
+	case "http":
+		if cfg.HTTPURL == "" {
+			return nil, fmt.Errorf("ACCESS_LOG_SINK=http requires ACCESS_LOG_HTTP_URL")
+		}
+		switch cfg.HTTPFormat {
+		case "ndjson", "loki", "elasticsearch":
+		default:
+			return nil, fmt.Errorf("unknown ACCESS_LOG_HTTP_FORMAT %q, want ndjson, loki or elasticsearch", cfg.HTTPFormat)
+		}
+		return &bulkWriter{
+			url:    cfg.HTTPURL,
+			format: cfg.HTTPFormat,
+			auth:   cfg.HTTPAuth,
+			client: &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown ACCESS_LOG_SINK %q, want stdout, file, syslog or http", cfg.Sink)
+}
+
+// AccessLog is the middleware.AccessSink that ships entries to a writer
+// in the background. Its buffer is bounded: when the sink is slow or down
+// and the buffer fills, new entries are dropped and counted rather than
+// holding up requests.
+type AccessLog struct {
+	entries chan *middleware.AccessEntry
+	writer  AccessLogWriter
+	batch   int
+	every   time.Duration
+	stop    chan struct{}
+	done    chan struct{}
+	closing sync.Once
+}
+
+func NewAccessLog(writer AccessLogWriter, buffer, batch int, every time.Duration) *AccessLog {
+	return &AccessLog{
+		entries: make(chan *middleware.AccessEntry, buffer),
+		writer:  writer,
+		batch:   batch,
+		every:   every,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Log queues e, or drops it if the buffer is full. Entries logged after
+// Close are dropped too.
+func (a *AccessLog) Log(e *middleware.AccessEntry) {
+	select {
+	case <-a.stop:
+		metricAccessLogDropped.Add(1)
+		return
+	default:
+	}
+	select {
+	case a.entries <- e:
+	default:
+		metricAccessLogDropped.Add(1)
+	}
+}
+
+// Run writes entries until Close, each batch once it is full or every
+// has passed since the last write.
+func (a *AccessLog) Run() {
+	defer close(a.done)
+	ticker := time.NewTicker(a.every)
+	defer ticker.Stop()
+	batch := make([]*middleware.AccessEntry, 0, a.batch)
+	for {
+		select {
+		case e := <-a.entries:
+			batch = append(batch, e)
+			if len(batch) < a.batch {
+				continue
+			}
+		case <-ticker.C:
+		case <-a.stop:
+			for {
+				select {
+				case e := <-a.entries:
+					batch = append(batch, e)
+					if len(batch) == a.batch {
+						a.write(batch)
+						batch = batch[:0]
+					}
+				default:
+					a.write(batch)
+					return
+				}
+			}
+		}
+		a.write(batch)
+		batch = batch[:0]
+	}
+}
+
+// write sends batch, giving up on it if the sink fails: retrying would
+// only let the buffer behind it fill.
+func (a *AccessLog) write(batch []*middleware.AccessEntry) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := a.writer.Write(ctx, batch); err != nil {
+		metricAccessLogFailed.Add(int64(len(batch)))
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"action":  "access_log",
+			"entries": len(batch),
+		}).Warn("shipping access log failed")
+		return
+	}
+	metricAccessLogShipped.Add(int64(len(batch)))
+}
+
+// Close stops taking entries and writes out the buffer, waiting until
+// ctx is done at most.
+func (a *AccessLog) Close(ctx context.Context) error {
+	a.closing.Do(func() { close(a.stop) })
+	select {
+	case <-a.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return a.writer.Close()
+}
+
+// accessSink returns a as a middleware.AccessSink, keeping a nil *AccessLog
+// from becoming a non-nil interface.
+func accessSink(a *AccessLog) middleware.AccessSink {
+	if a == nil {
+		return nil
+	}
+	return a
+}
+
+// lineWriter writes one JSON object per line.
+type lineWriter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (w *lineWriter) Write(_ context.Context, batch []*middleware.AccessEntry) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range batch {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.out.Write(buf.Bytes())
+	return err
+}
+
+func (w *lineWriter) Close() error {
+	if c, ok := w.out.(io.Closer); ok && w.out != os.Stdout {
+		return c.Close()
+	}
+	return nil
+}
+
+// syslogWriter sends each entry as an RFC 5424 message, facility local0
+// and severity info, with the JSON entry as its text. It dials lazily and
+// redials after an error.
+type syslogWriter struct {
+	network, addr string
+	hostname      string
+	conn          net.Conn
+}
+
+func newSyslogWriter(addr string) (*syslogWriter, error) {
+	u, err := url.Parse(addr)
+	if err != nil || addr == "" {
+		return nil, fmt.Errorf("ACCESS_LOG_SYSLOG_ADDR must be udp://host:port, tcp://host:port or unix:///path")
+	}
+	w := &syslogWriter{network: u.Scheme, addr: u.Host}
+	switch u.Scheme {
+	case "udp", "tcp":
+	case "unix":
+		w.network, w.addr = "unixgram", u.Path
+	default:
+		return nil, fmt.Errorf("ACCESS_LOG_SYSLOG_ADDR must be udp://host:port, tcp://host:port or unix:///path")
+	}
+	w.hostname, _ = os.Hostname()
+	if w.hostname == "" {
+		w.hostname = "-"
+	}
+	return w, nil
+}
+
+// syslogPriority is facility local0 (16) at severity info (6).
+const syslogPriority = 16*8 + 6
+
+func (w *syslogWriter) Write(ctx context.Context, batch []*middleware.AccessEntry) error {
+	if w.conn == nil {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, w.network, w.addr)
+		if err != nil {
+			return err
+		}
+		w.conn = conn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		w.conn.SetWriteDeadline(deadline)
+	}
+	for _, e := range batch {
+		body, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		msg := fmt.Sprintf("<%d>1 %s %s url-shortener %d access - %s",
+			syslogPriority, e.Time.Format(time.RFC3339Nano), w.hostname, os.Getpid(), body)
+		if w.network == "tcp" {
+			// Octet counting framing, RFC 6587.
+			msg = strconv.Itoa(len(msg)) + " " + msg
+		}
+		if _, err := io.WriteString(w.conn, msg); err != nil {
+			w.conn.Close()
+			w.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *syslogWriter) Close() error {
+	if w.conn == nil {
+		return nil
+	}
+	return w.conn.Close()
+}
+
+// bulkWriter posts each batch in one request.
+type bulkWriter struct {
+	url, format, auth string
+	client            *http.Client
+}
+
+func (w *bulkWriter) Write(ctx context.Context, batch []*middleware.AccessEntry) error {
+	body, contentType, err := w.encode(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if w.auth != "" {
+		req.Header.Set("Authorization", w.auth)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("access log sink: %s", resp.Status)
+	}
+	if w.format != "elasticsearch" {
+		return nil
+	}
+	// _bulk answers 200 even when some documents were refused.
+	var out struct {
+		Errors bool `json:"errors"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&out) == nil && out.Errors {
+		return fmt.Errorf("access log sink: elasticsearch refused some documents")
+	}
+	return nil
+}
+
+func (w *bulkWriter) encode(batch []*middleware.AccessEntry) ([]byte, string, error) {
+	var buf bytes.Buffer
+	switch w.format {
+	case "loki":
+		values := make([][2]string, len(batch))
+		for i, e := range batch {
+			line, err := json.Marshal(e)
+			if err != nil {
+				return nil, "", err
+			}
+			values[i] = [2]string{strconv.FormatInt(e.Time.UnixNano(), 10), string(line)}
+		}
+		err := json.NewEncoder(&buf).Encode(map[string]interface{}{
+			"streams": []map[string]interface{}{{
+				"stream": map[string]string{"app": "url-shortener", "log": "access"},
+				"values": values,
+			}},
+		})
+		return buf.Bytes(), "application/json", err
+	case "elasticsearch":
+		enc := json.NewEncoder(&buf)
+		for _, e := range batch {
+			buf.WriteString(`{"create":{}}` + "\n")
+			if err := enc.Encode(struct {
+				*middleware.AccessEntry
+				Timestamp time.Time `json:"@timestamp"`
+			}{e, e.Time}); err != nil {
+				return nil, "", err
+			}
+		}
+		return buf.Bytes(), "application/x-ndjson", nil
+	}
+	enc := json.NewEncoder(&buf)
+	for _, e := range batch {
+		if err := enc.Encode(e); err != nil {
+			return nil, "", err
+		}
+	}
+	return buf.Bytes(), "application/x-ndjson", nil
+}
+
+func (w *bulkWriter) Close() error { return nil }
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/storage"
+)
+
+// maxAliases caps the alias codes one link can have.
+const maxAliases = 20
+
+var errNotAlias = errors.New("alias not found")
+
+// Aliases maps alias codes to the link they stand for, so every code
+// resolves to, and counts clicks on, the one record. Like the links it
+// lives in this instance's memory; the link lists its own in
+// Link.Aliases.
+type Aliases struct {
+	mu     sync.RWMutex
+	to     map[string]string   // alias storage key -> link storage key
+	byLink map[string][]string // link storage key -> alias storage keys
+}
+
+func NewAliases() *Aliases {
+	return &Aliases{to: make(map[string]string), byLink: make(map[string][]string)}
+}
+
+// resolve returns the key of the link the alias stored under key stands
+// for.
+func (a *Aliases) resolve(key string) (string, bool) {
+	if a == nil {
+		return "", false
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	target, ok := a.to[key]
+	return target, ok
+}
+
+// taken reports whether key is in use as an alias.
+func (a *Aliases) taken(key string) bool {
+	_, ok := a.resolve(key)
+	return ok
+}
+
+// forget drops every alias of the link stored under key.
+func (a *Aliases) forget(key string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, alias := range a.byLink[key] {
+		delete(a.to, alias)
+	}
+	delete(a.byLink, key)
+}
+
+// aliasTaken is the 409 for an alias already in use as a code.
+func aliasTaken() *APIError {
+	msg := "alias is already in use"
+	e := newAPIError(http.StatusConflict, ErrCodeCodeTaken, msg)
+	e.Fields = []FieldError{{Field: "alias", Message: msg}}
+	return e
+}
+
+// rebuild re-indexes the aliases every link in backend lists, after links
+// were loaded around AddAlias. An alias already taken is left with its
+// current link.
+func (a *Aliases) rebuild(ctx context.Context, backend storage.Storage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_ = backend.Scan(ctx, func(l *Link) bool {
+		for _, alias := range l.Aliases {
+			key := storage.Key(l.Tenant, alias)
+			if _, taken := a.to[key]; !taken {
+				a.to[key] = l.Key()
+				a.byLink[l.Key()] = append(a.byLink[l.Key()], key)
+			}
+		}
+		return true
+	})
+}
+
+// validateAlias applies the custom_code rules to an alias.
+func (s *Store) validateAlias(alias string) error {
+	if alias == "" {
+		return fieldError("alias", "alias is required")
+	}
+	if strings.Contains(alias, storage.KeySeparator) {
+		return fieldError("alias", "alias must not contain "+storage.KeySeparator)
+	}
+	if apiErr := validateFolderCode(alias); apiErr != nil {
+		return apiErr
+	}
+	if s.filter.Blocked(alias) {
+		return fieldError("alias", ErrCodeBlocked.Error())
+	}
+	return nil
+}
+
+// AddAlias makes alias a second code for owner's link at code. The alias
+// must be free in the link's tenant, as a link code and as an alias.
+func (s *Store) AddAlias(ctx context.Context, code, alias, owner string) (*Link, error) {
+	if err := s.validateAlias(alias); err != nil {
+		return nil, err
+	}
+	l, err := s.Get(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	if !canManage(owner, l) {
+		return nil, ErrNotFound
+	}
+	if len(l.Aliases) >= maxAliases {
+		return nil, fieldError("alias", "a link can have at most "+strconv.Itoa(maxAliases)+" aliases")
+	}
+	key := storage.Key(l.Tenant, alias)
+
+	s.aliases.mu.Lock()
+	defer s.aliases.mu.Unlock()
+	if _, ok := s.aliases.to[key]; ok {
+		return nil, aliasTaken()
+	}
+	if _, err := s.backend.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		if err != nil {
+			return nil, err
+		}
+		return nil, aliasTaken()
+	}
+	l, err = s.backend.Update(ctx, l.Key(), func(l *Link) error {
+		if l.Deleted() {
+			return ErrNotFound
+		}
+		l.Aliases = append(l.Aliases, alias)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.aliases.to[key] = l.Key()
+	s.aliases.byLink[l.Key()] = append(s.aliases.byLink[l.Key()], key)
+	logrus.WithFields(logrus.Fields{
+		"action":     "add_alias",
+		"short_code": l.ShortCode,
+		"alias":      alias,
+		"owner":      owner,
+	}).Info("alias added")
+	return l, nil
+}
+
+// RemoveAlias frees alias, which must belong to owner's link at code.
+func (s *Store) RemoveAlias(ctx context.Context, code, alias, owner string) (*Link, error) {
+	l, err := s.Get(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	if !canManage(owner, l) {
+		return nil, ErrNotFound
+	}
+	key := storage.Key(l.Tenant, alias)
+
+	s.aliases.mu.Lock()
+	defer s.aliases.mu.Unlock()
+	if s.aliases.to[key] != l.Key() {
+		return nil, errNotAlias
+	}
+	l, err = s.backend.Update(ctx, l.Key(), func(l *Link) error {
+		kept := l.Aliases[:0]
+		for _, a := range l.Aliases {
+			if a != alias {
+				kept = append(kept, a)
+			}
+		}
+		l.Aliases = kept
+		if len(kept) == 0 {
+			l.Aliases = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	delete(s.aliases.to, key)
+	keys := s.aliases.byLink[l.Key()]
+	for i, k := range keys {
+		if k == key {
+			keys = append(keys[:i], keys[i+1:]...)
+			break
+		}
+	}
+	if len(keys) == 0 {
+		delete(s.aliases.byLink, l.Key())
+	} else {
+		s.aliases.byLink[l.Key()] = keys
+	}
+	logrus.WithFields(logrus.Fields{
+		"action":     "remove_alias",
+		"short_code": l.ShortCode,
+		"alias":      alias,
+		"owner":      owner,
+	}).Info("alias removed")
+	return l, nil
+}
+
+type aliasEntry struct {
+	Alias    string `json:"alias"`
+	ShortURL string `json:"short_url"`
+}
+
+type aliasesResponse struct {
+	ShortCode string       `json:"short_code"`
+	ShortURL  string       `json:"short_url"`
+	Aliases   []aliasEntry `json:"aliases"`
+}
+
+func (s *Store) aliasesResponse(l *Link) aliasesResponse {
+	resp := aliasesResponse{ShortCode: l.ShortCode, ShortURL: s.shortURL(l), Aliases: []aliasEntry{}}
+	for _, a := range l.Aliases {
+		resp.Aliases = append(resp.Aliases, aliasEntry{Alias: a, ShortURL: s.shortURL(&Link{ShortCode: a, Tenant: l.Tenant})})
+	}
+	return resp
+}
+
+// listAliasesHandler serves GET /api/links/{code}/aliases. code may
+// itself be an alias.
+func listAliasesHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, err := store.Get(r.Context(), codeVar(r))
+		if err == nil && !canManage(ownerFrom(r.Context()), link) {
+			err = ErrNotFound
+		}
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, store.aliasesResponse(link))
+	}
+}
+
+// addAliasHandler serves POST /api/links/{code}/aliases with
+// {"alias": "promo"}.
+func addAliasHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Alias string `json:"alias"`
+		}
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		link, err := store.AddAlias(r.Context(), codeVar(r), req.Alias, ownerFrom(r.Context()))
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusCreated, store.aliasesResponse(link))
+	}
+}
+
+// removeAliasHandler serves DELETE /api/links/{code}/aliases/{alias}.
+func removeAliasHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		alias := mux.Vars(r)["alias"]
+		if v, err := url.PathUnescape(alias); err == nil {
+			alias = v
+		}
+		_, err := store.RemoveAlias(r.Context(), codeVar(r), alias, ownerFrom(r.Context()))
+		if errors.Is(err, errNotAlias) {
+			httpError(w, r, http.StatusNotFound, ErrCodeNotFound, "alias not found")
+			return
+		}
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
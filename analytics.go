@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// referrerDirect stands for clicks that arrived without a Referer.
+const referrerDirect = "direct"
+
+const (
+	defaultAnalyticsTop = 10
+	maxAnalyticsTop     = 100
+)
+
+// ReferrerRollup counts clicks per referrer host in UTC day buckets.
+// Keys roll up many links: one per tenant and one per owner, see
+// rollupKeys.
+type ReferrerRollup interface {
+	Record(ctx context.Context, key, host string, at time.Time) error
+	// Range returns the counts per host of the days that overlap
+	// [from, to).
+	Range(ctx context.Context, key string, from, to time.Time) (map[string]int64, error)
+	// Prune deletes the days of every rollup that start before cutoff
+	// and returns how many there were.
+	Prune(ctx context.Context, cutoff time.Time) (int, error)
+}
+
+func dayOf(t time.Time) int64 {
+	return t.UTC().Truncate(24 * time.Hour).Unix()
+}
+
+// rollupKeys are the rollups a click on l counts towards: its tenant's
+// and its owner's.
+func rollupKeys(l *Link) []string {
+	keys := []string{rollupKey(l.Tenant, "")}
+	if l.Owner != "" {
+		keys = append(keys, rollupKey(l.Tenant, l.Owner))
+	}
+	return keys
+}
+
+// rollupKey is the rollup of owner's links in tenant, or of the whole
+// tenant when owner is empty.
+func rollupKey(tenant, owner string) string {
+	if owner == "" {
+		return "tenant:" + tenant
+	}
+	return "owner:" + tenant + ":" + owner
+}
+
+// referrerHost reduces a Referer to its lowercased host.
+func referrerHost(ref string) string {
+	u, err := url.Parse(ref)
+	if err != nil || u.Hostname() == "" {
+		return referrerDirect
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+type memoryReferrers struct {
+	mu        sync.Mutex
+	retention time.Duration
+	days      map[string]map[int64]map[string]int64
+}
+
+func newMemoryReferrers(retention time.Duration) *memoryReferrers {
+	return &memoryReferrers{retention: retention, days: make(map[string]map[int64]map[string]int64)}
+}
+
+func (m *memoryReferrers) Record(_ context.Context, key, host string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := m.days[key]
+	if d == nil {
+		d = make(map[int64]map[string]int64)
+		m.days[key] = d
+	}
+	day := dayOf(at)
+	hosts := d[day]
+	if hosts == nil && m.retention > 0 {
+		// A new day is the moment to drop those past retention.
+		cutoff := dayOf(at.Add(-m.retention))
+		for k := range d {
+			if k < cutoff {
+				delete(d, k)
+			}
+		}
+	}
+	if hosts == nil {
+		hosts = make(map[string]int64)
+		d[day] = hosts
+	}
+	hosts[host]++
+	return nil
+}
+
+func (m *memoryReferrers) Range(_ context.Context, key string, from, to time.Time) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]int64)
+	lo, hi := dayOf(from), to.Unix()
+	for day, hosts := range m.days[key] {
+		if day < lo || day >= hi {
+			continue
+		}
+		for h, n := range hosts {
+			out[h] += n
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryReferrers) Prune(_ context.Context, cutoff time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for key, d := range m.days {
+		for day := range d {
+			if day < cutoff.Unix() {
+				delete(d, day)
+				n++
+			}
+		}
+		if len(d) == 0 {
+			delete(m.days, key)
+		}
+	}
+	return n, nil
+}
+
+// redisReferrers keeps a day of a rollup in the hash
+// prefix+"referrers:"+key+":"+day, which expires after the retention, or
+// never if it is zero.
+type redisReferrers struct {
+	client    *redis.Client
+	prefix    string
+	retention time.Duration
+}
+
+func (r *redisReferrers) key(key string, day int64) string {
+	return r.prefix + "referrers:" + key + ":" + strconv.FormatInt(day, 10)
+}
+
+func (r *redisReferrers) Record(ctx context.Context, key, host string, at time.Time) error {
+	k := r.key(key, dayOf(at))
+	pipe := r.client.Pipeline()
+	pipe.HIncrBy(ctx, k, host, 1)
+	if r.retention > 0 {
+		pipe.Expire(ctx, k, r.retention+24*time.Hour)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Prune leaves old days to expire.
+func (r *redisReferrers) Prune(context.Context, time.Time) (int, error) {
+	return 0, nil
+}
+
+func (r *redisReferrers) Range(ctx context.Context, key string, from, to time.Time) (map[string]int64, error) {
+	pipe := r.client.Pipeline()
+	var cmds []*redis.MapStringStringCmd
+	for day := dayOf(from); day < to.Unix(); day += int64(24 * time.Hour / time.Second) {
+		cmds = append(cmds, pipe.HGetAll(ctx, r.key(key, day)))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	out := make(map[string]int64)
+	for _, cmd := range cmds {
+		for h, v := range cmd.Val() {
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				out[h] += n
+			}
+		}
+	}
+	return out, nil
+}
+
+// recordReferrer adds a click on l to the referrer rollups, if enabled.
+func (s *Store) recordReferrer(ctx context.Context, l *Link, rec ClickRecord) {
+	if s.referrers == nil {
+		return
+	}
+	host := referrerHost(rec.Referrer)
+	for _, key := range rollupKeys(l) {
+		if err := s.referrers.Record(ctx, key, host, rec.At); err != nil {
+			logrus.WithError(err).WithField("short_code", l.ShortCode).Warn("recording referrer rollup failed")
+			return
+		}
+	}
+}
+
+// LinkClicks is one entry of a summary's top links.
+type LinkClicks struct {
+	ShortCode string `json:"short_code"`
+	ShortURL  string `json:"short_url"`
+	LongURL   string `json:"long_url"`
+	Clicks    int64  `json:"clicks"`
+}
+
+// ReferrerClicks is one entry of a summary's top referrers.
+type ReferrerClicks struct {
+	Referrer string `json:"referrer"`
+	Clicks   int64  `json:"clicks"`
+}
+
+// AnalyticsSummary totals the clicks and links of an owner, or of a whole
+// tenant, over a range.
+type AnalyticsSummary struct {
+	Owner        string           `json:"owner,omitempty"`
+	Folder       string           `json:"folder,omitempty"`
+	Interval     string           `json:"interval"`
+	TZ           string           `json:"tz"`
+	From         time.Time        `json:"from"`
+	To           time.Time        `json:"to"`
+	TotalClicks  int64            `json:"total_clicks"`
+	Points       []SeriesPoint    `json:"points"`
+	TopLinks     []LinkClicks     `json:"top_links"`
+	TopReferrers []ReferrerClicks `json:"top_referrers"`
+	LinksCreated int              `json:"links_created"`
+	ActiveLinks  int              `json:"active_links"`
+}
+
+// Summary adds up the time series of owner's links in the request's
+// tenant, all of them when owner is empty, over the intervals starts
+// delimits, and ranks the top links and referrers. With a folder, it
+// covers the links in that folder owner may read, shared ones included;
+// referrers are counted per owner, not per link, and are left out then.
+func (s *Store) Summary(ctx context.Context, owner, folder string, starts []time.Time, top int) (*AnalyticsSummary, error) {
+	from, to := starts[0], starts[len(starts)-1]
+	var links []*Link
+	sum := &AnalyticsSummary{Owner: owner, Folder: folder, TopLinks: []LinkClicks{}, TopReferrers: []ReferrerClicks{}}
+	tenant := tenantFrom(ctx)
+	visible := func(l *Link) bool {
+		return l.Tenant == tenant && (owner == "" || l.Owner == owner) && !l.Reserved
+	}
+	if folder != "" {
+		shared, err := s.visibleTo(ctx, owner)
+		if err != nil {
+			return nil, err
+		}
+		visible = func(l *Link) bool { return folderOf(l.ShortCode) == folder && shared(l) }
+	}
+	err := s.backend.Scan(ctx, func(l *Link) bool {
+		if !visible(l) {
+			return true
+		}
+		if !l.Deleted() {
+			sum.ActiveLinks++
+		}
+		if !l.CreatedAt.Before(from) && l.CreatedAt.Before(to) {
+			sum.LinksCreated++
+		}
+		links = append(links, l)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	buckets := make(map[int64]int64)
+	for _, l := range links {
+		b, err := s.series.Range(ctx, l.Key(), from, to)
+		if err != nil {
+			return nil, err
+		}
+		var n int64
+		for k, c := range b {
+			buckets[k] += c
+			n += c
+		}
+		if n > 0 {
+			sum.TopLinks = append(sum.TopLinks, LinkClicks{ShortCode: l.ShortCode, ShortURL: s.shortURL(l), LongURL: l.LongURL, Clicks: n})
+		}
+	}
+	sum.Points = make([]SeriesPoint, 0, len(starts)-1)
+	for i := 0; i < len(starts)-1; i++ {
+		p := SeriesPoint{Start: starts[i].UTC()}
+		for b := starts[i].Unix(); b < starts[i+1].Unix(); b += int64(seriesBucket / time.Second) {
+			p.Clicks += buckets[b]
+		}
+		sum.TotalClicks += p.Clicks
+		sum.Points = append(sum.Points, p)
+	}
+	sort.Slice(sum.TopLinks, func(i, j int) bool {
+		if sum.TopLinks[i].Clicks == sum.TopLinks[j].Clicks {
+			return sum.TopLinks[i].ShortCode < sum.TopLinks[j].ShortCode
+		}
+		return sum.TopLinks[i].Clicks > sum.TopLinks[j].Clicks
+	})
+	if len(sum.TopLinks) > top {
+		sum.TopLinks = sum.TopLinks[:top]
+	}
+	if s.referrers != nil && folder == "" {
+		hosts, err := s.referrers.Range(ctx, rollupKey(tenant, owner), from, to)
+		if err != nil {
+			return nil, err
+		}
+		for h, n := range hosts {
+			sum.TopReferrers = append(sum.TopReferrers, ReferrerClicks{Referrer: h, Clicks: n})
+		}
+		sort.Slice(sum.TopReferrers, func(i, j int) bool {
+			if sum.TopReferrers[i].Clicks == sum.TopReferrers[j].Clicks {
+				return sum.TopReferrers[i].Referrer < sum.TopReferrers[j].Referrer
+			}
+			return sum.TopReferrers[i].Clicks > sum.TopReferrers[j].Clicks
+		})
+		if len(sum.TopReferrers) > top {
+			sum.TopReferrers = sum.TopReferrers[:top]
+		}
+	}
+	return sum, nil
+}
+
+// analyticsSummaryHandler serves GET /api/analytics/summary: the caller's
+// clicks per hour or day between from and to, their top links and
+// referrers and how many links they created, with the same interval, tz,
+// from and to parameters as timeSeriesHandler (default the last 30 days).
+// top (default 10) caps the rankings. Referrers are counted per UTC day,
+// so a range that starts or ends mid-day includes the whole day.
+// folder=name narrows the summary to one folder, shared ones included.
+func analyticsSummaryHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		interval := q.Get("interval")
+		switch interval {
+		case "":
+			interval = "day"
+		case "day", "hour":
+		default:
+			writeAPIError(w, r, fieldError("interval", "interval must be hour or day"))
+			return
+		}
+		tz := q.Get("tz")
+		if tz == "" {
+			tz = "UTC"
+		}
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			writeAPIError(w, r, fieldError("tz", "tz must be an IANA timezone such as Europe/Berlin"))
+			return
+		}
+		top := defaultAnalyticsTop
+		if v := q.Get("top"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxAnalyticsTop {
+				writeAPIError(w, r, fieldError("top", "top must be an integer between 1 and "+strconv.Itoa(maxAnalyticsTop)))
+				return
+			}
+			top = n
+		}
+		to, apiErr := parseTimeParam(q.Get("to"), "to", store.now())
+		if apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		step := 24 * time.Hour
+		if interval == "hour" {
+			step = time.Hour
+		}
+		from, apiErr := parseTimeParam(q.Get("from"), "from", to.Add(-30*24*time.Hour))
+		if apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		if !from.Before(to) {
+			writeAPIError(w, r, fieldError("from", "from must be before to"))
+			return
+		}
+		if to.Sub(from) > maxSeriesPoints*step {
+			writeAPIError(w, r, fieldError("from", "the range covers more than "+strconv.Itoa(maxSeriesPoints)+" intervals"))
+			return
+		}
+		if store.series == nil {
+			httpError(w, r, http.StatusNotFound, ErrCodeNotFound, "click time series are disabled")
+			return
+		}
+		sum, err := store.Summary(r.Context(), ownerFrom(r.Context()), q.Get("folder"), bucketStarts(interval, loc, from, to), top)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		sum.Interval, sum.TZ, sum.From, sum.To = interval, loc.String(), from, to
+		writeJSON(w, http.StatusOK, sum)
+	}
+}
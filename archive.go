@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/middleware"
+	"url-shortener/objectstore"
+)
+
+// ClickRecord is one raw click, as archived and as carried by
+// link.clicked events.
+type ClickRecord struct {
+	ShortCode   string    `json:"short_code"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Owner       string    `json:"owner,omitempty"`
+	CampaignID  string    `json:"campaign_id,omitempty"`
+	Destination string    `json:"destination"`
+	At          time.Time `json:"at"`
+	ClientIP    string    `json:"client_ip,omitempty"`
+	ClientHash  string    `json:"client_hash,omitempty"` // salted, set in privacy mode
+	UserAgent   string    `json:"user_agent,omitempty"`
+	Referrer    string    `json:"referrer,omitempty"`
+	Source      string    `json:"source,omitempty"` // share source, see shareSource
+	Bot         bool      `json:"bot,omitempty"`
+	Suspicious  string    `json:"suspicious,omitempty"` // the anomaly kind, if fraud detection flagged it
+
+	Geo   *GeoLocation `json:"geo,omitempty"`
+	Hints *ClientHints `json:"hints,omitempty"`
+
+	doNotTrack  bool
+	fingerprint string // User-Agent and Accept-Language, for fraud checks
+}
+
+func newClickRecord(r *http.Request, l *Link, dest string) ClickRecord {
+	return ClickRecord{
+		ShortCode:   l.ShortCode,
+		Tenant:      l.Tenant,
+		Owner:       l.Owner,
+		CampaignID:  l.CampaignID,
+		Destination: dest,
+		At:          time.Now().UTC(),
+		ClientIP:    middleware.ClientIP(r),
+		UserAgent:   r.UserAgent(),
+		Referrer:    r.Referer(),
+		Source:      shareSource(r),
+		Bot:         isBot(r),
+		Hints:       clientHints(r),
+		doNotTrack:  doNotTrack(r),
+		fingerprint: r.UserAgent() + "\x00" + r.Header.Get("Accept-Language"),
+	}
+}
+
+// ExportEntry describes one uploaded archive object.
+type ExportEntry struct {
+	Key        string    `json:"key"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	Records    int       `json:"records"`
+	Bytes      int       `json:"bytes"`
+	Instance   string    `json:"instance"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// ExportManifest remembers what has been exported.
+type ExportManifest interface {
+	Add(ctx context.Context, e ExportEntry) error
+	List(ctx context.Context) ([]ExportEntry, error)
+	// Remove drops the entries for the given object keys.
+	Remove(ctx context.Context, keys []string) error
+}
+
+type memoryManifest struct {
+	mu      sync.Mutex
+	entries []ExportEntry
+}
+
+func (m *memoryManifest) Add(_ context.Context, e ExportEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, e)
+	return nil
+}
+
+func (m *memoryManifest) List(context.Context) ([]ExportEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]ExportEntry{}, m.entries...), nil
+}
+
+func (m *memoryManifest) Remove(_ context.Context, keys []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	gone := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		gone[k] = true
+	}
+	kept := m.entries[:0]
+	for _, e := range m.entries {
+		if !gone[e.Key] {
+			kept = append(kept, e)
+		}
+	}
+	m.entries = kept
+	return nil
+}
+
+// redisManifest shares the manifest between instances, each of which
+// exports the clicks it served.
+type redisManifest struct {
+	client *redis.Client
+	key    string
+}
+
+func (m *redisManifest) Add(ctx context.Context, e ExportEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return m.client.RPush(ctx, m.key, b).Err()
+}
+
+func (m *redisManifest) List(ctx context.Context) ([]ExportEntry, error) {
+	raw, err := m.client.LRange(ctx, m.key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]ExportEntry, 0, len(raw))
+	for _, s := range raw {
+		var e ExportEntry
+		if err := json.Unmarshal([]byte(s), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Remove deletes the list items recording keys, matching them by their
+// stored JSON so entries added meanwhile are left alone.
+func (m *redisManifest) Remove(ctx context.Context, keys []string) error {
+	gone := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		gone[k] = true
+	}
+	raw, err := m.client.LRange(ctx, m.key, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	pipe := m.client.Pipeline()
+	for _, s := range raw {
+		var e ExportEntry
+		if json.Unmarshal([]byte(s), &e) == nil && gone[e.Key] {
+			pipe.LRem(ctx, m.key, 1, s)
+		}
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// ClickArchive buffers raw clicks and periodically uploads them as
+// gzipped ND-JSON objects. The buffer is bounded: when uploads keep
+// failing, or traffic outpaces the interval, new clicks are dropped and
+// counted rather than growing memory without limit. Clicks still buffered
+// when the process dies are lost.
+type ClickArchive struct {
+	mu      sync.Mutex
+	buf     []ClickRecord
+	max     int
+	dropped int64
+
+	uploader objectstore.Uploader
+	manifest ExportManifest
+	prefix   string
+	instance string
+}
+
+func NewClickArchive(uploader objectstore.Uploader, manifest ExportManifest, prefix, instance string, max int) *ClickArchive {
+	return &ClickArchive{uploader: uploader, manifest: manifest, prefix: prefix, instance: instance, max: max}
+}
+
+// Add buffers rec; it is a no-op on a nil archive.
+func (a *ClickArchive) Add(rec ClickRecord) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.buf) >= a.max {
+		a.dropped++
+		metricExportDropped.Add(1)
+		return
+	}
+	a.buf = append(a.buf, rec)
+}
+
+// Run flushes the buffer every interval.
+func (a *ClickArchive) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := a.Flush(context.Background()); err != nil {
+			logrus.WithError(err).WithField("action", "export").Warn("click export failed, will retry")
+		}
+	}
+}
+
+// Flush uploads everything buffered so far. On failure the records go back
+// to the front of the buffer for the next attempt.
+func (a *ClickArchive) Flush(ctx context.Context) error {
+	a.mu.Lock()
+	batch := a.buf
+	a.buf = nil
+	dropped := a.dropped
+	a.dropped = 0
+	a.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	body, err := encodeClicks(batch)
+	if err != nil {
+		return err
+	}
+	from, to := batch[0].At, batch[len(batch)-1].At
+	key := fmt.Sprintf("%sclicks/dt=%s/%s-%s.ndjson.gz", a.prefix, from.Format("2006-01-02"),
+		from.Format("20060102T150405.000000Z"), a.instance)
+	if err := a.uploader.Put(ctx, key, body, "application/x-ndjson"); err != nil {
+		a.requeue(batch, dropped)
+		return err
+	}
+	metricExportedClicks.Add(int64(len(batch)))
+	entry := ExportEntry{
+		Key:        key,
+		From:       from,
+		To:         to,
+		Records:    len(batch),
+		Bytes:      len(body),
+		Instance:   a.instance,
+		UploadedAt: time.Now().UTC(),
+	}
+	if err := a.manifest.Add(ctx, entry); err != nil {
+		logrus.WithError(err).WithField("key", key).Warn("recording export in manifest failed")
+	}
+	logrus.WithFields(logrus.Fields{
+		"action":  "export",
+		"key":     key,
+		"records": len(batch),
+		"dropped": dropped,
+	}).Info("click archive uploaded")
+	return nil
+}
+
+// Prune deletes the uploaded objects holding only clicks from before
+// cutoff, and their manifest entries, returning how many it deleted.
+// Stores that cannot delete objects are left to their own lifecycle
+// rules.
+func (a *ClickArchive) Prune(ctx context.Context, cutoff time.Time) (int, error) {
+	deleter, ok := a.uploader.(objectstore.Deleter)
+	if !ok {
+		return 0, nil
+	}
+	entries, err := a.manifest.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var gone []string
+	for _, e := range entries {
+		if !e.To.Before(cutoff) {
+			continue
+		}
+		if err := deleter.Delete(ctx, e.Key); err != nil {
+			logrus.WithError(err).WithField("key", e.Key).Warn("deleting click archive failed")
+			continue
+		}
+		gone = append(gone, e.Key)
+	}
+	if len(gone) == 0 {
+		return 0, nil
+	}
+	return len(gone), a.manifest.Remove(ctx, gone)
+}
+
+func (a *ClickArchive) requeue(batch []ClickRecord, dropped int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	merged := append(batch, a.buf...)
+	if len(merged) > a.max {
+		lost := len(merged) - a.max
+		metricExportDropped.Add(int64(lost))
+		dropped += int64(lost)
+		merged = merged[:a.max]
+	}
+	a.buf = merged
+	a.dropped += dropped
+}
+
+func encodeClicks(batch []ClickRecord) ([]byte, error) {
+	var out bytes.Buffer
+	zw := gzip.NewWriter(&out)
+	enc := json.NewEncoder(zw)
+	for _, rec := range batch {
+		if err := enc.Encode(rec); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// exportsHandler serves GET /api/admin/exports, the manifest of uploaded
+// archives, optionally restricted to objects overlapping ?from= and ?to=
+// (RFC 3339).
+func exportsHandler(manifest ExportManifest) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var from, to time.Time
+		for name, dst := range map[string]*time.Time{"from": &from, "to": &to} {
+			t, apiErr := parseTimeParam(r.URL.Query().Get(name), name, time.Time{})
+			if apiErr != nil {
+				writeAPIError(w, r, apiErr)
+				return
+			}
+			*dst = t
+		}
+		entries, err := manifest.List(r.Context())
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		out := []ExportEntry{}
+		for _, e := range entries {
+			if !from.IsZero() && e.To.Before(from) {
+				continue
+			}
+			if !to.IsZero() && e.From.After(to) {
+				continue
+			}
+			out = append(out, e)
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"exports": out})
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type ctxKey int
+
+const (
+	ownerKey ctxKey = iota
+	tenantKey
+	scopesKey
+	credentialExpiryKey
+	tokenIDKey
+	quickKeyKey
+)
+
+// parseAPIKeys reads API_KEYS, a comma-separated list of owner:key pairs.
+// An owner written tenant/owner belongs to that tenant.
+func parseAPIKeys(raw string) map[string]string {
+	keys := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		owner, key, ok := strings.Cut(pair, ":")
+		if !ok || owner == "" || key == "" {
+			logrus.Warnf("ignoring malformed API_KEYS entry %q", pair)
+			continue
+		}
+		keys[key] = owner
+	}
+	return keys
+}
+
+// requireAPIKey authenticates /api requests by X-API-Key or a Bearer token,
+// or on quickPath the key query parameter, and stores the credential's
+// owner, tenant and scopes in the context. The credential is either a
+// static key from API_KEYS or a token issued through /api/tokens. With no
+// keys configured the API stays open and links are created without an
+// owner.
+func requireAPIKey(keys map[string]string, admins map[string]bool, tokens TokenStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(keys) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			presented := apiKeyFrom(r)
+			owner, ok := lookupKey(keys, presented)
+			var scopes map[string]bool
+			var expires *time.Time
+			var tokenID string
+			if ok {
+				scopes = keyScopes(owner, admins)
+			} else if strings.HasPrefix(presented, tokenPrefix) {
+				t, err := tokens.Lookup(r.Context(), hashToken(presented))
+				if err != nil && !errors.Is(err, ErrTokenNotFound) {
+					writeAPIError(w, r, apiErrorFrom(err))
+					return
+				}
+				if err == nil && !t.expired(time.Now()) {
+					owner, scopes, expires, ok = t.Owner, scopeSet(t.Scopes), t.ExpiresAt, true
+					tokenID = t.ID
+				}
+			}
+			if !ok {
+				httpError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "missing, invalid or expired API key")
+				return
+			}
+			ctx := context.WithValue(r.Context(), ownerKey, owner)
+			ctx = context.WithValue(ctx, scopesKey, scopes)
+			ctx = context.WithValue(ctx, credentialExpiryKey, expires)
+			ctx = context.WithValue(ctx, tokenIDKey, tokenID)
+			next.ServeHTTP(w, r.WithContext(withTenant(ctx, tenantOf(owner))))
+		})
+	}
+}
+
+func apiKeyFrom(r *http.Request) string {
+	if k := r.Header.Get("X-API-Key"); k != "" {
+		return k
+	}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	if r.URL.Path == quickPath {
+		if k, ok := r.Context().Value(quickKeyKey).(string); ok {
+			return k
+		}
+		return r.URL.Query().Get("key")
+	}
+	return ""
+}
+
+func lookupKey(keys map[string]string, presented string) (string, bool) {
+	if presented == "" {
+		return "", false
+	}
+	for key, owner := range keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(presented)) == 1 {
+			return owner, true
+		}
+	}
+	return "", false
+}
+
+// ownerFrom returns the authenticated owner, or "" when auth is disabled.
+func ownerFrom(ctx context.Context) string {
+	owner, _ := ctx.Value(ownerKey).(string)
+	return owner
+}
+
+// tokenIDFrom returns the ID of the issued token the request was
+// authenticated with, or "" for a static key or without auth.
+func tokenIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(tokenIDKey).(string)
+	return id
+}
+
+// parseAdmins reads ADMINS, a comma-separated list of owners allowed to
+// use /api/admin.
+func parseAdmins(raw string) map[string]bool {
+	admins := make(map[string]bool)
+	for _, owner := range strings.Split(raw, ",") {
+		if owner = strings.TrimSpace(owner); owner != "" {
+			admins[owner] = true
+		}
+	}
+	return admins
+}
+
+// requireAdmin restricts a route to the owners in admins, using a
+// credential with the admin scope. Unlike the rest of the API it fails
+// closed: without API_KEYS and ADMINS nobody is an admin, and every
+// request is refused.
+func requireAdmin(admins map[string]bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !admins[ownerFrom(r.Context())] || !hasScope(r.Context(), ScopeAdmin) {
+				httpError(w, r, http.StatusForbidden, ErrCodeForbidden, "admin access required")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// canManage reports whether owner may modify l. Unowned links (created
+// while auth was disabled) can be managed by anyone.
+func canManage(owner string, l *Link) bool {
+	return l.Owner == "" || l.Owner == owner
+}
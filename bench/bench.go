@@ -0,0 +1,114 @@
+// Package bench benchmarks storage backends under contention. Like
+// storetest, it is called from a Benchmark function in the backend's own
+// tests, with a factory rather than a backend so every case starts empty:
+//
+//	func BenchmarkMemory(b *testing.B) {
+//		bench.Storage(b, func() storage.Storage { return storage.NewMemory() })
+//	}
+//
+// and run with go test -bench, so benchstat can compare runs:
+//
+//	go test -run '^$' -bench . ./storage/... ./bench | tee new.txt
+package bench
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"url-shortener/storage"
+)
+
+// Factory returns a fresh, empty backend.
+type Factory func() storage.Storage
+
+// Preloaded is how many links the read and increment cases start with.
+const Preloaded = 10000
+
+// Storage runs the Create, Get and Increment cases against a backend as
+// sub-benchmarks. Each runs its operations from GOMAXPROCS goroutines at
+// once.
+func Storage(b *testing.B, newStorage Factory) {
+	b.Run("Create", func(b *testing.B) { benchCreate(b, newStorage()) })
+	b.Run("Get", func(b *testing.B) { benchGet(b, newStorage()) })
+	b.Run("Increment", func(b *testing.B) { benchIncrement(b, newStorage(), Preloaded) })
+	b.Run("IncrementHot", func(b *testing.B) { benchIncrement(b, newStorage(), 1) })
+}
+
+func newLink(code string) *storage.Link {
+	now := time.Now().UTC()
+	return &storage.Link{
+		LongURL:   "https://example.com/" + code,
+		ShortCode: code,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	}
+}
+
+func preload(b *testing.B, s storage.Storage, n int) {
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		if err := s.Create(ctx, newLink(strconv.Itoa(i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+}
+
+func benchCreate(b *testing.B, s storage.Storage) {
+	defer s.Close()
+	ctx := context.Background()
+	var next int64
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			code := strconv.FormatInt(atomic.AddInt64(&next, 1), 36)
+			if err := s.Create(ctx, newLink(code)); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func benchGet(b *testing.B, s storage.Storage) {
+	defer s.Close()
+	preload(b, s, Preloaded)
+	ctx := context.Background()
+	var next int64
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := storage.Key("", strconv.FormatInt(atomic.AddInt64(&next, 1)%Preloaded, 10))
+			if _, err := s.Get(ctx, key); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// benchIncrement spreads click updates over n links; n=1 measures the
+// worst case of every writer contending for one hot link.
+func benchIncrement(b *testing.B, s storage.Storage, n int) {
+	defer s.Close()
+	preload(b, s, n)
+	ctx := context.Background()
+	var next int64
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := storage.Key("", strconv.FormatInt(atomic.AddInt64(&next, 1)%int64(n), 10))
+			_, err := s.Update(ctx, key, func(l *storage.Link) error {
+				l.Clicks++
+				return nil
+			})
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
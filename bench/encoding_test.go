@@ -0,0 +1,91 @@
+package bench
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"url-shortener/jsonpool"
+	"url-shortener/middleware"
+	"url-shortener/storage"
+)
+
+// ListSize is how many links the encoding cases put in one response,
+// the default page of GET /api/links.
+const ListSize = 100
+
+func listLinks() []*storage.Link {
+	links := make([]*storage.Link, ListSize)
+	for i := range links {
+		links[i] = newLink(strconv.Itoa(i))
+	}
+	return links
+}
+
+// BenchmarkEncodeList encodes a link list with a fresh encoder and
+// buffer, as handlers used to.
+func BenchmarkEncodeList(b *testing.B) {
+	links := listLinks()
+	body := map[string]interface{}{"links": links, "total": len(links)}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			var buf bytes.Buffer
+			if err := json.NewEncoder(&buf).Encode(body); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkEncodeListPooled encodes the same list with the pooled
+// encoder handlers use now.
+func BenchmarkEncodeListPooled(b *testing.B) {
+	links := listLinks()
+	body := map[string]interface{}{"links": links, "total": len(links)}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buf, err := jsonpool.Encode(body)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			buf.Release()
+		}
+	})
+}
+
+// BenchmarkGzipOver serves a list response too small to compress and one
+// large enough, through GzipOver with a 4 KiB threshold.
+func BenchmarkGzipOver(b *testing.B) {
+	links := listLinks()
+	b.Run("Small", func(b *testing.B) { benchGzipOver(b, links[:1]) })
+	b.Run("List", func(b *testing.B) { benchGzipOver(b, links) })
+}
+
+func benchGzipOver(b *testing.B, links []*storage.Link) {
+	h := middleware.GzipOver(4096)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = jsonpool.Write(w, http.StatusOK, links)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/api/links", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			h.ServeHTTP(discardWriter{header: http.Header{}}, req)
+		}
+	})
+}
+
+// discardWriter is a ResponseWriter that keeps nothing but headers.
+type discardWriter struct{ header http.Header }
+
+func (d discardWriter) Header() http.Header         { return d.header }
+func (d discardWriter) Write(b []byte) (int, error) { return io.Discard.Write(b) }
+func (d discardWriter) WriteHeader(int)             {}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// botSignatures are lower-cased User-Agent fragments of crawlers and the
+// link-preview fetchers used by chat apps and social networks.
+var botSignatures = []string{
+	"bot", "crawler", "spider", "slurp", "preview",
+	"facebookexternalhit", "facebookcatalog", "whatsapp", "skypeuripreview",
+	"embedly", "quora link preview", "vkshare", "outbrain", "pinterest",
+	"curl", "wget", "python-requests", "go-http-client", "headless",
+}
+
+// isBot reports whether r looks like an automated fetch rather than a
+// person following the link. Empty user agents count as bots.
+func isBot(r *http.Request) bool {
+	ua := strings.ToLower(r.UserAgent())
+	if ua == "" {
+		return true
+	}
+	for _, sig := range botSignatures {
+		if strings.Contains(ua, sig) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// clickBreakdown is where clicks on a link count besides its total: the
+// rotation destination served, the share source and the device. It
+// travels with the click, so that Increment counts all of it in the one
+// backend update that adds the click, and the click journal carries it
+// to the batched flush. A nil breakdown counts nothing.
+type clickBreakdown struct {
+	destinations map[int]int64
+	sources      map[string]int64
+	devices      map[string]map[string]int64
+}
+
+// newClickBreakdown describes a click on l served by destination pick
+// (negative if none of l's destinations), from share source (or ""),
+// with client hints h (or nil). It returns nil if none of that counts.
+func newClickBreakdown(l *Link, pick int, source string, h *ClientHints) *clickBreakdown {
+	b := &clickBreakdown{}
+	if pick >= 0 {
+		b.destinations = map[int]int64{pick: 1}
+	}
+	if source != "" {
+		b.sources = map[string]int64{source: 1}
+	}
+	if l.ClientHints && h != nil {
+		for dim, v := range h.dimensions() {
+			b.addDevice(dim, v, 1)
+		}
+	}
+	if b.empty() {
+		return nil
+	}
+	return b
+}
+
+func (b *clickBreakdown) empty() bool {
+	return b == nil || len(b.destinations)+len(b.sources)+len(b.devices) == 0
+}
+
+func (b *clickBreakdown) addDevice(dim, v string, n int64) {
+	if b.devices == nil {
+		b.devices = map[string]map[string]int64{}
+	}
+	if b.devices[dim] == nil {
+		b.devices[dim] = map[string]int64{}
+	}
+	b.devices[dim][v] += n
+}
+
+// merge adds other's counts to b, which must not be nil.
+func (b *clickBreakdown) merge(other *clickBreakdown) {
+	if other == nil {
+		return
+	}
+	for i, n := range other.destinations {
+		if b.destinations == nil {
+			b.destinations = map[int]int64{}
+		}
+		b.destinations[i] += n
+	}
+	for source, n := range other.sources {
+		if b.sources == nil {
+			b.sources = map[string]int64{}
+		}
+		b.sources[source] += n
+	}
+	for dim, counts := range other.devices {
+		for v, n := range counts {
+			b.addDevice(dim, v, n)
+		}
+	}
+}
+
+// apply counts the breakdown on l, inside the update that adds its
+// clicks to l.Clicks.
+func (b *clickBreakdown) apply(l *Link) {
+	if b == nil {
+		return
+	}
+	for i, n := range b.destinations {
+		countDestination(l, i, n)
+	}
+	for source, n := range b.sources {
+		countSource(l, source, n)
+	}
+	for dim, counts := range b.devices {
+		for v, n := range counts {
+			countDevice(l, dim, v, n)
+		}
+	}
+}
+
+// encode writes the breakdown as one query string for a journal line:
+// d=destination, s=source and h.<dimension>=value, one per click.
+func (b *clickBreakdown) encode() string {
+	if b.empty() {
+		return ""
+	}
+	q := url.Values{}
+	for i, n := range b.destinations {
+		for ; n > 0; n-- {
+			q.Add("d", strconv.Itoa(i))
+		}
+	}
+	for source, n := range b.sources {
+		for ; n > 0; n-- {
+			q.Add("s", source)
+		}
+	}
+	for dim, counts := range b.devices {
+		for v, n := range counts {
+			for ; n > 0; n-- {
+				q.Add("h."+dim, v)
+			}
+		}
+	}
+	return q.Encode()
+}
+
+// decodeBreakdown reads what encode wrote, skipping whatever it does not
+// recognise.
+func decodeBreakdown(s string) *clickBreakdown {
+	q, err := url.ParseQuery(s)
+	if err != nil {
+		return nil
+	}
+	b := &clickBreakdown{}
+	for name, values := range q {
+		for _, v := range values {
+			switch {
+			case name == "d":
+				if i, err := strconv.Atoi(v); err == nil && i >= 0 {
+					b.merge(&clickBreakdown{destinations: map[int]int64{i: 1}})
+				}
+			case name == "s":
+				b.merge(&clickBreakdown{sources: map[string]int64{v: 1}})
+			case strings.HasPrefix(name, "h."):
+				b.addDevice(strings.TrimPrefix(name, "h."), v, 1)
+			}
+		}
+	}
+	if b.empty() {
+		return nil
+	}
+	return b
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"url-shortener/storage"
+)
+
+var ErrCampaignNotFound = errors.New("campaign not found")
+
+// Campaign groups links so marketing can report on them together. Links
+// point at their campaign through Link.CampaignID.
+type Campaign struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Campaigns is the in-memory campaign registry.
+type Campaigns struct {
+	mu   sync.RWMutex
+	data map[string]*Campaign
+}
+
+func NewCampaigns() *Campaigns {
+	return &Campaigns{data: make(map[string]*Campaign)}
+}
+
+func (c *Campaigns) Create(name, owner string) *Campaign {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var id string
+	for {
+		id = generateCode(12)
+		if _, exists := c.data[id]; !exists {
+			break
+		}
+	}
+	cp := &Campaign{ID: id, Name: name, Owner: owner, CreatedAt: time.Now().UTC()}
+	c.data[id] = cp
+	return cp
+}
+
+// Get returns the campaign if it exists and owner may see it.
+func (c *Campaigns) Get(id, owner string) (*Campaign, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cp, ok := c.data[id]
+	if !ok || (cp.Owner != "" && cp.Owner != owner) {
+		return nil, ErrCampaignNotFound
+	}
+	cc := *cp
+	return &cc, nil
+}
+
+func (c *Campaigns) List(owner string) []*Campaign {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := []*Campaign{}
+	for _, cp := range c.data {
+		if owner == "" || cp.Owner == owner {
+			cc := *cp
+			out = append(out, &cc)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].position().Before(out[j].position()) })
+	return out
+}
+
+// position is the campaign's place in listings, newest first.
+func (c *Campaign) position() storage.Position {
+	return storage.Position{CreatedAt: c.CreatedAt, Key: c.ID}
+}
+
+// SetCampaign attaches a link to a campaign, or detaches it when id is "".
+func (s *Store) SetCampaign(ctx context.Context, code, owner, id string) (*Link, error) {
+	return s.backend.Update(ctx, s.key(ctx, code), func(l *Link) error {
+		if !canManage(owner, l) || l.Deleted() || l.Reserved {
+			return ErrNotFound
+		}
+		l.CampaignID = id
+		return nil
+	})
+}
+
+// CampaignStats is the aggregate reported by GET /api/campaigns/{id}/stats.
+type CampaignStats struct {
+	Campaign *Campaign          `json:"campaign"`
+	Links    int                `json:"links"`
+	Clicks   int64              `json:"clicks"`
+	PerLink  []CampaignLinkStat `json:"per_link"`
+}
+
+type CampaignLinkStat struct {
+	ShortCode string `json:"short_code"`
+	LongURL   string `json:"long_url"`
+	Clicks    int64  `json:"clicks"`
+}
+
+func (s *Store) campaignStats(ctx context.Context, cp *Campaign) (*CampaignStats, error) {
+	st := &CampaignStats{Campaign: cp, PerLink: []CampaignLinkStat{}}
+	var keys []string
+	err := s.backend.Scan(ctx, func(l *Link) bool {
+		if l.CampaignID == cp.ID && !l.Deleted() {
+			st.PerLink = append(st.PerLink, CampaignLinkStat{ShortCode: l.ShortCode, LongURL: l.LongURL, Clicks: l.Clicks})
+			keys = append(keys, l.Key())
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range st.PerLink {
+		if s.clicks != nil {
+			if n, err := s.clicks.Get(ctx, keys[i]); err == nil {
+				st.PerLink[i].Clicks = n
+			}
+		}
+		st.Clicks += st.PerLink[i].Clicks
+	}
+	st.Links = len(st.PerLink)
+	sort.Slice(st.PerLink, func(i, j int) bool { return st.PerLink[i].Clicks > st.PerLink[j].Clicks })
+	return st, nil
+}
+
+/* --- handlers --- */
+
+func createCampaignHandler(campaigns *Campaigns) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name string `json:"name"`
+		}
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" {
+			writeAPIError(w, r, fieldError("name", "name is required"))
+			return
+		}
+		writeJSON(w, http.StatusCreated, campaigns.Create(req.Name, ownerFrom(r.Context())))
+	}
+}
+
+// listCampaignsHandler serves GET /api/campaigns, a page of the caller's
+// campaigns at a time, newest first.
+func listCampaignsHandler(campaigns *Campaigns) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, after, apiErr := pageParams(r.URL.Query())
+		if apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		list, next := pageOf(campaigns.List(ownerFrom(r.Context())), (*Campaign).position, storage.Position.Before, after, limit)
+		writeCachedJSON(w, r, withNext(map[string]interface{}{"campaigns": list}, next), time.Time{})
+	}
+}
+
+// attachCampaignLinksHandler serves POST /api/campaigns/{id}/links with a
+// body of {"codes": [...]}.
+func attachCampaignLinksHandler(store *Store, campaigns *Campaigns) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner := ownerFrom(r.Context())
+		cp, err := campaigns.Get(mux.Vars(r)["id"], owner)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		var req struct {
+			Codes []string `json:"codes"`
+		}
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		if len(req.Codes) == 0 {
+			writeAPIError(w, r, fieldError("codes", "codes must list at least one short code"))
+			return
+		}
+		for _, code := range req.Codes {
+			if _, err := store.SetCampaign(r.Context(), code, owner, cp.ID); err != nil {
+				e := apiErrorFrom(err)
+				e.Fields = []FieldError{{Field: "codes", Message: code + ": " + e.Message}}
+				writeAPIError(w, r, e)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"campaign": cp, "attached": req.Codes})
+	}
+}
+
+// detachCampaignLinkHandler serves DELETE /api/campaigns/{id}/links/{code}.
+func detachCampaignLinkHandler(store *Store, campaigns *Campaigns) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner := ownerFrom(r.Context())
+		vars := mux.Vars(r)
+		cp, err := campaigns.Get(vars["id"], owner)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		l, err := store.Get(r.Context(), codeVar(r))
+		if err != nil || l.CampaignID != cp.ID {
+			httpError(w, r, http.StatusNotFound, ErrCodeLinkNotFound, "short link is not part of this campaign")
+			return
+		}
+		if _, err := store.SetCampaign(r.Context(), l.ShortCode, owner, ""); err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func campaignStatsHandler(store *Store, campaigns *Campaigns) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cp, err := campaigns.Get(mux.Vars(r)["id"], ownerFrom(r.Context()))
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		st, err := store.campaignStats(r.Context(), cp)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeCachedJSON(w, r, st, time.Time{})
+	}
+}
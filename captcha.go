@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/middleware"
+)
+
+// Captcha checks the token a form got from a captcha widget. remoteIP is
+// the visitor's address, passed on where the provider takes it.
+type Captcha interface {
+	Verify(ctx context.Context, token, remoteIP string) (bool, error)
+}
+
+// Captcha providers, chosen with CAPTCHA_PROVIDER.
+const (
+	CaptchaHCaptcha  = "hcaptcha"
+	CaptchaTurnstile = "turnstile"
+	CaptchaReCAPTCHA = "recaptcha"
+)
+
+// captchaVerifyURLs are the providers' siteverify endpoints.
+var captchaVerifyURLs = map[string]string{
+	CaptchaHCaptcha:  "https://api.hcaptcha.com/siteverify",
+	CaptchaTurnstile: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	CaptchaReCAPTCHA: "https://www.google.com/recaptcha/api/siteverify",
+}
+
+// newCaptcha builds the verifier cfg asks for, or returns nil if it asks
+// for none. CAPTCHA_VERIFY_URL, if set, overrides the provider's endpoint.
+func newCaptcha(cfg AbuseConfig) (Captcha, error) {
+	verifyURL := cfg.CaptchaVerifyURL
+	if cfg.CaptchaProvider != "" {
+		u, ok := captchaVerifyURLs[cfg.CaptchaProvider]
+		if !ok {
+			return nil, fmt.Errorf("unknown CAPTCHA_PROVIDER %q, want hcaptcha, turnstile or recaptcha", cfg.CaptchaProvider)
+		}
+		if verifyURL == "" {
+			verifyURL = u
+		}
+	}
+	if verifyURL == "" {
+		return nil, nil
+	}
+	return &CaptchaVerifier{URL: verifyURL, Secret: cfg.CaptchaSecret, Client: &http.Client{Timeout: 5 * time.Second}}, nil
+}
+
+// CaptchaVerifier speaks the siteverify protocol shared by reCAPTCHA,
+// hCaptcha and Turnstile.
+type CaptchaVerifier struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+func (c *CaptchaVerifier) Verify(ctx context.Context, token, remoteIP string) (bool, error) {
+	form := url.Values{"secret": {c.Secret}, "response": {token}}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("captcha verify: %s", resp.Status)
+	}
+	var out struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return false, err
+	}
+	return out.Success, nil
+}
+
+// checkCaptcha verifies token and, if it does not pass, answers r and
+// returns false. An unreachable provider fails closed with 503.
+func checkCaptcha(w http.ResponseWriter, r *http.Request, captcha Captcha, token string) bool {
+	if token == "" {
+		writeAPIError(w, r, fieldError("captcha_token", "captcha_token is required"))
+		return false
+	}
+	ok, err := captcha.Verify(r.Context(), token, middleware.ClientIP(r))
+	if err != nil {
+		logrus.WithError(err).Warn("captcha verification failed")
+		httpError(w, r, http.StatusServiceUnavailable, ErrCodeUnavailable, "captcha verification is unavailable")
+		return false
+	}
+	if !ok {
+		writeAPIError(w, r, fieldError("captcha_token", "captcha_token is invalid or expired"))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"url-shortener/storage"
+)
+
+// Limits on a link's card, in runes; crawlers cut longer texts anyway.
+const (
+	maxCardTitle       = 200
+	maxCardDescription = 500
+	maxCardImageURL    = 2048
+)
+
+// cardCrawlers are lower-cased User-Agent fragments of the fetchers that
+// build link previews from Open Graph and Twitter card tags.
+var cardCrawlers = []string{
+	"facebookexternalhit", "facebookcatalog", "twitterbot", "slackbot", "slack-imgproxy",
+	"linkedinbot", "discordbot", "telegrambot", "whatsapp", "skypeuripreview",
+	"pinterest", "redditbot", "embedly", "vkshare", "mastodon", "iframely",
+}
+
+// isCardCrawler reports whether r comes from a link-preview fetcher. It
+// is narrower than isBot: search engines and scripts still get the
+// redirect.
+func isCardCrawler(r *http.Request) bool {
+	ua := strings.ToLower(r.UserAgent())
+	for _, sig := range cardCrawlers {
+		if strings.Contains(ua, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCard trims c and checks it. A card with nothing set is no card,
+// and nil is returned.
+func validateCard(c *storage.Card) (*storage.Card, error) {
+	if c == nil {
+		return nil, nil
+	}
+	out := storage.Card{
+		Title:       strings.TrimSpace(c.Title),
+		Description: strings.TrimSpace(c.Description),
+		ImageURL:    strings.TrimSpace(c.ImageURL),
+	}
+	if out == (storage.Card{}) {
+		return nil, nil
+	}
+	if utf8.RuneCountInString(out.Title) > maxCardTitle {
+		return nil, fieldError("card.title", "card.title must be at most "+strconv.Itoa(maxCardTitle)+" characters")
+	}
+	if utf8.RuneCountInString(out.Description) > maxCardDescription {
+		return nil, fieldError("card.description", "card.description must be at most "+strconv.Itoa(maxCardDescription)+" characters")
+	}
+	if out.ImageURL != "" {
+		u, err := url.Parse(out.ImageURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(out.ImageURL) > maxCardImageURL {
+			return nil, fieldError("card.image_url", "card.image_url must be an absolute http or https URL")
+		}
+	}
+	return &out, nil
+}
+
+var cardTemplate = template.Must(template.New("card").Parse(`<!doctype html>
+<html><head><meta charset="utf-8">
+<title>{{.Title}}</title>
+<meta property="og:type" content="website">
+<meta property="og:url" content="{{.URL}}">
+{{if .Title}}<meta property="og:title" content="{{.Title}}">
+<meta name="twitter:title" content="{{.Title}}">
+{{end}}{{if .Description}}<meta property="og:description" content="{{.Description}}">
+<meta name="description" content="{{.Description}}">
+<meta name="twitter:description" content="{{.Description}}">
+{{end}}{{if .Image}}<meta property="og:image" content="{{.Image}}">
+<meta name="twitter:image" content="{{.Image}}">
+<meta name="twitter:card" content="summary_large_image">
+{{else}}<meta name="twitter:card" content="summary">
+{{end}}{{if .SiteName}}<meta property="og:site_name" content="{{.SiteName}}">
+{{end}}<meta http-equiv="refresh" content="0; url={{.Dest}}">
+</head><body><a href="{{.Dest}}">{{.Dest}}</a></body></html>
+`))
+
+// serveCard answers a preview crawler with l's card instead of the
+// redirect. Texts the card leaves out come from the destination's
+// preview. The page refreshes to dest for anyone who is not a crawler
+// after all. It is not counted as a click.
+func serveCard(w http.ResponseWriter, r *http.Request, store *Store, l *Link, dest string) {
+	page := struct {
+		URL, Title, Description, Image, SiteName, Dest string
+	}{
+		URL:         store.shortURL(l),
+		Title:       l.Card.Title,
+		Description: l.Card.Description,
+		Image:       l.Card.ImageURL,
+		SiteName:    store.tenantName(l),
+		Dest:        dest,
+	}
+	if p := l.Preview; p != nil {
+		page.Title = firstOf(page.Title, p.Title)
+		page.Description = firstOf(page.Description, p.Description)
+	}
+	store.setRedirectHeaders(w, l)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Add("Vary", "User-Agent")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_ = cardTemplate.Execute(w, page)
+	}
+}
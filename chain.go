@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Default middleware stacks; see Config.Middleware.
+const (
+	defaultMiddleware    = "request_id,real_ip,logging,recovery,host,body_limit"
+	defaultAPIMiddleware = "auth,rate_limit"
+)
+
+type middlewareFunc = func(http.Handler) http.Handler
+
+// buildChain resolves a comma-separated list of middleware names against
+// the available built-ins, in order, so the first name ends up outermost.
+// A name prefixed with "-" is accepted and skipped, which lets operators
+// switch one off without reordering the rest.
+func buildChain(spec string, builtins map[string]middlewareFunc) ([]middlewareFunc, error) {
+	var chain []middlewareFunc
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		disabled := strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+		mw, ok := builtins[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown middleware %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("middleware %q listed twice", name)
+		}
+		seen[name] = true
+		if !disabled {
+			chain = append(chain, mw)
+		}
+	}
+	return chain, nil
+}
+
+// wrap applies chain around h, first element outermost.
+func wrap(h http.Handler, chain []middlewareFunc) http.Handler {
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i](h)
+	}
+	return h
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/middleware"
+	"url-shortener/storage"
+	"url-shortener/storage/sqlite"
+)
+
+// Check statuses. A failure would stop the server from starting or keep
+// it from working; a warning deserves a look.
+const (
+	CheckOK   = "ok"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+)
+
+// tlsExpiryWarning is how soon a certificate expiry is warned about.
+const tlsExpiryWarning = 14 * 24 * time.Hour
+
+// CheckResult is one finding of the self-check.
+type CheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// CheckReport is what --check prints.
+type CheckReport struct {
+	OK        bool          `json:"ok"`
+	Version   string        `json:"version"`
+	Storage   string        `json:"storage"`
+	Checks    []CheckResult `json:"checks"`
+	CheckedAt time.Time     `json:"checked_at"`
+}
+
+func (r *CheckReport) add(name string, err error) {
+	if err != nil {
+		r.fail(name, err.Error())
+		return
+	}
+	r.Checks = append(r.Checks, CheckResult{Name: name, Status: CheckOK})
+}
+
+func (r *CheckReport) warn(name, detail string) {
+	r.Checks = append(r.Checks, CheckResult{Name: name, Status: CheckWarn, Detail: detail})
+}
+
+func (r *CheckReport) fail(name, detail string) {
+	r.OK = false
+	r.Checks = append(r.Checks, CheckResult{Name: name, Status: CheckFail, Detail: detail})
+}
+
+// openBackend opens the storage backend cfg names, mirrored to
+// STORAGE_MIRROR if that is set.
+func openBackend(cfg Config) (storage.Storage, error) {
+	backend, err := openNamedBackend("STORAGE_BACKEND", cfg.StorageBackend, cfg.SQLitePath)
+	if err != nil || cfg.MirrorBackend == "" {
+		return backend, err
+	}
+	if cfg.MirrorBackend == "sqlite" && cfg.MirrorSQLitePath == "" {
+		backend.Close()
+		return nil, fmt.Errorf("STORAGE_MIRROR=sqlite requires STORAGE_MIRROR_SQLITE_PATH")
+	}
+	secondary, err := openNamedBackend("STORAGE_MIRROR", cfg.MirrorBackend, cfg.MirrorSQLitePath)
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+	return storage.Mirror(backend, secondary, func(op, key string, err error) {
+		metricMirrorFailures.Add(1)
+		logrus.WithError(err).WithFields(logrus.Fields{"op": op, "storage_key": key}).Warn("mirroring write failed")
+	}), nil
+}
+
+func openNamedBackend(setting, name, sqlitePath string) (storage.Storage, error) {
+	switch name {
+	case "memory":
+		return storage.NewMemory(), nil
+	case "sqlite":
+		return sqlite.Open(sqlitePath, 5*time.Second)
+	}
+	return nil, fmt.Errorf("unknown %s %q, want memory or sqlite", setting, name)
+}
+
+// selfCheck validates cfg and what it points at the way startup would,
+// without serving: settings, the storage backend and the links in it,
+// Redis, DNS and TLS. Unlike startup it carries on past failures so the
+// report lists all of them.
+func selfCheck(ctx context.Context, cfg Config) *CheckReport {
+	rep := &CheckReport{OK: true, Version: version, Storage: cfg.StorageBackend, Checks: []CheckResult{}}
+	checkSettings(rep, cfg)
+	checkTLS(rep, cfg.Server)
+	checkDNS(ctx, rep, cfg)
+	if cfg.CoordinationMode == "redis" {
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err == nil {
+			rdb := redis.NewClient(opts)
+			err = rdb.Ping(ctx).Err()
+			rdb.Close()
+		}
+		rep.add("redis", err)
+	}
+	backend, err := openBackend(cfg)
+	if err != nil {
+		rep.fail("storage", err.Error())
+	} else {
+		defer backend.Close()
+		checkData(ctx, rep, cfg, backend)
+	}
+	rep.CheckedAt = time.Now().UTC()
+	return rep
+}
+
+// checkSettings runs the validation startup does on each setting.
+func checkSettings(rep *CheckReport, cfg Config) {
+	if cfg.ServiceMode != "" && !validMode(cfg.ServiceMode) {
+		rep.fail("SERVICE_MODE", "must be one of normal, read_only, maintenance")
+	}
+	if cfg.Validity.Policy != ValidityClamp && cfg.Validity.Policy != ValidityReject {
+		rep.fail("VALIDITY_POLICY", "must be clamp or reject")
+	}
+	switch cfg.LoopProtection {
+	case LoopReject, LoopWarn, LoopOff:
+	default:
+		rep.fail("LOOP_PROTECTION", "must be reject, warn or off")
+	}
+	if cfg.Cluster.Self != "" && cfg.Cluster.Secret == "" {
+		rep.fail("CLUSTER_SECRET", "required in cluster mode")
+	}
+	if cfg.Export.Enabled && cfg.Export.Bucket == "" {
+		rep.fail("EXPORT_ENABLED", "requires S3_BUCKET")
+	}
+	if cfg.CoordinationMode == "redis" && cfg.Clicks.FlushInterval > 0 {
+		rep.fail("CLICK_FLUSH_INTERVAL", "cannot be used with the shared redis click counter")
+	}
+	if len(parseAPIKeys(cfg.APIKeys)) == 0 {
+		rep.warn("API_KEYS", "empty: the API is open to anyone")
+	}
+
+	_, err := blocklistTerms(cfg.Codes.Blocklist, cfg.Codes.BlocklistFile)
+	rep.add("CODE_BLOCKLIST_FILE", err)
+	_, err = newCodeGenerator(cfg.Codes, nil, cfg.RedisPrefix)
+	rep.add("CODE_STRATEGY", err)
+	_, err = NewSigner(cfg.Signing.Keys, cfg.Signing.TokenTTL, cfg.Signing.Param)
+	rep.add("SIGNING_KEYS", err)
+	_, err = cfg.Digest.schedule()
+	rep.add("DIGEST_SCHEDULE", err)
+	_, err = parseRedirectHeaders(cfg.RedirectHeaders)
+	rep.add("REDIRECT_HEADERS", err)
+	policy := cfg.DestinationPolicy.policy()
+	rep.add("DESTINATION_POLICY", policy.normalize())
+	_, err = NewFlags(cfg.Flags)
+	rep.add("FEATURE_FLAGS", err)
+	_, err = middleware.ParseTrustedProxies(cfg.TrustedProxies)
+	rep.add("TRUSTED_PROXIES", err)
+	_, err = loadRobotsTxt(cfg.RobotsTxtFile)
+	rep.add("ROBOTS_TXT_FILE", err)
+	captcha, err := newCaptcha(cfg.Abuse)
+	if err == nil && cfg.Public.Enabled && captcha == nil {
+		err = errors.New("PUBLIC_SHORTEN_ENABLED requires CAPTCHA_PROVIDER or CAPTCHA_VERIFY_URL")
+	}
+	rep.add("CAPTCHA_PROVIDER", err)
+	_, err = newAccessLogWriter(cfg.AccessLog, cfg.Log)
+	rep.add("ACCESS_LOG_SINK", err)
+	_, err = newServer(cfg.Server, nil)
+	rep.add("HTTP2", err)
+}
+
+// checkTLS loads the certificate pair and warns of a near expiry.
+func checkTLS(rep *CheckReport, cfg ServerConfig) {
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" {
+		return
+	}
+	if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+		rep.fail("tls", "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		return
+	}
+	pair, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		rep.fail("tls", err.Error())
+		return
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		rep.fail("tls", err.Error())
+		return
+	}
+	left := time.Until(leaf.NotAfter)
+	switch {
+	case left <= 0:
+		rep.fail("tls", "certificate expired on "+leaf.NotAfter.UTC().Format(time.RFC3339))
+	case left < tlsExpiryWarning:
+		rep.warn("tls", "certificate expires on "+leaf.NotAfter.UTC().Format(time.RFC3339))
+	default:
+		rep.add("tls", nil)
+	}
+}
+
+// checkDNS resolves the hosts the server will need to reach.
+func checkDNS(ctx context.Context, rep *CheckReport, cfg Config) {
+	hosts := map[string]string{}
+	if cfg.CoordinationMode == "redis" {
+		if u, err := url.Parse(cfg.RedisURL); err == nil {
+			hosts["REDIS_URL"] = u.Hostname()
+		}
+	}
+	if cfg.SMTP.Addr != "" {
+		host, _, err := net.SplitHostPort(cfg.SMTP.Addr)
+		if err != nil {
+			host = cfg.SMTP.Addr
+		}
+		hosts["SMTP_ADDR"] = host
+	}
+	for _, p := range strings.Split(cfg.Cluster.Peers, ",") {
+		if u, err := url.Parse(strings.TrimSpace(p)); err == nil && u.Hostname() != "" {
+			hosts["CLUSTER_PEERS "+u.Host] = u.Hostname()
+		}
+	}
+	for name, host := range hosts {
+		if net.ParseIP(host) != nil {
+			continue
+		}
+		_, err := net.DefaultResolver.LookupHost(ctx, host)
+		rep.add("dns "+name, err)
+	}
+}
+
+// checkData scans the stored links for ones that cannot be served: codes
+// the router claims for itself, codes the blocklist now refuses, and
+// aliases that collide with a code or another link's alias.
+func checkData(ctx context.Context, rep *CheckReport, cfg Config, backend storage.Storage) {
+	blocked, _ := blocklistTerms(cfg.Codes.Blocklist, cfg.Codes.BlocklistFile)
+	filter := NewCodeFilter(blocked)
+	codes := map[string]bool{}
+	aliases := map[string]string{}
+	var shadowed, refused, duplicates []string
+	n := 0
+	err := backend.Scan(ctx, func(l *Link) bool {
+		n++
+		codes[l.Key()] = true
+		if routeCode(l.ShortCode) {
+			shadowed = append(shadowed, l.Key())
+		}
+		if !l.Reserved && filter.Blocked(l.ShortCode) {
+			refused = append(refused, l.Key())
+		}
+		for _, a := range l.Aliases {
+			key := storage.Key(l.Tenant, a)
+			if other, ok := aliases[key]; ok && other != l.Key() {
+				duplicates = append(duplicates, key)
+			}
+			aliases[key] = l.Key()
+		}
+		return true
+	})
+	if err != nil {
+		rep.fail("storage", err.Error())
+		return
+	}
+	rep.Checks = append(rep.Checks, CheckResult{Name: "storage", Status: CheckOK, Detail: fmt.Sprintf("%d links", n)})
+	for key := range aliases {
+		if codes[key] {
+			duplicates = append(duplicates, key)
+		}
+	}
+	listed := func(name, what string, keys []string) {
+		if len(keys) == 0 {
+			rep.add(name, nil)
+			return
+		}
+		if len(keys) > 20 {
+			keys = append(keys[:20], fmt.Sprintf("and %d more", len(keys)-20))
+		}
+		rep.warn(name, what+": "+strings.Join(keys, ", "))
+	}
+	listed("data reserved codes", "codes served by the server itself, never redirected", shadowed)
+	listed("data blocked codes", "codes the blocklist would refuse today", refused)
+	listed("data duplicate codes", "aliases that are also codes or belong to two links", duplicates)
+}
+
+// routeCode reports whether GET /{code} is answered by one of the
+// server's own routes rather than the redirect.
+func routeCode(code string) bool {
+	switch code {
+	case "health", "ready", "version", "robots.txt", "links.json", "links.xml", "ui", "api":
+		return true
+	}
+	first, _, _ := strings.Cut(code, FolderSeparator)
+	return first == "api" || first == "ui"
+}
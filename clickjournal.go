@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ClickJournal is a write-ahead log of batched clicks. Every click is
+// appended before it is counted in memory, and each flush rotates to a
+// new segment file, so a segment holds exactly the clicks of one batch.
+// A segment is removed once its batch is in the backend; whatever is left
+// on startup is replayed.
+//
+// Every entry carries a sequence number and a flush records the highest
+// one it applied on the link (Link.ClickSeq) in the same update as the
+// count, so replaying a segment whose batch had already landed before a
+// crash adds nothing. An entry also carries the click's breakdown
+// (clickBreakdown), which the flush counts in that same update. Entries
+// are written straight to the file without
+// fsync: they survive the process dying, not the machine losing power.
+type ClickJournal struct {
+	dir string
+
+	mu      sync.Mutex
+	f       *os.File
+	segment uint64
+	seq     uint64
+}
+
+// journalBatch is one segment's clicks, grouped by storage key.
+type journalBatch struct {
+	segment uint64
+	clicks  map[string]*pendingClicks
+}
+
+type pendingClicks struct {
+	n         int64
+	seq       uint64 // highest journal sequence counted in n
+	breakdown *clickBreakdown
+}
+
+// add counts a click with sequence seq and breakdown b.
+func (p *pendingClicks) add(seq uint64, b *clickBreakdown) {
+	p.n++
+	if seq > p.seq {
+		p.seq = seq
+	}
+	p.merge(b)
+}
+
+func (p *pendingClicks) merge(b *clickBreakdown) {
+	if b.empty() {
+		return
+	}
+	if p.breakdown == nil {
+		p.breakdown = &clickBreakdown{}
+	}
+	p.breakdown.merge(b)
+}
+
+const journalSuffix = ".clicks"
+
+// OpenClickJournal opens the journal in dir, creating it if needed, and
+// returns the batches left behind by the previous process, oldest first.
+func OpenClickJournal(dir string) (*ClickJournal, []journalBatch, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+	segments, err := journalSegments(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	j := &ClickJournal{dir: dir}
+	var leftover []journalBatch
+	for _, seg := range segments {
+		b, maxSeq, err := j.read(seg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if maxSeq > j.seq {
+			j.seq = maxSeq
+		}
+		j.segment = seg
+		leftover = append(leftover, b)
+	}
+	if _, err := j.rotate(); err != nil {
+		return nil, nil, err
+	}
+	return j, leftover, nil
+}
+
+func journalSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, journalSuffix) {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSuffix(name, journalSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, n)
+	}
+	sort.Slice(segments, func(i, k int) bool { return segments[i] < segments[k] })
+	return segments, nil
+}
+
+func (j *ClickJournal) path(segment uint64) string {
+	return filepath.Join(j.dir, fmt.Sprintf("%020d%s", segment, journalSuffix))
+}
+
+// read loads a segment; a torn last line from a crash mid-write is
+// ignored.
+func (j *ClickJournal) read(segment uint64) (journalBatch, uint64, error) {
+	b := journalBatch{segment: segment, clicks: map[string]*pendingClicks{}}
+	f, err := os.Open(j.path(segment))
+	if err != nil {
+		return b, 0, err
+	}
+	defer f.Close()
+	var maxSeq uint64
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.SplitN(sc.Text(), " ", 3)
+		if len(fields) < 2 || fields[1] == "" {
+			continue
+		}
+		seq, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		var breakdown *clickBreakdown
+		if len(fields) == 3 {
+			breakdown = decodeBreakdown(fields[2])
+		}
+		key := fields[1]
+		p := b.clicks[key]
+		if p == nil {
+			p = &pendingClicks{}
+			b.clicks[key] = p
+		}
+		p.add(seq, breakdown)
+		if seq > maxSeq {
+			maxSeq = seq
+		}
+	}
+	return b, maxSeq, sc.Err()
+}
+
+// Append records a click on key with breakdown b and returns its
+// sequence number.
+func (j *ClickJournal) Append(key string, b *clickBreakdown) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seq++
+	line := strconv.FormatUint(j.seq, 10) + " " + key
+	if enc := b.encode(); enc != "" {
+		line += " " + enc
+	}
+	if _, err := fmt.Fprintln(j.f, line); err != nil {
+		return 0, err
+	}
+	return j.seq, nil
+}
+
+// rotate starts a new segment and returns the one it closed.
+func (j *ClickJournal) rotate() (uint64, error) {
+	next := j.segment + 1
+	f, err := os.OpenFile(j.path(next), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	prev := j.segment
+	if j.f != nil {
+		_ = j.f.Close()
+	}
+	j.f, j.segment = f, next
+	return prev, nil
+}
+
+// Remove deletes a segment whose clicks are all in the backend.
+func (j *ClickJournal) Remove(segment uint64) error {
+	err := os.Remove(j.path(segment))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// ClickBatcher counts clicks in memory and applies them to the backend
+// every flush interval instead of updating the link on every redirect.
+type ClickBatcher struct {
+	journal *ClickJournal
+
+	mu      sync.Mutex
+	pending map[string]*pendingClicks
+	// held are segments whose batch failed to apply; their clicks were
+	// requeued and the files are kept until a later flush succeeds.
+	held []uint64
+}
+
+func NewClickBatcher(journal *ClickJournal) *ClickBatcher {
+	return &ClickBatcher{journal: journal, pending: map[string]*pendingClicks{}}
+}
+
+// Add journals a click on key with breakdown bd and queues it for the
+// next flush.
+func (b *ClickBatcher) Add(key string, bd *clickBreakdown) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	seq, err := b.journal.Append(key, bd)
+	if err != nil {
+		return err
+	}
+	p := b.pending[key]
+	if p == nil {
+		p = &pendingClicks{}
+		b.pending[key] = p
+	}
+	p.add(seq, bd)
+	return nil
+}
+
+// Pending returns the clicks on key not yet flushed.
+func (b *ClickBatcher) Pending(key string) int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if p := b.pending[key]; p != nil {
+		return p.n
+	}
+	return 0
+}
+
+// PendingTotal returns all clicks not yet flushed.
+func (b *ClickBatcher) PendingTotal() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var n int64
+	for _, p := range b.pending {
+		n += p.n
+	}
+	return n
+}
+
+// take swaps out the pending clicks and starts a new journal segment so
+// that the returned batch is exactly the closed segment's contents.
+func (b *ClickBatcher) take() (journalBatch, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	j := b.journal
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	seg, err := j.rotate()
+	if err != nil {
+		return journalBatch{}, err
+	}
+	batch := journalBatch{segment: seg, clicks: b.pending}
+	b.pending = map[string]*pendingClicks{}
+	return batch, nil
+}
+
+// requeue puts clicks that could not be applied back in front of the
+// next flush. Their sequence numbers only move forward, so a replay of
+// the held segment is still skipped once they land.
+func (b *ClickBatcher) requeue(failed map[string]*pendingClicks, segment uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, f := range failed {
+		p := b.pending[key]
+		if p == nil {
+			b.pending[key] = f
+			continue
+		}
+		p.n += f.n
+		p.merge(f.breakdown)
+	}
+	b.held = append(b.held, segment)
+}
+
+// RunClickFlush applies batched clicks every interval.
+func (s *Store) RunClickFlush(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		s.flushClicks(context.Background())
+	}
+}
+
+func (s *Store) flushClicks(ctx context.Context) {
+	batch, err := s.batch.take()
+	if err != nil {
+		logrus.WithError(err).Error("click journal rotation failed")
+		return
+	}
+	failed := s.applyClicks(ctx, batch)
+	if len(failed) > 0 {
+		s.batch.requeue(failed, batch.segment)
+		return
+	}
+	s.batch.mu.Lock()
+	held := append(s.batch.held, batch.segment)
+	s.batch.held = nil
+	s.batch.mu.Unlock()
+	for _, seg := range held {
+		if err := s.batch.journal.Remove(seg); err != nil {
+			logrus.WithError(err).Warn("removing click journal segment failed")
+		}
+	}
+}
+
+// applyClicks adds a batch to the backend and returns the keys whose
+// update failed. Links that are gone take their clicks with them.
+func (s *Store) applyClicks(ctx context.Context, batch journalBatch) map[string]*pendingClicks {
+	failed := map[string]*pendingClicks{}
+	var applied int64
+	for key, p := range batch.clicks {
+		var prev int64
+		l, err := s.backend.Update(ctx, key, func(l *Link) error {
+			if l.ClickSeq >= p.seq {
+				return errAlreadyApplied
+			}
+			prev = l.Clicks
+			l.Clicks += p.n
+			l.ClickSeq = p.seq
+			p.breakdown.apply(l)
+			if l.SlidingTTL {
+				if exp := s.now().Add(time.Duration(l.TTLSeconds) * time.Second); exp.After(l.ExpiresAt) {
+					l.ExpiresAt = exp
+					l.ExpiryNotified = false
+				}
+			}
+			return nil
+		})
+		switch {
+		case err == nil:
+			applied += p.n
+			s.checkMilestones(l, prev)
+		case errors.Is(err, errAlreadyApplied), errors.Is(err, ErrNotFound):
+		default:
+			logrus.WithError(err).WithField("storage_key", key).Warn("flushing clicks failed, will retry")
+			failed[key] = p
+		}
+	}
+	metricClicksFlushed.Add(applied)
+	return failed
+}
+
+var errAlreadyApplied = errors.New("clicks already applied")
+
+// ReplayClickJournal applies the batches a previous process journaled but
+// may not have flushed, then removes their segments.
+func (s *Store) ReplayClickJournal(ctx context.Context, leftover []journalBatch) error {
+	for _, batch := range leftover {
+		if failed := s.applyClicks(ctx, batch); len(failed) > 0 {
+			return fmt.Errorf("replaying click journal segment %d: %d links failed", batch.segment, len(failed))
+		}
+		if err := s.batch.journal.Remove(batch.segment); err != nil {
+			return err
+		}
+		var n int64
+		for _, p := range batch.clicks {
+			n += p.n
+		}
+		logrus.WithFields(logrus.Fields{
+			"action":  "click_replay",
+			"segment": batch.segment,
+			"clicks":  n,
+		}).Info("replayed click journal segment")
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"url-shortener/storage"
+)
+
+// updateCounter counts the backend updates a store makes.
+type updateCounter struct {
+	storage.Storage
+	updates int
+}
+
+func (u *updateCounter) Update(ctx context.Context, key string, fn func(*Link) error) (*Link, error) {
+	u.updates++
+	return u.Storage.Update(ctx, key, fn)
+}
+
+// TestClickBreakdown clicks a rotating link with client hints from two
+// share sources: the destination, source and device counts land in the
+// update that adds the clicks, whether that is the click's own, a batch
+// flush or a journal replay after a restart.
+func TestClickBreakdown(t *testing.T) {
+	mobile := false
+	hints := &ClientHints{Browser: "Firefox", Platform: "Linux", Mobile: &mobile}
+	clicks := []struct {
+		pick   int
+		source string
+	}{{0, "twitter"}, {1, "newsletter"}, {1, "twitter"}}
+
+	tests := []struct {
+		name        string
+		batched     bool
+		restart     bool
+		wantUpdates int
+	}{
+		{"direct", false, false, len(clicks)},
+		{"batched", true, false, 1},
+		{"replayed", true, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := &updateCounter{Storage: storage.NewMemory()}
+			s := NewStore("http://short.test", backend)
+			s.clock = systemClock{}
+			dir := t.TempDir()
+			if tt.batched {
+				journal, _, err := OpenClickJournal(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.batch = NewClickBatcher(journal)
+			}
+			l, err := s.Create(ctx, "https://example.com/a", "", time.Hour, LinkOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, err = backend.Update(ctx, l.Key(), func(l *Link) error {
+				l.ClientHints = true
+				l.Destinations = []storage.Destination{{URL: "https://example.com/a"}, {URL: "https://example.com/b"}}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			backend.updates = 0
+			for _, c := range clicks {
+				if s.Increment(ctx, l.ShortCode, newClickBreakdown(l, c.pick, c.source, hints)) == nil {
+					t.Fatal("Increment did not record the click")
+				}
+			}
+			switch {
+			case tt.restart:
+				journal, leftover, err := OpenClickJournal(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.batch = NewClickBatcher(journal)
+				if err := s.ReplayClickJournal(ctx, leftover); err != nil {
+					t.Fatal(err)
+				}
+			case tt.batched:
+				s.flushClicks(ctx)
+			}
+			if backend.updates != tt.wantUpdates {
+				t.Errorf("%d backend updates, want %d", backend.updates, tt.wantUpdates)
+			}
+
+			got, err := backend.Get(ctx, l.Key())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Clicks != 3 {
+				t.Errorf("Clicks = %d, want 3", got.Clicks)
+			}
+			if dests := []int64{got.Destinations[0].Clicks, got.Destinations[1].Clicks}; !reflect.DeepEqual(dests, []int64{1, 2}) {
+				t.Errorf("destination clicks = %v, want [1 2]", dests)
+			}
+			if want := map[string]int64{"twitter": 2, "newsletter": 1}; !reflect.DeepEqual(got.Sources, want) {
+				t.Errorf("Sources = %v, want %v", got.Sources, want)
+			}
+			want := map[string]map[string]int64{
+				"browser":  {"Firefox": 3},
+				"platform": {"Linux": 3},
+				"mobile":   {"false": 3},
+			}
+			if !reflect.DeepEqual(got.Devices, want) {
+				t.Errorf("Devices = %v, want %v", got.Devices, want)
+			}
+		})
+	}
+}
+
+func TestClickBreakdownEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		b    *clickBreakdown
+	}{
+		{"nil", nil},
+		{"destination", &clickBreakdown{destinations: map[int]int64{2: 3}}},
+		{"source with separators", &clickBreakdown{sources: map[string]int64{"a b&c=d": 1}}},
+		{"devices", &clickBreakdown{devices: map[string]map[string]int64{"platform": {"Linux": 2, "macOS": 1}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeBreakdown(tt.b.encode()); !reflect.DeepEqual(got, tt.b) {
+				t.Errorf("decodeBreakdown(encode()) = %+v, want %+v", got, tt.b)
+			}
+		})
+	}
+}
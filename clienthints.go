@@ -0,0 +1,223 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// acceptClientHints is the Accept-CH of a ClientHints link's interstitial
+// page. Chromium browsers send the first three on every secure request
+// anyway; the others only to origins that asked for them, from the next
+// request on.
+const acceptClientHints = "Sec-CH-UA, Sec-CH-UA-Mobile, Sec-CH-UA-Platform, " +
+	"Sec-CH-UA-Platform-Version, Sec-CH-UA-Model, Sec-CH-UA-Full-Version-List"
+
+// Bounds of the device breakdown. Values past maxDeviceValues in one
+// dimension are counted under otherSource.
+const (
+	maxDeviceValues = 50
+	maxHintLength   = 64
+)
+
+// ClientHints is what a click's request headers say about the device,
+// without any script on the page. Fields not sent are empty.
+type ClientHints struct {
+	Browser         string `json:"browser,omitempty"`
+	BrowserVersion  string `json:"browser_version,omitempty"`
+	Mobile          *bool  `json:"mobile,omitempty"`
+	Platform        string `json:"platform,omitempty"`
+	PlatformVersion string `json:"platform_version,omitempty"`
+	Model           string `json:"model,omitempty"`
+	Language        string `json:"language,omitempty"` // first of Accept-Language
+}
+
+// clientHints reads r's Sec-CH-UA headers and Accept-Language, or returns
+// nil if it has none of them.
+func clientHints(r *http.Request) *ClientHints {
+	h := &ClientHints{
+		Platform:        hintString(r.Header.Get("Sec-CH-UA-Platform")),
+		PlatformVersion: hintString(r.Header.Get("Sec-CH-UA-Platform-Version")),
+		Model:           hintString(r.Header.Get("Sec-CH-UA-Model")),
+		Language:        firstLanguage(r.Header.Get("Accept-Language")),
+	}
+	h.Browser, h.BrowserVersion = uaBrand(r.Header.Get("Sec-CH-UA-Full-Version-List"))
+	if h.Browser == "" {
+		h.Browser, h.BrowserVersion = uaBrand(r.Header.Get("Sec-CH-UA"))
+	}
+	switch r.Header.Get("Sec-CH-UA-Mobile") {
+	case "?1":
+		mobile := true
+		h.Mobile = &mobile
+	case "?0":
+		mobile := false
+		h.Mobile = &mobile
+	}
+	if *h == (ClientHints{}) {
+		return nil
+	}
+	return h
+}
+
+// generalize drops the hints that single out a device rather than
+// describe a kind of one, for privacy mode.
+func (h *ClientHints) generalize() *ClientHints {
+	if h == nil {
+		return nil
+	}
+	g := *h
+	g.BrowserVersion, g.PlatformVersion, g.Model = "", "", ""
+	return &g
+}
+
+// dimensions are the values h adds to a link's device breakdown.
+func (h *ClientHints) dimensions() map[string]string {
+	dims := map[string]string{}
+	for dim, v := range map[string]string{
+		"browser":  h.Browser,
+		"platform": h.Platform,
+		"model":    h.Model,
+		"language": h.Language,
+	} {
+		if v != "" {
+			dims[dim] = v
+		}
+	}
+	if h.Mobile != nil {
+		dims["mobile"] = strconv.FormatBool(*h.Mobile)
+	}
+	return dims
+}
+
+// hintString unquotes a structured-field string such as "Windows".
+func hintString(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(s[1 : len(s)-1])
+	}
+	if len(s) > maxHintLength {
+		s = s[:maxHintLength]
+	}
+	return s
+}
+
+// uaBrand picks the browser out of a Sec-CH-UA brand list such as
+// "Chromium";v="124", "Google Chrome";v="124", "Not-A.Brand";v="99",
+// skipping the made-up brands browsers add to keep servers from relying
+// on the order, and preferring a named browser to Chromium.
+func uaBrand(list string) (brand, version string) {
+	for _, item := range splitQuoted(list, ',') {
+		parts := splitQuoted(item, ';')
+		name := hintString(parts[0])
+		if name == "" || strings.HasPrefix(name, "Not") && strings.Contains(name, "Brand") {
+			continue
+		}
+		v := ""
+		for _, p := range parts[1:] {
+			if k, val, ok := strings.Cut(strings.TrimSpace(p), "="); ok && k == "v" {
+				v = hintString(val)
+			}
+		}
+		if brand == "" || brand == "Chromium" {
+			brand, version = name, v
+		}
+	}
+	return brand, version
+}
+
+// splitQuoted splits s at sep outside double quotes.
+func splitQuoted(s string, sep byte) []string {
+	var out []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			out = append(out, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(out, s[start:])
+}
+
+// firstLanguage returns the first language of an Accept-Language header in
+// canonical form, e.g. en-US, or "" if there is none.
+func firstLanguage(header string) string {
+	first, _, _ := strings.Cut(header, ",")
+	first, _, _ = strings.Cut(first, ";")
+	tag, err := language.Parse(strings.TrimSpace(first))
+	if err != nil || tag == language.Und {
+		return ""
+	}
+	return hintString(tag.String())
+}
+
+// countDevice adds n clicks with value v in dimension dim to l's device
+// breakdown.
+func countDevice(l *Link, dim, v string, n int64) {
+	if l.Devices == nil {
+		l.Devices = make(map[string]map[string]int64)
+	}
+	counts := l.Devices[dim]
+	if counts == nil {
+		counts = make(map[string]int64)
+		l.Devices[dim] = counts
+	}
+	if _, ok := counts[v]; !ok && len(counts) >= maxDeviceValues {
+		v = otherSource
+	}
+	counts[v] += n
+}
+
+// DeviceClicks is one row of a device breakdown.
+type DeviceClicks struct {
+	Value  string `json:"value"`
+	Clicks int64  `json:"clicks"`
+}
+
+type devicesResponse struct {
+	ShortCode   string                    `json:"short_code"`
+	Clicks      int64                     `json:"clicks"`
+	ClientHints bool                      `json:"client_hints"`
+	Dimensions  map[string][]DeviceClicks `json:"dimensions"`
+}
+
+// devicesHandler serves GET /api/stats/{code}/devices: the clicks of a
+// ClientHints link per browser, platform, mobile, model and language,
+// most clicked first. Clicks whose browser sent no hint for a dimension
+// are not in it.
+func devicesHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, err := store.Stats(r.Context(), codeVar(r))
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		resp := devicesResponse{
+			ShortCode:   link.ShortCode,
+			Clicks:      link.Clicks,
+			ClientHints: link.ClientHints,
+			Dimensions:  make(map[string][]DeviceClicks, len(link.Devices)),
+		}
+		for dim, counts := range link.Devices {
+			rows := make([]DeviceClicks, 0, len(counts))
+			for v, n := range counts {
+				rows = append(rows, DeviceClicks{Value: v, Clicks: n})
+			}
+			sort.Slice(rows, func(i, j int) bool {
+				if rows[i].Clicks != rows[j].Clicks {
+					return rows[i].Clicks > rows[j].Clicks
+				}
+				return rows[i].Value < rows[j].Value
+			})
+			resp.Dimensions[dim] = rows
+		}
+		writeCachedJSON(w, r, resp, link.UpdatedAt)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import "time"
+
+// Clock is the time source for expiry and every other time-based rule,
+// so that tests can run them against a fake clock such as storetest.Clock.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// now is the current time on the store's clock, in UTC.
+func (s *Store) now() time.Time {
+	if s.clock == nil {
+		return time.Now().UTC()
+	}
+	return s.clock.Now().UTC()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"url-shortener/notify"
+	"url-shortener/storage"
+	"url-shortener/storage/storetest"
+)
+
+var testEpoch = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// newClockedStore returns a store on an empty memory backend whose clock
+// the test moves by hand.
+func newClockedStore(t *testing.T) (*Store, *storetest.Clock) {
+	t.Helper()
+	clock := storetest.NewClock(testEpoch)
+	s := NewStore("http://short.test", storage.NewMemory())
+	s.clock = clock
+	return s, clock
+}
+
+func TestExpiryFollowsClock(t *testing.T) {
+	ctx := context.Background()
+	s, clock := newClockedStore(t)
+	l, err := s.Create(ctx, "https://example.com/a", "", time.Hour, LinkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testEpoch.Add(time.Hour); !l.ExpiresAt.Equal(want) {
+		t.Fatalf("ExpiresAt = %v, want %v", l.ExpiresAt, want)
+	}
+
+	clock.Advance(59 * time.Minute)
+	if links, _ := s.Lookup(ctx, "", "https://example.com/a"); len(links) != 1 {
+		t.Fatalf("before expiry: Lookup found %d links, want 1", len(links))
+	}
+	clock.Advance(2 * time.Minute)
+	if links, _ := s.Lookup(ctx, "", "https://example.com/a"); len(links) != 0 {
+		t.Fatalf("after expiry: Lookup found %d links, want 0", len(links))
+	}
+}
+
+func TestSweepFollowsClock(t *testing.T) {
+	ctx := context.Background()
+	s, clock := newClockedStore(t)
+	short, err := s.Create(ctx, "https://example.com/short", "", time.Hour, LinkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, err := s.Create(ctx, "https://example.com/long", "", 3*time.Hour, LinkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed, _ := s.sweep(ctx, true); removed != 0 {
+		t.Fatalf("sweep at creation removed %d links, want 0", removed)
+	}
+	clock.Advance(2 * time.Hour)
+	if removed, _ := s.sweep(ctx, true); removed != 1 {
+		t.Fatalf("sweep after 2h removed %d links, want 1", removed)
+	}
+	if _, err := s.Get(ctx, short.ShortCode); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get(expired) error = %v, want ErrNotFound", err)
+	}
+	if _, err := s.Get(ctx, long.ShortCode); err != nil {
+		t.Fatalf("Get(live) error = %v", err)
+	}
+}
+
+// webhookRecorder stands in for the network under a notifier's client,
+// answering every request with status.
+type webhookRecorder struct {
+	status   int
+	requests int
+}
+
+func (w *webhookRecorder) RoundTrip(r *http.Request) (*http.Response, error) {
+	w.requests++
+	return &http.Response{
+		StatusCode: w.status,
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    r,
+	}, nil
+}
+
+func newTestNotifier(notice time.Duration, hook *webhookRecorder) *Notifier {
+	n := NewNotifier(notice, SMTPConfig{})
+	n.client = &http.Client{Transport: hook}
+	n.dispatch = notify.Dispatcher{Attempts: 1}
+	return n
+}
+
+func TestExpiryNoticeLeadTime(t *testing.T) {
+	ctx := context.Background()
+	s, clock := newClockedStore(t)
+	hook := &webhookRecorder{status: http.StatusOK}
+	n := newTestNotifier(time.Hour, hook)
+	n.SetPrefs("alice", NotificationPrefs{
+		Enabled:              true,
+		NotificationChannels: NotificationChannels{WebhookURL: "https://hooks.example/expiry"},
+	})
+	n.SetPrefs("bob", NotificationPrefs{
+		Enabled:              true,
+		NotificationChannels: NotificationChannels{WebhookURL: "https://hooks.example/expiry"},
+		NoticeHours:          3,
+	})
+	if _, err := s.Create(ctx, "https://example.com/a", "", 4*time.Hour, LinkOptions{Owner: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create(ctx, "https://example.com/b", "", 4*time.Hour, LinkOptions{Owner: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		advance time.Duration
+		want    int // webhook requests so far
+	}{
+		{0, 0},
+		{59 * time.Minute, 0}, // 3h01m left: outside both windows
+		{2 * time.Minute, 1},  // 2h59m left: inside bob's 3h
+		{time.Hour, 1},        // 1h59m left: bob already notified
+		{time.Hour, 2},        // 59m left: inside alice's default 1h
+		{30 * time.Minute, 2}, // nothing further to send
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		n.notifyExpiring(s)
+		if hook.requests != step.want {
+			t.Fatalf("step %d (%s left): %d webhook requests, want %d",
+				i, testEpoch.Add(4*time.Hour).Sub(clock.Now()), hook.requests, step.want)
+		}
+	}
+}
+
+func TestExpiryNoticeRetriedAfterFailure(t *testing.T) {
+	ctx := context.Background()
+	s, clock := newClockedStore(t)
+	hook := &webhookRecorder{status: http.StatusBadGateway}
+	n := newTestNotifier(time.Hour, hook)
+	n.SetPrefs("alice", NotificationPrefs{
+		Enabled:              true,
+		NotificationChannels: NotificationChannels{WebhookURL: "https://hooks.example/expiry"},
+	})
+	if _, err := s.Create(ctx, "https://example.com/a", "", 2*time.Hour, LinkOptions{Owner: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(90 * time.Minute)
+	n.notifyExpiring(s)
+	if hook.requests != 1 {
+		t.Fatalf("first round: %d webhook requests, want 1", hook.requests)
+	}
+	hook.status = http.StatusOK
+	clock.Advance(time.Minute)
+	n.notifyExpiring(s)
+	n.notifyExpiring(s)
+	if hook.requests != 2 {
+		t.Fatalf("after the failure: %d webhook requests, want 2", hook.requests)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"url-shortener/cluster"
+)
+
+// ClusterConfig turns on cluster mode, in which links are spread over the
+// instances, each link held by Replicas of them, instead of every
+// instance keeping its own.
+type ClusterConfig struct {
+	Self           string        // CLUSTER_SELF, this node's URL as the others reach it; empty disables cluster mode
+	Peers          string        // CLUSTER_PEERS, comma-separated URLs of nodes to join through
+	Replicas       int           // CLUSTER_REPLICAS, nodes holding each link
+	GossipInterval time.Duration // CLUSTER_GOSSIP_INTERVAL between membership exchanges
+	FailAfter      time.Duration // CLUSTER_FAIL_AFTER without a heartbeat before a node is dropped
+	Secret         string        // CLUSTER_SECRET, shared by every node
+}
+
+// newClusterNode returns nil when cluster mode is off.
+func newClusterNode(cfg ClusterConfig) *cluster.Node {
+	if cfg.Self == "" {
+		return nil
+	}
+	var seeds []string
+	for _, p := range strings.Split(cfg.Peers, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			seeds = append(seeds, p)
+		}
+	}
+	return cluster.NewNode(cluster.Config{
+		Self:           cfg.Self,
+		Seeds:          seeds,
+		Replicas:       cfg.Replicas,
+		GossipInterval: cfg.GossipInterval,
+		FailAfter:      cfg.FailAfter,
+		Secret:         cfg.Secret,
+	})
+}
+
+// forwardToOwner sends redirects for codes held elsewhere in the cluster
+// to their owner.
+func forwardToOwner(node *cluster.Node, store *Store) func(http.Handler) http.Handler {
+	return node.Forward(func(r *http.Request) string {
+		return store.key(r.Context(), codeVar(r))
+	})
+}
+
+type clusterResponse struct {
+	Self     string           `json:"self"`
+	Leader   bool             `json:"leader"`
+	Replicas int              `json:"replicas"`
+	Members  []cluster.Member `json:"members"`
+}
+
+// clusterHandler serves GET /api/admin/cluster: this node's view of the
+// membership.
+func clusterHandler(node *cluster.Node) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, clusterResponse{
+			Self:     node.Self(),
+			Leader:   node.IsLeader(),
+			Replicas: node.Replicas(),
+			Members:  node.Members(),
+		})
+	}
+}
+
+// startCluster runs gossip and rebalancing in the background.
+func startCluster(cs *cluster.Storage) {
+	go cs.Node().Run(context.Background())
+	go cs.Run(context.Background())
+}
@@ -0,0 +1,70 @@
+package cluster
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ForwardedHeader marks a request one node has forwarded to another, so
+// that nodes with different views of the ring cannot bounce it forever.
+const ForwardedHeader = "X-Cluster-Forwarded"
+
+type forwarder struct {
+	node    *Node
+	proxies sync.Map // peer URL → *httputil.ReverseProxy
+}
+
+func (f *forwarder) proxy(peer string) (*httputil.ReverseProxy, error) {
+	if p, ok := f.proxies.Load(peer); ok {
+		return p.(*httputil.ReverseProxy), nil
+	}
+	u, err := url.Parse(peer)
+	if err != nil {
+		return nil, err
+	}
+	p := httputil.NewSingleHostReverseProxy(u)
+	actual, _ := f.proxies.LoadOrStore(peer, p)
+	return actual.(*httputil.ReverseProxy), nil
+}
+
+// Forward returns middleware that hands requests for keys this node does
+// not hold to the key's primary, keeping the original Host so that the
+// owner resolves the same tenant. keyOf returns the storage key a request
+// is for, or "" to serve it here. If the owner cannot be reached the
+// request is served here, reading the link from its replicas.
+//
+// The owner sees the request coming from this node: list the nodes in
+// its trusted proxies for it to log and rate limit the real client.
+func (n *Node) Forward(keyOf func(*http.Request) string) func(http.Handler) http.Handler {
+	f := &forwarder{node: n}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := ""
+			if r.Header.Get(ForwardedHeader) == "" {
+				key = keyOf(r)
+			}
+			if key == "" || n.Owns(key) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			peer := n.Primary(key)
+			p, err := f.proxy(peer)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			out := r.Clone(r.Context())
+			out.Header.Set(ForwardedHeader, n.Self())
+			rp := *p
+			rp.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, err error) {
+				logrus.WithError(err).WithField("peer", peer).Warn("forwarding to cluster owner failed, serving locally")
+				next.ServeHTTP(w, r)
+			}
+			rp.ServeHTTP(w, out)
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"url-shortener/storage"
+)
+
+// Nodes talk to each other under /internal/cluster/, authenticated by the
+// shared secret:
+//
+//	POST   /internal/cluster/gossip                 exchange membership
+//	GET    /internal/cluster/links?key=             read the local copy
+//	POST   /internal/cluster/links                  create, as primary
+//	PUT    /internal/cluster/links?key=&expect=     write if unchanged since expect, as primary
+//	PUT    /internal/cluster/links?replica=1        store a copy from the primary
+//	DELETE /internal/cluster/links?key=[&replica=1] delete, as primary or copy
+//	GET    /internal/cluster/find?url=&alive=       matching links this node is primary for
+//	GET    /internal/cluster/scan?alive=            every link this node is primary for
+//	GET    /internal/cluster/scan?alive=&ordered=1[&after=&after_key=]
+//	                                                the same in listing order, after a position
+//
+// alive lists the live nodes as the caller sees them; the ring built over
+// them decides who is primary.
+
+// wireLink carries the bookkeeping fields Link keeps out of its JSON.
+type wireLink struct {
+	*storage.Link
+	ExpiryNotified bool   `json:"expiry_notified,omitempty"`
+	ClickSeq       uint64 `json:"click_seq,omitempty"`
+}
+
+func wire(l *storage.Link) wireLink {
+	return wireLink{Link: l, ExpiryNotified: l.ExpiryNotified, ClickSeq: l.ClickSeq}
+}
+
+func decodeLink(dec *json.Decoder) (*storage.Link, error) {
+	w := wireLink{Link: &storage.Link{}}
+	if err := dec.Decode(&w); err != nil {
+		return nil, err
+	}
+	w.Link.ExpiryNotified, w.Link.ClickSeq = w.ExpiryNotified, w.ClickSeq
+	return w.Link, nil
+}
+
+// statusError maps a peer's answer to the storage errors it stands for.
+func statusError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return storage.ErrNotFound
+	case http.StatusConflict:
+		if resp.Header.Get("X-Cluster-Conflict") == "changed" {
+			return errConflict
+		}
+		return storage.ErrExists
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("cluster peer answered %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+func (s *Storage) call(ctx context.Context, method, peer, path string, l *storage.Link) (*storage.Link, error) {
+	var body io.Reader
+	if l != nil {
+		b, err := json.Marshal(wire(l))
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	resp, err := s.node.do(ctx, method, peer, path, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := statusError(resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	return decodeLink(json.NewDecoder(resp.Body))
+}
+
+func (s *Storage) remoteGet(ctx context.Context, peer, key string) (*storage.Link, error) {
+	return s.call(ctx, http.MethodGet, peer, "/internal/cluster/links?key="+url.QueryEscape(key), nil)
+}
+
+func (s *Storage) remoteCreate(ctx context.Context, peer string, l *storage.Link) error {
+	if l.UpdatedAt.IsZero() {
+		l.UpdatedAt = time.Now().UTC()
+	}
+	_, err := s.call(ctx, http.MethodPost, peer, "/internal/cluster/links", l)
+	return err
+}
+
+func (s *Storage) remotePut(ctx context.Context, peer, key string, l *storage.Link, expect time.Time) (*storage.Link, error) {
+	q := url.Values{"key": {key}, "expect": {expect.Format(time.RFC3339Nano)}}
+	return s.call(ctx, http.MethodPut, peer, "/internal/cluster/links?"+q.Encode(), l)
+}
+
+func (s *Storage) sendReplica(ctx context.Context, peer string, l *storage.Link) error {
+	_, err := s.call(ctx, http.MethodPut, peer, "/internal/cluster/links?replica=1", l)
+	return err
+}
+
+func (s *Storage) remoteDelete(ctx context.Context, peer, key string, replica bool) error {
+	q := url.Values{"key": {key}}
+	if replica {
+		q.Set("replica", "1")
+	}
+	_, err := s.call(ctx, http.MethodDelete, peer, "/internal/cluster/links?"+q.Encode(), nil)
+	return err
+}
+
+func (s *Storage) remoteFind(ctx context.Context, peer string, alive []string, longURL string) ([]*storage.Link, error) {
+	var out []*storage.Link
+	q := url.Values{"url": {longURL}, "alive": {strings.Join(alive, ",")}}
+	err := s.stream(ctx, peer, "/internal/cluster/find?"+q.Encode(), func(l *storage.Link) bool {
+		out = append(out, l)
+		return true
+	})
+	return out, err
+}
+
+func (s *Storage) remoteScan(ctx context.Context, peer string, alive []string, fn func(*storage.Link) bool) error {
+	q := url.Values{"alive": {strings.Join(alive, ",")}}
+	return s.stream(ctx, peer, "/internal/cluster/scan?"+q.Encode(), fn)
+}
+
+func (s *Storage) remoteScanFrom(ctx context.Context, peer string, alive []string, after *storage.Position, fn func(*storage.Link) bool) error {
+	q := url.Values{"alive": {strings.Join(alive, ",")}, "ordered": {"1"}}
+	if after != nil {
+		q.Set("after", after.CreatedAt.Format(time.RFC3339Nano))
+		q.Set("after_key", after.Key)
+	}
+	return s.stream(ctx, peer, "/internal/cluster/scan?"+q.Encode(), fn)
+}
+
+// stream reads newline-delimited links from peer until fn returns false.
+func (s *Storage) stream(ctx context.Context, peer, path string, fn func(*storage.Link) bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resp, err := s.node.do(ctx, http.MethodGet, peer, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := statusError(resp); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		l, err := decodeLink(dec)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !fn(l) {
+			return nil
+		}
+	}
+}
+
+// Handler serves the internal API other nodes call. Mount it at
+// /internal/cluster/, outside any middleware that could refuse writes.
+func (s *Storage) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/internal/cluster/gossip", s.node.gossipHandler)
+	mux.HandleFunc("/internal/cluster/links", s.linksHandler)
+	mux.HandleFunc("/internal/cluster/find", func(w http.ResponseWriter, r *http.Request) {
+		links, err := s.localFind(r.Context(), callerRing(r), r.URL.Query().Get("url"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		enc := json.NewEncoder(w)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for _, l := range links {
+			_ = enc.Encode(wire(l))
+		}
+	})
+	mux.HandleFunc("/internal/cluster/scan", func(w http.ResponseWriter, r *http.Request) {
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		send := func(l *storage.Link) bool {
+			return enc.Encode(wire(l)) == nil
+		}
+		q := r.URL.Query()
+		if q.Get("ordered") != "1" {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			_ = s.localScan(r.Context(), callerRing(r), send)
+			_ = bw.Flush()
+			return
+		}
+		var after *storage.Position
+		if v := q.Get("after"); v != "" {
+			at, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				http.Error(w, "invalid after", http.StatusBadRequest)
+				return
+			}
+			after = &storage.Position{CreatedAt: at, Key: q.Get("after_key")}
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		_ = s.localScanFrom(r.Context(), callerRing(r), after, send)
+		_ = bw.Flush()
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.node.authorized(r) {
+			http.Error(w, "unknown cluster node", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// callerRing rebuilds the ring the caller of a scan sees from its list
+// of live nodes.
+func callerRing(r *http.Request) *Ring {
+	var alive []string
+	for _, m := range strings.Split(r.URL.Query().Get("alive"), ",") {
+		if m != "" {
+			alive = append(alive, m)
+		}
+	}
+	return NewRing(alive)
+}
+
+func (s *Storage) linksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := r.URL.Query()
+	key, replica := q.Get("key"), q.Get("replica") == "1"
+	var l *storage.Link
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		var err error
+		if l, err = decodeLink(json.NewDecoder(r.Body)); err != nil {
+			http.Error(w, "invalid link", http.StatusBadRequest)
+			return
+		}
+	}
+	var out *storage.Link
+	var err error
+	switch {
+	case r.Method == http.MethodGet:
+		out, err = s.local.Get(ctx, key)
+	case r.Method == http.MethodPost:
+		err = s.createPrimary(ctx, l)
+	case r.Method == http.MethodPut && replica:
+		err = s.applyReplica(ctx, l)
+	case r.Method == http.MethodPut:
+		var expect time.Time
+		if expect, err = time.Parse(time.RFC3339Nano, q.Get("expect")); err != nil {
+			http.Error(w, "invalid expect", http.StatusBadRequest)
+			return
+		}
+		out, err = s.updatePrimary(ctx, key, func(dst *storage.Link) error {
+			if !dst.UpdatedAt.Equal(expect) {
+				return errConflict
+			}
+			*dst = *l
+			return nil
+		})
+	case r.Method == http.MethodDelete && replica:
+		err = s.local.Delete(ctx, key)
+	case r.Method == http.MethodDelete:
+		err = s.deletePrimary(ctx, key)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if out == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(wire(out))
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errConflict):
+		w.Header().Set("X-Cluster-Conflict", "changed")
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, storage.ErrExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
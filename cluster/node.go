@@ -0,0 +1,325 @@
+// Package cluster spreads links across several in-memory instances
+// without a database. Nodes learn about each other by gossip, every key
+// is owned by Replicas nodes picked by consistent hashing, and a node
+// serves keys it does not hold by asking, or forwarding to, their owner.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SecretHeader carries the shared secret on requests between nodes.
+const SecretHeader = "X-Cluster-Secret"
+
+// Config describes this node and how it finds and watches the others.
+type Config struct {
+	// Self is the base URL other nodes reach this one at, e.g.
+	// http://10.0.0.5:8080. It is also the node's name on the ring.
+	Self string
+	// Seeds are nodes contacted at startup; the rest are learned from
+	// them. Listing every node is fine.
+	Seeds []string
+	// Replicas is how many nodes hold each link, the owner included.
+	Replicas int
+	// GossipInterval is how often membership is exchanged with a peer.
+	GossipInterval time.Duration
+	// FailAfter is how long a node may go without a fresh heartbeat
+	// before it is taken off the ring.
+	FailAfter time.Duration
+	// Secret authenticates nodes to each other.
+	Secret string
+}
+
+// Member is one node as seen by this one.
+type Member struct {
+	URL string `json:"url"`
+	// Heartbeat is the node's own counter; it only ever grows, restarts
+	// included, since it starts from the clock.
+	Heartbeat uint64    `json:"heartbeat"`
+	Alive     bool      `json:"alive"`
+	LastSeen  time.Time `json:"last_seen"` // when Heartbeat last advanced, by our clock
+}
+
+// Node is this process's membership in the cluster.
+type Node struct {
+	cfg    Config
+	client *http.Client
+
+	mu      sync.Mutex
+	members map[string]*Member
+	ring    atomic.Pointer[Ring]
+	changes chan struct{} // signalled when the ring is rebuilt
+}
+
+// NewNode returns a node that knows only itself and cfg.Seeds until it
+// starts gossiping.
+func NewNode(cfg Config) *Node {
+	cfg.Self = normalize(cfg.Self)
+	if cfg.Replicas < 1 {
+		cfg.Replicas = 1
+	}
+	n := &Node{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		members: map[string]*Member{},
+		changes: make(chan struct{}, 1),
+	}
+	now := time.Now()
+	n.members[cfg.Self] = &Member{URL: cfg.Self, Heartbeat: uint64(now.UnixMilli()), Alive: true, LastSeen: now}
+	for _, seed := range cfg.Seeds {
+		if seed = normalize(seed); seed != "" && seed != cfg.Self {
+			// Seeds start out dead so that keys are not routed to them
+			// before they have answered once.
+			n.members[seed] = &Member{URL: seed}
+		}
+	}
+	n.rebuild()
+	return n
+}
+
+func normalize(u string) string {
+	return strings.TrimRight(strings.TrimSpace(u), "/")
+}
+
+// Self returns this node's URL.
+func (n *Node) Self() string { return n.cfg.Self }
+
+// Replicas returns how many nodes hold each key.
+func (n *Node) Replicas() int { return n.cfg.Replicas }
+
+// Owners returns the live nodes responsible for key, the primary first.
+func (n *Node) Owners(key string) []string {
+	return n.ring.Load().Owners(key, n.cfg.Replicas)
+}
+
+// Primary returns the live node that owns key.
+func (n *Node) Primary(key string) string {
+	if owners := n.Owners(key); len(owners) > 0 {
+		return owners[0]
+	}
+	return n.cfg.Self
+}
+
+// Owns reports whether this node holds key, as primary or replica.
+func (n *Node) Owns(key string) bool {
+	return contains(n.Owners(key), n.cfg.Self)
+}
+
+// IsLeader reports whether this node has the lowest URL among the live
+// ones, which makes it the one to run cluster-wide singleton jobs.
+func (n *Node) IsLeader() bool {
+	return n.Alive()[0] == n.cfg.Self
+}
+
+// Alive returns the URLs of the live nodes, this one included, sorted.
+func (n *Node) Alive() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.aliveLocked()
+}
+
+func (n *Node) aliveLocked() []string {
+	var out []string
+	for url, m := range n.members {
+		if m.Alive {
+			out = append(out, url)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Members returns every node this one has heard of, sorted by URL.
+func (n *Node) Members() []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	out := make([]Member, 0, len(n.members))
+	for _, m := range n.members {
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].URL < out[j].URL })
+	return out
+}
+
+// Changes is signalled, without blocking, whenever the set of live nodes
+// changes and keys may have moved.
+func (n *Node) Changes() <-chan struct{} { return n.changes }
+
+// rebuild replaces the ring with one over the live members. The caller
+// holds n.mu or has not shared n yet.
+func (n *Node) rebuild() {
+	n.ring.Store(NewRing(n.aliveLocked()))
+	select {
+	case n.changes <- struct{}{}:
+	default:
+	}
+}
+
+// Run gossips every GossipInterval until ctx is cancelled.
+func (n *Node) Run(ctx context.Context) {
+	ticker := time.NewTicker(n.cfg.GossipInterval)
+	defer ticker.Stop()
+	for {
+		n.round(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// round advances our heartbeat, swaps membership with one random peer,
+// contacting dead ones too so that a recovered node is noticed, and then
+// retires nodes whose heartbeat has gone stale.
+func (n *Node) round(ctx context.Context) {
+	n.mu.Lock()
+	self := n.members[n.cfg.Self]
+	self.Heartbeat++
+	if now := uint64(time.Now().UnixMilli()); now > self.Heartbeat {
+		self.Heartbeat = now
+	}
+	self.LastSeen = time.Now()
+	var peers []string
+	for url := range n.members {
+		if url != n.cfg.Self {
+			peers = append(peers, url)
+		}
+	}
+	n.mu.Unlock()
+
+	if len(peers) > 0 {
+		peer := peers[rand.Intn(len(peers))]
+		if err := n.exchange(ctx, peer); err != nil {
+			logrus.WithError(err).WithField("peer", peer).Debug("cluster gossip failed")
+		}
+	}
+	n.expire()
+}
+
+type gossipMessage struct {
+	Members []Member `json:"members"`
+}
+
+func (n *Node) digest() gossipMessage {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var msg gossipMessage
+	for _, m := range n.members {
+		if m.Heartbeat > 0 {
+			msg.Members = append(msg.Members, Member{URL: m.URL, Heartbeat: m.Heartbeat})
+		}
+	}
+	return msg
+}
+
+// exchange sends our view to peer and merges its view into ours.
+func (n *Node) exchange(ctx context.Context, peer string) error {
+	body, _ := json.Marshal(n.digest())
+	resp, err := n.do(ctx, http.MethodPost, peer, "/internal/cluster/gossip", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gossip: %s", resp.Status)
+	}
+	var msg gossipMessage
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		return err
+	}
+	n.merge(msg)
+	return nil
+}
+
+// merge takes every heartbeat in msg that is newer than ours.
+func (n *Node) merge(msg gossipMessage) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	changed := false
+	for _, in := range msg.Members {
+		url := normalize(in.URL)
+		if url == "" || url == n.cfg.Self {
+			continue
+		}
+		m, ok := n.members[url]
+		if !ok {
+			m = &Member{URL: url}
+			n.members[url] = m
+		}
+		if in.Heartbeat <= m.Heartbeat {
+			continue
+		}
+		m.Heartbeat, m.LastSeen = in.Heartbeat, now
+		if !m.Alive {
+			m.Alive, changed = true, true
+			logrus.WithFields(logrus.Fields{"action": "cluster_join", "node": url}).Info("cluster node is up")
+		}
+	}
+	if changed {
+		n.rebuild()
+	}
+}
+
+// expire marks nodes dead once their heartbeat is older than FailAfter.
+// Dead nodes stay listed so that their stale heartbeats, still held by
+// other nodes, cannot bring them back.
+func (n *Node) expire() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	changed := false
+	for url, m := range n.members {
+		if url != n.cfg.Self && m.Alive && time.Since(m.LastSeen) > n.cfg.FailAfter {
+			m.Alive, changed = false, true
+			logrus.WithFields(logrus.Fields{"action": "cluster_leave", "node": url}).Warn("cluster node is down")
+		}
+	}
+	if changed {
+		n.rebuild()
+	}
+}
+
+// do sends an authenticated request to peer.
+func (n *Node) do(ctx context.Context, method, peer, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, peer+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(SecretHeader, n.cfg.Secret)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return n.client.Do(req)
+}
+
+// authorized reports whether r carries the cluster secret.
+func (n *Node) authorized(r *http.Request) bool {
+	got := r.Header.Get(SecretHeader)
+	return n.cfg.Secret != "" && subtle.ConstantTimeCompare([]byte(got), []byte(n.cfg.Secret)) == 1
+}
+
+func (n *Node) gossipHandler(w http.ResponseWriter, r *http.Request) {
+	var msg gossipMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, "invalid gossip message", http.StatusBadRequest)
+		return
+	}
+	n.merge(msg)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(n.digest())
+}
@@ -0,0 +1,87 @@
+package cluster
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// virtualNodes is how many points each member takes on the ring. More
+// points spread keys more evenly at the cost of a larger ring.
+const virtualNodes = 128
+
+// Ring assigns keys to members by consistent hashing: a key belongs to
+// the first member clockwise from its hash, and its replicas to the next
+// distinct members after that. Adding or removing a member only moves
+// the keys next to its points.
+type Ring struct {
+	points  []uint64
+	members []string // members[i] owns points[i]
+}
+
+// NewRing builds a ring over members, which are node URLs.
+func NewRing(members []string) *Ring {
+	r := &Ring{}
+	type point struct {
+		hash   uint64
+		member string
+	}
+	points := make([]point, 0, len(members)*virtualNodes)
+	for _, m := range members {
+		for i := 0; i < virtualNodes; i++ {
+			points = append(points, point{hash(m + "#" + strconv.Itoa(i)), m})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].member < points[j].member
+	})
+	for _, p := range points {
+		r.points = append(r.points, p.hash)
+		r.members = append(r.members, p.member)
+	}
+	return r
+}
+
+// Owners returns up to n distinct members responsible for key, the
+// primary first.
+func (r *Ring) Owners(key string, n int) []string {
+	if len(r.points) == 0 || n < 1 {
+		return nil
+	}
+	h := hash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	var out []string
+	for i := 0; i < len(r.points) && len(out) < n; i++ {
+		m := r.members[(start+i)%len(r.points)]
+		if !contains(out, m) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// hash is 64-bit FNV-1a followed by a finalizer, since FNV alone clusters
+// inputs that differ only in their last bytes.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
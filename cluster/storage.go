@@ -0,0 +1,501 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/storage"
+)
+
+// maxUpdateAttempts bounds how often a remote Update is retried when the
+// link changed between reading and writing it.
+const maxUpdateAttempts = 8
+
+var (
+	errConflict  = errors.New("link changed concurrently")
+	errContended = errors.New("link is being updated too often to apply the change")
+)
+
+// Storage spreads links over the cluster. Each node keeps the links it
+// owns in local; the key's primary applies every write, then copies the
+// result to the other owners in the background. Reads and writes for
+// keys this node does not own go to their owners over HTTP.
+//
+// Update takes a function, which cannot be sent to another node, so a
+// remote Update reads the link, applies fn here and writes it back only
+// if the owner's copy has not changed since, retrying otherwise.
+type Storage struct {
+	local storage.Storage
+	node  *Node
+
+	mu     sync.Mutex
+	queues map[string]*replicaQueue
+}
+
+// NewStorage wraps local, which holds this node's share of the links.
+func NewStorage(local storage.Storage, node *Node) *Storage {
+	return &Storage{local: local, node: node, queues: map[string]*replicaQueue{}}
+}
+
+// Node returns the membership s routes by.
+func (s *Storage) Node() *Node { return s.node }
+
+func (s *Storage) self() string { return s.node.Self() }
+
+// Get reads key from its owners in order, so a link is still found while
+// a newly joined primary is being handed its copy.
+func (s *Storage) Get(ctx context.Context, key string) (*storage.Link, error) {
+	var lastErr error = storage.ErrNotFound
+	for _, owner := range s.node.Owners(key) {
+		var l *storage.Link
+		var err error
+		if owner == s.self() {
+			l, err = s.local.Get(ctx, key)
+		} else {
+			l, err = s.remoteGet(ctx, owner, key)
+		}
+		if err == nil {
+			return l, nil
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+func (s *Storage) Create(ctx context.Context, l *storage.Link) error {
+	if primary := s.node.Primary(l.Key()); primary != s.self() {
+		return s.remoteCreate(ctx, primary, l)
+	}
+	return s.createPrimary(ctx, l)
+}
+
+// createPrimary inserts l as its owner. The other owners are checked
+// first, since one of them may hold l's key from before the ring changed.
+func (s *Storage) createPrimary(ctx context.Context, l *storage.Link) error {
+	if _, err := s.adopt(ctx, l.Key()); err == nil {
+		return storage.ErrExists
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	if err := s.local.Create(ctx, l); err != nil {
+		return err
+	}
+	s.replicate(l.Key(), l)
+	return nil
+}
+
+// adopt makes sure this node has a local copy of key, fetching it from
+// another owner if need be.
+func (s *Storage) adopt(ctx context.Context, key string) (*storage.Link, error) {
+	l, err := s.local.Get(ctx, key)
+	if !errors.Is(err, storage.ErrNotFound) {
+		return l, err
+	}
+	for _, owner := range s.node.Owners(key) {
+		if owner == s.self() {
+			continue
+		}
+		l, err := s.remoteGet(ctx, owner, key)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := s.local.Create(ctx, l); err != nil && !errors.Is(err, storage.ErrExists) {
+			return nil, err
+		}
+		return s.local.Get(ctx, key)
+	}
+	return nil, storage.ErrNotFound
+}
+
+func (s *Storage) Update(ctx context.Context, key string, fn func(*storage.Link) error) (*storage.Link, error) {
+	if primary := s.node.Primary(key); primary != s.self() {
+		return s.remoteUpdate(ctx, primary, key, fn)
+	}
+	return s.updatePrimary(ctx, key, fn)
+}
+
+func (s *Storage) updatePrimary(ctx context.Context, key string, fn func(*storage.Link) error) (*storage.Link, error) {
+	if _, err := s.adopt(ctx, key); err != nil {
+		return nil, err
+	}
+	l, err := s.local.Update(ctx, key, fn)
+	if err != nil {
+		return nil, err
+	}
+	s.replicate(key, l)
+	return l, nil
+}
+
+func (s *Storage) remoteUpdate(ctx context.Context, primary, key string, fn func(*storage.Link) error) (*storage.Link, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		l, err := s.remoteGet(ctx, primary, key)
+		if err != nil {
+			return nil, err
+		}
+		expect := l.UpdatedAt
+		if err := fn(l); err != nil {
+			return nil, err
+		}
+		l, err = s.remotePut(ctx, primary, key, l, expect)
+		if errors.Is(err, errConflict) {
+			continue
+		}
+		return l, err
+	}
+	return nil, errContended
+}
+
+func (s *Storage) Delete(ctx context.Context, key string) error {
+	if primary := s.node.Primary(key); primary != s.self() {
+		return s.remoteDelete(ctx, primary, key, false)
+	}
+	return s.deletePrimary(ctx, key)
+}
+
+func (s *Storage) deletePrimary(ctx context.Context, key string) error {
+	if _, err := s.adopt(ctx, key); err != nil {
+		return err
+	}
+	if err := s.local.Delete(ctx, key); err != nil {
+		return err
+	}
+	s.replicate(key, nil)
+	return nil
+}
+
+// primaryOn reports whether ring makes this node l's primary.
+func (s *Storage) primaryOn(ring *Ring, l *storage.Link) bool {
+	owners := ring.Owners(l.Key(), 1)
+	return len(owners) == 1 && owners[0] == s.self()
+}
+
+// FindByURL asks every live node for the matching links it is primary
+// for, judged as in Scan.
+func (s *Storage) FindByURL(ctx context.Context, longURL string) ([]*storage.Link, error) {
+	alive := s.node.Alive()
+	ring := NewRing(alive)
+	var out []*storage.Link
+	for _, member := range alive {
+		var links []*storage.Link
+		var err error
+		if member == s.self() {
+			links, err = s.localFind(ctx, ring, longURL)
+		} else {
+			links, err = s.remoteFind(ctx, member, alive, longURL)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cluster node %s: %w", member, err)
+		}
+		out = append(out, links...)
+	}
+	return out, nil
+}
+
+func (s *Storage) localFind(ctx context.Context, ring *Ring, longURL string) ([]*storage.Link, error) {
+	links, err := s.local.FindByURL(ctx, longURL)
+	if err != nil {
+		return nil, err
+	}
+	out := links[:0]
+	for _, l := range links {
+		if s.primaryOn(ring, l) {
+			out = append(out, l)
+		}
+	}
+	return out, nil
+}
+
+// Scan visits every link in the cluster once, node by node, each node
+// listing the links it is primary for. Every node judges that by this
+// node's view of the ring, so that a link is neither skipped nor listed
+// twice while the nodes disagree about who is alive.
+func (s *Storage) Scan(ctx context.Context, fn func(*storage.Link) bool) error {
+	alive := s.node.Alive()
+	ring := NewRing(alive)
+	stopped := false
+	visit := func(l *storage.Link) bool {
+		stopped = !fn(l)
+		return !stopped
+	}
+	for _, member := range alive {
+		var err error
+		if member == s.self() {
+			err = s.localScan(ctx, ring, visit)
+		} else {
+			err = s.remoteScan(ctx, member, alive, visit)
+		}
+		if err != nil {
+			return fmt.Errorf("cluster node %s: %w", member, err)
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+// localScan visits the local links that ring makes this node primary for.
+func (s *Storage) localScan(ctx context.Context, ring *Ring, fn func(*storage.Link) bool) error {
+	return s.local.Scan(ctx, func(l *storage.Link) bool {
+		if !s.primaryOn(ring, l) {
+			return true
+		}
+		return fn(l)
+	})
+}
+
+// ScanFrom merges the ordered scans of every live node, each listing the
+// links it is primary for as in Scan. Every node streams ahead into a
+// small buffer; the link listed first among their heads goes next.
+func (s *Storage) ScanFrom(ctx context.Context, after *storage.Position, fn func(*storage.Link) bool) error {
+	alive := s.node.Alive()
+	ring := NewRing(alive)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	feeds := make([]*feed, len(alive))
+	for i, member := range alive {
+		f := &feed{member: member, links: make(chan *storage.Link, 64)}
+		feeds[i] = f
+		go func() {
+			defer close(f.links)
+			send := func(l *storage.Link) bool {
+				select {
+				case f.links <- l:
+					return true
+				case <-ctx.Done():
+					return false
+				}
+			}
+			if f.member == s.self() {
+				f.err = s.localScanFrom(ctx, ring, after, send)
+			} else {
+				f.err = s.remoteScanFrom(ctx, f.member, alive, after, send)
+			}
+		}()
+	}
+	for _, f := range feeds {
+		if err := f.next(); err != nil {
+			return err
+		}
+	}
+	for {
+		var first *feed
+		for _, f := range feeds {
+			if f.head != nil && (first == nil || storage.PositionOf(f.head).Before(storage.PositionOf(first.head))) {
+				first = f
+			}
+		}
+		if first == nil {
+			return nil
+		}
+		if !fn(first.head) {
+			return nil
+		}
+		if err := first.next(); err != nil {
+			return err
+		}
+	}
+}
+
+// feed is one node's stream of links in a merged ScanFrom.
+type feed struct {
+	member string
+	links  chan *storage.Link
+	err    error // set before links is closed
+	head   *storage.Link
+}
+
+// next moves head on to the feed's next link, nil at its end.
+func (f *feed) next() error {
+	l, ok := <-f.links
+	if !ok {
+		f.head = nil
+		if f.err != nil {
+			return fmt.Errorf("cluster node %s: %w", f.member, f.err)
+		}
+		return nil
+	}
+	f.head = l
+	return nil
+}
+
+// localScanFrom is localScan in listing order from the position.
+func (s *Storage) localScanFrom(ctx context.Context, ring *Ring, after *storage.Position, fn func(*storage.Link) bool) error {
+	return s.local.ScanFrom(ctx, after, func(l *storage.Link) bool {
+		if !s.primaryOn(ring, l) {
+			return true
+		}
+		return fn(l)
+	})
+}
+
+func (s *Storage) Close() error { return s.local.Close() }
+
+// Usage reports this node's share, replicas included.
+func (s *Storage) Usage(ctx context.Context) (storage.Usage, error) {
+	if u, ok := s.local.(storage.UsageReporter); ok {
+		return u.Usage(ctx)
+	}
+	return storage.Usage{}, storage.ErrUnsupported
+}
+
+func (s *Storage) Compact(ctx context.Context) error {
+	if c, ok := s.local.(storage.Compactor); ok {
+		return c.Compact(ctx)
+	}
+	return storage.ErrUnsupported
+}
+
+// applyReplica stores a copy pushed by key's primary unless ours is
+// newer. Replicas keep the primary's UpdatedAt, so the copies compare.
+func (s *Storage) applyReplica(ctx context.Context, l *storage.Link) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, err := s.local.Get(ctx, l.Key())
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+	case err != nil:
+		return err
+	case cur.UpdatedAt.After(l.UpdatedAt):
+		return nil
+	default:
+		if err := s.local.Delete(ctx, l.Key()); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	err = s.local.Create(ctx, l)
+	if errors.Is(err, storage.ErrExists) {
+		return nil
+	}
+	return err
+}
+
+// Run hands links to their new owners whenever the ring changes, until
+// ctx is cancelled.
+func (s *Storage) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.node.Changes():
+			s.rebalance(ctx)
+		}
+	}
+}
+
+// rebalance copies every local link to the owners the current ring gives
+// it, and drops local copies of links this node no longer owns once the
+// owner has them.
+func (s *Storage) rebalance(ctx context.Context) {
+	var moved, dropped int
+	err := s.local.Scan(ctx, func(l *storage.Link) bool {
+		owners := s.node.Owners(l.Key())
+		if contains(owners, s.self()) {
+			if owners[0] == s.self() {
+				s.replicate(l.Key(), l)
+			}
+			return true
+		}
+		if len(owners) == 0 {
+			return true
+		}
+		if err := s.sendReplica(ctx, owners[0], l); err != nil {
+			logrus.WithError(err).WithField("peer", owners[0]).Warn("handing link to its new owner failed")
+			return true
+		}
+		moved++
+		if err := s.local.Delete(ctx, l.Key()); err == nil {
+			dropped++
+		}
+		return true
+	})
+	if err != nil {
+		logrus.WithError(err).Warn("cluster rebalance interrupted")
+	}
+	logrus.WithFields(logrus.Fields{
+		"action":  "cluster_rebalance",
+		"members": len(s.node.Alive()),
+		"moved":   moved,
+		"dropped": dropped,
+	}).Info("cluster ring changed")
+}
+
+// replicate queues l, or its deletion when l is nil, for the other
+// owners of key.
+func (s *Storage) replicate(key string, l *storage.Link) {
+	for _, owner := range s.node.Owners(key) {
+		if owner != s.self() {
+			s.queue(owner).push(key, l)
+		}
+	}
+}
+
+func (s *Storage) queue(peer string) *replicaQueue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[peer]
+	if !ok {
+		q = &replicaQueue{pending: map[string]*storage.Link{}, wake: make(chan struct{}, 1)}
+		s.queues[peer] = q
+		go q.run(func(key string, l *storage.Link) error {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if l == nil {
+				err := s.remoteDelete(ctx, peer, key, true)
+				if errors.Is(err, storage.ErrNotFound) {
+					return nil
+				}
+				return err
+			}
+			return s.sendReplica(ctx, peer, l)
+		})
+	}
+	return q
+}
+
+// replicaQueue sends one peer its copies. Writes to the same key that
+// pile up while the peer is slow collapse into the latest.
+type replicaQueue struct {
+	mu      sync.Mutex
+	pending map[string]*storage.Link // nil: deleted
+	wake    chan struct{}
+}
+
+func (q *replicaQueue) push(key string, l *storage.Link) {
+	if l != nil {
+		l = l.Clone()
+	}
+	q.mu.Lock()
+	q.pending[key] = l
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run sends pending copies forever. A copy the peer refuses is dropped:
+// the next rebalance offers it again.
+func (q *replicaQueue) run(send func(string, *storage.Link) error) {
+	for range q.wake {
+		q.mu.Lock()
+		batch := q.pending
+		q.pending = map[string]*storage.Link{}
+		q.mu.Unlock()
+		for key, l := range batch {
+			if err := send(key, l); err != nil {
+				logrus.WithError(err).WithField("short_code", key).Debug("replicating link failed")
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Command loadgen drives a running shortener with a mix of redirects and
+// creates and reports latency percentiles per operation:
+//
+//	go run ./cmd/loadgen -target http://localhost:8080 -api-key k -duration 30s -concurrency 64
+//
+// It seeds -seed links first, then each worker repeatedly either creates
+// a link (with probability -create-ratio) or follows a random known code
+// without chasing the redirect.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type result struct {
+	op      string
+	latency time.Duration
+	ok      bool
+}
+
+type pool struct {
+	mu    sync.RWMutex
+	codes []string
+}
+
+func (p *pool) add(code string) {
+	p.mu.Lock()
+	p.codes = append(p.codes, code)
+	p.mu.Unlock()
+}
+
+func (p *pool) random(r *rand.Rand) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.codes[r.Intn(len(p.codes))]
+}
+
+type client struct {
+	target string
+	apiKey string
+	http   *http.Client
+}
+
+func (c *client) create(r *rand.Rand) (string, error) {
+	body, _ := json.Marshal(map[string]string{"url": fmt.Sprintf("https://example.com/load/%d", r.Int63())})
+	req, err := http.NewRequest(http.MethodPost, c.target+"/api/shorten", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return "", fmt.Errorf("create: %s", resp.Status)
+	}
+	var out struct {
+		ShortCode string `json:"short_code"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	return out.ShortCode, nil
+}
+
+func (c *client) redirect(code string) error {
+	resp, err := c.http.Get(c.target + "/" + code)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 {
+		return fmt.Errorf("redirect: %s", resp.Status)
+	}
+	return nil
+}
+
+func main() {
+	target := flag.String("target", "http://localhost:8080", "base URL of the server")
+	apiKey := flag.String("api-key", "", "API key sent with creates")
+	duration := flag.Duration("duration", 10*time.Second, "how long to run")
+	concurrency := flag.Int("concurrency", 32, "concurrent workers")
+	createRatio := flag.Float64("create-ratio", 0.05, "fraction of requests that create a link")
+	seed := flag.Int("seed", 100, "links created before the run")
+	flag.Parse()
+
+	c := &client{
+		target: *target,
+		apiKey: *apiKey,
+		http: &http.Client{
+			Timeout:       10 * time.Second,
+			Transport:     &http.Transport{MaxIdleConnsPerHost: *concurrency},
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+	codes := &pool{}
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 0; i < *seed; i++ {
+		code, err := c.create(rng)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "seeding failed:", err)
+			os.Exit(1)
+		}
+		codes.add(code)
+	}
+
+	results := make(chan result, 1024)
+	deadline := time.Now().Add(*duration)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func(r *rand.Rand) {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				start := time.Now()
+				if r.Float64() < *createRatio {
+					code, err := c.create(r)
+					if err == nil {
+						codes.add(code)
+					}
+					results <- result{op: "create", latency: time.Since(start), ok: err == nil}
+					continue
+				}
+				err := c.redirect(codes.random(r))
+				results <- result{op: "redirect", latency: time.Since(start), ok: err == nil}
+			}
+		}(rand.New(rand.NewSource(rng.Int63())))
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	latencies := map[string][]time.Duration{}
+	errs := map[string]int{}
+	for res := range results {
+		latencies[res.op] = append(latencies[res.op], res.latency)
+		if !res.ok {
+			errs[res.op]++
+		}
+	}
+	report(os.Stdout, latencies, errs, *duration)
+}
+
+func report(w io.Writer, latencies map[string][]time.Duration, errs map[string]int, elapsed time.Duration) {
+	fmt.Fprintf(w, "%-10s %9s %8s %9s %10s %10s %10s\n", "op", "requests", "errors", "req/s", "p50", "p95", "p99")
+	for _, op := range []string{"redirect", "create"} {
+		l := latencies[op]
+		if len(l) == 0 {
+			continue
+		}
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		fmt.Fprintf(w, "%-10s %9d %8d %9.0f %10s %10s %10s\n", op, len(l), errs[op],
+			float64(len(l))/elapsed.Seconds(), percentile(l, 50), percentile(l, 95), percentile(l, 99))
+	}
+}
+
+// percentile returns the p-th percentile of sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return sorted[i].Round(time.Microsecond)
+}
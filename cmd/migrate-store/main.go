@@ -0,0 +1,237 @@
+// Command migrate-store copies every link, with its click totals, from
+// one place to another and verifies the copy:
+//
+//	go run ./cmd/migrate-store -from http://old:8080 -from-key k1 -to http://new:8080 -to-key k2
+//
+// Each end is a running server, addressed by URL and an admin API key; a
+// backend opened directly, such as sqlite:/var/lib/shortener.db; or a
+// snapshot file of newline-delimited links ("-" for stdin or stdout).
+// Servers are read and written through /api/admin/storage/snapshot, so
+// the source keeps serving throughout.
+//
+// Codes the target already has are skipped unless -overwrite is set,
+// which makes the target a copy of the source: changed links are
+// replaced, keeping the larger click count, and links deleted from the
+// source since the last run are deleted from the target. For a live
+// cutover, run the server with STORAGE_MIRROR so that writes reach the
+// new backend as they happen, copy once with -overwrite, then switch
+// STORAGE_BACKEND over.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"url-shortener/storage"
+	"url-shortener/storage/sqlite"
+)
+
+type endpoint struct {
+	target string
+	apiKey string
+	http   *http.Client
+}
+
+func (e endpoint) server() bool {
+	return strings.HasPrefix(e.target, "http://") || strings.HasPrefix(e.target, "https://")
+}
+
+// openBackend opens e directly if it names a backend, returning false
+// otherwise.
+func (e endpoint) openBackend() (storage.Storage, bool, error) {
+	path, ok := strings.CutPrefix(e.target, "sqlite:")
+	if !ok {
+		return nil, false, nil
+	}
+	s, err := sqlite.Open(path, 5*time.Second)
+	return s, true, err
+}
+
+func (e endpoint) snapshotURL() string {
+	return strings.TrimRight(e.target, "/") + "/api/admin/storage/snapshot"
+}
+
+// open returns a reader over e's snapshot.
+func (e endpoint) open(ctx context.Context) (io.ReadCloser, error) {
+	if !e.server() {
+		if e.target == "-" {
+			return io.NopCloser(os.Stdin), nil
+		}
+		return os.Open(e.target)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.snapshotURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-API-Key", e.apiKey)
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("reading %s: %s", e.target, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// write sends every link in src to e.
+func (e endpoint) write(ctx context.Context, src storage.Storage, overwrite bool) error {
+	if dst, ok, err := e.openBackend(); ok {
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+		res, err := storage.Copy(ctx, src, dst, overwrite, func(res storage.LoadResult) {
+			if n := res.Created + res.Overwritten + res.Skipped; n%1000 == 0 {
+				fmt.Fprintf(os.Stderr, "target: %d links written\n", n)
+			}
+		})
+		fmt.Fprintf(os.Stderr, "target: %d created, %d overwritten, %d skipped, %d deleted\n",
+			res.Created, res.Overwritten, res.Skipped, res.Deleted)
+		return err
+	}
+	if !e.server() {
+		out := os.Stdout
+		if e.target != "-" {
+			f, err := os.Create(e.target)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		_, err := storage.WriteSnapshot(ctx, out, src, nil)
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := storage.WriteSnapshot(ctx, pw, src, nil)
+		pw.CloseWithError(err)
+	}()
+	url := e.snapshotURL()
+	if overwrite {
+		url += "?overwrite=true"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, pr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", e.apiKey)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("writing %s: %s: %s", e.target, resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Fprintf(os.Stderr, "target: %s\n", strings.TrimSpace(string(body)))
+	return nil
+}
+
+// load returns e's links: the backend itself if e names one, or else its
+// snapshot read into memory, reporting progress on stderr. The caller
+// closes the result.
+func (e endpoint) load(ctx context.Context, label string) (storage.Storage, int, error) {
+	if s, ok, err := e.openBackend(); ok {
+		if err != nil {
+			return nil, 0, err
+		}
+		n := 0
+		if err := s.Scan(ctx, func(*storage.Link) bool { n++; return true }); err != nil {
+			s.Close()
+			return nil, 0, err
+		}
+		return s, n, nil
+	}
+	r, err := e.open(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+	m := storage.NewMemory()
+	res, err := storage.LoadSnapshot(ctx, r, m, false, func(res storage.LoadResult) {
+		if n := res.Created + res.Skipped; n%1000 == 0 {
+			fmt.Fprintf(os.Stderr, "%s: %d links read\n", label, n)
+		}
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return m, res.Created, nil
+}
+
+func main() {
+	from := flag.String("from", "", "source server URL, sqlite:PATH or snapshot file (- for stdin)")
+	fromKey := flag.String("from-key", "", "admin API key for a source server")
+	to := flag.String("to", "", "target server URL, sqlite:PATH or snapshot file (- for stdout)")
+	toKey := flag.String("to-key", "", "admin API key for a target server")
+	overwrite := flag.Bool("overwrite", false, "make the target a copy of the source: replace links it has and delete those the source lacks")
+	verify := flag.Bool("verify", true, "read the target back and compare it with the source")
+	timeout := flag.Duration("timeout", 10*time.Minute, "overall time limit")
+	flag.Parse()
+	if *from == "" || *to == "" {
+		fmt.Fprintln(os.Stderr, "usage: migrate-store -from SOURCE -to TARGET [-overwrite] [-verify=false]")
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	client := &http.Client{}
+	src := endpoint{target: *from, apiKey: *fromKey, http: client}
+	dst := endpoint{target: *to, apiKey: *toKey, http: client}
+
+	start := time.Now()
+	links, n, err := src.load(ctx, "source")
+	if err != nil {
+		fail("reading source", err)
+	}
+	defer links.Close()
+	fmt.Fprintf(os.Stderr, "source: %d links read in %s\n", n, time.Since(start).Round(time.Millisecond))
+	if err := dst.write(ctx, links, *overwrite); err != nil {
+		fail("writing target", err)
+	}
+	fmt.Fprintf(os.Stderr, "copied %d links in %s\n", n, time.Since(start).Round(time.Millisecond))
+	if !*verify || dst.target == "-" {
+		return
+	}
+
+	copied, _, err := dst.load(ctx, "target")
+	if err != nil {
+		fail("reading target back", err)
+	}
+	defer copied.Close()
+	diff, err := storage.Diff(ctx, links, copied)
+	if err != nil {
+		fail("verifying", err)
+	}
+	if len(diff) > 0 {
+		for i, key := range diff {
+			if i == 20 {
+				fmt.Fprintf(os.Stderr, "  ... and %d more\n", len(diff)-i)
+				break
+			}
+			fmt.Fprintln(os.Stderr, "  differs:", key)
+		}
+		fail("verifying", fmt.Errorf("%d of %d links are missing or differ on the target", len(diff), n))
+	}
+	fmt.Fprintf(os.Stderr, "verified: all %d links match\n", n)
+}
+
+func fail(what string, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("%w (raise -timeout)", err)
+	}
+	fmt.Fprintf(os.Stderr, "%s: %v\n", what, err)
+	os.Exit(1)
+}
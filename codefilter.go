@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+)
+
+// CodeFilter rejects codes containing a blocked term. Codes and terms are
+// compared in a folded form, so "Sh1t", "s-h-i-t" and "shiiit" all match
+// "shit", and look-alike characters (0/O, 1/l/I) cannot smuggle a term
+// past the list.
+type CodeFilter struct {
+	mu    sync.RWMutex
+	terms []string // folded
+}
+
+// NewCodeFilter combines the bundled blocklist with extra terms.
+func NewCodeFilter(extra []string) *CodeFilter {
+	f := &CodeFilter{}
+	f.SetExtra(extra)
+	return f
+}
+
+// SetExtra replaces the terms added to the bundled blocklist.
+func (f *CodeFilter) SetExtra(extra []string) {
+	var terms []string
+	for _, t := range append(loadWords("words/blocklist.txt"), extra...) {
+		if t = foldCode(t); t != "" {
+			terms = append(terms, t)
+		}
+	}
+	f.mu.Lock()
+	f.terms = terms
+	f.mu.Unlock()
+}
+
+// Blocked reports whether code contains a blocked term. A nil filter
+// blocks nothing.
+func (f *CodeFilter) Blocked(code string) bool {
+	if f == nil {
+		return false
+	}
+	folded := foldCode(code)
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, t := range f.terms {
+		if strings.Contains(folded, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// confusables maps digits, symbols and look-alike letters onto the letter
+// they are usually read as.
+var confusables = map[rune]rune{
+	'0': 'o', '1': 'i', 'l': 'i', '|': 'i', '!': 'i',
+	'3': 'e', '4': 'a', '@': 'a', '5': 's', '$': 's',
+	'7': 't', '8': 'b', '9': 'g',
+}
+
+// foldCode lower-cases s, maps confusables, drops separators and
+// collapses runs of the same letter.
+func foldCode(s string) string {
+	var b strings.Builder
+	var last rune
+	for _, r := range strings.ToLower(s) {
+		if r == '-' || r == '_' || r == '.' || r == ' ' {
+			continue
+		}
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		if r == last {
+			continue
+		}
+		b.WriteRune(r)
+		last = r
+	}
+	return b.String()
+}
+
+// blocklistTerms gathers CODE_BLOCKLIST (comma-separated) and the lines of
+// CODE_BLOCKLIST_FILE.
+func blocklistTerms(list, file string) ([]string, error) {
+	var terms []string
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			terms = append(terms, t)
+		}
+	}
+	if file == "" {
+		return terms, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if t := strings.TrimSpace(sc.Text()); t != "" && !strings.HasPrefix(t, "#") {
+			terms = append(terms, t)
+		}
+	}
+	return terms, sc.Err()
+}
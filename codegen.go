@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// CodeGenerator produces candidate short codes. Store.Create retries when a
+// candidate is already taken, so generators need not be collision-free,
+// though the sequential ones are unless codes are also set by hand.
+type CodeGenerator interface {
+	Next(ctx context.Context) (string, error)
+}
+
+// collisionObserver is implemented by generators that adapt to how full
+// the keyspace is. Store.Create reports the fate of every candidate.
+type collisionObserver interface {
+	Observe(collided bool)
+}
+
+// randomCodes draws length characters uniformly from base62. After
+// threshold consecutive collisions the keyspace is considered crowded and
+// length grows by one, up to maxLength.
+type randomCodes struct {
+	mu        sync.Mutex
+	length    int
+	maxLength int
+	threshold int
+	streak    int
+}
+
+func newRandomCodes(length, maxLength, threshold int) *randomCodes {
+	if maxLength < length {
+		maxLength = length
+	}
+	metricCodeLength.Set(int64(length))
+	return &randomCodes{length: length, maxLength: maxLength, threshold: threshold}
+}
+
+func (g *randomCodes) Next(context.Context) (string, error) {
+	g.mu.Lock()
+	n := g.length
+	g.mu.Unlock()
+	return generateCode(n), nil
+}
+
+func (g *randomCodes) Observe(collided bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !collided {
+		g.streak = 0
+		return
+	}
+	g.streak++
+	if g.threshold <= 0 || g.streak < g.threshold || g.length >= g.maxLength {
+		return
+	}
+	g.streak = 0
+	g.length++
+	metricCodeEscalations.Add(1)
+	metricCodeLength.Set(int64(g.length))
+	logrus.WithField("code_length", g.length).Warn("random keyspace crowded, growing code length")
+}
+
+// Sequence hands out increasing integers, starting at 1.
+type Sequence interface {
+	Next(ctx context.Context) (uint64, error)
+}
+
+type memorySequence struct{ n atomic.Uint64 }
+
+func (s *memorySequence) Next(context.Context) (uint64, error) { return s.n.Add(1), nil }
+
+// redisSequence shares one counter between every instance.
+type redisSequence struct {
+	client *redis.Client
+	key    string
+}
+
+func (s *redisSequence) Next(ctx context.Context) (uint64, error) {
+	n, err := s.client.Incr(ctx, s.key).Result()
+	return uint64(n), err
+}
+
+// sequentialCodes encodes seq<<nodeBits | node in base62, so each of up to
+// 2^nodeBits nodes owns a disjoint slice of the keyspace and codes stay as
+// short as the volume allows: the first few thousand fit in two characters.
+type sequentialCodes struct {
+	seq      Sequence
+	node     uint64
+	nodeBits uint
+}
+
+func (g *sequentialCodes) Next(ctx context.Context) (string, error) {
+	n, err := g.seq.Next(ctx)
+	if err != nil {
+		return "", err
+	}
+	return encodeBase62(n<<g.nodeBits | g.node), nil
+}
+
+// snowflakeEpoch is the zero point of snowflake timestamps.
+var snowflakeEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const (
+	snowflakeNodeBits = 10
+	snowflakeSeqBits  = 12
+)
+
+// snowflakeCodes builds Twitter-style IDs from a millisecond timestamp, a
+// 10-bit node ID and a 12-bit per-millisecond sequence. Nodes need no
+// shared state, at the cost of roughly 10-character codes.
+type snowflakeCodes struct {
+	mu   sync.Mutex
+	node uint64
+	last int64
+	seq  uint64
+}
+
+func (g *snowflakeCodes) Next(context.Context) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Since(snowflakeEpoch).Milliseconds()
+	if now < g.last {
+		// The clock stepped back; keep issuing from the last timestamp.
+		now = g.last
+	}
+	if now == g.last {
+		g.seq = (g.seq + 1) & (1<<snowflakeSeqBits - 1)
+		if g.seq == 0 {
+			for now <= g.last {
+				time.Sleep(time.Millisecond)
+				now = time.Since(snowflakeEpoch).Milliseconds()
+			}
+		}
+	} else {
+		g.seq = 0
+	}
+	g.last = now
+	id := uint64(now)<<(snowflakeNodeBits+snowflakeSeqBits) | g.node<<snowflakeSeqBits | g.seq
+	return encodeBase62(id), nil
+}
+
+func encodeBase62(n uint64) string {
+	if n == 0 {
+		return string(base62[0])
+	}
+	var b []rune
+	for n > 0 {
+		b = append(b, base62[n%62])
+		n /= 62
+	}
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+// newCodeGenerator builds the generator named by CODE_STRATEGY. rdb may be
+// nil, in which case the sequential counter is per process.
+func newCodeGenerator(cfg CodeConfig, rdb *redis.Client, prefix string) (CodeGenerator, error) {
+	switch cfg.Strategy {
+	case "", "random":
+		return newRandomCodes(CodeLength, cfg.MaxLength, cfg.CollisionThreshold), nil
+	case "sequential":
+		if cfg.NodeBits > 16 || cfg.NodeID >= 1<<cfg.NodeBits {
+			return nil, fmt.Errorf("NODE_ID %d does not fit in CODE_NODE_BITS=%d", cfg.NodeID, cfg.NodeBits)
+		}
+		var seq Sequence = &memorySequence{}
+		if rdb != nil {
+			seq = &redisSequence{client: rdb, key: prefix + "seq:codes"}
+		}
+		return &sequentialCodes{seq: seq, node: cfg.NodeID, nodeBits: cfg.NodeBits}, nil
+	case "snowflake":
+		if cfg.NodeID >= 1<<snowflakeNodeBits {
+			return nil, errors.New("NODE_ID must be below 1024 for the snowflake strategy")
+		}
+		return &snowflakeCodes{node: cfg.NodeID}, nil
+	default:
+		return nil, fmt.Errorf("unknown CODE_STRATEGY %q", cfg.Strategy)
+	}
+}
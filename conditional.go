@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"url-shortener/jsonpool"
+)
+
+// writeCachedJSON writes v like writeJSON, adding an ETag derived from
+// the body and, when lastModified is set, a Last-Modified header. A
+// request whose If-None-Match (or, failing that, If-Modified-Since) shows
+// it already has this representation gets a bodiless 304 instead.
+//
+// The ETag is authoritative. Last-Modified may lag behind changes it does
+// not see, such as removed list entries or clicks counted by another
+// instance in redis mode, so clients should prefer If-None-Match.
+func writeCachedJSON(w http.ResponseWriter, r *http.Request, v interface{}, lastModified time.Time) {
+	body, err := jsonpool.Encode(v)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, ErrCodeInternal, "internal error")
+		return
+	}
+	defer body.Release()
+	writeCached(w, r, body.Bytes(), "application/json", "private, no-cache", lastModified)
+}
+
+// writeCached is writeCachedJSON for a body already encoded as
+// contentType, served with the given Cache-Control.
+func writeCached(w http.ResponseWriter, r *http.Request, body []byte, contentType, cacheControl string, lastModified time.Time) {
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", cacheControl)
+	if !lastModified.IsZero() {
+		h.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !lastModified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// latestUpdate returns the newest UpdatedAt among links.
+func latestUpdate(links []*Link) time.Time {
+	var latest time.Time
+	for _, l := range links {
+		if l.UpdatedAt.After(latest) {
+			latest = l.UpdatedAt
+		}
+	}
+	return latest
+}
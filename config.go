@@ -0,0 +1,647 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Config holds the tunables read from the environment at startup, and
+// from CONFIG_FILE, which can be reloaded; see Reloader.
+type Config struct {
+	MaxBodyBytes int64 // MAX_BODY_BYTES, applied to every request body
+
+	// SnapshotMaxBytes (SNAPSHOT_MAX_BYTES) replaces MaxBodyBytes for
+	// snapshots loaded through /api/admin/storage/snapshot, which hold a
+	// whole store; 0 lifts the limit.
+	SnapshotMaxBytes int64
+
+	Server ServerConfig
+
+	// StorageBackend is STORAGE_BACKEND: memory (default), which loses
+	// links on restart, or sqlite, a single file at SQLitePath
+	// (SQLITE_PATH) for single-node deployments.
+	StorageBackend string
+	SQLitePath     string
+
+	// MirrorBackend (STORAGE_MIRROR) names a second backend, as
+	// STORAGE_BACKEND does, that every write is also applied to while a
+	// migration to it is under way; MirrorSQLitePath
+	// (STORAGE_MIRROR_SQLITE_PATH) is its file. Reads stay on the
+	// primary. Empty disables mirroring.
+	MirrorBackend    string
+	MirrorSQLitePath string
+
+	// CoordinationMode is "local" (per-process state) or "redis", in which
+	// case rate limit buckets and click counters are shared via RedisURL.
+	CoordinationMode string // COORDINATION_MODE
+	RedisURL         string // REDIS_URL
+	RedisPrefix      string // REDIS_PREFIX, namespaces every key we write
+
+	RateLimitPerMinute int // RATE_LIMIT_PER_MINUTE per client on /api, 0 disables
+
+	CleanupInterval time.Duration // CLEANUP_INTERVAL between expiry sweeps
+	InstanceID      string        // INSTANCE_ID, identifies this node in leader election
+
+	APIKeys string // API_KEYS, comma-separated owner:key pairs; empty disables auth
+	Admins  string // ADMINS, comma-separated owners allowed to use /api/admin
+
+	// ServiceMode, if set, forces normal, read_only or maintenance mode
+	// cluster-wide at startup (SERVICE_MODE).
+	ServiceMode string
+
+	// DefaultValidity is DEFAULT_VALIDITY, the lifetime of links created
+	// without validity_minutes or expires_at.
+	DefaultValidity time.Duration
+
+	ExpiryNotice time.Duration // EXPIRY_NOTICE, default lead time for expiry notifications
+	SMTP         SMTPConfig
+	Digest       DigestConfig
+
+	CountHeadClicks bool // COUNT_HEAD_CLICKS, count HEAD /{code} as a click
+
+	// TrustedProxies lists the IPs/CIDRs whose forwarding headers are
+	// believed when resolving the client address (TRUSTED_PROXIES).
+	TrustedProxies string
+
+	// Host is the "host" middleware's settings.
+	Host HostConfig
+
+	IdempotencyTTL time.Duration // IDEMPOTENCY_TTL, how long Idempotency-Keys are remembered
+
+	// DeleteGrace is how long deleted links stay restorable (DELETE_GRACE);
+	// SOFT_DELETE=false deletes immediately instead.
+	DeleteGrace time.Duration
+
+	// DefaultQuota applies to owners without an entry in Quotas (QUOTAS);
+	// set via QUOTA_ACTIVE_LINKS, QUOTA_DAILY_CREATES, QUOTA_TRACKED_CLICKS.
+	DefaultQuota Quota
+	Quotas       string
+
+	// Validity bounds how long links may live (VALIDITY_MIN, VALIDITY_MAX,
+	// VALIDITY_POLICY clamp or reject); VALIDITY_LIMITS overrides it per
+	// owner.
+	Validity       ValidityLimit
+	ValidityLimits string
+
+	Codes CodeConfig
+
+	Signing SigningConfig
+
+	Health HealthConfig
+
+	Preview PreviewConfig
+
+	Cluster ClusterConfig
+
+	Encryption EncryptionConfig
+
+	Edge EdgeConfig
+
+	Export ExportConfig
+
+	Events EventsConfig
+
+	GeoIP GeoIPConfig
+
+	Privacy PrivacyConfig
+
+	Clicks ClicksConfig
+
+	Abuse AbuseConfig
+
+	Public PublicConfig
+
+	Reservations ReservationConfig
+
+	Flatten FlattenConfig
+
+	// LoopProtection is LOOP_PROTECTION: reject (default), warn or off
+	// for destinations that redirect back to the link being created.
+	LoopProtection string
+
+	// RedirectHeaders is REDIRECT_HEADERS, "Name: value" pairs separated
+	// by ";" added to every redirect, e.g. "X-Robots-Tag: noindex".
+	RedirectHeaders string
+
+	// RobotsTxtFile is ROBOTS_TXT_FILE, served as /robots.txt instead of
+	// the default that disallows crawling short links.
+	RobotsTxtFile string
+
+	DestinationPolicy DomainPolicyConfig
+
+	Fraud FraudConfig
+
+	Flags FlagsConfig
+
+	// Middleware and APIMiddleware list, outermost first, the middleware
+	// wrapping every request (MIDDLEWARE: recovery, request_id, real_ip,
+	// logging, host, body_limit, cors, gzip) and /api requests
+	// (API_MIDDLEWARE: auth, rate_limit). Mode, tenant and suspension
+	// checks always apply.
+	Middleware    string
+	APIMiddleware string
+	CORSOrigins   string // CORS_ALLOWED_ORIGINS, comma-separated; "*" allows any
+
+	// GzipMinBytes is GZIP_MIN_BYTES: list and export responses at least
+	// this large are compressed for clients that accept it, whether or
+	// not gzip is in MIDDLEWARE. 0 disables.
+	GzipMinBytes int
+
+	Log       LogConfig
+	AccessLog AccessLogConfig
+	Tracing   TracingConfig
+}
+
+func loadConfig() Config {
+	return Config{
+		MaxBodyBytes:       envInt64("MAX_BODY_BYTES", 1<<20),
+		SnapshotMaxBytes:   envInt64("SNAPSHOT_MAX_BYTES", 1<<30),
+		StorageBackend:     envString("STORAGE_BACKEND", "memory"),
+		SQLitePath:         envString("SQLITE_PATH", "shortener.db"),
+		MirrorBackend:      getenv("STORAGE_MIRROR"),
+		MirrorSQLitePath:   getenv("STORAGE_MIRROR_SQLITE_PATH"),
+		CoordinationMode:   envString("COORDINATION_MODE", "local"),
+		RedisURL:           envString("REDIS_URL", "redis://localhost:6379/0"),
+		RedisPrefix:        envString("REDIS_PREFIX", "shortener:"),
+		RateLimitPerMinute: int(envInt64("RATE_LIMIT_PER_MINUTE", 60)),
+		CleanupInterval:    envDuration("CLEANUP_INTERVAL", time.Minute),
+		InstanceID:         envString("INSTANCE_ID", defaultInstanceID()),
+		APIKeys:            getenv("API_KEYS"),
+		Admins:             getenv("ADMINS"),
+		ServiceMode:        getenv("SERVICE_MODE"),
+		DefaultValidity:    envDuration("DEFAULT_VALIDITY", DefaultValidityMinutes*time.Minute),
+		ExpiryNotice:       envDuration("EXPIRY_NOTICE", 24*time.Hour),
+		Digest: DigestConfig{
+			Hour:    int(envInt64("DIGEST_HOUR", 8)),
+			Weekday: envString("DIGEST_WEEKDAY", "monday"),
+		},
+		SMTP: SMTPConfig{
+			Addr:     getenv("SMTP_ADDR"),
+			From:     envString("SMTP_FROM", "shortener@localhost"),
+			Username: getenv("SMTP_USERNAME"),
+			Password: getenv("SMTP_PASSWORD"),
+		},
+		Validity: ValidityLimit{
+			Min:    envDuration("VALIDITY_MIN", 0),
+			Max:    envDuration("VALIDITY_MAX", 0),
+			Policy: envString("VALIDITY_POLICY", ValidityClamp),
+		},
+		ValidityLimits:  getenv("VALIDITY_LIMITS"),
+		CountHeadClicks: envBool("COUNT_HEAD_CLICKS", false),
+		TrustedProxies:  getenv("TRUSTED_PROXIES"),
+		IdempotencyTTL:  envDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+		DeleteGrace:     softDeleteGrace(),
+		Host: HostConfig{
+			Canonical:  getenv("CANONICAL_HOST"),
+			Aliases:    getenv("HOST_ALIASES"),
+			ForceHTTPS: envBool("FORCE_HTTPS", false),
+		},
+		DefaultQuota: Quota{
+			ActiveLinks:   envInt64("QUOTA_ACTIVE_LINKS", 0),
+			DailyCreates:  envInt64("QUOTA_DAILY_CREATES", 0),
+			TrackedClicks: envInt64("QUOTA_TRACKED_CLICKS", 0),
+		},
+		Quotas: getenv("QUOTAS"),
+		Codes: CodeConfig{
+			Strategy: envString("CODE_STRATEGY", "random"),
+			NodeID:   uint64(envInt64("NODE_ID", 0)),
+			NodeBits: uint(envInt64("CODE_NODE_BITS", 0)),
+
+			CollisionThreshold: int(envInt64("CODE_COLLISION_THRESHOLD", 5)),
+			MaxLength:          int(envInt64("CODE_MAX_LENGTH", 12)),
+
+			Blocklist:     getenv("CODE_BLOCKLIST"),
+			BlocklistFile: getenv("CODE_BLOCKLIST_FILE"),
+		},
+		Signing: SigningConfig{
+			Keys:     getenv("SIGNING_KEYS"),
+			TokenTTL: envDuration("SIGNED_TOKEN_TTL", 5*time.Minute),
+			Param:    envString("SIGNED_TOKEN_PARAM", "sl_token"),
+		},
+		Health: HealthConfig{
+			Enabled:     envBool("HEALTH_CHECK_ENABLED", false),
+			Interval:    envDuration("HEALTH_CHECK_INTERVAL", 15*time.Minute),
+			Timeout:     envDuration("HEALTH_CHECK_TIMEOUT", 10*time.Second),
+			Concurrency: int(envInt64("HEALTH_CHECK_CONCURRENCY", 8)),
+		},
+		Preview: PreviewConfig{
+			Enabled:     envBool("PREVIEW_FETCH", false),
+			Timeout:     envDuration("PREVIEW_FETCH_TIMEOUT", 5*time.Second),
+			Concurrency: int(envInt64("PREVIEW_FETCH_CONCURRENCY", 4)),
+		},
+		Cluster: ClusterConfig{
+			Self:           getenv("CLUSTER_SELF"),
+			Peers:          getenv("CLUSTER_PEERS"),
+			Replicas:       int(envInt64("CLUSTER_REPLICAS", 2)),
+			GossipInterval: envDuration("CLUSTER_GOSSIP_INTERVAL", time.Second),
+			FailAfter:      envDuration("CLUSTER_FAIL_AFTER", 5*time.Second),
+			Secret:         getenv("CLUSTER_SECRET"),
+		},
+		Encryption: EncryptionConfig{
+			Keys:      getenv("URL_ENCRYPTION_KEYS"),
+			ActiveKey: getenv("URL_ENCRYPTION_ACTIVE_KEY"),
+		},
+		Edge: EdgeConfig{
+			Provider:            getenv("EDGE_PROVIDER"),
+			CloudflareAccount:   getenv("CLOUDFLARE_ACCOUNT_ID"),
+			CloudflareNamespace: getenv("CLOUDFLARE_KV_NAMESPACE_ID"),
+			CloudflareToken:     getenv("CLOUDFLARE_API_TOKEN"),
+			FastlyStore:         getenv("FASTLY_KV_STORE_ID"),
+			FastlyToken:         getenv("FASTLY_API_TOKEN"),
+		},
+		Export: ExportConfig{
+			Enabled:    envBool("EXPORT_ENABLED", false),
+			Interval:   envDuration("EXPORT_INTERVAL", time.Hour),
+			BufferSize: int(envInt64("EXPORT_BUFFER_SIZE", 100000)),
+			Prefix:     getenv("EXPORT_PREFIX"),
+			Endpoint:   envString("S3_ENDPOINT", "https://s3.amazonaws.com"),
+			Region:     envString("S3_REGION", "us-east-1"),
+			Bucket:     getenv("S3_BUCKET"),
+			AccessKey:  getenv("S3_ACCESS_KEY_ID"),
+			SecretKey:  getenv("S3_SECRET_ACCESS_KEY"),
+			PathStyle:  envBool("S3_PATH_STYLE", false),
+		},
+		Events: EventsConfig{
+			KafkaBrokers:    getenv("KAFKA_BROKERS"),
+			KafkaTopic:      envString("KAFKA_TOPIC", "shortener.links"),
+			KafkaClickTopic: envString("KAFKA_CLICK_TOPIC", "shortener.clicks"),
+		},
+		Middleware:    envString("MIDDLEWARE", defaultMiddleware),
+		APIMiddleware: envString("API_MIDDLEWARE", defaultAPIMiddleware),
+		CORSOrigins:   getenv("CORS_ALLOWED_ORIGINS"),
+		GzipMinBytes:  int(envInt64("GZIP_MIN_BYTES", 0)),
+		GeoIP: GeoIPConfig{
+			Path:           getenv("GEOIP_DB_PATH"),
+			ReloadInterval: envDuration("GEOIP_RELOAD_INTERVAL", time.Minute),
+		},
+		Privacy: PrivacyConfig{
+			Global:       envBool("PRIVACY_MODE", false),
+			HonorDNT:     envBool("HONOR_DNT", true),
+			SaltRotation: envDuration("PRIVACY_SALT_ROTATION", 24*time.Hour),
+		},
+		Server: ServerConfig{
+			Addr:              envString("HTTP_ADDR", ":8080"),
+			ReadTimeout:       envDuration("HTTP_READ_TIMEOUT", 5*time.Second),
+			ReadHeaderTimeout: envDuration("HTTP_READ_HEADER_TIMEOUT", 2*time.Second),
+			WriteTimeout:      envDuration("HTTP_WRITE_TIMEOUT", 10*time.Second),
+			IdleTimeout:       envDuration("HTTP_IDLE_TIMEOUT", 2*time.Minute),
+			MaxHeaderBytes:    int(envInt64("HTTP_MAX_HEADER_BYTES", 1<<20)),
+			TLSCertFile:       getenv("TLS_CERT_FILE"),
+			TLSKeyFile:        getenv("TLS_KEY_FILE"),
+			HTTP2:             envBool("HTTP2_ENABLED", true),
+			HTTP2Cleartext:    envBool("HTTP2_CLEARTEXT", false),
+			HTTP2MaxStreams:   uint32(envInt64("HTTP2_MAX_CONCURRENT_STREAMS", 250)),
+			DrainGrace:        envDuration("DRAIN_GRACE", 10*time.Second),
+			DrainTimeout:      envDuration("DRAIN_TIMEOUT", 30*time.Second),
+		},
+		Abuse: AbuseConfig{
+			RateLimitPerHour: int(envInt64("REPORT_RATE_LIMIT_PER_HOUR", 10)),
+			CaptchaProvider:  getenv("CAPTCHA_PROVIDER"),
+			CaptchaVerifyURL: getenv("CAPTCHA_VERIFY_URL"),
+			CaptchaSecret:    getenv("CAPTCHA_SECRET"),
+		},
+		Public: PublicConfig{
+			Enabled:          envBool("PUBLIC_SHORTEN_ENABLED", false),
+			RateLimitPerHour: int(envInt64("PUBLIC_RATE_LIMIT_PER_HOUR", 10)),
+			MaxValidity:      envDuration("PUBLIC_MAX_VALIDITY", 24*time.Hour),
+		},
+		LoopProtection:  envString("LOOP_PROTECTION", LoopReject),
+		RedirectHeaders: getenv("REDIRECT_HEADERS"),
+		RobotsTxtFile:   getenv("ROBOTS_TXT_FILE"),
+		Fraud: FraudConfig{
+			Enabled:     envBool("FRAUD_DETECTION", true),
+			IPMaxClicks: int(envInt64("FRAUD_IP_MAX_CLICKS", 30)),
+			IPWindow:    envDuration("FRAUD_IP_WINDOW", 10*time.Minute),
+			SpikeMin:    int(envInt64("FRAUD_SPIKE_MIN", 100)),
+			SpikeFactor: envFloat("FRAUD_SPIKE_FACTOR", 10),
+			GeoWindow:   envDuration("FRAUD_GEO_WINDOW", 30*time.Minute),
+		},
+		DestinationPolicy: DomainPolicyConfig{
+			Mode:    getenv("DESTINATION_POLICY"),
+			Domains: getenv("DESTINATION_DOMAINS"),
+		},
+		Flags: FlagsConfig{
+			Spec: getenv("FEATURE_FLAGS"),
+			File: getenv("FEATURE_FLAGS_FILE"),
+		},
+		Flatten: FlattenConfig{
+			Enabled:    envBool("FLATTEN_REDIRECTS", false),
+			MaxHops:    int(envInt64("FLATTEN_MAX_HOPS", 5)),
+			Timeout:    envDuration("FLATTEN_TIMEOUT", 3*time.Second),
+			Shorteners: envString("FLATTEN_SHORTENERS", defaultShorteners),
+		},
+		Reservations: ReservationConfig{
+			DefaultHold: envDuration("RESERVATION_DEFAULT_HOLD", 24*time.Hour),
+			MaxHold:     envDuration("RESERVATION_MAX_HOLD", 7*24*time.Hour),
+			MaxPerOwner: int(envInt64("RESERVATION_MAX_PER_OWNER", 50)),
+		},
+		Clicks: ClicksConfig{
+			FlushInterval:   envDuration("CLICK_FLUSH_INTERVAL", 0),
+			JournalDir:      envString("CLICK_JOURNAL_DIR", "click-journal"),
+			SeriesEnabled:   envBool("CLICK_SERIES_ENABLED", true),
+			SeriesRetention: envDuration("CLICK_SERIES_RETENTION", 30*24*time.Hour),
+			HourlyRetention: envDuration("CLICK_RETENTION_HOURLY", 180*24*time.Hour),
+			DailyRetention:  envDuration("CLICK_RETENTION_DAILY", 0),
+			RawRetention:    envDuration("CLICK_RETENTION_RAW", 0),
+			PruneInterval:   envDuration("CLICK_RETENTION_INTERVAL", time.Hour),
+		},
+		Log: LogConfig{
+			Format:             envString("LOG_FORMAT", "text"),
+			Level:              envString("LOG_LEVEL", "info"),
+			File:               getenv("LOG_FILE"),
+			MaxSizeMB:          int(envInt64("LOG_MAX_SIZE_MB", 100)),
+			MaxBackups:         int(envInt64("LOG_MAX_BACKUPS", 5)),
+			MaxAgeDays:         int(envInt64("LOG_MAX_AGE_DAYS", 30)),
+			RedirectSampleRate: int(envInt64("LOG_REDIRECT_SAMPLE_RATE", 1)),
+			SlowThreshold:      envDuration("LOG_SLOW_THRESHOLD", time.Second),
+			URLRedaction:       envString("LOG_URL_REDACTION", RedactNone),
+		},
+		AccessLog: AccessLogConfig{
+			Sink:          getenv("ACCESS_LOG_SINK"),
+			File:          getenv("ACCESS_LOG_FILE"),
+			SyslogAddr:    getenv("ACCESS_LOG_SYSLOG_ADDR"),
+			HTTPURL:       getenv("ACCESS_LOG_HTTP_URL"),
+			HTTPFormat:    envString("ACCESS_LOG_HTTP_FORMAT", "ndjson"),
+			HTTPAuth:      getenv("ACCESS_LOG_HTTP_AUTH"),
+			Buffer:        int(envInt64("ACCESS_LOG_BUFFER", 10000)),
+			BatchSize:     int(envInt64("ACCESS_LOG_BATCH_SIZE", 500)),
+			FlushInterval: envDuration("ACCESS_LOG_FLUSH_INTERVAL", time.Second),
+		},
+		Tracing: TracingConfig{
+			Enabled:     envBool("TRACING_ENABLED", false),
+			Endpoint:    getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+			ServiceName: envString("OTEL_SERVICE_NAME", "url-shortener"),
+			SampleRatio: envFloat("TRACING_SAMPLE_RATIO", 1),
+		},
+	}
+}
+
+// HostConfig keeps requests on one host and scheme. Requests for
+// www.Canonical and the aliases are redirected to Canonical, tenant domains
+// are served as they are, and any other host is refused with 421.
+type HostConfig struct {
+	Canonical  string // CANONICAL_HOST, e.g. sho.rt; empty allows any host
+	Aliases    string // HOST_ALIASES, comma-separated hosts redirected to CANONICAL_HOST
+	ForceHTTPS bool   // FORCE_HTTPS redirects plain http, as seen through TRUSTED_PROXIES
+}
+
+// CodeConfig selects how generated short codes are produced.
+type CodeConfig struct {
+	Strategy string // CODE_STRATEGY: random, sequential or snowflake
+	NodeID   uint64 // NODE_ID, distinguishes instances sharing a keyspace
+	NodeBits uint   // CODE_NODE_BITS reserved for NodeID in sequential codes
+
+	// Random codes grow by one character after CollisionThreshold
+	// consecutive collisions (CODE_COLLISION_THRESHOLD, 0 disables), up
+	// to MaxLength (CODE_MAX_LENGTH).
+	CollisionThreshold int
+	MaxLength          int
+
+	// Blocklist (CODE_BLOCKLIST, comma-separated) and BlocklistFile
+	// (CODE_BLOCKLIST_FILE, one term per line) extend the bundled list of
+	// terms no code may contain.
+	Blocklist     string
+	BlocklistFile string
+}
+
+// SigningConfig controls the tokens appended to signed links.
+type SigningConfig struct {
+	// Keys is SIGNING_KEYS, comma-separated kid:secret pairs; the first
+	// signs, the rest are kept for rotation.
+	Keys     string
+	TokenTTL time.Duration // SIGNED_TOKEN_TTL, how long a token is valid
+	Param    string        // SIGNED_TOKEN_PARAM, the query parameter name
+}
+
+// HealthConfig controls destination monitoring.
+type HealthConfig struct {
+	Enabled     bool          // HEALTH_CHECK_ENABLED
+	Interval    time.Duration // HEALTH_CHECK_INTERVAL between rounds
+	Timeout     time.Duration // HEALTH_CHECK_TIMEOUT per request
+	Concurrency int           // HEALTH_CHECK_CONCURRENCY destinations probed at once
+}
+
+// ExportConfig controls the raw click archive uploaded to S3-compatible
+// storage (GCS works through its interoperability endpoint).
+type ExportConfig struct {
+	Enabled    bool          // EXPORT_ENABLED
+	Interval   time.Duration // EXPORT_INTERVAL between uploads
+	BufferSize int           // EXPORT_BUFFER_SIZE clicks held before new ones are dropped
+	Prefix     string        // EXPORT_PREFIX prepended to object keys
+
+	Endpoint  string // S3_ENDPOINT
+	Region    string // S3_REGION
+	Bucket    string // S3_BUCKET
+	AccessKey string // S3_ACCESS_KEY_ID
+	SecretKey string // S3_SECRET_ACCESS_KEY
+	PathStyle bool   // S3_PATH_STYLE, needed by MinIO and most self-hosted stores
+}
+
+// EventsConfig enables publishing lifecycle events (see LinkEvent) to
+// Kafka.
+type EventsConfig struct {
+	KafkaBrokers    string // KAFKA_BROKERS, comma-separated host:port; empty disables
+	KafkaTopic      string // KAFKA_TOPIC for link.created, link.expired and link.deleted
+	KafkaClickTopic string // KAFKA_CLICK_TOPIC for the higher-volume link.clicked
+}
+
+// GeoIPConfig points at a local MaxMind database used to locate clicks.
+type GeoIPConfig struct {
+	Path           string        // GEOIP_DB_PATH, a GeoLite2/GeoIP2 City or Country .mmdb; empty disables
+	ReloadInterval time.Duration // GEOIP_RELOAD_INTERVAL between checks for a replaced file
+}
+
+// ServerConfig tunes the HTTP listener. Streaming endpoints clear their
+// own write deadline, so WriteTimeout only bounds ordinary responses.
+type ServerConfig struct {
+	Addr              string        // HTTP_ADDR to listen on
+	ReadTimeout       time.Duration // HTTP_READ_TIMEOUT for the whole request, body included
+	ReadHeaderTimeout time.Duration // HTTP_READ_HEADER_TIMEOUT for the request headers
+	WriteTimeout      time.Duration // HTTP_WRITE_TIMEOUT for the response
+	IdleTimeout       time.Duration // HTTP_IDLE_TIMEOUT before an idle keep-alive connection is closed
+	MaxHeaderBytes    int           // HTTP_MAX_HEADER_BYTES
+
+	// TLSCertFile and TLSKeyFile (TLS_CERT_FILE, TLS_KEY_FILE) serve HTTPS
+	// when both are set.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	HTTP2           bool   // HTTP2_ENABLED negotiates HTTP/2 over TLS
+	HTTP2Cleartext  bool   // HTTP2_CLEARTEXT also accepts h2c on the plain listener
+	HTTP2MaxStreams uint32 // HTTP2_MAX_CONCURRENT_STREAMS per connection
+
+	// On SIGTERM or POST /api/admin/drain, /ready fails for DrainGrace
+	// before the listener closes; requests then get DrainTimeout to
+	// finish. See Drainer.
+	DrainGrace   time.Duration // DRAIN_GRACE
+	DrainTimeout time.Duration // DRAIN_TIMEOUT
+}
+
+// AbuseConfig guards the public POST /report/{code} endpoint.
+type AbuseConfig struct {
+	RateLimitPerHour int // REPORT_RATE_LIMIT_PER_HOUR per client IP, 0 disables
+
+	// CaptchaProvider is CAPTCHA_PROVIDER: hcaptcha, turnstile or
+	// recaptcha. CaptchaVerifyURL (CAPTCHA_VERIFY_URL) overrides its
+	// siteverify endpoint, or names one on its own. Tokens are checked
+	// with CaptchaSecret (CAPTCHA_SECRET). With neither set, reports are
+	// accepted without a captcha.
+	CaptchaProvider  string
+	CaptchaVerifyURL string
+	CaptchaSecret    string
+}
+
+// PublicConfig opens POST /public/shorten to visitors without an API key,
+// who must solve the captcha set up in AbuseConfig.
+type PublicConfig struct {
+	Enabled          bool          // PUBLIC_SHORTEN_ENABLED
+	RateLimitPerHour int           // PUBLIC_RATE_LIMIT_PER_HOUR per client IP, 0 disables
+	MaxValidity      time.Duration // PUBLIC_MAX_VALIDITY, also the default lifetime
+}
+
+// ReservationConfig bounds code reservations made with POST /api/reserve.
+type ReservationConfig struct {
+	DefaultHold time.Duration // RESERVATION_DEFAULT_HOLD when the request names none
+	MaxHold     time.Duration // RESERVATION_MAX_HOLD
+	MaxPerOwner int           // RESERVATION_MAX_PER_OWNER live reservations, 0 for no limit
+}
+
+// ClicksConfig enables batched click counting; see ClickJournal.
+type ClicksConfig struct {
+	// FlushInterval is CLICK_FLUSH_INTERVAL between batch flushes; zero
+	// updates the link on every click.
+	FlushInterval time.Duration
+	JournalDir    string // CLICK_JOURNAL_DIR holding the write-ahead journal
+
+	SeriesEnabled   bool          // CLICK_SERIES_ENABLED keeps per-link clicks over time
+	SeriesRetention time.Duration // CLICK_SERIES_RETENTION at full resolution, then rolled into hours
+
+	HourlyRetention time.Duration // CLICK_RETENTION_HOURLY before hours are rolled into days, 0 forever
+	DailyRetention  time.Duration // CLICK_RETENTION_DAILY before days are deleted, 0 forever
+	RawRetention    time.Duration // CLICK_RETENTION_RAW for exported raw clicks, 0 forever
+	PruneInterval   time.Duration // CLICK_RETENTION_INTERVAL between pruning runs
+}
+
+// Retention is the policy the pruning job enforces; see RunRetention.
+func (c ClicksConfig) Retention() RetentionPolicy {
+	return RetentionPolicy{Fine: c.SeriesRetention, Hourly: c.HourlyRetention, Daily: c.DailyRetention, Raw: c.RawRetention}
+}
+
+// PrivacyConfig controls how much of a click is recorded; see Privacy.
+type PrivacyConfig struct {
+	Global       bool          // PRIVACY_MODE scrubs every link's click records
+	HonorDNT     bool          // HONOR_DNT skips recording clicks sent with DNT or Sec-GPC
+	SaltRotation time.Duration // PRIVACY_SALT_ROTATION between salt changes
+}
+
+func softDeleteGrace() time.Duration {
+	if !envBool("SOFT_DELETE", true) {
+		return 0
+	}
+	return envDuration("DELETE_GRACE", 24*time.Hour)
+}
+
+// configFile holds CONFIG_FILE's settings. They take precedence over the
+// environment, so that a reload can change them.
+var configFile atomic.Pointer[map[string]string]
+
+func getenv(key string) string {
+	if m := configFile.Load(); m != nil {
+		if v, ok := (*m)[key]; ok {
+			return v
+		}
+	}
+	return os.Getenv(key)
+}
+
+// readConfigFile parses KEY=VALUE lines, skipping blank lines and #
+// comments. Values may be wrapped in single or double quotes.
+func readConfigFile(path string) (map[string]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]string)
+	for i, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, v, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, i+1)
+		}
+		v = strings.TrimSpace(v)
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		out[key] = v
+	}
+	return out, nil
+}
+
+func envString(key, def string) string {
+	if v := getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envBool(key string, def bool) bool {
+	v := getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		logrus.WithField("key", key).Warnf("invalid boolean %q, using default %t", v, def)
+		return def
+	}
+	return b
+}
+
+func envFloat(key string, def float64) float64 {
+	v := getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		logrus.WithField("key", key).Warnf("invalid number %q, using default %g", v, def)
+		return def
+	}
+	return f
+}
+
+func envInt64(key string, def int64) int64 {
+	v := getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		logrus.WithField("key", key).Warnf("invalid integer %q, using default %d", v, def)
+		return def
+	}
+	return n
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v := getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		logrus.WithField("key", key).Warnf("invalid duration %q, using default %s", v, def)
+		return def
+	}
+	return d
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ClickCounter holds click totals outside the process so that every
+// instance in a cluster reports the same numbers. With no counter
+// configured the Store counts on the Link itself.
+type ClickCounter interface {
+	Incr(ctx context.Context, code string) (int64, error)
+	Get(ctx context.Context, code string) (int64, error)
+	Set(ctx context.Context, code string, n int64) error
+	Delete(ctx context.Context, code string) error
+}
+
+type redisCounter struct {
+	client *redis.Client
+	prefix string
+}
+
+func newRedisCounter(client *redis.Client, prefix string) *redisCounter {
+	return &redisCounter{client: client, prefix: prefix}
+}
+
+func (c *redisCounter) key(code string) string { return c.prefix + "clicks:" + code }
+
+func (c *redisCounter) start(ctx context.Context, op, code string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "counter."+op, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("short_code", code)))
+}
+
+func (c *redisCounter) Incr(ctx context.Context, code string) (int64, error) {
+	ctx, span := c.start(ctx, "Incr", code)
+	defer span.End()
+	n, err := c.client.Incr(ctx, c.key(code)).Result()
+	if err != nil {
+		span.RecordError(err)
+	}
+	return n, err
+}
+
+func (c *redisCounter) Get(ctx context.Context, code string) (int64, error) {
+	ctx, span := c.start(ctx, "Get", code)
+	defer span.End()
+	n, err := c.client.Get(ctx, c.key(code)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	return n, err
+}
+
+func (c *redisCounter) Set(ctx context.Context, code string, n int64) error {
+	ctx, span := c.start(ctx, "Set", code)
+	defer span.End()
+	err := c.client.Set(ctx, c.key(code), n, 0).Err()
+	if err != nil {
+		span.RecordError(err)
+	}
+	return err
+}
+
+func (c *redisCounter) Delete(ctx context.Context, code string) error {
+	ctx, span := c.start(ctx, "Delete", code)
+	defer span.End()
+	return c.client.Del(ctx, c.key(code)).Err()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"url-shortener/storage"
+)
+
+// Link listings are ordered newest first, ties broken by storage key, and
+// paged with opaque cursors naming the last link of the previous page.
+// A cursor stays valid however the store changes: links created since
+// sort before it and are not repeated, deleted ones are simply gone, and
+// no link that existed throughout is skipped or shown twice. Listings of
+// other things (tokens, campaigns, reports, ...) use the same cursors,
+// with the item's ID as the key.
+
+// pageCursor is the position of a link in listing order.
+type pageCursor struct {
+	CreatedAt time.Time `json:"t"`
+	Key       string    `json:"k"`
+}
+
+// listedBefore reports whether a comes before b in listing order.
+func listedBefore(a, b *Link) bool {
+	return storage.PositionOf(a).Before(storage.PositionOf(b))
+}
+
+// encodeCursor returns the cursor of the page after the position.
+func encodeCursor(p storage.Position) string {
+	b, _ := json.Marshal(pageCursor{CreatedAt: p.CreatedAt, Key: p.Key})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor parses a cursor from a previous page; "" is the first
+// page, and nil is returned.
+func decodeCursor(s string) (*pageCursor, *APIError) {
+	if s == "" {
+		return nil, nil
+	}
+	var c pageCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(b, &c) != nil || c.Key == "" {
+		return nil, fieldError("cursor", "cursor is not one this server handed out")
+	}
+	return &c, nil
+}
+
+// position returns the storage position the cursor names, nil for the
+// first page.
+func (c *pageCursor) position() *storage.Position {
+	if c == nil {
+		return nil
+	}
+	return &storage.Position{CreatedAt: c.CreatedAt, Key: c.Key}
+}
+
+// linkPage collects one page of links from a scan in listing order
+// (storage.Storage.ScanFrom) that started at the cursor: the first limit
+// links, and one more that only tells whether there is a next page.
+type linkPage struct {
+	limit int
+	kept  []*Link
+}
+
+func newLinkPage(limit int) *linkPage {
+	return &linkPage{limit: limit}
+}
+
+// add keeps l and reports whether the page wants more.
+func (p *linkPage) add(l *Link) bool {
+	p.kept = append(p.kept, l)
+	return len(p.kept) <= p.limit
+}
+
+// links returns the page in listing order and the cursor of the next
+// one, "" if this is the last.
+func (p *linkPage) links() ([]*Link, string) {
+	if len(p.kept) <= p.limit {
+		return p.kept, ""
+	}
+	out := p.kept[:p.limit]
+	return out, encodeCursor(storage.PositionOf(out[len(out)-1]))
+}
+
+// pageOf pages a listing that is not served by an ordered scan. It
+// sorts items in place by the positions pos gives them, before telling
+// which comes first, and returns at most limit of them after the cursor
+// with the cursor of the next page, "" if this is the last.
+func pageOf[T any](items []T, pos func(T) storage.Position, before func(a, b storage.Position) bool, after *pageCursor, limit int) ([]T, string) {
+	sort.Slice(items, func(i, j int) bool { return before(pos(items[i]), pos(items[j])) })
+	if after != nil {
+		p := *after.position()
+		items = items[sort.Search(len(items), func(i int) bool { return before(p, pos(items[i])) }):]
+	}
+	if len(items) <= limit {
+		return items, ""
+	}
+	items = items[:limit]
+	return items, encodeCursor(pos(items[limit-1]))
+}
+
+// oldestFirst orders positions by ascending CreatedAt, ties broken by
+// key, for listings that are queues rather than feeds.
+func oldestFirst(a, b storage.Position) bool {
+	if a.CreatedAt.Equal(b.CreatedAt) {
+		return a.Key < b.Key
+	}
+	return a.CreatedAt.Before(b.CreatedAt)
+}
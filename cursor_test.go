@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"url-shortener/storage"
+	"url-shortener/storage/storetest"
+)
+
+type linksPage struct {
+	Links      []*Link `json:"links"`
+	NextCursor string  `json:"next_cursor"`
+}
+
+func listPage(t *testing.T, h http.Handler, cursor string) ([]string, string) {
+	t.Helper()
+	var page linksPage
+	storetest.DecodeJSON(t, storetest.Do(t, h, storetest.Request{Path: "/api/links?limit=2&cursor=" + cursor}), http.StatusOK, &page)
+	codes := []string{}
+	for _, l := range page.Links {
+		codes = append(codes, l.ShortCode)
+	}
+	return codes, page.NextCursor
+}
+
+// TestListCursorStable pages through /api/links while links are created
+// and deleted between pages: no link that exists throughout is skipped
+// or repeated, even when the link a cursor names is gone.
+func TestListCursorStable(t *testing.T) {
+	ctx := context.Background()
+	s, clock := newClockedStore(t)
+	create := func(code string) {
+		t.Helper()
+		if _, err := s.Create(ctx, "https://example.com/"+code, code, time.Hour, LinkOptions{}); err != nil {
+			t.Fatalf("Create(%s): %v", code, err)
+		}
+	}
+	// Newest first: f, then d and e created at the same moment, c, b, a.
+	for _, code := range []string{"a", "b", "c", "d", "e", "f"} {
+		if code != "e" {
+			clock.Advance(time.Minute)
+		}
+		create(code)
+	}
+	h := listLinksHandler(s)
+
+	var seen []string
+	codes, next := listPage(t, h, "")
+	seen = append(seen, codes...)
+	if want := []string{"f", "d"}; !reflect.DeepEqual(codes, want) {
+		t.Fatalf("first page = %v, want %v", codes, want)
+	}
+
+	// The cursor's own link and one on the next page go; a newer link
+	// and an older one arrive.
+	for _, code := range []string{"d", "c"} {
+		if err := s.Delete(ctx, code, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.Advance(time.Minute)
+	create("newer")
+	clock.Set(testEpoch)
+	create("older")
+
+	for next != "" {
+		codes, next = listPage(t, h, next)
+		seen = append(seen, codes...)
+	}
+	if want := []string{"f", "d", "e", "b", "a", "older"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("pages listed %v, want %v", seen, want)
+	}
+}
+
+func TestPageOf(t *testing.T) {
+	ids := []string{"d", "b", "e", "a", "c"}
+	pos := func(id string) storage.Position { return storage.Position{Key: id} }
+	cursor := func(id string) *pageCursor { return &pageCursor{Key: id} }
+	tests := []struct {
+		name     string
+		after    *pageCursor
+		limit    int
+		want     []string
+		wantNext string
+	}{
+		{"first page", nil, 2, []string{"a", "b"}, "b"},
+		{"middle page", cursor("b"), 2, []string{"c", "d"}, "d"},
+		{"last page", cursor("d"), 2, []string{"e"}, ""},
+		{"exactly the rest", cursor("c"), 2, []string{"d", "e"}, ""},
+		{"after a removed item", cursor("bb"), 2, []string{"c", "d"}, "d"},
+		{"past the end", cursor("z"), 2, []string{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, next := pageOf(append([]string(nil), ids...), pos, storage.Position.Before, tt.after, tt.limit)
+			if len(got) == 0 {
+				got = []string{}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("page = %v, want %v", got, tt.want)
+			}
+			var wantNext string
+			if tt.wantNext != "" {
+				wantNext = encodeCursor(pos(tt.wantNext))
+			}
+			if next != wantNext {
+				t.Errorf("next = %q, want the cursor of %q", next, tt.wantNext)
+			}
+		})
+	}
+}
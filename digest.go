@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Digest frequencies an owner can opt in to with NotificationPrefs.Digest.
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// maxDigestLinks caps each section of a digest.
+const maxDigestLinks = 20
+
+// DigestConfig says when digests go out.
+type DigestConfig struct {
+	Hour    int    // DIGEST_HOUR, UTC hour of day
+	Weekday string // DIGEST_WEEKDAY weekly digests are sent on, e.g. monday
+}
+
+// digestSchedule is a validated DigestConfig.
+type digestSchedule struct {
+	hour    int
+	weekday time.Weekday
+}
+
+func (c DigestConfig) schedule() (digestSchedule, error) {
+	if c.Hour < 0 || c.Hour > 23 {
+		return digestSchedule{}, fmt.Errorf("DIGEST_HOUR must be between 0 and 23")
+	}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(c.Weekday, d.String()) {
+			return digestSchedule{hour: c.Hour, weekday: d}, nil
+		}
+	}
+	return digestSchedule{}, fmt.Errorf("DIGEST_WEEKDAY %q is not a day of the week", c.Weekday)
+}
+
+// due reports whether a digest at frequency has been scheduled since
+// last.
+func (sc digestSchedule) due(frequency string, now, last time.Time) bool {
+	slot := time.Date(now.Year(), now.Month(), now.Day(), sc.hour, 0, 0, 0, time.UTC)
+	if slot.After(now) {
+		slot = slot.AddDate(0, 0, -1)
+	}
+	if frequency == DigestWeekly {
+		for slot.Weekday() != sc.weekday {
+			slot = slot.AddDate(0, 0, -1)
+		}
+	}
+	return last.Before(slot)
+}
+
+func digestPeriod(frequency string) time.Duration {
+	if frequency == DigestWeekly {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+type digestLink struct {
+	ShortCode string    `json:"short_code"`
+	ShortURL  string    `json:"short_url"`
+	LongURL   string    `json:"long_url"`
+	Clicks    int64     `json:"clicks"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// digestEvent is what a digest webhook receives.
+type digestEvent struct {
+	Event       string       `json:"event"`
+	Owner       string       `json:"owner"`
+	Frequency   string       `json:"frequency"`
+	From        time.Time    `json:"from"`
+	To          time.Time    `json:"to"`
+	ActiveLinks int          `json:"active_links"`
+	TotalClicks int64        `json:"total_clicks"`
+	Expiring    []digestLink `json:"expiring_soon"`
+	Top         []digestLink `json:"top_links"`
+	Created     []digestLink `json:"new_links"`
+}
+
+// digest compiles owner's links: those expiring within the next period,
+// the most clicked, and those created during the last one.
+func (s *Store) digest(ctx context.Context, owner, frequency string, now time.Time) (*digestEvent, error) {
+	period := digestPeriod(frequency)
+	ev := &digestEvent{
+		Event:     "links.digest",
+		Owner:     owner,
+		Frequency: frequency,
+		From:      now.Add(-period),
+		To:        now,
+		Expiring:  []digestLink{},
+		Top:       []digestLink{},
+		Created:   []digestLink{},
+	}
+	err := s.backend.Scan(ctx, func(l *Link) bool {
+		if l.Owner != owner || l.Deleted() || l.Reserved || !now.Before(l.ExpiresAt) {
+			return true
+		}
+		d := digestLink{
+			ShortCode: l.ShortCode,
+			ShortURL:  s.shortURL(l),
+			LongURL:   l.LongURL,
+			Clicks:    l.Clicks + s.batch.Pending(l.Key()),
+			CreatedAt: l.CreatedAt,
+			ExpiresAt: l.ExpiresAt,
+		}
+		ev.ActiveLinks++
+		ev.TotalClicks += d.Clicks
+		if l.ExpiresAt.Sub(now) <= period && !l.Draft {
+			ev.Expiring = append(ev.Expiring, d)
+		}
+		if l.CreatedAt.After(ev.From) {
+			ev.Created = append(ev.Created, d)
+		}
+		if d.Clicks > 0 {
+			ev.Top = append(ev.Top, d)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ev.Expiring, func(i, j int) bool { return ev.Expiring[i].ExpiresAt.Before(ev.Expiring[j].ExpiresAt) })
+	sort.Slice(ev.Created, func(i, j int) bool { return ev.Created[i].CreatedAt.After(ev.Created[j].CreatedAt) })
+	sort.Slice(ev.Top, func(i, j int) bool { return ev.Top[i].Clicks > ev.Top[j].Clicks })
+	ev.Expiring = capDigest(ev.Expiring)
+	ev.Created = capDigest(ev.Created)
+	if len(ev.Top) > 5 {
+		ev.Top = ev.Top[:5]
+	}
+	return ev, nil
+}
+
+func capDigest(links []digestLink) []digestLink {
+	if len(links) > maxDigestLinks {
+		return links[:maxDigestLinks]
+	}
+	return links
+}
+
+// text renders the digest for Slack and email.
+func (ev *digestEvent) text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Your %s short link digest: %d active links, %d clicks in total.\n", ev.Frequency, ev.ActiveLinks, ev.TotalClicks)
+	section := func(title string, links []digestLink, line func(digestLink) string) {
+		if len(links) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "\n%s:\n", title)
+		for _, l := range links {
+			b.WriteString("  " + line(l) + "\n")
+		}
+	}
+	section("Expiring soon", ev.Expiring, func(l digestLink) string {
+		return fmt.Sprintf("%s → %s, expires %s", l.ShortURL, l.LongURL, l.ExpiresAt.Format(time.RFC3339))
+	})
+	section("Top links", ev.Top, func(l digestLink) string {
+		return fmt.Sprintf("%s → %s, %d clicks", l.ShortURL, l.LongURL, l.Clicks)
+	})
+	section("New links", ev.Created, func(l digestLink) string {
+		return fmt.Sprintf("%s → %s", l.ShortURL, l.LongURL)
+	})
+	return b.String()
+}
+
+// RunDigests checks every interval for owners whose digest is due and
+// sends it. Each instance reports the links it holds.
+func (n *Notifier) RunDigests(store *Store, sc digestSchedule, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		n.sendDueDigests(store, sc)
+	}
+}
+
+func (n *Notifier) sendDueDigests(store *Store, sc digestSchedule) {
+	ctx := context.Background()
+	now := store.now()
+	n.mu.RLock()
+	owners := make(map[string]NotificationPrefs)
+	for owner, p := range n.prefs {
+		if p.Digest != "" {
+			owners[owner] = p
+		}
+	}
+	n.mu.RUnlock()
+	for owner, p := range owners {
+		last := n.lastDigest(owner)
+		if last.IsZero() {
+			// Start with the next scheduled digest rather than one for a
+			// period that began before the owner opted in or we started.
+			n.markDigest(owner, now)
+			continue
+		}
+		if !sc.due(p.Digest, now, last) {
+			continue
+		}
+		ev, err := store.digest(ctx, owner, p.Digest, now)
+		if err != nil {
+			logrus.WithError(err).WithField("owner", owner).Warn("compiling digest failed")
+			continue
+		}
+		n.markDigest(owner, now)
+		if ev.ActiveLinks == 0 {
+			continue
+		}
+		log := logrus.WithFields(logrus.Fields{"action": "digest", "owner": owner, "frequency": p.Digest})
+		if n.deliver(owner, p, ev, "Your "+p.Digest+" short link digest", ev.text(), log) == nil {
+			log.Info("digest sent")
+		}
+	}
+}
+
+func (n *Notifier) lastDigest(owner string) time.Time {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.digestSent[owner]
+}
+
+func (n *Notifier) markDigest(owner string, at time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.digestSent[owner] = at
+}
+
+// digestPreviewHandler serves GET /api/notifications/digest: the digest
+// the caller would receive now, at ?frequency= or their chosen one.
+func digestPreviewHandler(store *Store, n *Notifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner := ownerFrom(r.Context())
+		frequency := r.URL.Query().Get("frequency")
+		if frequency == "" {
+			frequency = n.Prefs(owner).Digest
+		}
+		switch frequency {
+		case "":
+			frequency = DigestDaily
+		case DigestDaily, DigestWeekly:
+		default:
+			writeAPIError(w, r, fieldError("frequency", "frequency must be daily or weekly"))
+			return
+		}
+		ev, err := store.digest(r.Context(), owner, frequency, store.now())
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, ev)
+	}
+}
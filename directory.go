@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultDirectoryLimit = 100
+	maxDirectoryLimit     = 1000
+
+	// directoryMaxAge is how long shared caches may keep a feed page.
+	directoryMaxAge = 5 * time.Minute
+)
+
+// publicPage returns a page of the links in the request's tenant that
+// opted in to the public directory and can be followed by anyone right
+// now: at most limit of them after the cursor, newest first.
+func (s *Store) publicPage(ctx context.Context, after *pageCursor, limit int) (*linkPage, error) {
+	tenant := tenantFrom(ctx)
+	now := s.now()
+	page := newLinkPage(limit)
+	err := s.backend.ScanFrom(ctx, after.position(), func(l *Link) bool {
+		if l.Public && !l.NoIndex && l.Tenant == tenant && !l.Draft && !l.Deleted() && !l.Reserved &&
+			l.TakenDownAt == nil && !l.BurnAfterRead && len(l.AllowedIPs) == 0 && now.Before(l.ExpiresAt) {
+			return page.add(l)
+		}
+		return true
+	})
+	return page, err
+}
+
+type directoryEntry struct {
+	ShortURL    string    `json:"short_url" xml:"short_url"`
+	LongURL     string    `json:"long_url" xml:"long_url"`
+	Title       string    `json:"title,omitempty" xml:"title,omitempty"`
+	Description string    `json:"description,omitempty" xml:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at" xml:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" xml:"updated_at"`
+}
+
+type directoryPage struct {
+	XMLName xml.Name         `json:"-" xml:"links"`
+	Limit   int              `json:"limit" xml:"limit,attr"`
+	Next    string           `json:"next,omitempty" xml:"next,attr,omitempty"`
+	Links   []directoryEntry `json:"links" xml:"link"`
+}
+
+// directoryHandler serves GET /links.json and /links.xml: the public
+// links of the host's tenant, paged with ?cursor= and ?limit=; next is
+// the URL of the following page. Pages may be cached by shared caches for
+// directoryMaxAge.
+func directoryHandler(store *Store, format string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		limit := defaultDirectoryLimit
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxDirectoryLimit {
+				writeAPIError(w, r, fieldError("limit", "limit must be an integer between 1 and "+strconv.Itoa(maxDirectoryLimit)))
+				return
+			}
+			limit = n
+		}
+		after, apiErr := decodeCursor(q.Get("cursor"))
+		if apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		found, err := store.publicPage(r.Context(), after, limit)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		links, next := found.links()
+		page := directoryPage{Limit: limit, Links: []directoryEntry{}}
+		if next != "" {
+			page.Next = r.URL.Path + "?cursor=" + next + "&limit=" + strconv.Itoa(limit)
+		}
+		for _, l := range links {
+			e := directoryEntry{ShortURL: store.shortURL(l), LongURL: l.LongURL, CreatedAt: l.CreatedAt, UpdatedAt: l.UpdatedAt}
+			if l.Preview != nil {
+				e.Title, e.Description = l.Preview.Title, l.Preview.Description
+			}
+			page.Links = append(page.Links, e)
+		}
+
+		var body bytes.Buffer
+		contentType := "application/json"
+		if format == "xml" {
+			contentType = "application/xml; charset=utf-8"
+			body.WriteString(xml.Header)
+			err = xml.NewEncoder(&body).Encode(page)
+		} else {
+			err = json.NewEncoder(&body).Encode(page)
+		}
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, ErrCodeInternal, "internal error")
+			return
+		}
+		cacheControl := "public, max-age=" + strconv.Itoa(int(directoryMaxAge/time.Second))
+		w.Header().Add("Vary", "Host")
+		writeCached(w, r, body.Bytes(), contentType, cacheControl, latestUpdate(links))
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Destination policy modes.
+const (
+	PolicyAllow = "allow" // only listed domains may be shortened
+	PolicyBlock = "block" // every domain but the listed ones may
+)
+
+// DomainPolicy restricts which destination hosts may be shortened. A
+// pattern is a host ("example.com", matching only itself), "*.example.com"
+// for any subdomain of it, or "*" for every host. An empty Mode applies
+// no restriction.
+type DomainPolicy struct {
+	Mode    string   `json:"mode,omitempty"`
+	Domains []string `json:"domains,omitempty"`
+}
+
+// DomainPolicyConfig is the policy for the default tenant and for tenants
+// that have none of their own.
+type DomainPolicyConfig struct {
+	Mode    string // DESTINATION_POLICY: allow, block or empty for none
+	Domains string // DESTINATION_DOMAINS, comma-separated patterns
+}
+
+func (c DomainPolicyConfig) policy() DomainPolicy {
+	p := DomainPolicy{Mode: c.Mode}
+	for _, d := range strings.Split(c.Domains, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			p.Domains = append(p.Domains, d)
+		}
+	}
+	return p
+}
+
+// normalize checks the policy and lower-cases its patterns in place.
+func (p *DomainPolicy) normalize() error {
+	switch p.Mode {
+	case "", PolicyAllow, PolicyBlock:
+	default:
+		return fmt.Errorf("mode must be %s or %s", PolicyAllow, PolicyBlock)
+	}
+	for i, d := range p.Domains {
+		d = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(d), "."))
+		host := strings.TrimPrefix(d, "*.")
+		if d == "" || (d != "*" && (host == "" || strings.ContainsAny(host, "*/:@ "))) {
+			return fmt.Errorf("%q is not a domain pattern", p.Domains[i])
+		}
+		p.Domains[i] = d
+	}
+	return nil
+}
+
+// match returns the first pattern host matches, or "".
+func (p DomainPolicy) match(host string) string {
+	for _, d := range p.Domains {
+		switch {
+		case d == "*", d == host:
+			return d
+		case strings.HasPrefix(d, "*.") && strings.HasSuffix(host, d[1:]):
+			return d
+		}
+	}
+	return ""
+}
+
+// denies returns the reason host may not be shortened under p, or "".
+func (p DomainPolicy) denies(host string) string {
+	rule := p.match(host)
+	switch {
+	case p.Mode == PolicyAllow && rule == "":
+		return "is not on the allowlist"
+	case p.Mode == PolicyBlock && rule != "":
+		return "is blocked by " + rule
+	}
+	return ""
+}
+
+// domainPolicy is the policy in force for the request's tenant.
+func (s *Store) domainPolicy(ctx context.Context) DomainPolicy {
+	if tenant := tenantFrom(ctx); tenant != "" && s.tenants != nil {
+		if t, err := s.tenants.Get(tenant); err == nil && t.DomainPolicy != nil {
+			return *t.DomainPolicy
+		}
+	}
+	return s.destPolicy
+}
+
+// checkDestination fails with a 403 naming the host if field's URL may
+// not be shortened in this tenant.
+func (s *Store) checkDestination(ctx context.Context, field, rawURL string) error {
+	p := s.domainPolicy(ctx)
+	if p.Mode == "" {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil // reported as an invalid URL elsewhere
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	reason := p.denies(host)
+	if reason == "" {
+		return nil
+	}
+	msg := "destination domain " + host + " " + reason
+	e := newAPIError(http.StatusForbidden, ErrCodeDomainNotAllowed, msg)
+	e.Fields = []FieldError{{Field: field, Message: msg}}
+	e.Details = map[string]interface{}{
+		"domain": host,
+		"policy": p.Mode,
+	}
+	if rule := p.match(host); rule != "" {
+		e.Details["rule"] = rule
+	}
+	if tenant := tenantFrom(ctx); tenant != "" {
+		e.Details["tenant"] = tenant
+	}
+	return e
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDomainPolicyNormalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  DomainPolicy
+		want    []string
+		wantErr bool
+	}{
+		{"no mode", DomainPolicy{}, nil, false},
+		{"lower-cased and trimmed", DomainPolicy{Mode: PolicyAllow, Domains: []string{" Example.COM. ", "*.Corp.example"}},
+			[]string{"example.com", "*.corp.example"}, false},
+		{"wildcard for all", DomainPolicy{Mode: PolicyBlock, Domains: []string{"*"}}, []string{"*"}, false},
+		{"unknown mode", DomainPolicy{Mode: "deny"}, nil, true},
+		{"empty pattern", DomainPolicy{Mode: PolicyAllow, Domains: []string{""}}, nil, true},
+		{"wildcard without a domain", DomainPolicy{Mode: PolicyAllow, Domains: []string{"*.."}}, nil, true},
+		{"wildcard in the middle", DomainPolicy{Mode: PolicyAllow, Domains: []string{"a.*.example.com"}}, nil, true},
+		{"URL instead of host", DomainPolicy{Mode: PolicyAllow, Domains: []string{"https://example.com"}}, nil, true},
+		{"port", DomainPolicy{Mode: PolicyAllow, Domains: []string{"example.com:443"}}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.normalize()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalize() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(tt.policy.Domains, tt.want) {
+				t.Errorf("domains = %q, want %q", tt.policy.Domains, tt.want)
+			}
+		})
+	}
+}
+
+func TestDomainPolicyDenies(t *testing.T) {
+	allow := DomainPolicy{Mode: PolicyAllow, Domains: []string{"example.com", "*.corp.example"}}
+	block := DomainPolicy{Mode: PolicyBlock, Domains: []string{"evil.example", "*.tracker.example"}}
+	tests := []struct {
+		policy DomainPolicy
+		host   string
+		denied bool
+	}{
+		{allow, "example.com", false},
+		{allow, "www.example.com", true},
+		{allow, "wiki.corp.example", false},
+		{allow, "a.b.corp.example", false},
+		{allow, "corp.example", true},
+		{allow, "notcorp.example", true},
+		{allow, "other.org", true},
+		{block, "evil.example", true},
+		{block, "www.evil.example", false},
+		{block, "ads.tracker.example", true},
+		{block, "tracker.example", false},
+		{block, "other.org", false},
+		{DomainPolicy{Mode: PolicyBlock, Domains: []string{"*"}}, "anything.example", true},
+		{DomainPolicy{Domains: []string{"example.com"}}, "other.org", false},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.denies(tt.host) != ""; got != tt.denied {
+			t.Errorf("%s %v denies %s = %v, want %v", tt.policy.Mode, tt.policy.Domains, tt.host, got, tt.denied)
+		}
+	}
+}
+
+func TestCheckDestination(t *testing.T) {
+	global := DomainPolicy{Mode: PolicyBlock, Domains: []string{"evil.example"}}
+	tests := []struct {
+		name       string
+		tenant     string
+		url        string
+		wantDenied bool
+		wantRule   string
+	}{
+		{"global policy allows", "", "https://example.com/a", false, ""},
+		{"global policy blocks", "", "https://evil.example/a", true, "evil.example"},
+		{"host matched case- and dot-insensitively", "", "https://EVIL.example./a", true, "evil.example"},
+		{"tenant policy replaces the global one", "acme", "https://evil.example/a", true, ""},
+		{"tenant allowlist", "acme", "https://docs.acme.example/a", false, ""},
+		{"tenant without a policy falls back", "plain", "https://evil.example/a", true, "evil.example"},
+		{"tenant without a policy, allowed", "plain", "https://example.com/a", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newClockedStore(t)
+			s.destPolicy = global
+			s.tenants = NewTenants()
+			acme := &DomainPolicy{Mode: PolicyAllow, Domains: []string{"*.acme.example"}}
+			if _, err := s.tenants.Create(Tenant{ID: "acme", DomainPolicy: acme}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.tenants.Create(Tenant{ID: "plain"}); err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			if tt.tenant != "" {
+				ctx = withTenant(ctx, tt.tenant)
+			}
+
+			_, err := s.Create(ctx, tt.url, "", time.Hour, LinkOptions{})
+			var e *APIError
+			if !tt.wantDenied {
+				if err != nil {
+					t.Fatalf("Create(%s) = %v, want it allowed", tt.url, err)
+				}
+				return
+			}
+			if !errors.As(err, &e) || e.Status != http.StatusForbidden || e.Code != ErrCodeDomainNotAllowed {
+				t.Fatalf("Create(%s) = %v, want a 403 %s", tt.url, err, ErrCodeDomainNotAllowed)
+			}
+			if len(e.Fields) != 1 || e.Fields[0].Field != "url" {
+				t.Errorf("fields = %+v, want the url field", e.Fields)
+			}
+			if rule, _ := e.Details["rule"].(string); rule != tt.wantRule {
+				t.Errorf("rule = %q, want %q", rule, tt.wantRule)
+			}
+			if tenant, _ := e.Details["tenant"].(string); tenant != tt.tenant {
+				t.Errorf("tenant = %q, want %q", tenant, tt.tenant)
+			}
+		})
+	}
+}
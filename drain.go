@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Drainer takes the process out of rotation and stops it without
+// dropping requests. Once draining, /ready fails and responses close
+// their connections; after the grace period, which gives load balancers
+// time to notice, the listener closes, in-flight requests get up to the
+// timeout to finish, buffered clicks are flushed and Done is closed.
+type Drainer struct {
+	grace    time.Duration
+	timeout  time.Duration
+	draining atomic.Bool
+	once     sync.Once
+	start    chan struct{}
+	done     chan struct{}
+}
+
+func NewDrainer(grace, timeout time.Duration) *Drainer {
+	return &Drainer{grace: grace, timeout: timeout, start: make(chan struct{}), done: make(chan struct{})}
+}
+
+// Drain starts draining. It reports false if that had already begun.
+func (d *Drainer) Drain() bool {
+	started := false
+	d.once.Do(func() {
+		started = true
+		d.draining.Store(true)
+		close(d.start)
+	})
+	return started
+}
+
+// Draining reports whether Drain has been called.
+func (d *Drainer) Draining() bool { return d.draining.Load() }
+
+// Done is closed once the server has shut down and flushed.
+func (d *Drainer) Done() <-chan struct{} { return d.done }
+
+// DrainOnSignal drains on the first of sigs, typically SIGTERM, and exits
+// at once on the second.
+func (d *Drainer) DrainOnSignal(sigs ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	for sig := range ch {
+		if !d.Drain() {
+			logrus.WithField("signal", sig.String()).Warn("second signal while draining, exiting now")
+			os.Exit(1)
+		}
+		logrus.WithFields(logrus.Fields{"action": "drain", "signal": sig.String()}).Info("draining")
+	}
+}
+
+// Run waits for Drain, then shuts srv down as described on Drainer and
+// calls flush before closing Done.
+func (d *Drainer) Run(srv *http.Server, flush func(context.Context)) {
+	<-d.start
+	srv.SetKeepAlivesEnabled(false)
+	log := logrus.WithField("action", "drain")
+	log.WithField("grace", d.grace).Info("readiness failing, waiting for the load balancer")
+	time.Sleep(d.grace)
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.WithError(err).Warn("requests still in flight at the drain timeout")
+	}
+	flush(ctx)
+	log.Info("drained")
+	close(d.done)
+}
+
+// Flush writes out what is held in memory: batched clicks and the click
+// archive buffer.
+func (s *Store) Flush(ctx context.Context) {
+	if s.batch != nil {
+		s.flushClicks(ctx)
+	}
+	if s.archive != nil {
+		if err := s.archive.Flush(ctx); err != nil {
+			logrus.WithError(err).WithField("action", "export").Warn("click export failed, buffered clicks are lost")
+		}
+	}
+}
+
+// readyHandler serves GET /ready, which fails with 503 while draining.
+// Unlike /health it is meant for load balancer readiness checks.
+func readyHandler(d *Drainer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if d.Draining() {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+	}
+}
+
+// drainHandler serves POST /api/admin/drain, which drains the instance
+// that receives it as SIGTERM would.
+func drainHandler(d *Drainer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if d.Drain() {
+			logrus.WithFields(logrus.Fields{"action": "drain", "by": ownerFrom(r.Context())}).Info("draining")
+		}
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"status":        "draining",
+			"grace_seconds": int(d.grace / time.Second),
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/edge"
+	"url-shortener/storage"
+)
+
+// EdgeConfig selects the edge cache links can be pre-warmed into.
+type EdgeConfig struct {
+	Provider            string // EDGE_PROVIDER, cloudflare or fastly; empty disables
+	CloudflareAccount   string // CLOUDFLARE_ACCOUNT_ID
+	CloudflareNamespace string // CLOUDFLARE_KV_NAMESPACE_ID
+	CloudflareToken     string // CLOUDFLARE_API_TOKEN
+	FastlyStore         string // FASTLY_KV_STORE_ID
+	FastlyToken         string // FASTLY_API_TOKEN
+}
+
+func newEdgeCache(cfg EdgeConfig) edge.Cache {
+	client := &http.Client{Timeout: 10 * time.Second}
+	switch cfg.Provider {
+	case "":
+		return nil
+	case "cloudflare":
+		if cfg.CloudflareAccount == "" || cfg.CloudflareNamespace == "" || cfg.CloudflareToken == "" {
+			logrus.Fatal("EDGE_PROVIDER=cloudflare needs CLOUDFLARE_ACCOUNT_ID, CLOUDFLARE_KV_NAMESPACE_ID and CLOUDFLARE_API_TOKEN")
+		}
+		return &edge.Cloudflare{AccountID: cfg.CloudflareAccount, NamespaceID: cfg.CloudflareNamespace, APIToken: cfg.CloudflareToken, Client: client}
+	case "fastly":
+		if cfg.FastlyStore == "" || cfg.FastlyToken == "" {
+			logrus.Fatal("EDGE_PROVIDER=fastly needs FASTLY_KV_STORE_ID and FASTLY_API_TOKEN")
+		}
+		return &edge.Fastly{StoreID: cfg.FastlyStore, APIToken: cfg.FastlyToken, Client: client}
+	default:
+		logrus.Fatalf("unknown EDGE_PROVIDER %q", cfg.Provider)
+		return nil
+	}
+}
+
+// edgeKey is where l's entry lives: its short URL without the scheme.
+func (s *Store) edgeKey(l *Link) string {
+	u := s.shortURL(l)
+	if _, rest, ok := strings.Cut(u, "://"); ok {
+		return rest
+	}
+	return u
+}
+
+// edgeEntry returns what the edge should answer for l, or why it cannot:
+// anything decided per click stays at the origin. Clicks answered at the
+// edge are not counted.
+func (s *Store) edgeEntry(l *Link, now time.Time) (edge.Entry, string) {
+	var reason string
+	switch {
+	case l.Deleted(), l.Reserved, l.Draft, l.TakenDownAt != nil, !now.Before(l.ExpiresAt):
+		reason = "it does not redirect"
+	case l.Signed:
+		reason = "it is signed"
+	case l.BurnAfterRead:
+		reason = "it burns after reading"
+	case l.Passthrough:
+		reason = "it passes paths through"
+	case len(l.Destinations) > 0:
+		reason = "it rotates destinations"
+	case len(l.AllowedIPs) > 0:
+		reason = "it is restricted to networks"
+	case l.Schedule != nil:
+		reason = "it has opening hours"
+	case len(l.Timeline) > 0:
+		reason = "it has scheduled destination changes"
+	case l.SlidingTTL:
+		reason = "its lifetime slides with clicks"
+	case l.FallbackURL != "":
+		reason = "it has a fallback"
+	case l.Card != nil:
+		reason = "it shows a card to preview crawlers"
+	case s.interstitial(l) != nil:
+		reason = "it shows an interstitial"
+	}
+	if reason != "" {
+		return edge.Entry{}, reason
+	}
+	h := http.Header{}
+	s.addRedirectHeaders(h, l)
+	e := edge.Entry{Location: l.LongURL, Status: http.StatusFound, ExpiresAt: l.ExpiresAt}
+	if len(h) > 0 {
+		e.Headers = make(map[string]string, len(h))
+		for name := range h {
+			e.Headers[name] = h.Get(name)
+		}
+	}
+	return e, ""
+}
+
+// Prewarm pushes code's redirect to the edge cache. From then on every
+// change to the link is pushed too, and the entry is purged once the link
+// stops redirecting the same way at the edge.
+func (s *Store) Prewarm(ctx context.Context, code, owner string) (string, *edge.Entry, error) {
+	if s.edge == nil {
+		return "", nil, newAPIError(http.StatusServiceUnavailable, ErrCodeUnavailable, "no edge cache is configured")
+	}
+	l, err := s.Get(ctx, code)
+	if err == nil && !canManage(owner, l) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	e, reason := s.edgeEntry(l, s.now())
+	if reason != "" {
+		return "", nil, newAPIError(http.StatusConflict, ErrCodeConflict, "link cannot be served from the edge: "+reason)
+	}
+	key := s.edgeKey(l)
+	if err := s.edge.Put(ctx, key, e); err != nil {
+		logrus.WithError(err).WithField("short_code", code).Warn("pushing link to the edge failed")
+		return "", nil, newAPIError(http.StatusBadGateway, ErrCodeUnavailable, "edge cache refused the link")
+	}
+	if !l.EdgeCached {
+		if _, err := s.backend.Update(ctx, l.Key(), func(l *Link) error {
+			l.EdgeCached = true
+			return nil
+		}); err != nil {
+			return "", nil, err
+		}
+	}
+	logrus.WithFields(logrus.Fields{"action": "prewarm", "short_code": code, "edge_key": key}).Info("link pushed to the edge")
+	return key, &e, nil
+}
+
+// edgeSync keeps the edge entries of pre-warmed links in step with the
+// backend: an update that changes how a link redirects re-pushes it, and
+// one after which it no longer can be served at the edge, or a delete,
+// purges it. Pushes happen in the background, one at a time and in order.
+type edgeSync struct {
+	storage.Storage
+	store *Store
+	cache edge.Cache
+	queue chan func(context.Context)
+}
+
+func newEdgeSync(next storage.Storage, store *Store, cache edge.Cache) *edgeSync {
+	e := &edgeSync{Storage: next, store: store, cache: cache, queue: make(chan func(context.Context), 1024)}
+	go func() {
+		for op := range e.queue {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			op(ctx)
+			cancel()
+		}
+	}()
+	return e
+}
+
+func (e *edgeSync) Update(ctx context.Context, key string, fn func(*Link) error) (*Link, error) {
+	var before *Link
+	l, err := e.Storage.Update(ctx, key, func(l *Link) error {
+		before = nil
+		if l.EdgeCached {
+			before = l.Clone()
+		}
+		return fn(l)
+	})
+	if err == nil && before != nil {
+		e.sync(before, l.Clone())
+	}
+	return l, err
+}
+
+func (e *edgeSync) Delete(ctx context.Context, key string) error {
+	l, _ := e.Storage.Get(ctx, key)
+	if err := e.Storage.Delete(ctx, key); err != nil {
+		return err
+	}
+	if l != nil && l.EdgeCached {
+		e.sync(l, nil)
+	}
+	return nil
+}
+
+// sync brings the edge from before to after; nil after is a deleted link.
+func (e *edgeSync) sync(before, after *Link) {
+	now := e.store.now()
+	oldKey := e.store.edgeKey(before)
+	old, oldReason := e.store.edgeEntry(before, now)
+	var (
+		newKey    string
+		cur       edge.Entry
+		curReason = "deleted"
+	)
+	if after != nil {
+		newKey = e.store.edgeKey(after)
+		cur, curReason = e.store.edgeEntry(after, now)
+	}
+	if oldKey == newKey && oldReason == curReason && old.Equal(cur) {
+		return
+	}
+	e.queue <- func(ctx context.Context) {
+		log := logrus.WithFields(logrus.Fields{"action": "edge_sync", "short_code": before.ShortCode})
+		if curReason == "" {
+			if err := e.cache.Put(ctx, newKey, cur); err != nil {
+				log.WithError(err).Warn("updating the edge entry failed")
+			}
+		}
+		if curReason != "" || newKey != oldKey {
+			if err := e.cache.Purge(ctx, oldKey); err != nil {
+				log.WithError(err).Warn("purging the edge entry failed")
+			}
+		}
+	}
+}
+
+func (e *edgeSync) Usage(ctx context.Context) (storage.Usage, error) {
+	if u, ok := e.Storage.(storage.UsageReporter); ok {
+		return u.Usage(ctx)
+	}
+	return storage.Usage{}, storage.ErrUnsupported
+}
+
+func (e *edgeSync) Compact(ctx context.Context) error {
+	if c, ok := e.Storage.(storage.Compactor); ok {
+		return c.Compact(ctx)
+	}
+	return storage.ErrUnsupported
+}
+
+type prewarmResponse struct {
+	ShortCode string `json:"short_code"`
+	EdgeKey   string `json:"edge_key"`
+	edge.Entry
+}
+
+// prewarmHandler serves POST /api/links/{code}/prewarm.
+func prewarmHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, e, err := store.Prewarm(r.Context(), codeVar(r), ownerFrom(r.Context()))
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, prewarmResponse{ShortCode: codeVar(r), EdgeKey: key, Entry: *e})
+	}
+}
@@ -0,0 +1,141 @@
+// Package edge pushes redirect mappings to the key-value stores of edge
+// platforms (Cloudflare Workers KV, Fastly KV Store), where a small worker
+// answers redirects without a round trip to the origin.
+package edge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Entry is what the edge worker needs to answer a redirect. It is stored
+// as JSON under the short URL without its scheme, e.g. "sho.rt/promo".
+type Entry struct {
+	Location  string            `json:"location"`
+	Status    int               `json:"status"`
+	ExpiresAt time.Time         `json:"expires_at"`
+	Headers   map[string]string `json:"headers,omitempty"`
+}
+
+// Equal reports whether e and o answer a redirect the same way.
+func (e Entry) Equal(o Entry) bool {
+	if e.Location != o.Location || e.Status != o.Status || !e.ExpiresAt.Equal(o.ExpiresAt) || len(e.Headers) != len(o.Headers) {
+		return false
+	}
+	for k, v := range e.Headers {
+		if ov, ok := o.Headers[k]; !ok || ov != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Cache is an edge key-value store.
+type Cache interface {
+	// Put stores e under key until e.ExpiresAt.
+	Put(ctx context.Context, key string, e Entry) error
+	// Purge removes key; removing a missing key is not an error.
+	Purge(ctx context.Context, key string) error
+}
+
+// Cloudflare writes to a Workers KV namespace through the Cloudflare API.
+type Cloudflare struct {
+	AccountID   string
+	NamespaceID string
+	APIToken    string
+	Client      *http.Client
+	// BaseURL overrides https://api.cloudflare.com/client/v4.
+	BaseURL string
+}
+
+func (c *Cloudflare) valueURL(key string) string {
+	base := c.BaseURL
+	if base == "" {
+		base = "https://api.cloudflare.com/client/v4"
+	}
+	return base + "/accounts/" + url.PathEscape(c.AccountID) + "/storage/kv/namespaces/" +
+		url.PathEscape(c.NamespaceID) + "/values/" + url.PathEscape(key)
+}
+
+func (c *Cloudflare) Put(ctx context.Context, key string, e Entry) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	u := c.valueURL(key)
+	// KV refuses expirations less than 60 seconds ahead; the worker checks
+	// expires_at itself anyway.
+	if exp := e.ExpiresAt.Unix(); exp > time.Now().Add(time.Minute).Unix() {
+		u += "?expiration=" + strconv.FormatInt(exp, 10)
+	}
+	return do(ctx, c.Client, http.MethodPut, u, body, http.Header{"Authorization": {"Bearer " + c.APIToken}}, false)
+}
+
+func (c *Cloudflare) Purge(ctx context.Context, key string) error {
+	return do(ctx, c.Client, http.MethodDelete, c.valueURL(key), nil, http.Header{"Authorization": {"Bearer " + c.APIToken}}, true)
+}
+
+// Fastly writes to a Fastly KV Store through the Fastly API.
+type Fastly struct {
+	StoreID  string
+	APIToken string
+	Client   *http.Client
+	// BaseURL overrides https://api.fastly.com.
+	BaseURL string
+}
+
+func (f *Fastly) keyURL(key string) string {
+	base := f.BaseURL
+	if base == "" {
+		base = "https://api.fastly.com"
+	}
+	return base + "/resources/stores/kv/" + url.PathEscape(f.StoreID) + "/keys/" + url.PathEscape(key)
+}
+
+func (f *Fastly) Put(ctx context.Context, key string, e Entry) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return do(ctx, f.Client, http.MethodPut, f.keyURL(key), body, http.Header{"Fastly-Key": {f.APIToken}}, false)
+}
+
+func (f *Fastly) Purge(ctx context.Context, key string) error {
+	return do(ctx, f.Client, http.MethodDelete, f.keyURL(key), nil, http.Header{"Fastly-Key": {f.APIToken}}, true)
+}
+
+func do(ctx context.Context, client *http.Client, method, u string, body []byte, header http.Header, missingOK bool) error {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && missingOK {
+		return nil
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: status %d: %s", method, req.URL.Path, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"url-shortener/jsonpool"
+	"url-shortener/middleware"
+	"url-shortener/storage"
+)
+
+// Machine-readable error codes returned in the error envelope. Clients
+// should branch on these rather than on the human message.
+const (
+	ErrCodeInvalidRequest = "INVALID_REQUEST"
+	ErrCodeInvalidJSON    = "INVALID_JSON"
+	ErrCodeBodyTooLarge   = "BODY_TOO_LARGE"
+	ErrCodeInvalidURL     = "INVALID_URL"
+	ErrCodeCodeTaken      = "CODE_TAKEN"
+	ErrCodeLinkNotFound   = "LINK_NOT_FOUND"
+	ErrCodeLinkExpired    = "LINK_EXPIRED"
+	ErrCodeLinkConsumed   = "LINK_CONSUMED"
+	ErrCodeLinkDisabled   = "LINK_DISABLED"
+	ErrCodeNotFound       = "NOT_FOUND"
+	ErrCodeRateLimited    = "RATE_LIMITED"
+	ErrCodeQuotaExceeded  = "QUOTA_EXCEEDED"
+	ErrCodeUnauthorized   = "UNAUTHORIZED"
+	ErrCodeForbidden      = "FORBIDDEN"
+	ErrCodeConflict       = "CONFLICT"
+	ErrCodeRedirectLoop   = "REDIRECT_LOOP"
+
+	ErrCodeDomainNotAllowed = "DOMAIN_NOT_ALLOWED"
+	ErrCodeMisdirected      = "MISDIRECTED_REQUEST"
+
+	ErrCodeTenantSuspended = "TENANT_SUSPENDED"
+	ErrCodeInternal        = "INTERNAL_ERROR"
+	ErrCodeUnavailable     = "SERVICE_UNAVAILABLE"
+
+	ErrCodeIdempotencyMismatch = "IDEMPOTENCY_KEY_REUSED"
+	ErrCodeIdempotencyInFlight = "IDEMPOTENCY_IN_PROGRESS"
+)
+
+// Store errors; mapped to API errors by apiErrorFrom.
+var (
+	ErrInvalidURL = errors.New("invalid url")
+	ErrCodeExists = errors.New("custom code already exists")
+	ErrNotFound   = storage.ErrNotFound
+	ErrConsumed   = errors.New("short link has already been used")
+
+	ErrCodeSpaceExhausted = errors.New("could not find a free short code")
+	ErrCodeBlocked        = errors.New("custom code contains a blocked term")
+
+	ErrRedirectLoop = errors.New("destination redirects in a loop")
+)
+
+// FieldError points at a single offending request field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// APIError is the body of every non-2xx JSON response, wrapped as
+// {"error": {...}}.
+type APIError struct {
+	Status    int          `json:"-"`
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	RequestID string       `json:"request_id,omitempty"`
+	Fields    []FieldError `json:"fields,omitempty"`
+
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func (e *APIError) Error() string { return e.Message }
+
+func newAPIError(status int, code, msg string) *APIError {
+	return &APIError{Status: status, Code: code, Message: msg}
+}
+
+// fieldError builds a 400 for a single invalid field.
+func fieldError(field, msg string) *APIError {
+	e := newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, msg)
+	e.Fields = []FieldError{{Field: field, Message: msg}}
+	return e
+}
+
+// apiErrorFrom maps store errors to their API representation.
+func apiErrorFrom(err error) *APIError {
+	var apiErr *APIError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr
+	case errors.Is(err, ErrInvalidURL):
+		e := fieldError("url", "url must be an absolute URL")
+		e.Code = ErrCodeInvalidURL
+		return e
+	case errors.Is(err, ErrNotFound):
+		return newAPIError(http.StatusNotFound, ErrCodeLinkNotFound, err.Error())
+	case errors.Is(err, ErrConsumed):
+		return newAPIError(http.StatusGone, ErrCodeLinkConsumed, err.Error())
+	case errors.Is(err, ErrCampaignNotFound), errors.Is(err, ErrTenantNotFound),
+		errors.Is(err, ErrReportNotFound):
+		return newAPIError(http.StatusNotFound, ErrCodeNotFound, err.Error())
+	case errors.Is(err, ErrCodeExists):
+		e := newAPIError(http.StatusConflict, ErrCodeCodeTaken, err.Error())
+		e.Fields = []FieldError{{Field: "custom_code", Message: err.Error()}}
+		return e
+	case errors.Is(err, ErrCodeBlocked):
+		return fieldError("custom_code", err.Error())
+	case errors.Is(err, ErrRedirectLoop):
+		e := fieldError("url", err.Error())
+		e.Code = ErrCodeRedirectLoop
+		return e
+	case errors.Is(err, ErrCodeSpaceExhausted):
+		return newAPIError(http.StatusServiceUnavailable, ErrCodeUnavailable, err.Error())
+	default:
+		return newAPIError(http.StatusInternalServerError, ErrCodeInternal, "internal error")
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, r *http.Request, e *APIError) {
+	if len(e.Fields) > 0 || len(e.Details) > 0 {
+		body := *e
+		body.RequestID = middleware.GetRequestID(r.Context())
+		writeJSON(w, e.Status, map[string]*APIError{"error": &body})
+		return
+	}
+	// Plain errors, the bulk of them on the redirect path, are spliced
+	// from a cached encoding of their code and message instead.
+	buf := jsonpool.Get()
+	defer buf.Release()
+	b := append(buf.AvailableBuffer(), errorPrefix(e.Code, e.Message)...)
+	if id := middleware.GetRequestID(r.Context()); id != "" {
+		b = append(b, `,"request_id":`...)
+		b = jsonpool.AppendString(b, id)
+	}
+	b = append(b, "}}\n"...)
+	buf.Write(b)
+	jsonpool.WriteBytes(w, e.Status, buf.Bytes())
+}
+
+// maxErrorPrefixes bounds the cache of encoded error heads; messages
+// built from input would otherwise grow it without limit.
+const maxErrorPrefixes = 512
+
+var (
+	errorPrefixes    sync.Map // code + "\x00" + message → []byte
+	errorPrefixCount atomic.Int64
+)
+
+// errorPrefix returns `{"error":{"code":…,"message":…` for code and msg.
+func errorPrefix(code, msg string) []byte {
+	key := code + "\x00" + msg
+	if p, ok := errorPrefixes.Load(key); ok {
+		return p.([]byte)
+	}
+	p := append([]byte(`{"error":{"code":`), jsonpool.AppendString(nil, code)...)
+	p = append(p, `,"message":`...)
+	p = jsonpool.AppendString(p, msg)
+	if errorPrefixCount.Load() < maxErrorPrefixes {
+		if _, loaded := errorPrefixes.LoadOrStore(key, p); !loaded {
+			errorPrefixCount.Add(1)
+		}
+	}
+	return p
+}
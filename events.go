@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/storage"
+)
+
+// ClickEvent is pushed to stream subscribers for every counted click.
+type ClickEvent struct {
+	ShortCode string    `json:"short_code"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Clicks    int64     `json:"clicks"`
+	At        time.Time `json:"at"`
+}
+
+// clickBufferSize is how many events a slow subscriber may fall behind
+// before further events for it are dropped.
+const clickBufferSize = 64
+
+type clickSub struct {
+	ch      chan ClickEvent
+	dropped atomic.Int64
+}
+
+// ClickBus fans click events out to stream subscribers. Publishing never
+// blocks: a subscriber whose buffer is full misses events and is told how
+// many on its next delivery. With a Redis client set, events travel over
+// pub/sub so a dashboard sees clicks served by any instance.
+type ClickBus struct {
+	mu   sync.Mutex
+	subs map[string]map[*clickSub]struct{}
+
+	client  *redis.Client
+	channel string
+}
+
+func NewClickBus() *ClickBus {
+	return &ClickBus{subs: make(map[string]map[*clickSub]struct{})}
+}
+
+// Subscribe registers for events on the link stored under key; call the
+// returned func to stop.
+func (b *ClickBus) Subscribe(key string) (*clickSub, func()) {
+	sub := &clickSub{ch: make(chan ClickEvent, clickBufferSize)}
+	b.mu.Lock()
+	if b.subs[key] == nil {
+		b.subs[key] = make(map[*clickSub]struct{})
+	}
+	b.subs[key][sub] = struct{}{}
+	b.mu.Unlock()
+	return sub, func() {
+		b.mu.Lock()
+		delete(b.subs[key], sub)
+		if len(b.subs[key]) == 0 {
+			delete(b.subs, key)
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (b *ClickBus) Publish(ctx context.Context, ev ClickEvent) {
+	if b.client == nil {
+		b.deliver(ev)
+		return
+	}
+	raw, err := json.Marshal(ev)
+	if err == nil {
+		err = b.client.Publish(ctx, b.channel, raw).Err()
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("short_code", ev.ShortCode).Warn("publishing click event failed")
+	}
+}
+
+func (b *ClickBus) deliver(ev ClickEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs[storage.Key(ev.Tenant, ev.ShortCode)] {
+		select {
+		case sub.ch <- ev:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// UseRedis switches the bus to Redis pub/sub on channel and relays
+// received events to local subscribers until ctx is cancelled.
+func (b *ClickBus) UseRedis(ctx context.Context, client *redis.Client, channel string) {
+	b.client, b.channel = client, channel
+	ps := client.Subscribe(ctx, channel)
+	go func() {
+		defer ps.Close()
+		for msg := range ps.Channel() {
+			var ev ClickEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil {
+				continue
+			}
+			b.deliver(ev)
+		}
+	}()
+}
+
+const streamHeartbeat = 15 * time.Second
+
+// clickStreamHandler serves GET /api/stats/{code}/stream as Server-Sent
+// Events: a "stats" event with the current total, then a "click" event per
+// click. "dropped" events report clicks skipped because the client was
+// reading too slowly; their totals are caught up by the next click event.
+func clickStreamHandler(store *Store, bus *ClickBus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		code := codeVar(r)
+		link, err := store.Stats(r.Context(), code)
+		if err == nil && !canManage(ownerFrom(r.Context()), link) {
+			err = ErrNotFound
+		}
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		rc := http.NewResponseController(w)
+		// Streams outlive the server's WriteTimeout.
+		_ = rc.SetWriteDeadline(time.Time{})
+
+		sub, unsubscribe := bus.Subscribe(link.Key())
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		send := func(event string, v interface{}) bool {
+			raw, _ := json.Marshal(v)
+			if _, err := w.Write([]byte("event: " + event + "\ndata: " + string(raw) + "\n\n")); err != nil {
+				return false
+			}
+			return rc.Flush() == nil
+		}
+		if !send("stats", ClickEvent{ShortCode: code, Tenant: link.Tenant, Clicks: link.Clicks, At: store.now()}) {
+			return
+		}
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case ev := <-sub.ch:
+				if n := sub.dropped.Swap(0); n > 0 && !send("dropped", map[string]int64{"dropped": n}) {
+					return
+				}
+				if !send("click", ev) {
+					return
+				}
+			case <-heartbeat.C:
+				if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil || rc.Flush() != nil {
+					return
+				}
+			}
+		}
+	}
+}
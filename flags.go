@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Feature flags gate behaviours that are rolled out gradually.
+const (
+	// FlagAnalytics records counted clicks in the time series, the export
+	// archive and the event stream. Click totals are kept regardless.
+	FlagAnalytics = "analytics"
+	// FlagDedupe answers a plain shorten request for a URL the caller has
+	// already shortened with the existing link instead of a new one.
+	FlagDedupe = "dedupe"
+	// FlagMilestones sends click milestone alerts.
+	FlagMilestones = "click_milestones"
+)
+
+// defaultFlags is the state of every known flag before configuration.
+var defaultFlags = map[string]FlagRule{
+	FlagAnalytics:  {Enabled: true, Percent: 100},
+	FlagDedupe:     {Enabled: false},
+	FlagMilestones: {Enabled: true, Percent: 100},
+}
+
+// FlagRule is one flag's setting. An enabled flag applies to Percent of
+// owners, picked by a stable hash, plus every owner in Owners.
+type FlagRule struct {
+	Enabled bool     `json:"enabled"`
+	Percent int      `json:"percent"`
+	Owners  []string `json:"owners,omitempty"`
+}
+
+// on reports whether the rule applies to subject (an owner).
+func (r FlagRule) on(name, subject string) bool {
+	if !r.Enabled {
+		return false
+	}
+	for _, o := range r.Owners {
+		if o == subject {
+			return true
+		}
+	}
+	if r.Percent >= 100 {
+		return true
+	}
+	if r.Percent <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name + ":" + subject))
+	return int(h.Sum32()%100) < r.Percent
+}
+
+// FlagsConfig is where flags are read from. File takes precedence over
+// Spec and is re-read on POST /api/admin/flags/reload and on every config
+// reload.
+type FlagsConfig struct {
+	// Spec is FEATURE_FLAGS, e.g. "dedupe=on,analytics=off,click_milestones=25%".
+	Spec string
+	// File is FEATURE_FLAGS_FILE, a JSON object of flag name to FlagRule.
+	File string
+}
+
+// Flags holds the live flag set. Admin overrides are kept across reloads
+// until removed, and only affect this instance.
+type Flags struct {
+	cfg FlagsConfig
+
+	mu        sync.RWMutex
+	rules     map[string]FlagRule
+	overrides map[string]FlagRule
+}
+
+func NewFlags(cfg FlagsConfig) (*Flags, error) {
+	f := &Flags{overrides: make(map[string]FlagRule)}
+	if err := f.Configure(cfg); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload rebuilds the flag set from the defaults, FEATURE_FLAGS and the
+// flags file. On error the previous set stays in force.
+func (f *Flags) Reload() error {
+	f.mu.RLock()
+	cfg := f.cfg
+	f.mu.RUnlock()
+	return f.Configure(cfg)
+}
+
+// Configure switches to cfg and reloads from it.
+func (f *Flags) Configure(cfg FlagsConfig) error {
+	rules, err := loadFlags(cfg)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.cfg = cfg
+	f.rules = rules
+	f.mu.Unlock()
+	logrus.WithFields(logrus.Fields{
+		"action": "reload_flags",
+		"flags":  len(rules),
+	}).Info("feature flags loaded")
+	return nil
+}
+
+func loadFlags(cfg FlagsConfig) (map[string]FlagRule, error) {
+	rules := make(map[string]FlagRule, len(defaultFlags))
+	for k, v := range defaultFlags {
+		rules[k] = v
+	}
+	if err := parseFlagSpec(cfg.Spec, rules); err != nil {
+		return nil, fmt.Errorf("FEATURE_FLAGS: %w", err)
+	}
+	if cfg.File != "" {
+		raw, err := os.ReadFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		var file map[string]FlagRule
+		if err := json.Unmarshal(raw, &file); err != nil {
+			return nil, fmt.Errorf("%s: %w", cfg.File, err)
+		}
+		for name, r := range file {
+			if err := validateFlag(name, r); err != nil {
+				return nil, fmt.Errorf("%s: %w", cfg.File, err)
+			}
+			rules[name] = r
+		}
+	}
+	return rules, nil
+}
+
+// parseFlagSpec applies FEATURE_FLAGS entries (name=on|off|N%) to rules.
+func parseFlagSpec(spec string, rules map[string]FlagRule) error {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, v, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("%q must be name=on, name=off or name=N%%", entry)
+		}
+		var r FlagRule
+		switch v {
+		case "on", "true":
+			r = FlagRule{Enabled: true, Percent: 100}
+		case "off", "false":
+		default:
+			n, err := strconv.Atoi(strings.TrimSuffix(v, "%"))
+			if err != nil || !strings.HasSuffix(v, "%") {
+				return fmt.Errorf("%q must be name=on, name=off or name=N%%", entry)
+			}
+			r = FlagRule{Enabled: true, Percent: n}
+		}
+		if err := validateFlag(name, r); err != nil {
+			return err
+		}
+		rules[name] = r
+	}
+	return nil
+}
+
+func validateFlag(name string, r FlagRule) error {
+	if _, known := defaultFlags[name]; !known {
+		return fmt.Errorf("unknown feature flag %q", name)
+	}
+	if r.Percent < 0 || r.Percent > 100 {
+		return fmt.Errorf("flag %q: percent must be between 0 and 100", name)
+	}
+	return nil
+}
+
+// Enabled reports whether flag name is on for subject. A nil Flags uses
+// the defaults.
+func (f *Flags) Enabled(name, subject string) bool {
+	if f == nil {
+		return defaultFlags[name].on(name, subject)
+	}
+	f.mu.RLock()
+	r, ok := f.overrides[name]
+	if !ok {
+		r = f.rules[name]
+	}
+	f.mu.RUnlock()
+	return r.on(name, subject)
+}
+
+// flagState is one flag in the admin listing.
+type flagState struct {
+	FlagRule
+	Overridden bool `json:"overridden,omitempty"`
+}
+
+// Snapshot returns the effective rule of every flag.
+func (f *Flags) Snapshot() map[string]flagState {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	out := make(map[string]flagState, len(f.rules))
+	for name, r := range f.rules {
+		if o, ok := f.overrides[name]; ok {
+			out[name] = flagState{FlagRule: o, Overridden: true}
+			continue
+		}
+		out[name] = flagState{FlagRule: r}
+	}
+	return out
+}
+
+// Names returns the flags that are on for at least some owners.
+func (f *Flags) Names() []string {
+	out := []string{}
+	for name, st := range f.Snapshot() {
+		if st.Enabled && (st.Percent > 0 || len(st.Owners) > 0) {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Override pins a flag on this instance; a nil rule removes the pin.
+func (f *Flags) Override(name string, r *FlagRule) error {
+	if r == nil {
+		if _, known := defaultFlags[name]; !known {
+			return fmt.Errorf("unknown feature flag %q", name)
+		}
+	} else if err := validateFlag(name, *r); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	if r == nil {
+		delete(f.overrides, name)
+	} else {
+		f.overrides[name] = *r
+	}
+	f.mu.Unlock()
+	logrus.WithFields(logrus.Fields{
+		"action":  "override_flag",
+		"flag":    name,
+		"removed": r == nil,
+	}).Warn("feature flag overridden")
+	return nil
+}
+
+// flagsHandler serves GET /api/admin/flags.
+func flagsHandler(flags *Flags) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"flags": flags.Snapshot()})
+	}
+}
+
+// reloadFlagsHandler serves POST /api/admin/flags/reload.
+func reloadFlagsHandler(flags *Flags) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := flags.Reload(); err != nil {
+			writeAPIError(w, r, newAPIError(http.StatusUnprocessableEntity, ErrCodeInvalidRequest, err.Error()))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"flags": flags.Snapshot()})
+	}
+}
+
+// overrideFlagHandler serves PUT and DELETE /api/admin/flags/{name}: PUT
+// takes a FlagRule and pins it on this instance, DELETE unpins it.
+func overrideFlagHandler(flags *Flags) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		var rule *FlagRule
+		if r.Method == http.MethodPut {
+			rule = &FlagRule{}
+			if apiErr := decodeJSON(r, rule); apiErr != nil {
+				writeAPIError(w, r, apiErr)
+				return
+			}
+		}
+		if err := flags.Override(name, rule); err != nil {
+			if _, known := defaultFlags[name]; !known {
+				httpError(w, r, http.StatusNotFound, ErrCodeNotFound, err.Error())
+				return
+			}
+			writeAPIError(w, r, fieldError("percent", err.Error()))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"flags": flags.Snapshot()})
+	}
+}
+
+var errNoDuplicate = errors.New("no duplicate link")
+
+// findDuplicate returns owner's newest live link to longURL that a plain
+// shorten request would produce again, for FlagDedupe.
+func (s *Store) findDuplicate(ctx context.Context, owner, longURL string) (*Link, error) {
+	links, err := s.Lookup(ctx, owner, longURL)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range links {
+		if l.Owner != owner || l.Draft || l.TakenDownAt != nil {
+			continue
+		}
+		if l.SlidingTTL || l.BurnAfterRead || l.Passthrough || l.Signed || l.Privacy ||
+			l.CampaignID != "" || l.FallbackURL != "" || l.Notes != "" || len(l.Metadata) > 0 || len(l.Milestones) > 0 ||
+			len(l.Destinations) > 0 || len(l.AllowedIPs) > 0 || l.Schedule != nil || l.Public || len(l.Headers) > 0 || l.NoIndex ||
+			l.Card != nil || l.Interstitial != nil || l.ClientHints {
+			continue
+		}
+		return l, nil
+	}
+	return nil, errNoDuplicate
+}
+
+// plainRequest reports whether req asks for nothing beyond a destination
+// and a lifetime, so an existing plain link is an equivalent answer.
+func plainRequest(req ShortenRequest) bool {
+	return req.CustomCode == "" && !req.Draft && !req.SlidingTTL && req.CampaignID == "" &&
+		!req.BurnAfterRead && !req.Passthrough && !req.Signed && len(req.Claims) == 0 &&
+		req.FallbackURL == "" && req.Notes == "" && len(req.Metadata) == 0 && !req.Privacy &&
+		len(req.Milestones) == 0 && len(req.Destinations) == 0 && len(req.AllowedIPs) == 0 && req.Schedule == nil && !req.Public && len(req.Headers) == 0 && !req.NoIndex &&
+		req.Card == nil && req.Interstitial == nil && !req.ClientHints &&
+		(req.Style == "" || req.Style == StyleRandom)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// FolderSeparator splits a vanity code like hr/leave-policy into its
+// folder and name. Folder codes are ordinary codes that happen to contain
+// one separator; they are not passthrough links.
+const FolderSeparator = "/"
+
+// validateFolderCode rejects custom codes with more than one folder level
+// or with empty or dot segments, none of which survive URL routing.
+func validateFolderCode(code string) *APIError {
+	if !strings.Contains(code, FolderSeparator) {
+		return nil
+	}
+	parts := strings.Split(code, FolderSeparator)
+	if len(parts) != 2 {
+		return fieldError("custom_code", "custom_code may contain at most one "+FolderSeparator)
+	}
+	for _, p := range parts {
+		if p == "" || p == "." || p == ".." {
+			return fieldError("custom_code", "custom_code folder and name must not be empty or dot segments")
+		}
+	}
+	return nil
+}
+
+// folderOf returns the folder of a code, or "" for a top-level code.
+func folderOf(code string) string {
+	folder, _, ok := strings.Cut(code, FolderSeparator)
+	if !ok {
+		return ""
+	}
+	return folder
+}
+
+// codeVar returns the {code} route variable. The API router matches on
+// the escaped path so folder codes can be addressed as hr%2Fleave-policy.
+func codeVar(r *http.Request) string {
+	return pathVar(r, "code")
+}
+
+// pathVar returns the unescaped route variable name.
+func pathVar(r *http.Request, name string) string {
+	raw := mux.Vars(r)[name]
+	if v, err := url.PathUnescape(raw); err == nil {
+		return v
+	}
+	return raw
+}
+
+// resolveDeepPath splits the path of a multi-segment redirect request into
+// the code to serve and the rest: a folder code that exists wins over a
+// passthrough link named after its folder.
+func (s *Store) resolveDeepPath(ctx context.Context, first, rest string) (code, remainder string) {
+	second, after, _ := strings.Cut(rest, "/")
+	if second != "" {
+		candidate := first + FolderSeparator + second
+		if l, err := s.Get(ctx, candidate); err == nil && !l.Deleted() {
+			return candidate, after
+		}
+	}
+	return first, rest
+}
+
+// Folder summarises the links sharing a folder. Role is set for folders
+// shared with the caller: read, write, or owner for the one sharing it.
+type Folder struct {
+	Name  string `json:"name"`
+	Links int    `json:"links"`
+	Role  string `json:"role,omitempty"`
+}
+
+// Folder roles. Readers see every link in the folder, with its stats;
+// writers may also change and delete them. Links keep their own owner.
+const (
+	FolderRead  = "read"
+	FolderWrite = "write"
+	FolderOwner = "owner"
+)
+
+var ErrFolderNotShared = errors.New("folder is not shared")
+
+// FolderACL shares a folder of a tenant with other users of it. Owner,
+// who shared it first, manages Members, which map users to their roles.
+type FolderACL struct {
+	Tenant    string            `json:"tenant,omitempty"`
+	Name      string            `json:"name"`
+	Owner     string            `json:"owner"`
+	Members   map[string]string `json:"members"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// role returns user's role on the folder, or "".
+func (a *FolderACL) role(user string) string {
+	if user == a.Owner {
+		return FolderOwner
+	}
+	return a.Members[user]
+}
+
+// FolderStore keeps folder sharing.
+type FolderStore interface {
+	// Get returns a folder's sharing or ErrFolderNotShared.
+	Get(ctx context.Context, tenant, name string) (*FolderACL, error)
+	Save(ctx context.Context, acl *FolderACL) error
+	// Shared maps the folders of tenant shared with user, or owned by
+	// them, to user's role.
+	Shared(ctx context.Context, tenant, user string) (map[string]string, error)
+}
+
+type memoryFolders struct {
+	mu   sync.RWMutex
+	acls map[string]*FolderACL
+}
+
+func newMemoryFolders() *memoryFolders {
+	return &memoryFolders{acls: make(map[string]*FolderACL)}
+}
+
+func folderKey(tenant, name string) string { return tenant + FolderSeparator + name }
+
+func (m *memoryFolders) Get(_ context.Context, tenant, name string) (*FolderACL, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	acl, ok := m.acls[folderKey(tenant, name)]
+	if !ok {
+		return nil, ErrFolderNotShared
+	}
+	return acl.clone(), nil
+}
+
+func (m *memoryFolders) Save(_ context.Context, acl *FolderACL) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.acls[folderKey(acl.Tenant, acl.Name)] = acl.clone()
+	return nil
+}
+
+func (m *memoryFolders) Shared(_ context.Context, tenant, user string) (map[string]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := map[string]string{}
+	for _, acl := range m.acls {
+		if acl.Tenant == tenant {
+			if role := acl.role(user); role != "" {
+				out[acl.Name] = role
+			}
+		}
+	}
+	return out, nil
+}
+
+func (a *FolderACL) clone() *FolderACL {
+	c := *a
+	c.Members = make(map[string]string, len(a.Members))
+	for k, v := range a.Members {
+		c.Members[k] = v
+	}
+	return &c
+}
+
+// redisFolders keeps each tenant's folder sharing in one hash, keyed by
+// folder name.
+type redisFolders struct {
+	client *redis.Client
+	prefix string
+}
+
+func (r *redisFolders) key(tenant string) string { return r.prefix + "folders:" + tenant }
+
+func (r *redisFolders) Get(ctx context.Context, tenant, name string) (*FolderACL, error) {
+	b, err := r.client.HGet(ctx, r.key(tenant), name).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrFolderNotShared
+	}
+	if err != nil {
+		return nil, err
+	}
+	var acl FolderACL
+	if err := json.Unmarshal(b, &acl); err != nil {
+		return nil, err
+	}
+	return &acl, nil
+}
+
+func (r *redisFolders) Save(ctx context.Context, acl *FolderACL) error {
+	b, err := json.Marshal(acl)
+	if err != nil {
+		return err
+	}
+	return r.client.HSet(ctx, r.key(acl.Tenant), acl.Name, b).Err()
+}
+
+func (r *redisFolders) Shared(ctx context.Context, tenant, user string) (map[string]string, error) {
+	all, err := r.client.HGetAll(ctx, r.key(tenant)).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]string{}
+	for _, v := range all {
+		var acl FolderACL
+		if err := json.Unmarshal([]byte(v), &acl); err != nil {
+			continue
+		}
+		if role := acl.role(user); role != "" {
+			out[acl.Name] = role
+		}
+	}
+	return out, nil
+}
+
+// folderRole returns the role owner holds on the folder of l, or "".
+// Lookup failures grant nothing.
+func (s *Store) folderRole(ctx context.Context, owner string, l *Link) string {
+	folder := folderOf(l.ShortCode)
+	if folder == "" || owner == "" {
+		return ""
+	}
+	acl, err := s.folders.Get(ctx, l.Tenant, folder)
+	if err != nil {
+		if !errors.Is(err, ErrFolderNotShared) {
+			logrus.WithError(err).WithField("folder", folder).Warn("folder sharing lookup failed")
+		}
+		return ""
+	}
+	return acl.role(owner)
+}
+
+// canRead reports whether owner may see l and its stats: it is theirs or
+// in a folder shared with them.
+func (s *Store) canRead(ctx context.Context, owner string, l *Link) bool {
+	return canManage(owner, l) || s.folderRole(ctx, owner, l) != ""
+}
+
+// canWrite reports whether owner may change l: it is theirs or in a
+// folder they may write to.
+func (s *Store) canWrite(ctx context.Context, owner string, l *Link) bool {
+	if canManage(owner, l) {
+		return true
+	}
+	role := s.folderRole(ctx, owner, l)
+	return role == FolderWrite || role == FolderOwner
+}
+
+// visibleTo returns a test for the links of the request's tenant that
+// owner may read, all of them when owner is "". It looks up the folders
+// shared with owner once, for use while scanning.
+func (s *Store) visibleTo(ctx context.Context, owner string) (func(*Link) bool, error) {
+	tenant := tenantFrom(ctx)
+	shared := map[string]string{}
+	if owner != "" {
+		var err error
+		if shared, err = s.folders.Shared(ctx, tenant, owner); err != nil {
+			return nil, err
+		}
+	}
+	return func(l *Link) bool {
+		if l.Tenant != tenant || l.Reserved {
+			return false
+		}
+		return owner == "" || l.Owner == owner || shared[folderOf(l.ShortCode)] != ""
+	}, nil
+}
+
+// foldersHandler serves GET /api/folders, the caller's folders and those
+// shared with them, with link counts; GET /api/links?folder=name lists
+// one of them.
+func foldersHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner := ownerFrom(r.Context())
+		links, err := store.List(r.Context(), owner, ListFilter{})
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		shared := map[string]string{}
+		if owner != "" {
+			if shared, err = store.folders.Shared(r.Context(), tenantFrom(r.Context()), owner); err != nil {
+				writeAPIError(w, r, apiErrorFrom(err))
+				return
+			}
+		}
+		counts := map[string]int{}
+		for name := range shared {
+			counts[name] = 0
+		}
+		for _, l := range links {
+			if f := folderOf(l.ShortCode); f != "" {
+				counts[f]++
+			}
+		}
+		out := make([]Folder, 0, len(counts))
+		for name, n := range counts {
+			out = append(out, Folder{Name: name, Links: n, Role: shared[name]})
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+		writeCachedJSON(w, r, map[string]interface{}{"folders": out}, latestUpdate(links))
+	}
+}
+
+// folderMembersHandler serves GET /api/folders/{name}/members, the
+// sharing of a folder, to anyone it is shared with.
+func folderMembersHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		acl, err := store.folders.Get(r.Context(), tenantFrom(r.Context()), pathVar(r, "name"))
+		owner := ownerFrom(r.Context())
+		if err == nil && owner != "" && acl.role(owner) == "" {
+			err = ErrFolderNotShared
+		}
+		if errors.Is(err, ErrFolderNotShared) {
+			httpError(w, r, http.StatusNotFound, ErrCodeNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, acl)
+	}
+}
+
+// setFolderMemberHandler serves PUT /api/folders/{name}/members/{member}
+// with {"role": "read"} or {"role": "write"}, and DELETE on the same path
+// when remove is set. Only the folder's owner may change its members;
+// the first to share a folder, who must own a link in it, becomes that
+// owner. Members must belong to the folder's tenant.
+func setFolderMemberHandler(store *Store, remove bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Role string `json:"role"`
+		}
+		if !remove {
+			if apiErr := decodeJSON(r, &req); apiErr != nil {
+				writeAPIError(w, r, apiErr)
+				return
+			}
+			if req.Role != FolderRead && req.Role != FolderWrite {
+				writeAPIError(w, r, fieldError("role", "role must be read or write"))
+				return
+			}
+		}
+		ctx := r.Context()
+		owner, tenant := ownerFrom(ctx), tenantFrom(ctx)
+		name, member := pathVar(r, "name"), pathVar(r, "member")
+		if member == "" || member == owner || tenantOf(member) != tenant {
+			writeAPIError(w, r, fieldError("member", "member must be another user of this tenant"))
+			return
+		}
+		acl, err := store.folders.Get(ctx, tenant, name)
+		switch {
+		case errors.Is(err, ErrFolderNotShared):
+			links, err := store.List(ctx, owner, ListFilter{Folder: name})
+			if err != nil {
+				writeAPIError(w, r, apiErrorFrom(err))
+				return
+			}
+			if len(links) == 0 {
+				httpError(w, r, http.StatusNotFound, ErrCodeNotFound, "you have no links in this folder")
+				return
+			}
+			acl = &FolderACL{Tenant: tenant, Name: name, Owner: owner, Members: map[string]string{}}
+		case err != nil:
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		case owner != "" && acl.Owner != owner:
+			httpError(w, r, http.StatusForbidden, ErrCodeForbidden, "only the folder's owner can change its members")
+			return
+		}
+		if remove {
+			delete(acl.Members, member)
+		} else {
+			acl.Members[member] = req.Role
+		}
+		acl.UpdatedAt = store.now()
+		if err := store.folders.Save(ctx, acl); err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"action": "folder_share",
+			"folder": name,
+			"member": member,
+			"role":   req.Role,
+			"by":     owner,
+		}).Info("folder sharing changed")
+		writeJSON(w, http.StatusOK, acl)
+	}
+}
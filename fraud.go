@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Anomaly kinds.
+const (
+	AnomalySpike       = "spike"        // far more clicks in a minute than the hour before
+	AnomalyIPFlood     = "ip_flood"     // one client address clicking over and over
+	AnomalyGeoVelocity = "geo_velocity" // one client seen in two countries too quickly
+)
+
+// FraudConfig tunes the click fraud heuristics.
+type FraudConfig struct {
+	Enabled bool // FRAUD_DETECTION
+
+	IPMaxClicks int           // FRAUD_IP_MAX_CLICKS from one address within IPWindow
+	IPWindow    time.Duration // FRAUD_IP_WINDOW
+
+	// A minute with more than SpikeMin clicks (FRAUD_SPIKE_MIN) and
+	// SpikeFactor times the previous hour's average (FRAUD_SPIKE_FACTOR)
+	// is a spike; clicks past that point are suspicious.
+	SpikeMin    int
+	SpikeFactor float64
+
+	// GeoWindow is FRAUD_GEO_WINDOW: the same browser, by User-Agent and
+	// Accept-Language, in two countries within it is not a person
+	// travelling. GeoIP data has no coordinates, so this works at country
+	// level.
+	GeoWindow time.Duration
+}
+
+// Anomaly is one detected pattern on a link. Clicks that keep matching it
+// extend it rather than opening a new one.
+type Anomaly struct {
+	Kind   string    `json:"kind"`
+	Detail string    `json:"detail"`
+	Start  time.Time `json:"start"`
+	Last   time.Time `json:"last"`
+	Clicks int64     `json:"suspicious_clicks"`
+}
+
+const (
+	maxAnomaliesPerLink = 100
+	spikeHistory        = 60 // minutes the spike baseline averages over
+	maxTrackedLinks     = 10000
+)
+
+// FraudDetector watches the clicks this instance serves. Its state is in
+// memory and per instance, like the links themselves.
+type FraudDetector struct {
+	cfg FraudConfig
+
+	mu    sync.Mutex
+	links map[string]*linkActivity
+}
+
+type linkActivity struct {
+	lastSeen time.Time
+	// minutes is a ring of per-minute click counts; minuteOf says which
+	// minute (Unix minutes) each slot currently holds.
+	minutes   [spikeHistory + 1]int
+	minuteOf  [spikeHistory + 1]int64
+	clients   map[uint64]*clientWindow
+	browsers  map[uint64]*sighting
+	open      map[string]*Anomaly // ongoing anomalies by kind and subject
+	anomalies []*Anomaly          // oldest first
+}
+
+type clientWindow struct {
+	start time.Time
+	count int
+}
+
+type sighting struct {
+	country string
+	at      time.Time
+}
+
+func NewFraudDetector(cfg FraudConfig) *FraudDetector {
+	return &FraudDetector{cfg: cfg, links: make(map[string]*linkActivity)}
+}
+
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// Observe records a click on the link stored under key and returns the
+// kind of anomaly it is part of, or "", and whether that anomaly starts
+// with it. Bot clicks are already set apart and are not judged. A nil
+// detector flags nothing.
+func (d *FraudDetector) Observe(key string, rec *ClickRecord) (kind string, opened bool) {
+	if d == nil || rec.Bot {
+		return "", false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := rec.At
+	a := d.activity(key, now)
+
+	subject, detail := "", ""
+	if burst := a.countMinute(now); d.spiking(a, burst, now) {
+		kind, detail = AnomalySpike, fmt.Sprintf("%d clicks in one minute", burst)
+	}
+	if rec.ClientIP != "" {
+		id := hash64(rec.ClientIP)
+		c := a.clients[id]
+		if c == nil || now.Sub(c.start) > d.cfg.IPWindow {
+			c = &clientWindow{start: now}
+			a.clients[id] = c
+		}
+		c.count++
+		if d.cfg.IPMaxClicks > 0 && c.count > d.cfg.IPMaxClicks {
+			kind, subject = AnomalyIPFlood, fmt.Sprint(id)
+			detail = fmt.Sprintf("more than %d clicks from one address within %s", d.cfg.IPMaxClicks, d.cfg.IPWindow)
+		}
+	}
+	if rec.Geo != nil && rec.Geo.Country != "" && rec.fingerprint != "" {
+		id := hash64(rec.fingerprint)
+		prev := a.browsers[id]
+		if prev != nil && prev.country != rec.Geo.Country && now.Sub(prev.at) < d.cfg.GeoWindow {
+			kind, subject = AnomalyGeoVelocity, fmt.Sprint(id)
+			detail = fmt.Sprintf("one browser clicked from %s and %s within %s",
+				prev.country, rec.Geo.Country, now.Sub(prev.at).Round(time.Second))
+		}
+		a.browsers[id] = &sighting{country: rec.Geo.Country, at: now}
+	}
+	if kind == "" {
+		return "", false
+	}
+	return kind, a.record(kind, subject, detail, now, d.window(kind))
+}
+
+// activity returns key's state, creating it and, when too many links are
+// tracked, dropping those idle for an hour.
+func (d *FraudDetector) activity(key string, now time.Time) *linkActivity {
+	a := d.links[key]
+	if a == nil {
+		if len(d.links) >= maxTrackedLinks {
+			for k, old := range d.links {
+				if now.Sub(old.lastSeen) > time.Hour {
+					delete(d.links, k)
+				}
+			}
+		}
+		a = &linkActivity{
+			clients:  make(map[uint64]*clientWindow),
+			browsers: make(map[uint64]*sighting),
+			open:     make(map[string]*Anomaly),
+		}
+		d.links[key] = a
+	}
+	if len(a.clients) > maxTrackedLinks || len(a.browsers) > maxTrackedLinks {
+		a.prune(now, d.cfg.IPWindow, d.cfg.GeoWindow)
+	}
+	a.lastSeen = now
+	return a
+}
+
+func (a *linkActivity) prune(now time.Time, ipWindow, geoWindow time.Duration) {
+	for id, c := range a.clients {
+		if now.Sub(c.start) > ipWindow {
+			delete(a.clients, id)
+		}
+	}
+	for id, s := range a.browsers {
+		if now.Sub(s.at) > geoWindow {
+			delete(a.browsers, id)
+		}
+	}
+}
+
+// countMinute adds a click to now's minute and returns its count.
+func (a *linkActivity) countMinute(now time.Time) int {
+	m := now.Unix() / 60
+	i := m % int64(len(a.minutes))
+	if a.minuteOf[i] != m {
+		a.minuteOf[i], a.minutes[i] = m, 0
+	}
+	a.minutes[i]++
+	return a.minutes[i]
+}
+
+func (d *FraudDetector) spiking(a *linkActivity, burst int, now time.Time) bool {
+	if d.cfg.SpikeMin <= 0 || burst <= d.cfg.SpikeMin {
+		return false
+	}
+	m := now.Unix() / 60
+	var before int
+	for i, of := range a.minuteOf {
+		if of != m && m-of <= spikeHistory {
+			before += a.minutes[i]
+		}
+	}
+	avg := float64(before) / spikeHistory
+	if avg < 1 {
+		avg = 1
+	}
+	return float64(burst) > d.cfg.SpikeFactor*avg
+}
+
+// window is how long an anomaly of kind stays open between clicks.
+func (d *FraudDetector) window(kind string) time.Duration {
+	switch kind {
+	case AnomalyIPFlood:
+		return d.cfg.IPWindow
+	case AnomalyGeoVelocity:
+		return d.cfg.GeoWindow
+	}
+	return 2 * time.Minute
+}
+
+// record attributes a click to the open anomaly of kind and subject, or
+// opens one, reporting true.
+func (a *linkActivity) record(kind, subject, detail string, now time.Time, window time.Duration) bool {
+	id := kind + ":" + subject
+	if an := a.open[id]; an != nil && now.Sub(an.Last) <= window {
+		an.Last, an.Detail = now, detail
+		an.Clicks++
+		return false
+	}
+	an := &Anomaly{Kind: kind, Detail: detail, Start: now, Last: now, Clicks: 1}
+	a.open[id] = an
+	a.anomalies = append(a.anomalies, an)
+	if len(a.anomalies) > maxAnomaliesPerLink {
+		a.anomalies = a.anomalies[len(a.anomalies)-maxAnomaliesPerLink:]
+	}
+	for k, o := range a.open {
+		if now.Sub(o.Last) > time.Hour {
+			delete(a.open, k)
+		}
+	}
+	return true
+}
+
+// Anomalies returns what was detected on key, newest first.
+func (d *FraudDetector) Anomalies(key string) []Anomaly {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := []Anomaly{}
+	if a := d.links[key]; a != nil {
+		for i := len(a.anomalies) - 1; i >= 0; i-- {
+			out = append(out, *a.anomalies[i])
+		}
+	}
+	return out
+}
+
+// Forget drops key's state once its link is gone.
+func (d *FraudDetector) Forget(key string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	delete(d.links, key)
+	d.mu.Unlock()
+}
+
+// checkFraud runs the heuristics on a click and counts it against l if
+// they flag it.
+func (s *Store) checkFraud(ctx context.Context, l *Link, rec *ClickRecord) {
+	kind, opened := s.fraud.Observe(l.Key(), rec)
+	if kind == "" {
+		return
+	}
+	rec.Suspicious = kind
+	metricSuspiciousClicks.Add(1)
+	updated, err := s.backend.Update(ctx, l.Key(), func(l *Link) error {
+		l.SuspiciousClicks++
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if opened {
+		logrus.WithFields(logrus.Fields{
+			"action":     "suspicious_click",
+			"short_code": l.ShortCode,
+			"kind":       kind,
+		}).Warn("suspicious clicks detected")
+	}
+	l.SuspiciousClicks = updated.SuspiciousClicks
+}
+
+type anomaliesResponse struct {
+	ShortCode        string    `json:"short_code"`
+	Clicks           int64     `json:"clicks"`
+	SuspiciousClicks int64     `json:"suspicious_clicks"`
+	Anomalies        []Anomaly `json:"anomalies"`
+}
+
+// anomaliesHandler serves GET /api/stats/{code}/anomalies.
+func anomaliesHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if store.fraud == nil {
+			httpError(w, r, http.StatusNotFound, ErrCodeNotFound, "click fraud detection is disabled")
+			return
+		}
+		link, err := store.Stats(r.Context(), codeVar(r))
+		if err == nil && !canManage(ownerFrom(r.Context()), link) {
+			err = ErrNotFound
+		}
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, anomaliesResponse{
+			ShortCode:        link.ShortCode,
+			Clicks:           link.Clicks,
+			SuspiciousClicks: link.SuspiciousClicks,
+			Anomalies:        store.fraud.Anomalies(link.Key()),
+		})
+	}
+}
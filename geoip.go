@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/sirupsen/logrus"
+)
+
+// GeoLocation is where a client address resolves to. Fields are empty
+// when the database does not know them.
+type GeoLocation struct {
+	Country string `json:"country,omitempty"` // ISO 3166-1 alpha-2
+	Region  string `json:"region,omitempty"`  // ISO 3166-2 subdivision code
+	City    string `json:"city,omitempty"`    // English name
+}
+
+// GeoResolver maps client IPs to locations. Implementations must answer
+// from local data: they are called on the redirect path.
+type GeoResolver interface {
+	Lookup(ip net.IP) (*GeoLocation, error)
+}
+
+// MaxMind resolves against a GeoLite2/GeoIP2 City or Country database
+// and reloads it when the file changes on disk.
+type MaxMind struct {
+	path string
+
+	mu      sync.RWMutex
+	db      *geoip2.Reader
+	city    bool
+	modTime time.Time
+}
+
+// OpenMaxMind loads the mmdb file at path.
+func OpenMaxMind(path string) (*MaxMind, error) {
+	m := &MaxMind{path: path}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *MaxMind) load() error {
+	fi, err := os.Stat(m.path)
+	if err != nil {
+		return err
+	}
+	db, err := geoip2.Open(m.path)
+	if err != nil {
+		return err
+	}
+	city := strings.Contains(db.Metadata().DatabaseType, "City")
+	m.mu.Lock()
+	old := m.db
+	m.db, m.city, m.modTime = db, city, fi.ModTime()
+	m.mu.Unlock()
+	if old != nil {
+		_ = old.Close()
+	}
+	return nil
+}
+
+// Watch reloads the database whenever its modification time changes,
+// checking every interval. A file that fails to load leaves the previous
+// database in service.
+func (m *MaxMind) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		fi, err := os.Stat(m.path)
+		if err != nil {
+			continue
+		}
+		m.mu.RLock()
+		changed := !fi.ModTime().Equal(m.modTime)
+		m.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := m.load(); err != nil {
+			logrus.WithError(err).WithField("path", m.path).Warn("reloading GeoIP database failed, keeping the old one")
+			continue
+		}
+		logrus.WithFields(logrus.Fields{
+			"action": "geoip_reload",
+			"path":   m.path,
+		}).Info("GeoIP database reloaded")
+	}
+}
+
+func (m *MaxMind) Lookup(ip net.IP) (*GeoLocation, error) {
+	if ip == nil {
+		return nil, errors.New("invalid ip")
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.city {
+		rec, err := m.db.Country(ip)
+		if err != nil {
+			return nil, err
+		}
+		return &GeoLocation{Country: rec.Country.IsoCode}, nil
+	}
+	rec, err := m.db.City(ip)
+	if err != nil {
+		return nil, err
+	}
+	loc := &GeoLocation{Country: rec.Country.IsoCode, City: rec.City.Names["en"]}
+	if len(rec.Subdivisions) > 0 {
+		loc.Region = rec.Subdivisions[0].IsoCode
+	}
+	return loc, nil
+}
+
+// locate resolves ip with the configured resolver, if any.
+func (s *Store) locate(ip string) *GeoLocation {
+	if s.geo == nil || ip == "" {
+		return nil
+	}
+	loc, err := s.geo.Lookup(net.ParseIP(ip))
+	if err != nil || (loc.Country == "" && loc.City == "") {
+		return nil
+	}
+	return loc
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/storage"
+)
+
+// HealthChecker periodically probes link destinations and records the
+// result on each link, alerting owners when a destination goes down.
+type HealthChecker struct {
+	store       *Store
+	notifier    *Notifier
+	client      *http.Client
+	concurrency int
+}
+
+func NewHealthChecker(store *Store, notifier *Notifier, timeout time.Duration, concurrency int) *HealthChecker {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &HealthChecker{
+		store:       store,
+		notifier:    notifier,
+		client:      newOutboundClient(timeout),
+		concurrency: concurrency,
+	}
+}
+
+// Run checks every interval while this instance is the leader.
+func (hc *HealthChecker) Run(interval time.Duration, elector Elector) {
+	for {
+		time.Sleep(interval)
+		if elector.IsLeader() {
+			hc.checkAll(context.Background())
+		}
+	}
+}
+
+// checkAll probes each distinct live destination once and fans the result
+// out to every link pointing at it.
+func (hc *HealthChecker) checkAll(ctx context.Context) {
+	now := time.Now().UTC()
+	byURL := make(map[string][]string)
+	err := hc.store.backend.Scan(ctx, func(l *Link) bool {
+		if !l.Draft && !l.Burned && !l.Deleted() && !l.Reserved && now.Before(l.ExpiresAt) {
+			byURL[l.LongURL] = append(byURL[l.LongURL], l.Key())
+		}
+		return true
+	})
+	if err != nil {
+		logrus.WithError(err).Warn("health check scan failed")
+		return
+	}
+	sem := make(chan struct{}, hc.concurrency)
+	var wg sync.WaitGroup
+	for dest, keys := range byURL {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(dest string, keys []string) {
+			defer func() { <-sem; wg.Done() }()
+			h := hc.probe(ctx, dest)
+			for _, key := range keys {
+				hc.record(ctx, key, h)
+			}
+		}(dest, keys)
+	}
+	wg.Wait()
+}
+
+// probe issues a HEAD request, retrying with GET for servers that do not
+// implement HEAD.
+func (hc *HealthChecker) probe(ctx context.Context, dest string) storage.Health {
+	h := storage.Health{CheckedAt: time.Now().UTC()}
+	resp, err := hc.do(ctx, http.MethodHead, dest)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp, err = hc.do(ctx, http.MethodGet, dest)
+	}
+	var certErr *tls.CertificateVerificationError
+	var unknownAuth x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	switch {
+	case err != nil && (errors.As(err, &certErr) || errors.As(err, &unknownAuth) || errors.As(err, &hostErr) || errors.As(err, &invalid)):
+		h.Status, h.Error = storage.HealthTLSError, err.Error()
+	case err != nil:
+		h.Status, h.Error = storage.HealthUnreachable, err.Error()
+	default:
+		h.HTTPStatus = resp.StatusCode
+		switch {
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+			h.Status = storage.HealthNotFound
+		case resp.StatusCode >= 500:
+			h.Status = storage.HealthServerError
+		case resp.StatusCode >= 400:
+			h.Status = storage.HealthClientError
+		default:
+			h.Status = storage.HealthAlive
+		}
+	}
+	return h
+}
+
+func (hc *HealthChecker) do(ctx context.Context, method, dest string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, dest, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "url-shortener-healthcheck/1.0")
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// record stores h on the link under key, carrying DownSince over from the
+// previous result, and alerts the owner on the transition to down.
+func (hc *HealthChecker) record(ctx context.Context, key string, h storage.Health) {
+	wentDown := false
+	l, err := hc.store.backend.Update(ctx, key, func(l *Link) error {
+		prev := l.Health
+		next := h
+		if next.Down() {
+			if prev.Down() && prev.DownSince != nil {
+				next.DownSince = prev.DownSince
+			} else {
+				since := h.CheckedAt
+				next.DownSince = &since
+				wentDown = true
+			}
+		}
+		l.Health = &next
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if wentDown {
+		logrus.WithFields(logrus.Fields{
+			"action":      "health_check",
+			"storage_key": key,
+			"status":      h.Status,
+			"http_status": h.HTTPStatus,
+		}).Warn("destination is down")
+		if l.Owner != "" {
+			if p := hc.notifier.Prefs(l.Owner); p.Enabled {
+				hc.notifier.sendHealthAlert(p, l, hc.store.shortURL(l))
+			}
+		}
+	}
+}
+
+type healthEvent struct {
+	Event     string          `json:"event"`
+	ShortCode string          `json:"short_code"`
+	ShortURL  string          `json:"short_url"`
+	LongURL   string          `json:"long_url"`
+	Owner     string          `json:"owner"`
+	Health    *storage.Health `json:"health"`
+}
+
+func (n *Notifier) sendHealthAlert(p NotificationPrefs, l *Link, shortURL string) {
+	ev := healthEvent{
+		Event:     "link.destination_down",
+		ShortCode: l.ShortCode,
+		ShortURL:  shortURL,
+		LongURL:   l.LongURL,
+		Owner:     l.Owner,
+		Health:    l.Health,
+	}
+	text := fmt.Sprintf("The destination of %s (%s) is failing: %s.", ev.ShortURL, ev.LongURL, describeHealth(l.Health))
+	log := logrus.WithFields(logrus.Fields{"action": "health_alert", "short_code": l.ShortCode, "owner": l.Owner})
+	if n.deliver(l.Owner, p, ev, "Destination of short link "+l.ShortCode+" is down", text, log) == nil {
+		log.Info("health alert sent")
+	}
+}
+
+func describeHealth(h *storage.Health) string {
+	if h.HTTPStatus != 0 {
+		return fmt.Sprintf("%s (HTTP %d)", h.Status, h.HTTPStatus)
+	}
+	return h.Status
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// Keys of the texts on the HTML pages visitors see.
+const (
+	msgExpiredTitle     = "expired.title"
+	msgExpiredText      = "expired.text"
+	msgNotFoundTitle    = "not_found.title"
+	msgNotFoundText     = "not_found.text"
+	msgDisabledTitle    = "disabled.title"
+	msgDisabledText     = "disabled.text"
+	msgRestrictedTitle  = "restricted.title"
+	msgRestrictedText   = "restricted.text"
+	msgClosedTitle      = "closed.title"
+	msgClosedText       = "closed.text"
+	msgClosedOpens      = "closed.opens" // %s is when it opens
+	msgMaintenanceTitle = "maintenance.title"
+	msgMaintenanceText  = "maintenance.text"
+	msgLeavingTitle     = "leaving.title"
+	msgLeavingText      = "leaving.text"      // %s is the destination
+	msgLeavingCountdown = "leaving.countdown" // %d is the seconds left
+	msgLeavingContinue  = "leaving.continue"
+)
+
+// pageTexts are the bundled translations, by language and key. English is
+// the fallback for languages and keys that are missing.
+var pageTexts = map[string]map[string]string{
+	"en": {
+		msgExpiredTitle:     "Link expired",
+		msgExpiredText:      "This short link has expired.",
+		msgNotFoundTitle:    "Link not found",
+		msgNotFoundText:     "There is no short link at this address.",
+		msgDisabledTitle:    "Link disabled",
+		msgDisabledText:     "This short link has been disabled.",
+		msgRestrictedTitle:  "Access restricted",
+		msgRestrictedText:   "This link can only be opened from an approved network.",
+		msgClosedTitle:      "Come back later",
+		msgClosedText:       "This link is only available during its opening hours.",
+		msgClosedOpens:      "It opens again %s.",
+		msgMaintenanceTitle: "Down for maintenance",
+		msgMaintenanceText:  "We'll be back shortly.",
+		msgLeavingTitle:     "You are leaving this site",
+		msgLeavingText:      "You are about to go to %s.",
+		msgLeavingCountdown: "Redirecting in %d seconds…",
+		msgLeavingContinue:  "Continue",
+	},
+	"de": {
+		msgExpiredTitle:     "Link abgelaufen",
+		msgExpiredText:      "Dieser Kurzlink ist abgelaufen.",
+		msgNotFoundTitle:    "Link nicht gefunden",
+		msgNotFoundText:     "Unter dieser Adresse gibt es keinen Kurzlink.",
+		msgDisabledTitle:    "Link gesperrt",
+		msgDisabledText:     "Dieser Kurzlink wurde gesperrt.",
+		msgRestrictedTitle:  "Zugriff eingeschränkt",
+		msgRestrictedText:   "Dieser Link kann nur aus einem freigegebenen Netzwerk geöffnet werden.",
+		msgClosedTitle:      "Bitte später wiederkommen",
+		msgClosedText:       "Dieser Link ist nur zu seinen Öffnungszeiten verfügbar.",
+		msgClosedOpens:      "Er öffnet wieder %s.",
+		msgMaintenanceTitle: "Wartungsarbeiten",
+		msgMaintenanceText:  "Wir sind gleich wieder da.",
+		msgLeavingTitle:     "Sie verlassen diese Seite",
+		msgLeavingText:      "Sie werden zu %s weitergeleitet.",
+		msgLeavingCountdown: "Weiterleitung in %d Sekunden …",
+		msgLeavingContinue:  "Weiter",
+	},
+	"fr": {
+		msgExpiredTitle:     "Lien expiré",
+		msgExpiredText:      "Ce lien court a expiré.",
+		msgNotFoundTitle:    "Lien introuvable",
+		msgNotFoundText:     "Il n'y a pas de lien court à cette adresse.",
+		msgDisabledTitle:    "Lien désactivé",
+		msgDisabledText:     "Ce lien court a été désactivé.",
+		msgRestrictedTitle:  "Accès restreint",
+		msgRestrictedText:   "Ce lien ne peut être ouvert que depuis un réseau autorisé.",
+		msgClosedTitle:      "Revenez plus tard",
+		msgClosedText:       "Ce lien n'est disponible que pendant ses heures d'ouverture.",
+		msgClosedOpens:      "Il rouvre %s.",
+		msgMaintenanceTitle: "En maintenance",
+		msgMaintenanceText:  "Nous serons bientôt de retour.",
+		msgLeavingTitle:     "Vous quittez ce site",
+		msgLeavingText:      "Vous allez être redirigé vers %s.",
+		msgLeavingCountdown: "Redirection dans %d secondes…",
+		msgLeavingContinue:  "Continuer",
+	},
+	"es": {
+		msgExpiredTitle:     "Enlace caducado",
+		msgExpiredText:      "Este enlace corto ha caducado.",
+		msgNotFoundTitle:    "Enlace no encontrado",
+		msgNotFoundText:     "No hay ningún enlace corto en esta dirección.",
+		msgDisabledTitle:    "Enlace desactivado",
+		msgDisabledText:     "Este enlace corto ha sido desactivado.",
+		msgRestrictedTitle:  "Acceso restringido",
+		msgRestrictedText:   "Este enlace solo se puede abrir desde una red autorizada.",
+		msgClosedTitle:      "Vuelve más tarde",
+		msgClosedText:       "Este enlace solo está disponible en su horario.",
+		msgClosedOpens:      "Vuelve a abrir el %s.",
+		msgMaintenanceTitle: "En mantenimiento",
+		msgMaintenanceText:  "Volveremos enseguida.",
+		msgLeavingTitle:     "Estás saliendo de este sitio",
+		msgLeavingText:      "Vas a ir a %s.",
+		msgLeavingCountdown: "Redirigiendo en %d segundos…",
+		msgLeavingContinue:  "Continuar",
+	},
+}
+
+// defaultPageLanguage is served when nothing the client accepts matches.
+const defaultPageLanguage = "en"
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!doctype html>
+<html lang="{{.Lang}}"><head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body style="font-family:sans-serif;text-align:center;margin-top:15vh">
+<h1>{{if .Brand}}{{.Brand}}{{else}}{{.Title}}{{end}}</h1>
+{{range .Lines}}<p>{{.}}</p>
+{{end}}</body></html>
+`))
+
+// Pages renders the HTML pages visitors get instead of a redirect, in the
+// language their Accept-Language asks for. Tenants may override any text
+// and add languages of their own; see Tenant.Messages.
+type Pages struct {
+	tenants *Tenants // optional
+}
+
+// localized looks texts up in one language, tenant overrides first.
+type localized struct {
+	lang      string
+	overrides map[string]map[string]string
+}
+
+func (l localized) text(key string) string {
+	for _, lang := range []string{l.lang, defaultPageLanguage} {
+		if s, ok := l.overrides[lang][key]; ok {
+			return s
+		}
+		if s, ok := pageTexts[lang][key]; ok {
+			return s
+		}
+	}
+	return key
+}
+
+// localize picks the language for r among the bundled ones and those
+// the request's tenant added.
+func (p *Pages) localize(r *http.Request) localized {
+	var overrides map[string]map[string]string
+	if p != nil && p.tenants != nil {
+		if t, err := p.tenants.Get(tenantFrom(r.Context())); err == nil {
+			overrides = t.Messages
+		}
+	}
+	tags := []language.Tag{language.Make(defaultPageLanguage)}
+	names := []string{defaultPageLanguage}
+	add := func(lang string) {
+		for _, n := range names {
+			if n == lang {
+				return
+			}
+		}
+		tags = append(tags, language.Make(lang))
+		names = append(names, lang)
+	}
+	for lang := range pageTexts {
+		add(lang)
+	}
+	for lang := range overrides {
+		add(lang)
+	}
+	_, i := language.MatchStrings(language.NewMatcher(tags), r.Header.Get("Accept-Language"))
+	return localized{lang: names[i], overrides: overrides}
+}
+
+// pageLine is one paragraph of a page: the text under key, formatted
+// with args, or text as is if key is empty.
+type pageLine struct {
+	key  string
+	args []interface{}
+	text string
+}
+
+func line(key string, args ...interface{}) pageLine { return pageLine{key: key, args: args} }
+
+// render writes the page titled by titleKey, under brand (the tenant's
+// name) if there is one.
+func (p *Pages) render(w http.ResponseWriter, r *http.Request, status int, brand, titleKey string, lines ...pageLine) {
+	loc := p.localize(r)
+	page := struct {
+		Lang, Title, Brand string
+		Lines              []string
+	}{Lang: loc.lang, Title: loc.text(titleKey), Brand: brand}
+	for _, l := range lines {
+		switch {
+		case l.key == "":
+			page.Lines = append(page.Lines, l.text)
+		case len(l.args) > 0:
+			page.Lines = append(page.Lines, fmt.Sprintf(loc.text(l.key), l.args...))
+		default:
+			page.Lines = append(page.Lines, loc.text(l.key))
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", loc.lang)
+	w.Header().Add("Vary", "Accept-Language")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		_ = pageTemplate.Execute(w, page)
+	}
+}
+
+// wantsHTML reports whether r comes from a browser rather than an API
+// client: it lists text/html in Accept.
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// validateMessages checks tenant text overrides: languages must be BCP 47
+// tags and keys must be known.
+func validateMessages(msgs map[string]map[string]string) *APIError {
+	for lang, texts := range msgs {
+		if _, err := language.Parse(lang); err != nil {
+			return fieldError("messages", fmt.Sprintf("%q is not a language tag", lang))
+		}
+		for key := range texts {
+			if _, ok := pageTexts[defaultPageLanguage][key]; !ok {
+				return fieldError("messages", fmt.Sprintf("%q is not a page text", key))
+			}
+		}
+	}
+	return nil
+}
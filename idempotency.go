@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	IdempotencyHeader    = "Idempotency-Key"
+	maxIdempotencyKeyLen = 255
+
+	// idemSweepInterval is how often memoryIdempotency drops the keys
+	// that expired without being used again.
+	idemSweepInterval = time.Minute
+)
+
+// idemRecord is what is remembered for an Idempotency-Key: a fingerprint
+// of the request it was first used with and, once finished, the response.
+type idemRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	Pending     bool   `json:"pending"`
+	Status      int    `json:"status,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// IdempotencyStore remembers idempotency keys for a TTL.
+type IdempotencyStore interface {
+	// Reserve claims key for a new request. If the key is already known
+	// the existing record is returned and reserved is false.
+	Reserve(ctx context.Context, key, fingerprint string, ttl time.Duration) (existing *idemRecord, reserved bool, err error)
+	// Complete stores the final response for a reserved key.
+	Complete(ctx context.Context, key string, rec idemRecord, ttl time.Duration) error
+	// Release forgets a reserved key so the client may retry with it.
+	Release(ctx context.Context, key string) error
+}
+
+type memIdemEntry struct {
+	rec     idemRecord
+	expires time.Time
+}
+
+// memoryIdempotency checks a key's expiry when the key is used again;
+// keys that never are go in a sweep at most every idemSweepInterval.
+type memoryIdempotency struct {
+	clock   Clock
+	mu      sync.Mutex
+	entries map[string]*memIdemEntry
+	swept   time.Time
+}
+
+func newMemoryIdempotency() *memoryIdempotency {
+	return &memoryIdempotency{clock: systemClock{}, entries: make(map[string]*memIdemEntry)}
+}
+
+func (m *memoryIdempotency) Reserve(_ context.Context, key, fp string, ttl time.Duration) (*idemRecord, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.clock.Now()
+	if now.Sub(m.swept) >= idemSweepInterval {
+		m.sweep(now)
+	}
+	if e, ok := m.entries[key]; ok && now.Before(e.expires) {
+		rec := e.rec
+		return &rec, false, nil
+	}
+	m.entries[key] = &memIdemEntry{rec: idemRecord{Fingerprint: fp, Pending: true}, expires: now.Add(ttl)}
+	return nil, true, nil
+}
+
+// sweep drops expired keys; callers hold mu.
+func (m *memoryIdempotency) sweep(now time.Time) {
+	for k, e := range m.entries {
+		if !now.Before(e.expires) {
+			delete(m.entries, k)
+		}
+	}
+	m.swept = now
+}
+
+func (m *memoryIdempotency) Complete(_ context.Context, key string, rec idemRecord, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = &memIdemEntry{rec: rec, expires: m.clock.Now().Add(ttl)}
+	return nil
+}
+
+func (m *memoryIdempotency) Release(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+// redisIdempotency shares keys across instances so a retry landing on a
+// different node still replays the original response.
+type redisIdempotency struct {
+	client *redis.Client
+	prefix string
+}
+
+func newRedisIdempotency(client *redis.Client, prefix string) *redisIdempotency {
+	return &redisIdempotency{client: client, prefix: prefix + "idem:"}
+}
+
+func (r *redisIdempotency) Reserve(ctx context.Context, key, fp string, ttl time.Duration) (*idemRecord, bool, error) {
+	pending, _ := json.Marshal(idemRecord{Fingerprint: fp, Pending: true})
+	ok, err := r.client.SetNX(ctx, r.prefix+key, pending, ttl).Result()
+	if err != nil || ok {
+		return nil, ok, err
+	}
+	raw, err := r.client.Get(ctx, r.prefix+key).Bytes()
+	if err == redis.Nil {
+		// Expired between SETNX and GET; let the caller retry.
+		return r.Reserve(ctx, key, fp, ttl)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	var rec idemRecord
+	if err := json.Unmarshal(raw, &rec); err != nil {
+		return nil, false, err
+	}
+	return &rec, false, nil
+}
+
+func (r *redisIdempotency) Complete(ctx context.Context, key string, rec idemRecord, ttl time.Duration) error {
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(ctx, r.prefix+key, raw, ttl).Err()
+}
+
+func (r *redisIdempotency) Release(ctx context.Context, key string) error {
+	return r.client.Del(ctx, r.prefix+key).Err()
+}
+
+// recordingWriter tees the response so it can be stored for replay.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(code int) {
+	rw.status = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// retryable reports whether a response asks the client to try again, so
+// that replaying it for the retry would defeat the point.
+func retryable(status int) bool {
+	switch status {
+	case 0, http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return true
+	}
+	return status >= 500
+}
+
+// validatesOnly reports whether a JSON body asks, with validate_only,
+// only to be checked, as ?dry_run does.
+func validatesOnly(body []byte) bool {
+	var req struct {
+		ValidateOnly bool `json:"validate_only"`
+	}
+	return json.Unmarshal(body, &req) == nil && req.ValidateOnly
+}
+
+// idempotent makes next safe to retry with an Idempotency-Key header: the
+// first response for a key is stored for ttl and replayed for retries with
+// the same payload. Keys are scoped to the caller's owner. Responses that
+// ask for a retry (server errors, 429 and the like) are not remembered,
+// and neither are dry runs, ?dry_run or validate_only, which would
+// otherwise be replayed for the real request.
+func idempotent(store IdempotencyStore, ttl time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyHeader)
+		if key == "" || isDryRun(r) {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			writeAPIError(w, r, newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "Idempotency-Key must not exceed 255 characters"))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if validatesOnly(body) {
+			next(w, r)
+			return
+		}
+		sum := sha256.Sum256(body)
+		fp := hex.EncodeToString(sum[:])
+		key = ownerFrom(r.Context()) + ":" + key
+
+		existing, reserved, err := store.Reserve(r.Context(), key, fp, ttl)
+		if err != nil {
+			logrus.WithError(err).Warn("idempotency store unavailable")
+			writeAPIError(w, r, newAPIError(http.StatusServiceUnavailable, ErrCodeUnavailable, "idempotency store unavailable"))
+			return
+		}
+		if !reserved {
+			switch {
+			case existing.Fingerprint != fp:
+				writeAPIError(w, r, newAPIError(http.StatusUnprocessableEntity, ErrCodeIdempotencyMismatch,
+					"Idempotency-Key was already used with a different request body"))
+			case existing.Pending:
+				writeAPIError(w, r, newAPIError(http.StatusConflict, ErrCodeIdempotencyInFlight,
+					"a request with this Idempotency-Key is still in progress"))
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(existing.Status)
+				_, _ = w.Write(existing.Body)
+			}
+			return
+		}
+
+		// A panicking handler must not leave the key pending until the
+		// TTL, turning every retry into a conflict; release it and let
+		// the panic go on to the recovery middleware.
+		defer func() {
+			if p := recover(); p != nil {
+				_ = store.Release(context.WithoutCancel(r.Context()), key)
+				panic(p)
+			}
+		}()
+		rw := &recordingWriter{ResponseWriter: w}
+		next(rw, r)
+		if retryable(rw.status) {
+			_ = store.Release(r.Context(), key)
+			return
+		}
+		rec := idemRecord{Fingerprint: fp, Status: rw.status, Body: rw.body.Bytes()}
+		if err := store.Complete(r.Context(), key, rec, ttl); err != nil {
+			logrus.WithError(err).Warn("storing idempotent response failed")
+		}
+	}
+}
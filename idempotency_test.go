@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"url-shortener/storage/storetest"
+)
+
+func idemRequest(key string, body interface{}) storetest.Request {
+	return storetest.Request{
+		Method: http.MethodPost,
+		Path:   "/api/shorten",
+		Body:   body,
+		Header: http.Header{IdempotencyHeader: {key}},
+	}
+}
+
+// countingHandler answers with the status of its current call, from
+// statuses, and counts the calls.
+type countingHandler struct {
+	statuses []int
+	calls    int
+}
+
+func (h *countingHandler) serve(w http.ResponseWriter, r *http.Request) {
+	status := h.statuses[h.calls%len(h.statuses)]
+	h.calls++
+	writeJSON(w, status, map[string]int{"call": h.calls})
+}
+
+func TestIdempotent(t *testing.T) {
+	first := map[string]string{"url": "https://example.com/a"}
+	second := map[string]string{"url": "https://example.com/b"}
+	tests := []struct {
+		name      string
+		statuses  []int
+		requests  []storetest.Request
+		wantCodes []int
+		wantCalls int
+	}{
+		{"replay", []int{http.StatusCreated},
+			[]storetest.Request{idemRequest("k", first), idemRequest("k", first)},
+			[]int{http.StatusCreated, http.StatusCreated}, 1},
+		{"client error replayed", []int{http.StatusBadRequest, http.StatusCreated},
+			[]storetest.Request{idemRequest("k", first), idemRequest("k", first)},
+			[]int{http.StatusBadRequest, http.StatusBadRequest}, 1},
+		{"mismatch", []int{http.StatusCreated},
+			[]storetest.Request{idemRequest("k", first), idemRequest("k", second)},
+			[]int{http.StatusCreated, http.StatusUnprocessableEntity}, 1},
+		{"other key", []int{http.StatusCreated},
+			[]storetest.Request{idemRequest("k", first), idemRequest("other", first)},
+			[]int{http.StatusCreated, http.StatusCreated}, 2},
+		{"server error released", []int{http.StatusInternalServerError, http.StatusCreated},
+			[]storetest.Request{idemRequest("k", first), idemRequest("k", first)},
+			[]int{http.StatusInternalServerError, http.StatusCreated}, 2},
+		{"rate limited released", []int{http.StatusTooManyRequests, http.StatusCreated},
+			[]storetest.Request{idemRequest("k", first), idemRequest("k", first)},
+			[]int{http.StatusTooManyRequests, http.StatusCreated}, 2},
+		{"validate_only not remembered", []int{http.StatusOK, http.StatusCreated},
+			[]storetest.Request{
+				idemRequest("k", map[string]interface{}{"url": "https://example.com/a", "validate_only": true}),
+				idemRequest("k", first),
+			},
+			[]int{http.StatusOK, http.StatusCreated}, 2},
+		{"dry_run not remembered", []int{http.StatusOK, http.StatusCreated},
+			[]storetest.Request{
+				{Method: http.MethodPost, Path: "/api/shorten?dry_run=true", Body: first, Header: http.Header{IdempotencyHeader: {"k"}}},
+				idemRequest("k", first),
+			},
+			[]int{http.StatusOK, http.StatusCreated}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &countingHandler{statuses: tt.statuses}
+			h := idempotent(newMemoryIdempotency(), time.Hour, next.serve)
+			for i, req := range tt.requests {
+				rec := storetest.Do(t, h, req)
+				if rec.Code != tt.wantCodes[i] {
+					t.Errorf("request %d: status %d, want %d: %s", i+1, rec.Code, tt.wantCodes[i], rec.Body)
+				}
+			}
+			if next.calls != tt.wantCalls {
+				t.Errorf("handler ran %d times, want %d", next.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestIdempotentReplayHeader(t *testing.T) {
+	next := &countingHandler{statuses: []int{http.StatusCreated}}
+	h := idempotent(newMemoryIdempotency(), time.Hour, next.serve)
+	req := idemRequest("k", map[string]string{"url": "https://example.com/a"})
+	firstBody := storetest.Do(t, h, req).Body.String()
+	rec := storetest.Do(t, h, req)
+	if rec.Header().Get("Idempotent-Replayed") != "true" || rec.Body.String() != firstBody {
+		t.Errorf("retry got %q (replayed %q), want the first response %q", rec.Body, rec.Header().Get("Idempotent-Replayed"), firstBody)
+	}
+}
+
+func TestIdempotentInFlight(t *testing.T) {
+	idem := newMemoryIdempotency()
+	started, finish := make(chan struct{}), make(chan struct{})
+	h := idempotent(idem, time.Hour, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+		writeJSON(w, http.StatusCreated, map[string]string{})
+	})
+	req := idemRequest("k", map[string]string{"url": "https://example.com/a"})
+	done := make(chan int)
+	go func() { done <- storetest.Do(t, h, req).Code }()
+	<-started
+	if rec := storetest.Do(t, h, req); rec.Code != http.StatusConflict {
+		t.Errorf("retry while in flight: status %d, want 409", rec.Code)
+	}
+	close(finish)
+	if code := <-done; code != http.StatusCreated {
+		t.Errorf("first request: status %d, want 201", code)
+	}
+}
+
+func TestIdempotentPanicReleasesKey(t *testing.T) {
+	idem := newMemoryIdempotency()
+	h := idempotent(idem, time.Hour, func(http.ResponseWriter, *http.Request) { panic("boom") })
+	req := idemRequest("k", map[string]string{"url": "https://example.com/a"})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("the handler's panic was swallowed")
+			}
+		}()
+		storetest.Do(t, h, req)
+	}()
+	if _, reserved, _ := idem.Reserve(context.Background(), ":k", "any", time.Hour); !reserved {
+		t.Error("key still held after the handler panicked")
+	}
+}
+
+func TestMemoryIdempotencyExpiry(t *testing.T) {
+	ctx := context.Background()
+	clock := storetest.NewClock(testEpoch)
+	idem := newMemoryIdempotency()
+	idem.clock = clock
+	if _, reserved, _ := idem.Reserve(ctx, "a", "fp", time.Minute); !reserved {
+		t.Fatal("first Reserve did not reserve")
+	}
+	if _, reserved, _ := idem.Reserve(ctx, "idle", "fp", time.Minute); !reserved {
+		t.Fatal("Reserve(idle) did not reserve")
+	}
+	if _, reserved, _ := idem.Reserve(ctx, "a", "fp", time.Minute); reserved {
+		t.Fatal("Reserve reserved a key that is still held")
+	}
+
+	clock.Advance(time.Minute)
+	if _, reserved, _ := idem.Reserve(ctx, "a", "fp", time.Minute); !reserved {
+		t.Error("Reserve did not take over an expired key")
+	}
+	if _, held := idem.entries["idle"]; held {
+		t.Error("the sweep kept an expired key")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"url-shortener/storage"
+)
+
+// Bounds of an interstitial.
+const (
+	defaultInterstitialSeconds = 5
+	maxInterstitialSeconds     = 60
+	maxInterstitialNotice      = 1000
+)
+
+// validateInterstitial trims in and fills in the default countdown. An
+// empty one, {}, is no interstitial, and nil is returned.
+func validateInterstitial(field string, in *storage.Interstitial) (*storage.Interstitial, error) {
+	if in == nil {
+		return nil, nil
+	}
+	out := storage.Interstitial{Notice: strings.TrimSpace(in.Notice), Seconds: in.Seconds}
+	if out == (storage.Interstitial{}) {
+		return nil, nil
+	}
+	if out.Seconds == 0 {
+		out.Seconds = defaultInterstitialSeconds
+	}
+	if out.Seconds < 1 || out.Seconds > maxInterstitialSeconds {
+		return nil, fieldError(field+".seconds", "seconds must be between 1 and "+strconv.Itoa(maxInterstitialSeconds))
+	}
+	if utf8.RuneCountInString(out.Notice) > maxInterstitialNotice {
+		return nil, fieldError(field+".notice", "notice must be at most "+strconv.Itoa(maxInterstitialNotice)+" characters")
+	}
+	return &out, nil
+}
+
+// interstitial returns the notice l's visitors see first: its own, or
+// else its tenant's, or nil.
+func (s *Store) interstitial(l *Link) *storage.Interstitial {
+	if l.Interstitial != nil {
+		return l.Interstitial
+	}
+	if l.Tenant != "" && s.tenants != nil {
+		if t, err := s.tenants.Get(l.Tenant); err == nil {
+			return t.Interstitial
+		}
+	}
+	return nil
+}
+
+// showInterstitial reports whether r gets the interstitial page rather
+// than the redirect: API clients, HEAD requests and bots skip it.
+func showInterstitial(r *http.Request) bool {
+	return r.Method == http.MethodGet && wantsHTML(r) && !isBot(r)
+}
+
+var interstitialTemplate = template.Must(template.New("interstitial").Parse(`<!doctype html>
+<html lang="{{.Lang}}"><head><meta charset="utf-8"><meta name="robots" content="noindex">
+<meta http-equiv="refresh" content="{{.Seconds}}; url={{.Dest}}"><title>{{.Title}}</title></head>
+<body style="font-family:sans-serif;text-align:center;margin-top:15vh">
+<h1>{{if .Brand}}{{.Brand}}{{else}}{{.Title}}{{end}}</h1>
+{{if .Notice}}<p>{{.Notice}}</p>
+{{end}}<p>{{.Text}}</p>
+<p id="countdown" data-text="{{.Countdown}}">{{.CountdownNow}}</p>
+<p><a href="{{.Dest}}">{{.Continue}}</a></p>
+<script>
+(function () {
+	var el = document.getElementById("countdown"), n = {{.Seconds}};
+	var t = setInterval(function () {
+		n = Math.max(n - 1, 0);
+		el.textContent = el.getAttribute("data-text").replace("%d", n);
+		if (n === 0) clearInterval(t);
+	}, 1000);
+})();
+</script>
+</body></html>
+`))
+
+// serveInterstitial shows in before sending the visitor on to dest, in
+// their language; the page moves on by itself after in.Seconds.
+func serveInterstitial(w http.ResponseWriter, r *http.Request, store *Store, l *Link, in *storage.Interstitial, dest string) {
+	loc := store.pages.localize(r)
+	countdown := loc.text(msgLeavingCountdown)
+	page := struct {
+		Lang, Title, Brand, Notice, Text, Countdown, CountdownNow, Continue, Dest string
+		Seconds                                                                   int
+	}{
+		Lang:         loc.lang,
+		Title:        loc.text(msgLeavingTitle),
+		Brand:        store.tenantName(l),
+		Notice:       in.Notice,
+		Text:         fmt.Sprintf(loc.text(msgLeavingText), dest),
+		Countdown:    countdown,
+		CountdownNow: strings.Replace(countdown, "%d", strconv.Itoa(in.Seconds), 1),
+		Continue:     loc.text(msgLeavingContinue),
+		Dest:         dest,
+		Seconds:      in.Seconds,
+	}
+	store.setRedirectHeaders(w, l)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", loc.lang)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Add("Vary", "Accept, Accept-Language")
+	if l.ClientHints {
+		w.Header().Set("Accept-CH", acceptClientHints)
+	}
+	w.WriteHeader(http.StatusOK)
+	_ = interstitialTemplate.Execute(w, page)
+}
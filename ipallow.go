@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxAllowedIPs caps the ranges one link can list.
+const maxAllowedIPs = 50
+
+// parseAllowedIPs checks a link's allowed_ips and returns them as
+// canonical prefixes; a bare address is a single-host range.
+func parseAllowedIPs(raw []string) ([]string, error) {
+	if len(raw) > maxAllowedIPs {
+		return nil, fieldError("allowed_ips", "allowed_ips may list at most "+strconv.Itoa(maxAllowedIPs)+" ranges")
+	}
+	var out []string
+	for _, s := range raw {
+		s = strings.TrimSpace(s)
+		var p netip.Prefix
+		if strings.Contains(s, "/") {
+			var err error
+			if p, err = netip.ParsePrefix(s); err != nil {
+				return nil, fieldError("allowed_ips", strconv.Quote(s)+" is not an IP address or CIDR range")
+			}
+			p = p.Masked()
+		} else {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fieldError("allowed_ips", strconv.Quote(s)+" is not an IP address or CIDR range")
+			}
+			addr = addr.Unmap()
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		out = append(out, p.String())
+	}
+	return out, nil
+}
+
+// ipAllowed reports whether ip falls in one of ranges. Anything stored
+// that no longer parses allows nobody.
+func ipAllowed(ranges []string, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, r := range ranges {
+		if p, err := netip.ParsePrefix(r); err == nil && p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveIPRestricted answers a client outside link's allowed ranges with
+// a 403 page carrying the tenant's name, if it has one.
+func serveIPRestricted(w http.ResponseWriter, r *http.Request, store *Store, link *Link) {
+	logrus.WithFields(logrus.Fields{
+		"action":     "redirect_denied",
+		"short_code": link.ShortCode,
+	}).Debug("client outside the link's allowed ranges")
+	w.Header().Set("Cache-Control", "no-store")
+	store.pages.render(w, r, http.StatusForbidden, store.tenantName(link), msgRestrictedTitle, line(msgRestrictedText))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"url-shortener/middleware"
+)
+
+func TestParseAllowedIPs(t *testing.T) {
+	tooMany := make([]string, maxAllowedIPs+1)
+	for i := range tooMany {
+		tooMany[i] = "10.0.0.1"
+	}
+	tests := []struct {
+		name    string
+		raw     []string
+		want    []string
+		wantErr bool
+	}{
+		{"none", nil, nil, false},
+		{"address becomes a host range", []string{"192.0.2.7", "2001:db8::1"}, []string{"192.0.2.7/32", "2001:db8::1/128"}, false},
+		{"range is masked", []string{" 10.1.2.3/8 "}, []string{"10.0.0.0/8"}, false},
+		{"IPv4-mapped address unmapped", []string{"::ffff:192.0.2.7"}, []string{"192.0.2.7/32"}, false},
+		{"host name", []string{"example.com"}, nil, true},
+		{"bad prefix length", []string{"10.0.0.0/33"}, nil, true},
+		{"too many", tooMany, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAllowedIPs(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAllowedIPs(%q) error = %v, want error %v", tt.raw, err, tt.wantErr)
+			}
+			var e *APIError
+			if err != nil && (!errors.As(err, &e) || len(e.Fields) != 1 || e.Fields[0].Field != "allowed_ips") {
+				t.Errorf("error = %v, want one on allowed_ips", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAllowedIPs(%q) = %q, want %q", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPAllowed(t *testing.T) {
+	ranges := []string{"10.0.0.0/8", "192.0.2.7/32", "2001:db8::/32"}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.20.30.40", true},
+		{"11.0.0.1", false},
+		{"192.0.2.7", true},
+		{"192.0.2.8", false},
+		{"::ffff:10.0.0.1", true},
+		{"2001:db8::42", true},
+		{"2001:db9::1", false},
+		{"", false},
+		{"not-an-ip", false},
+	}
+	for _, tt := range tests {
+		if got := ipAllowed(ranges, tt.ip); got != tt.want {
+			t.Errorf("ipAllowed(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	if ipAllowed([]string{"garbage"}, "10.0.0.1") {
+		t.Error("a range that no longer parses allowed a client")
+	}
+}
+
+// TestRedirectAllowedIPs follows an IP-restricted link from several
+// clients, directly and behind a trusted proxy.
+func TestRedirectAllowedIPs(t *testing.T) {
+	trusted, err := middleware.ParseTrustedProxies("172.16.0.0/12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded string
+		want      int
+	}{
+		{"client in range", "10.1.2.3:5000", "", http.StatusFound},
+		{"client out of range", "198.51.100.1:5000", "", http.StatusForbidden},
+		{"in range behind a trusted proxy", "172.16.0.1:5000", "10.1.2.3", http.StatusFound},
+		{"out of range behind a trusted proxy", "172.16.0.1:5000", "198.51.100.1", http.StatusForbidden},
+		{"spoofed header from an untrusted peer", "198.51.100.1:5000", "10.1.2.3", http.StatusForbidden},
+	}
+	ctx := context.Background()
+	s, _ := newClockedStore(t)
+	s.pages = &Pages{}
+	l, err := s.Create(ctx, "https://example.com/internal", "", time.Hour, LinkOptions{AllowedIPs: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	r.Use(middleware.RealIP(trusted))
+	r.HandleFunc("/{code}", redirectHandler(s, NewQuotas(Quota{}, nil, newMemoryUsage()), nil, false))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/"+l.ShortCode, nil)
+			req.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d", rec.Code, tt.want)
+			}
+			if loc := rec.Header().Get("Location"); (loc != "") != (tt.want == http.StatusFound) {
+				t.Errorf("Location = %q with status %d", loc, rec.Code)
+			}
+		})
+	}
+}
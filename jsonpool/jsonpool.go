@@ -0,0 +1,133 @@
+// Package jsonpool encodes JSON into pooled buffers, so that handlers
+// writing large bodies (link lists, stats, exports) do not allocate a
+// fresh encoder and grow a fresh buffer for every response.
+package jsonpool
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// maxPooled is the largest buffer returned to the pool; bigger ones are
+// left to the garbage collector so one huge export does not pin memory.
+const maxPooled = 1 << 20
+
+// Buffer is a bytes.Buffer with its own encoder.
+type Buffer struct {
+	bytes.Buffer
+	enc *json.Encoder
+}
+
+var pool = sync.Pool{New: func() interface{} {
+	b := &Buffer{}
+	b.enc = json.NewEncoder(&b.Buffer)
+	return b
+}}
+
+// Get returns an empty buffer from the pool.
+func Get() *Buffer {
+	b := pool.Get().(*Buffer)
+	b.Reset()
+	return b
+}
+
+// Release hands b back to the pool. Its bytes must not be used after.
+func (b *Buffer) Release() {
+	if b.Cap() <= maxPooled {
+		pool.Put(b)
+	}
+}
+
+// Encode appends v to b as encoding/json's Encoder writes it, newline
+// included.
+func (b *Buffer) Encode(v interface{}) error {
+	return b.enc.Encode(v)
+}
+
+// Encode returns v encoded in a pooled buffer, which the caller releases
+// once done with its bytes.
+func Encode(v interface{}) (*Buffer, error) {
+	b := Get()
+	if err := b.Encode(v); err != nil {
+		b.Release()
+		return nil, err
+	}
+	return b, nil
+}
+
+// Write sends v as an application/json response with status. The body is
+// encoded before the header goes out, so it also gets a Content-Length.
+func Write(w http.ResponseWriter, status int, v interface{}) error {
+	b, err := Encode(v)
+	if err != nil {
+		return err
+	}
+	defer b.Release()
+	WriteBytes(w, status, b.Bytes())
+	return nil
+}
+
+// WriteBytes sends an already encoded JSON body.
+func WriteBytes(w http.ResponseWriter, status int, body []byte) {
+	h := w.Header()
+	h.Set("Content-Type", "application/json")
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+const hex = "0123456789abcdef"
+
+// AppendString appends s as a JSON string literal, escaped the way
+// encoding/json escapes it (HTML characters and invalid UTF-8 included).
+func AppendString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				dst = append(dst, '\\', c)
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hex[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// Elector reports whether this instance currently holds cluster-wide
+// leadership for singleton background work such as expiry sweeps.
+type Elector interface {
+	IsLeader() bool
+}
+
+// soloElector is used when there is no cluster: the process always leads.
+type soloElector struct{}
+
+func (soloElector) IsLeader() bool { return true }
+
+// acquireOrRenew takes the lock if it is free or extends it if we hold it.
+var acquireOrRenew = redis.NewScript(`
+local v = redis.call('GET', KEYS[1])
+if v == false then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+if v == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// redisElector holds leadership through a Redis key with a TTL. The holder
+// renews it every ttl/3; if it dies the key lapses and another instance
+// takes over on its next attempt.
+type redisElector struct {
+	client *redis.Client
+	key    string
+	id     string
+	ttl    time.Duration
+	leader atomic.Bool
+}
+
+func newRedisElector(client *redis.Client, key, id string, ttl time.Duration) *redisElector {
+	return &redisElector{client: client, key: key, id: id, ttl: ttl}
+}
+
+func (e *redisElector) IsLeader() bool { return e.leader.Load() }
+
+// Run campaigns for leadership until ctx is cancelled.
+func (e *redisElector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	for {
+		e.campaign(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *redisElector) campaign(ctx context.Context) {
+	held, err := acquireOrRenew.Run(ctx, e.client, []string{e.key}, e.id, e.ttl.Milliseconds()).Int()
+	if err != nil {
+		// Without Redis we cannot prove we still hold the lock.
+		logrus.WithError(err).Warn("leader election failed")
+		held = 0
+	}
+	was := e.leader.Swap(held == 1)
+	if was != (held == 1) {
+		logrus.WithFields(logrus.Fields{
+			"instance": e.id,
+			"leader":   held == 1,
+		}).Info("cleanup leadership changed")
+	}
+}
+
+func defaultInstanceID() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeElector is led or not as the test says.
+type fakeElector bool
+
+func (e fakeElector) IsLeader() bool { return bool(e) }
+
+func TestCleanupLeavesSharedBackendToLeader(t *testing.T) {
+	tests := []struct {
+		name        string
+		shared      bool
+		leader      bool
+		wantRemoved int
+	}{
+		{"own backend, leader", false, true, 1},
+		{"own backend, follower", false, false, 1},
+		{"shared backend, leader", true, true, 1},
+		{"shared backend, follower", true, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, clock := newClockedStore(t)
+			s.sharedBackend = tt.shared
+			l, err := s.Create(ctx, "https://example.com/a", "", time.Hour, LinkOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			clock.Advance(2 * time.Hour)
+
+			removed, _ := s.cleanup(ctx, fakeElector(tt.leader))
+			if removed != tt.wantRemoved {
+				t.Errorf("cleanup removed %d links, want %d", removed, tt.wantRemoved)
+			}
+			_, err = s.backend.Get(ctx, l.Key())
+			if gone := errors.Is(err, ErrNotFound); gone != (tt.wantRemoved == 1) {
+				t.Errorf("expired link removed = %v, want %v", gone, tt.wantRemoved == 1)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+)
+
+// Link lifecycle event types.
+const (
+	EventLinkCreated = "link.created"
+	EventLinkExpired = "link.expired"
+	EventLinkDeleted = "link.deleted"
+	EventLinkClicked = "link.clicked"
+)
+
+// linkEventVersion is bumped on incompatible changes to LinkEvent.
+const linkEventVersion = 1
+
+// LinkEvent is the message published for every lifecycle change. It is
+// JSON-encoded and keyed by tenant/short_code, so all events for a link
+// land on one partition in order. Consumers should ignore unknown fields;
+// removing or retyping a field bumps version.
+//
+//	{
+//	  "version": 1,
+//	  "id": "9f0c...",               // unique per event, for de-duplication
+//	  "type": "link.clicked",        // link.created, link.expired, link.deleted, link.clicked
+//	  "at": "2024-05-01T12:00:00Z",
+//	  "tenant": "acme",              // omitted for the default tenant
+//	  "short_code": "promo",
+//	  "owner": "alice",
+//	  "long_url": "https://example.com/",
+//	  "campaign_id": "c1",
+//	  "expires_at": "2024-05-02T12:00:00Z",
+//	  "clicks": 42,
+//	  "restorable_until": "...",     // link.deleted, when the link went to the trash
+//	  "click": {...}                 // link.clicked: referrer, user agent, client IP
+//	}
+type LinkEvent struct {
+	Version    int       `json:"version"`
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	At         time.Time `json:"at"`
+	Tenant     string    `json:"tenant,omitempty"`
+	ShortCode  string    `json:"short_code"`
+	Owner      string    `json:"owner,omitempty"`
+	LongURL    string    `json:"long_url"`
+	CampaignID string    `json:"campaign_id,omitempty"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Clicks     int64     `json:"clicks"`
+
+	RestorableUntil *time.Time   `json:"restorable_until,omitempty"`
+	Click           *ClickRecord `json:"click,omitempty"`
+}
+
+func newLinkEvent(typ string, l *Link) LinkEvent {
+	id := make([]byte, 12)
+	_, _ = rand.Read(id)
+	return LinkEvent{
+		Version:    linkEventVersion,
+		ID:         hex.EncodeToString(id),
+		Type:       typ,
+		At:         time.Now().UTC(),
+		Tenant:     l.Tenant,
+		ShortCode:  l.ShortCode,
+		Owner:      l.Owner,
+		LongURL:    l.LongURL,
+		CampaignID: l.CampaignID,
+		ExpiresAt:  l.ExpiresAt,
+		Clicks:     l.Clicks,
+	}
+}
+
+// EventPublisher ships lifecycle events to an external bus. Publish must
+// not block the request path.
+type EventPublisher interface {
+	Publish(ctx context.Context, ev LinkEvent)
+	Close() error
+}
+
+// kafkaPublisher writes link.clicked events to clickTopic and everything
+// else to topic. Writes are asynchronous; failures are logged and the
+// events dropped.
+type kafkaPublisher struct {
+	w          *kafka.Writer
+	topic      string
+	clickTopic string
+}
+
+func newKafkaPublisher(brokers, topic, clickTopic string) *kafkaPublisher {
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(brokers, ",")...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireOne,
+		Async:        true,
+		BatchTimeout: 50 * time.Millisecond,
+		Completion: func(msgs []kafka.Message, err error) {
+			if err != nil {
+				metricEventsFailed.Add(int64(len(msgs)))
+				logrus.WithError(err).WithField("messages", len(msgs)).Warn("publishing link events failed")
+				return
+			}
+			metricEventsPublished.Add(int64(len(msgs)))
+		},
+	}
+	return &kafkaPublisher{w: w, topic: topic, clickTopic: clickTopic}
+}
+
+func (p *kafkaPublisher) Publish(ctx context.Context, ev LinkEvent) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	topic := p.topic
+	if ev.Type == EventLinkClicked {
+		topic = p.clickTopic
+	}
+	msg := kafka.Message{
+		Topic: topic,
+		Key:   []byte(ev.Tenant + "/" + ev.ShortCode),
+		Value: b,
+		Headers: []kafka.Header{
+			{Key: "type", Value: []byte(ev.Type)},
+		},
+	}
+	if err := p.w.WriteMessages(ctx, msg); err != nil {
+		metricEventsFailed.Add(1)
+		logrus.WithError(err).WithField("type", ev.Type).Warn("publishing link event failed")
+	}
+}
+
+func (p *kafkaPublisher) Close() error { return p.w.Close() }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// publishHandler serves POST /api/links/{code}/publish and .../unpublish.
+// Drafts keep their code reserved but 404 on redirect until published.
+func publishHandler(store *Store, draft bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, err := store.SetDraft(r.Context(), codeVar(r), ownerFrom(r.Context()), draft)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, link)
+	}
+}
+
+// Page sizes of link listings. maxListLimit is the documented largest
+// page; walk longer listings with the cursor each page returns.
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// listLimit parses the limit parameter of a listing.
+func listLimit(v string) (int, *APIError) {
+	if v == "" {
+		return defaultListLimit, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > maxListLimit {
+		return 0, fieldError("limit", "limit must be an integer between 1 and "+strconv.Itoa(maxListLimit))
+	}
+	return n, nil
+}
+
+// pageParams parses the limit and cursor parameters of a paged listing.
+func pageParams(q url.Values) (int, *pageCursor, *APIError) {
+	limit, apiErr := listLimit(q.Get("limit"))
+	if apiErr != nil {
+		return 0, nil, apiErr
+	}
+	after, apiErr := decodeCursor(q.Get("cursor"))
+	return limit, after, apiErr
+}
+
+// withNext adds next_cursor to a page's response when there is a next
+// page.
+func withNext(resp map[string]interface{}, next string) map[string]interface{} {
+	if next != "" {
+		resp["next_cursor"] = next
+	}
+	return resp
+}
+
+// listLinksHandler serves GET /api/links?q=...&limit=N with the caller's
+// links, newest first; deleted=true lists the trash, folder=name one
+// folder, and each meta=key:value keeps only links with that metadata.
+// next_cursor, when set, is passed back as cursor for the next page.
+func listLinksHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		limit, after, apiErr := pageParams(q)
+		if apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		meta, err := parseMetadataFilter(q["meta"])
+		if err != nil {
+			writeAPIError(w, r, fieldError("meta", err.Error()))
+			return
+		}
+		page, err := store.ListPage(r.Context(), ownerFrom(r.Context()), ListFilter{
+			Query:    q.Get("q"),
+			Folder:   q.Get("folder"),
+			Deleted:  q.Get("deleted") == "true",
+			Metadata: meta,
+		}, after, limit)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		links, next := page.links()
+		writeCachedJSON(w, r, withNext(map[string]interface{}{"links": links}, next), latestUpdate(links))
+	}
+}
+
+// deleteLinkHandler serves DELETE /api/links/{code}. Within the configured
+// grace period the link can be brought back with restoreLinkHandler.
+func deleteLinkHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := store.Delete(r.Context(), codeVar(r), ownerFrom(r.Context())); err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// restoreLinkHandler serves POST /api/links/{code}/restore.
+func restoreLinkHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, err := store.Restore(r.Context(), codeVar(r), ownerFrom(r.Context()))
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, link)
+	}
+}
+
+// Clone creates a new link with the settings of code but fresh stats. A
+// zero validity reuses the original link's lifetime.
+func (s *Store) Clone(ctx context.Context, code, owner, custom string, validity time.Duration) (*Link, error) {
+	src, err := s.Get(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	if !canManage(owner, src) {
+		return nil, ErrNotFound
+	}
+	if validity == 0 {
+		validity = src.ExpiresAt.Sub(src.CreatedAt)
+		if src.SlidingTTL {
+			validity = time.Duration(src.TTLSeconds) * time.Second
+		}
+		validity = s.clampValidity(owner, validity)
+	}
+	return s.Create(ctx, src.LongURL, custom, validity, LinkOptions{
+		Draft:         src.Draft,
+		Owner:         src.Owner,
+		SlidingTTL:    src.SlidingTTL,
+		CampaignID:    src.CampaignID,
+		BurnAfterRead: src.BurnAfterRead,
+		Passthrough:   src.Passthrough,
+		Signed:        src.Signed,
+		Claims:        src.Claims,
+		FallbackURL:   src.FallbackURL,
+		Notes:         src.Notes,
+		Metadata:      src.Metadata,
+		Privacy:       src.Privacy,
+		Milestones:    src.Milestones,
+		Destinations:  destinationRequests(src.Destinations),
+		Rotation:      src.Rotation,
+		AllowedIPs:    src.AllowedIPs,
+		Schedule:      src.Schedule,
+		Public:        src.Public,
+		Headers:       src.Headers,
+		NoIndex:       src.NoIndex,
+		Card:          src.Card,
+		Interstitial:  src.Interstitial,
+		ClientHints:   src.ClientHints,
+	})
+}
+
+// cloneLinkHandler serves POST /api/links/{code}/clone. The body is
+// optional and may set custom_code and validity_minutes or expires_at for
+// the copy.
+func cloneLinkHandler(store *Store, quotas *Quotas) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			CustomCode     string     `json:"custom_code,omitempty"`
+			ValidityMinute int        `json:"validity_minutes,omitempty"`
+			ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+		}
+		if r.ContentLength != 0 {
+			if apiErr := decodeJSON(r, &req); apiErr != nil {
+				writeAPIError(w, r, apiErr)
+				return
+			}
+		}
+		owner := ownerFrom(r.Context())
+		validity, clamped, err := store.requestedValidity(owner, req.ValidityMinute, req.ExpiresAt)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		if apiErr := quotas.CheckCreate(r.Context(), store, owner); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		link, err := store.Clone(r.Context(), codeVar(r), owner, req.CustomCode, validity)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		quotas.RecordCreate(r.Context(), owner)
+		resp := store.shortenResponse(link)
+		resp.ValidityClamped = clamped
+		writeJSON(w, http.StatusCreated, resp)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Bulk actions an admin can apply to the links a search matches.
+const (
+	BulkExpire      = "expire"
+	BulkDelete      = "delete"
+	BulkRetag       = "retag"
+	BulkChangeOwner = "change_owner"
+)
+
+const (
+	maxSearchPattern = 1024
+	// maxBulkLinks bounds one bulk action; larger sets must be narrowed
+	// down, which also keeps a mistyped filter from hitting everything.
+	maxBulkLinks = 10000
+)
+
+// LinkSearch selects links across owners and tenants. Every set field
+// must match; links in the trash and reservations are never matched.
+type LinkSearch struct {
+	// Destination is a regular expression (RE2 syntax) searched for in
+	// the destination URL and in every rotating destination.
+	Destination   string            `json:"destination,omitempty"`
+	Owner         *string           `json:"owner,omitempty"`  // "" matches unowned links
+	Tenant        *string           `json:"tenant,omitempty"` // "" matches the default tenant
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	CreatedAfter  *time.Time        `json:"created_after,omitempty"`
+	CreatedBefore *time.Time        `json:"created_before,omitempty"`
+	MinClicks     int64             `json:"min_clicks,omitempty"`
+}
+
+func (f *LinkSearch) empty() bool {
+	return f.Destination == "" && f.Owner == nil && f.Tenant == nil && len(f.Metadata) == 0 &&
+		f.CreatedAfter == nil && f.CreatedBefore == nil && f.MinClicks == 0
+}
+
+// compile validates f and returns its matcher.
+func (f *LinkSearch) compile() (func(*Link) bool, *APIError) {
+	var re *regexp.Regexp
+	if f.Destination != "" {
+		if len(f.Destination) > maxSearchPattern {
+			return nil, fieldError("destination", fmt.Sprintf("destination must not exceed %d bytes", maxSearchPattern))
+		}
+		var err error
+		if re, err = regexp.Compile(f.Destination); err != nil {
+			return nil, fieldError("destination", "destination must be a valid regular expression: "+err.Error())
+		}
+	}
+	if f.MinClicks < 0 {
+		return nil, fieldError("min_clicks", "min_clicks must not be negative")
+	}
+	if f.CreatedAfter != nil && f.CreatedBefore != nil && !f.CreatedAfter.Before(*f.CreatedBefore) {
+		return nil, fieldError("created_before", "created_before must be after created_after")
+	}
+	return func(l *Link) bool {
+		if l.Deleted() || l.Reserved {
+			return false
+		}
+		if (f.Owner != nil && l.Owner != *f.Owner) || (f.Tenant != nil && l.Tenant != *f.Tenant) ||
+			l.Clicks < f.MinClicks || !matchesMetadata(l.Metadata, f.Metadata) {
+			return false
+		}
+		if (f.CreatedAfter != nil && l.CreatedAt.Before(*f.CreatedAfter)) ||
+			(f.CreatedBefore != nil && !l.CreatedAt.Before(*f.CreatedBefore)) {
+			return false
+		}
+		return re == nil || matchesDestination(re, l)
+	}, nil
+}
+
+func matchesDestination(re *regexp.Regexp, l *Link) bool {
+	if re.MatchString(l.LongURL) {
+		return true
+	}
+	for _, d := range l.Destinations {
+		if re.MatchString(d.URL) {
+			return true
+		}
+	}
+	return false
+}
+
+// Search returns the links match accepts, from every tenant, newest
+// first.
+func (s *Store) Search(ctx context.Context, match func(*Link) bool) ([]*Link, error) {
+	out := []*Link{}
+	err := s.backend.ScanFrom(ctx, nil, func(l *Link) bool {
+		if match(l) {
+			out = append(out, l)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SearchPage returns the page of Search's links after the cursor, at
+// most limit of them.
+func (s *Store) SearchPage(ctx context.Context, match func(*Link) bool, after *pageCursor, limit int) (*linkPage, error) {
+	page := newLinkPage(limit)
+	err := s.backend.ScanFrom(ctx, after.position(), func(l *Link) bool {
+		if match(l) {
+			return page.add(l)
+		}
+		return true
+	})
+	return page, err
+}
+
+type searchRequest struct {
+	LinkSearch
+	Limit  int    `json:"limit,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// searchLinksHandler serves POST /api/admin/links/search. A response
+// with next_cursor has more matches; send it back as cursor, with the
+// same filter, for the next page.
+func searchLinksHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req searchRequest
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		if req.Limit == 0 {
+			req.Limit = defaultListLimit
+		}
+		if req.Limit < 1 || req.Limit > maxListLimit {
+			writeAPIError(w, r, fieldError("limit", fmt.Sprintf("limit must be between 1 and %d", maxListLimit)))
+			return
+		}
+		after, apiErr := decodeCursor(req.Cursor)
+		if apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		match, apiErr := req.compile()
+		if apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		page, err := store.SearchPage(r.Context(), match, after, req.Limit)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		links, next := page.links()
+		writeJSON(w, http.StatusOK, withNext(map[string]interface{}{"links": links}, next))
+	}
+}
+
+type bulkRequest struct {
+	Filter LinkSearch `json:"filter"`
+	Action string     `json:"action"`
+	DryRun bool       `json:"dry_run,omitempty"`
+
+	// Metadata is the retag change: a null value removes the key.
+	Metadata map[string]*string `json:"metadata,omitempty"`
+	// Owner is the new owner for change_owner.
+	Owner string `json:"owner,omitempty"`
+}
+
+// BulkTarget identifies one matched link.
+type BulkTarget struct {
+	ShortCode string `json:"short_code"`
+	Tenant    string `json:"tenant,omitempty"`
+	LongURL   string `json:"long_url"`
+	Owner     string `json:"owner,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type bulkResponse struct {
+	Action  string       `json:"action"`
+	DryRun  bool         `json:"dry_run"`
+	Matched int          `json:"matched"`
+	Applied int          `json:"applied"`
+	Failed  int          `json:"failed"`
+	Links   []BulkTarget `json:"links"`
+}
+
+// bulkAction returns the change req asks for, applied to one link.
+func (s *Store) bulkAction(req *bulkRequest) (func(context.Context, *Link) error, *APIError) {
+	switch req.Action {
+	case BulkExpire:
+		return s.expireNow, nil
+	case BulkDelete:
+		return func(ctx context.Context, l *Link) error {
+			return s.deleteKey(ctx, l.Key(), "")
+		}, nil
+	case BulkRetag:
+		if len(req.Metadata) == 0 {
+			return nil, fieldError("metadata", "retag needs metadata to set or remove")
+		}
+		return func(ctx context.Context, l *Link) error {
+			_, err := s.backend.Update(ctx, l.Key(), func(l *Link) error {
+				return applyMetadataPatch(l, req.Metadata)
+			})
+			return err
+		}, nil
+	case BulkChangeOwner:
+		if req.Owner == "" {
+			return nil, fieldError("owner", "change_owner needs an owner")
+		}
+		return func(ctx context.Context, l *Link) error {
+			if tenantOf(req.Owner) != l.Tenant {
+				return errors.New("owner belongs to another tenant")
+			}
+			_, err := s.backend.Update(ctx, l.Key(), func(l *Link) error {
+				l.Owner = req.Owner
+				return nil
+			})
+			return err
+		}, nil
+	default:
+		return nil, fieldError("action", "action must be expire, delete, retag or change_owner")
+	}
+}
+
+// expireNow ends the link's lifetime; the next sweep removes it.
+func (s *Store) expireNow(ctx context.Context, l *Link) error {
+	now := s.now()
+	_, err := s.backend.Update(ctx, l.Key(), func(l *Link) error {
+		if l.ExpiresAt.After(now) {
+			l.ExpiresAt = now
+			l.SlidingTTL = false
+		}
+		return nil
+	})
+	return err
+}
+
+// applyMetadataPatch sets or, for nil values, removes keys of l.Metadata.
+func applyMetadataPatch(l *Link, patch map[string]*string) error {
+	md := make(map[string]string, len(l.Metadata)+len(patch))
+	for k, v := range l.Metadata {
+		md[k] = v
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(md, k)
+		} else {
+			md[k] = *v
+		}
+	}
+	if err := validateMetadata(md); err != nil {
+		return fieldError("metadata", err.Error())
+	}
+	if len(md) == 0 {
+		md = nil
+	}
+	l.Metadata = md
+	return nil
+}
+
+// bulkLinksHandler serves POST /api/admin/links/bulk: it applies an action
+// to every link the filter matches or, with dry_run, lists them. A link
+// that fails does not stop the others; it is reported with its error.
+func bulkLinksHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req bulkRequest
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		if req.Filter.empty() {
+			writeAPIError(w, r, fieldError("filter", "filter must set at least one condition"))
+			return
+		}
+		apply, apiErr := store.bulkAction(&req)
+		if apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		match, apiErr := req.Filter.compile()
+		if apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		links, err := store.Search(r.Context(), match)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		if len(links) > maxBulkLinks {
+			writeAPIError(w, r, fieldError("filter", fmt.Sprintf("filter matches %d links, more than the %d one bulk action may change", len(links), maxBulkLinks)))
+			return
+		}
+		resp := bulkResponse{Action: req.Action, DryRun: req.DryRun, Matched: len(links), Links: make([]BulkTarget, 0, len(links))}
+		for _, l := range links {
+			t := BulkTarget{ShortCode: l.ShortCode, Tenant: l.Tenant, LongURL: l.LongURL, Owner: l.Owner}
+			if !req.DryRun {
+				if err := apply(r.Context(), l); err != nil {
+					t.Error = err.Error()
+					resp.Failed++
+				} else {
+					resp.Applied++
+				}
+			}
+			resp.Links = append(resp.Links, t)
+		}
+		if !req.DryRun {
+			logrus.WithFields(logrus.Fields{
+				"action":  "bulk_" + req.Action,
+				"admin":   ownerFrom(r.Context()),
+				"matched": resp.Matched,
+				"applied": resp.Applied,
+				"failed":  resp.Failed,
+			}).Warn("bulk link action applied")
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
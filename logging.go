@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// LogConfig controls the application and access log output.
+type LogConfig struct {
+	Format     string // LOG_FORMAT: "text" or "json"
+	Level      string // LOG_LEVEL: any logrus level name
+	File       string // LOG_FILE: path to write to instead of stdout
+	MaxSizeMB  int    // LOG_MAX_SIZE_MB before the file is rotated
+	MaxBackups int    // LOG_MAX_BACKUPS rotated files to keep
+	MaxAgeDays int    // LOG_MAX_AGE_DAYS to keep rotated files
+
+	RedirectSampleRate int           // LOG_REDIRECT_SAMPLE_RATE, log 1 in N redirects
+	SlowThreshold      time.Duration // LOG_SLOW_THRESHOLD, flag slower requests with slow=true
+
+	// URLRedaction (LOG_URL_REDACTION) keeps tokens and email addresses
+	// carried in URLs out of the logs: RedactNone, RedactQuery or
+	// RedactFull.
+	URLRedaction string
+}
+
+// URL redaction modes.
+const (
+	RedactNone  = "none"
+	RedactQuery = "query" // drop query strings and fragments
+	RedactFull  = "full"  // replace whole URLs
+)
+
+// redactedURL replaces URLs under RedactFull.
+const redactedURL = "[redacted-url]"
+
+// urlPattern finds absolute URLs anywhere in a log line: destinations,
+// webhook targets, and the ones net/http quotes in its errors.
+var urlPattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>]+`)
+
+// redactURLs rewrites every URL in s according to mode.
+func redactURLs(mode, s string) string {
+	if mode != RedactQuery && mode != RedactFull || !strings.Contains(s, "://") {
+		return s
+	}
+	return urlPattern.ReplaceAllStringFunc(s, func(u string) string {
+		if mode == RedactFull {
+			return redactedURL
+		}
+		if i := strings.IndexAny(u, "?#"); i >= 0 {
+			return u[:i]
+		}
+		return u
+	})
+}
+
+// urlRedactionHook applies redactURLs to the message and every string or
+// error field of each entry, whichever package logged it.
+type urlRedactionHook struct{ mode string }
+
+func (h urlRedactionHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (h urlRedactionHook) Fire(e *logrus.Entry) error {
+	e.Message = redactURLs(h.mode, e.Message)
+	for k, v := range e.Data {
+		switch v := v.(type) {
+		case string:
+			e.Data[k] = redactURLs(h.mode, v)
+		case error:
+			if s := v.Error(); strings.Contains(s, "://") {
+				e.Data[k] = redactURLs(h.mode, s)
+			}
+		}
+	}
+	return nil
+}
+
+func setupLogging(cfg LogConfig) {
+	if cfg.Format == "json" {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	}
+
+	level, err := logrus.ParseLevel(cfg.Level)
+	if err != nil {
+		logrus.WithField("level", cfg.Level).Warn("unknown LOG_LEVEL, using info")
+		level = logrus.InfoLevel
+	}
+	logrus.SetLevel(level)
+
+	switch cfg.URLRedaction {
+	case "", RedactNone:
+	case RedactQuery, RedactFull:
+		logrus.AddHook(urlRedactionHook{mode: cfg.URLRedaction})
+	default:
+		logrus.WithField("mode", cfg.URLRedaction).Fatal("LOG_URL_REDACTION must be none, query or full")
+	}
+
+	var out io.Writer = os.Stdout
+	if cfg.File != "" {
+		out = &lumberjack.Logger{
+			Filename:   cfg.File,
+			MaxSize:    cfg.MaxSizeMB,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAgeDays,
+			Compress:   true,
+		}
+	}
+	logrus.SetOutput(out)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"url-shortener/storage"
+)
+
+// Lookup returns owner's live links pointing at longURL (compared by
+// storage.CanonicalURL), newest first. An empty owner sees every link.
+func (s *Store) Lookup(ctx context.Context, owner, longURL string) ([]*Link, error) {
+	links, err := s.backend.FindByURL(ctx, longURL)
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+	tenant := tenantFrom(ctx)
+	out := []*Link{}
+	for _, l := range links {
+		if l.Tenant != tenant || (owner != "" && l.Owner != owner) {
+			continue
+		}
+		if l.Burned || l.Deleted() || l.Reserved || now.After(l.ExpiresAt) {
+			continue
+		}
+		out = append(out, l)
+	}
+	sort.Slice(out, func(i, j int) bool { return listedBefore(out[i], out[j]) })
+	return out, nil
+}
+
+// lookupHandler serves GET /api/lookup?url=..., answering "has this
+// destination already been shortened?" for the caller, a page of links
+// at a time.
+func lookupHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, after, apiErr := pageParams(r.URL.Query())
+		if apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		raw := r.URL.Query().Get("url")
+		if _, err := url.ParseRequestURI(raw); err != nil {
+			e := fieldError("url", "url must be an absolute URL")
+			e.Code = ErrCodeInvalidURL
+			writeAPIError(w, r, e)
+			return
+		}
+		links, err := store.Lookup(r.Context(), ownerFrom(r.Context()), raw)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		links, next := pageOf(links, storage.PositionOf, storage.Position.Before, after, limit)
+		writeCachedJSON(w, r, withNext(map[string]interface{}{
+			"url":   storage.CanonicalURL(raw),
+			"links": links,
+		}, next), latestUpdate(links))
+	}
+}
@@ -1,254 +1,1809 @@
-package main
-
-import (
-	"encoding/json"
-	"fmt"
-	"math/rand"
-	"net/http"
-	"net/url"
-	"sync"
-	"time"
-
-	"github.com/gorilla/mux"
-	"github.com/sirupsen/logrus"
-
-	"url-shortener/middleware"
-)
-
-const (
-	DefaultValidityMinutes = 30
-	CodeLength             = 6
-)
-
-var base62 = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
-
-type Link struct {
-	LongURL   string    json:"long_url"
-	ShortCode string    json:"short_code"
-	CreatedAt time.Time json:"created_at"
-	ExpiresAt time.Time json:"expires_at"
-	Clicks    int64     json:"clicks"
-}
-
-type Store struct {
-	sync.RWMutex
-	data   map[string]*Link
-	domain string // e.g. http://localhost:8080
-}
-
-func NewStore(domain string) *Store {
-	return &Store{
-		data:   make(map[string]*Link),
-		domain: domain,
-	}
-}
-
-func (s *Store) Create(longURL string, custom string, validity time.Duration) (*Link, error) {
-	s.Lock()
-	defer s.Unlock()
-
-	// validate URL
-	_, err := url.ParseRequestURI(longURL)
-	if err != nil {
-		return nil, fmt.Errorf("invalid url")
-	}
-
-	var code string
-	if custom != "" {
-		if _, exists := s.data[custom]; exists {
-			return nil, fmt.Errorf("custom code already exists")
-		}
-		code = custom
-	} else {
-		// generate unique code
-		for {
-			code = generateCode(CodeLength)
-			if _, exists := s.data[code]; !exists {
-				break
-			}
-		}
-	}
-
-	now := time.Now().UTC()
-	l := &Link{
-		LongURL:   longURL,
-		ShortCode: code,
-		CreatedAt: now,
-		ExpiresAt: now.Add(validity),
-		Clicks:    0,
-	}
-	s.data[code] = l
-	logrus.WithFields(logrus.Fields{
-		"action":     "create",
-		"short_code": code,
-		"long_url":   longURL,
-		"expires_at": l.ExpiresAt,
-	}).Info("link created")
-	return l, nil
-}
-
-func (s *Store) Get(code string) (*Link, bool) {
-	s.RLock()
-	defer s.RUnlock()
-	l, ok := s.data[code]
-	return l, ok
-}
-
-func (s *Store) Increment(code string) {
-	s.Lock()
-	defer s.Unlock()
-	if l, ok := s.data[code]; ok {
-		l.Clicks++
-	}
-}
-
-func (s *Store) CleanupExpired() {
-	for {
-		time.Sleep(1 * time.Minute)
-		now := time.Now().UTC()
-		s.Lock()
-		for k, v := range s.data {
-			if now.After(v.ExpiresAt) {
-				delete(s.data, k)
-				logrus.WithField("short_code", k).Info("expired and removed")
-			}
-		}
-		s.Unlock()
-	}
-}
-
-func generateCode(n int) string {
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = base62[rand.Intn(len(base62))]
-	}
-	return string(b)
-}
-
-/* --- HTTP Handlers --- */
-
-type ShortenRequest struct {
-	URL            string json:"url"
-	CustomCode     string json:"custom_code,omitempty"
-	ValidityMinute int    json:"validity_minutes,omitempty"
-}
-
-type ShortenResponse struct {
-	ShortURL  string    json:"short_url"
-	ShortCode string    json:"short_code"
-	ExpiresAt time.Time json:"expires_at"
-	LongURL   string    json:"long_url"
-}
-
-func shortenHandler(store *Store) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var req ShortenRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			httpError(w, http.StatusBadRequest, "invalid json")
-			return
-		}
-		if req.URL == "" {
-			httpError(w, http.StatusBadRequest, "url is required")
-			return
-		}
-		validity := time.Duration(DefaultValidityMinutes) * time.Minute
-		if req.ValidityMinute > 0 {
-			validity = time.Duration(req.ValidityMinute) * time.Minute
-		}
-		link, err := store.Create(req.URL, req.CustomCode, validity)
-		if err != nil {
-			httpError(w, http.StatusBadRequest, err.Error())
-			return
-		}
-		resp := ShortenResponse{
-			ShortURL:  fmt.Sprintf("%s/%s", store.domain, link.ShortCode),
-			ShortCode: link.ShortCode,
-			ExpiresAt: link.ExpiresAt,
-			LongURL:   link.LongURL,
-		}
-		writeJSON(w, http.StatusCreated, resp)
-	}
-}
-
-func redirectHandler(store *Store) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		code := vars["code"]
-		link, ok := store.Get(code)
-		if !ok {
-			httpError(w, http.StatusNotFound, "short link not found")
-			return
-		}
-		if time.Now().UTC().After(link.ExpiresAt) {
-			httpError(w, http.StatusGone, "short link expired")
-			return
-		}
-		store.Increment(code)
-		logrus.WithFields(logrus.Fields{
-			"action":     "redirect",
-			"short_code": code,
-			"to":         link.LongURL,
-		}).Info("redirecting")
-		http.Redirect(w, r, link.LongURL, http.StatusFound)
-	}
-}
-
-func statsHandler(store *Store) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		code := vars["code"]
-		link, ok := store.Get(code)
-		if !ok {
-			httpError(w, http.StatusNotFound, "short link not found")
-			return
-		}
-		writeJSON(w, http.StatusOK, link)
-	}
-}
-
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
-}
-
-/* --- helpers --- */
-
-func httpError(w http.ResponseWriter, status int, msg string) {
-	writeJSON(w, status, map[string]string{"error": msg})
-}
-
-func writeJSON(w http.ResponseWriter, status int, v interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	_ = json.NewEncoder(w).Encode(v)
-}
-
-func main() {
-	rand.Seed(time.Now().UnixNano())
-	logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
-
-	domain := "http://localhost:8080" // change if deploying
-	store := NewStore(domain)
-	go store.CleanupExpired()
-
-	r := mux.NewRouter()
-
-	// 👇 Apply logging middleware globally
-	r.Use(middleware.LoggingMiddleware)
-
-	api := r.PathPrefix("/api").Subrouter()
-	api.HandleFunc("/shorten", shortenHandler(store)).Methods("POST")
-	api.HandleFunc("/stats/{code}", statsHandler(store)).Methods("GET")
-	r.HandleFunc("/health", healthHandler).Methods("GET")
-	r.HandleFunc("/{code}", redirectHandler(store)).Methods("GET")
-
-	srv := &http.Server{
-		Handler:      r,
-		Addr:         ":8080",
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-	}
-	logrus.Infof("starting server on %s", srv.Addr)
-	if err := srv.ListenAndServe(); err != nil {
-		logrus.Fatal(err)
-	}
-}
\ No newline at end of file
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+
+	"url-shortener/cluster"
+	"url-shortener/edge"
+	"url-shortener/jsonpool"
+	"url-shortener/middleware"
+	"url-shortener/objectstore"
+	"url-shortener/ratelimit"
+	"url-shortener/storage"
+)
+
+const (
+	DefaultValidityMinutes = 30
+	CodeLength             = 6
+
+	// maxCodeAttempts bounds the collision retries of a single Create.
+	maxCodeAttempts = 100
+)
+
+var base62 = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
+
+type Link = storage.Link
+
+// LinkOptions carries the optional per-link settings accepted on creation.
+type LinkOptions struct {
+	Draft         bool
+	Owner         string
+	SlidingTTL    bool
+	CampaignID    string
+	BurnAfterRead bool
+	Passthrough   bool
+	Signed        bool
+	Claims        map[string]string
+	Style         string // StyleRandom (the configured strategy) or StyleWords
+	FallbackURL   string
+	OnConflict    string // what a taken custom code does; ConflictError by default
+	Notes         string
+	Metadata      map[string]string
+	Privacy       bool
+	Milestones    []int64
+	Flatten       bool // follow short-link destinations to the final URL
+	Destinations  []DestinationRequest
+	Rotation      string
+	AllowedIPs    []string // CIDR ranges that may follow the link
+	Schedule      *storage.Schedule
+	Public        bool // listed in the public directory
+	Headers       map[string]string
+	NoIndex       bool
+	Card          *storage.Card // shown to preview crawlers
+	Interstitial  *storage.Interstitial
+	ClientHints   bool // ask for and count client hints
+
+	// DryRun runs every check Create would but writes nothing. Generated
+	// codes are not drawn, so the returned link has no ShortCode unless a
+	// custom one was given.
+	DryRun bool
+}
+
+// OnConflict policies for custom codes that are already taken.
+const (
+	ConflictError          = "error"           // fail with ErrCodeExists
+	ConflictOverwrite      = "overwrite"       // replace the caller's existing link
+	ConflictReturnExisting = "return_existing" // hand back the caller's existing link
+)
+
+// Store applies the shortener's rules (validation, code generation,
+// expiry bookkeeping) on top of a storage backend.
+type Store struct {
+	backend storage.Storage
+	clock   Clock
+	domain  string       // e.g. http://localhost:8080
+	clicks  ClickCounter // optional shared counter; nil counts locally
+	tenants *Tenants     // resolves tenant domains for short URLs
+	codes   CodeGenerator
+	words   CodeGenerator // readable codes for StyleWords
+	filter  *CodeFilter   // rejects offensive codes; nil allows all
+	events  *ClickBus     // optional; receives every counted click
+	archive *ClickArchive // optional; raw clicks for export
+
+	publisher EventPublisher  // optional; lifecycle events for external consumers
+	geo       GeoResolver     // optional; locates clicks
+	privacy   *Privacy        // optional; scrubs click records
+	batch     *ClickBatcher   // optional; journals clicks and flushes them in batches
+	validity  *ValidityLimits // optional; bounds how long links may live
+	notifier  *Notifier       // optional; sends click milestone alerts
+	series    ClickSeries     // optional; clicks over time
+	referrers ReferrerRollup  // optional; clicks per referrer host and day
+	flattener *Flattener      // optional; resolves short-link destinations
+	loopMode  string          // LoopReject, LoopWarn or LoopOff; "" is off
+	flags     *Flags          // optional; nil uses the flag defaults
+	fraud     *FraudDetector  // optional; flags suspicious clicks
+	rotations rotations       // round-robin positions of rotating links
+	aliases   *Aliases        // further codes for existing links
+	folders   FolderStore     // folders shared with other users
+	previews  *PreviewFetcher // optional; reads destination titles
+	pages     *Pages          // renders visitor-facing HTML pages
+	edge      edge.Cache      // optional; receives pre-warmed redirects
+
+	// destPolicy applies to tenants without a DomainPolicy of their own.
+	destPolicy DomainPolicy
+
+	// redirectHeaders, REDIRECT_HEADERS, go on every redirect; a link's
+	// own Headers override them.
+	redirectHeaders map[string]string
+
+	// defaultValidity is DEFAULT_VALIDITY in nanoseconds, swapped on
+	// reload; zero means DefaultValidityMinutes.
+	defaultValidity atomic.Int64
+
+	// deleteGrace is how long soft-deleted links can be restored; zero
+	// deletes immediately.
+	deleteGrace time.Duration
+
+	// sharedBackend is set when other instances see the same links, as
+	// in cluster mode, so that only the leader sweeps them.
+	sharedBackend bool
+}
+
+func NewStore(domain string, backend storage.Storage) *Store {
+	return &Store{
+		backend: backend,
+		clock:   systemClock{},
+		domain:  domain,
+		codes:   newRandomCodes(CodeLength, CodeLength, 0),
+		words:   newWordCodes(),
+		aliases: NewAliases(),
+		folders: newMemoryFolders(),
+	}
+}
+
+func (s *Store) Create(ctx context.Context, longURL string, custom string, validity time.Duration, opts LinkOptions) (*Link, error) {
+	l, _, err := s.CreateOrResolve(ctx, longURL, custom, validity, opts)
+	return l, err
+}
+
+// CreateOrResolve is Create with opts.OnConflict applied to a taken custom
+// code; created is false when an existing link was returned or
+// overwritten. Only links the caller can manage are ever reused, and the
+// check and write happen in one backend update.
+func (s *Store) CreateOrResolve(ctx context.Context, longURL string, custom string, validity time.Duration, opts LinkOptions) (link *Link, created bool, err error) {
+	// validate URL
+	_, err = url.ParseRequestURI(longURL)
+	if err != nil {
+		return nil, false, ErrInvalidURL
+	}
+	if err := s.checkDestination(ctx, "url", longURL); err != nil {
+		return nil, false, err
+	}
+	if opts.FallbackURL != "" {
+		if _, err := url.ParseRequestURI(opts.FallbackURL); err != nil {
+			return nil, false, fieldError("fallback_url", "fallback_url must be an absolute URL")
+		}
+		if err := s.checkDestination(ctx, "fallback_url", opts.FallbackURL); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := validateNotes(opts.Notes); err != nil {
+		return nil, false, fieldError("notes", err.Error())
+	}
+	if err := validateMetadata(opts.Metadata); err != nil {
+		return nil, false, fieldError("metadata", err.Error())
+	}
+	milestones, err := validateMilestones(opts.Milestones)
+	if err != nil {
+		return nil, false, fieldError("milestones", err.Error())
+	}
+	allowedIPs, err := parseAllowedIPs(opts.AllowedIPs)
+	if err != nil {
+		return nil, false, err
+	}
+	schedule, err := validateSchedule(opts.Schedule)
+	if err != nil {
+		return nil, false, err
+	}
+	headers, err := validateRedirectHeaders("headers", opts.Headers, false)
+	if err != nil {
+		return nil, false, err
+	}
+	card, err := validateCard(opts.Card)
+	if err != nil {
+		return nil, false, err
+	}
+	interstitial, err := validateInterstitial("interstitial", opts.Interstitial)
+	if err != nil {
+		return nil, false, err
+	}
+	var destinations []storage.Destination
+	rotation := ""
+	if len(opts.Destinations) > 0 {
+		if destinations, rotation, err = s.validateDestinations(ctx, opts.Rotation, opts.Destinations); err != nil {
+			return nil, false, err
+		}
+	}
+	var chain []string
+	if opts.Flatten && s.flattener != nil {
+		if longURL, chain, err = s.flatten(ctx, longURL); err != nil {
+			return nil, false, err
+		}
+		if err := s.checkDestination(ctx, "url", longURL); err != nil {
+			return nil, false, err
+		}
+	}
+	var (
+		loopTargets map[string]bool
+		cyclic      bool
+	)
+	if s.loopMode == LoopReject || s.loopMode == LoopWarn {
+		loopTargets, cyclic = s.ownTargets(ctx, longURL)
+		for _, d := range destinations[min(len(destinations), 1):] {
+			targets, c := s.ownTargets(ctx, d.URL)
+			if loopTargets == nil {
+				loopTargets = map[string]bool{}
+			}
+			for k := range targets {
+				loopTargets[k] = true
+			}
+			cyclic = cyclic || c
+		}
+	}
+	if cyclic {
+		if err := s.loopFound(longURL, "the short links it points through loop"); err != nil {
+			return nil, false, err
+		}
+	}
+
+	now := s.now()
+	l := &Link{
+		LongURL:       longURL,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(validity),
+		Clicks:        0,
+		Draft:         opts.Draft,
+		Owner:         opts.Owner,
+		CampaignID:    opts.CampaignID,
+		BurnAfterRead: opts.BurnAfterRead,
+		Passthrough:   opts.Passthrough,
+		Signed:        opts.Signed,
+		Claims:        opts.Claims,
+		FallbackURL:   opts.FallbackURL,
+		Notes:         opts.Notes,
+		Metadata:      opts.Metadata,
+		Privacy:       opts.Privacy,
+		Milestones:    milestones,
+		RedirectChain: chain,
+		Destinations:  destinations,
+		Rotation:      rotation,
+		AllowedIPs:    allowedIPs,
+		Schedule:      schedule,
+		Headers:       headers,
+		NoIndex:       opts.NoIndex,
+		Card:          card,
+		Interstitial:  interstitial,
+		ClientHints:   opts.ClientHints,
+		Public:        opts.Public,
+	}
+	if opts.SlidingTTL {
+		l.SlidingTTL = true
+		l.TTLSeconds = int64(validity / time.Second)
+	}
+
+	l.Tenant = tenantFrom(ctx)
+	if custom != "" {
+		if strings.Contains(custom, storage.KeySeparator) {
+			return nil, false, fieldError("custom_code", "custom_code must not contain "+storage.KeySeparator)
+		}
+		if apiErr := validateFolderCode(custom); apiErr != nil {
+			return nil, false, apiErr
+		}
+		if s.filter.Blocked(custom) {
+			return nil, false, ErrCodeBlocked
+		}
+		l.ShortCode = custom
+		if s.aliases.taken(l.Key()) {
+			return nil, false, ErrCodeExists
+		}
+		if loopTargets[l.Key()] {
+			if err := s.loopFound(longURL, "it leads back to this short link"); err != nil {
+				return nil, false, err
+			}
+		}
+		if opts.DryRun {
+			return s.dryRunCustom(ctx, l, opts)
+		}
+		for {
+			err := s.backend.Create(ctx, l)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, storage.ErrExists) {
+				return nil, false, err
+			}
+			claimed, err := s.claimReservation(ctx, l, opts.Owner)
+			if err == nil {
+				l = claimed
+				break
+			}
+			if !errors.Is(err, errNotReserved) {
+				if errors.Is(err, ErrNotFound) {
+					continue
+				}
+				return nil, false, err
+			}
+			existing, err := s.resolveConflict(ctx, l, opts)
+			if errors.Is(err, ErrNotFound) {
+				continue // removed since Create failed; try again
+			}
+			return existing, false, err
+		}
+	} else if opts.DryRun {
+		return l, true, nil
+	} else {
+		// generate unique code
+		gen := s.codes
+		if opts.Style == StyleWords {
+			gen = s.words
+		}
+		observer, _ := gen.(collisionObserver)
+		for attempt := 0; ; attempt++ {
+			if attempt == maxCodeAttempts {
+				return nil, false, ErrCodeSpaceExhausted
+			}
+			code, err := gen.Next(ctx)
+			if err != nil {
+				return nil, false, err
+			}
+			if s.filter.Blocked(code) {
+				metricCodeBlocked.Add(1)
+				continue
+			}
+			l.ShortCode = code
+			if loopTargets[l.Key()] && s.loopMode == LoopReject {
+				continue // someone linked to this code before it existed
+			}
+			if s.aliases.taken(l.Key()) {
+				metricCodeCollisions.Add(1)
+				continue
+			}
+			err = s.backend.Create(ctx, l)
+			collided := errors.Is(err, storage.ErrExists)
+			if observer != nil {
+				observer.Observe(collided)
+			}
+			if err == nil {
+				break
+			}
+			if !collided {
+				return nil, false, err
+			}
+			metricCodeCollisions.Add(1)
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"action":     "create",
+		"short_code": l.ShortCode,
+		"long_url":   longURL,
+		"expires_at": l.ExpiresAt,
+		"draft":      l.Draft,
+		"owner":      l.Owner,
+	}).Info("link created")
+	s.emit(ctx, newLinkEvent(EventLinkCreated, l))
+	s.fetchPreview(l)
+	return l, true, nil
+}
+
+// dryRunCustom reports what Create would do with the custom code on l
+// without writing: created is false if opts.OnConflict would reuse the
+// existing link.
+func (s *Store) dryRunCustom(ctx context.Context, l *Link, opts LinkOptions) (*Link, bool, error) {
+	existing, err := s.backend.Get(ctx, l.Key())
+	if errors.Is(err, ErrNotFound) {
+		return l, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if existing.Reserved {
+		if !claimable(opts.Owner, existing, s.now()) {
+			return nil, false, ErrCodeExists
+		}
+		return l, true, nil
+	}
+	switch opts.OnConflict {
+	case ConflictReturnExisting:
+		if canManage(opts.Owner, existing) && !existing.Deleted() {
+			return existing, false, nil
+		}
+	case ConflictOverwrite:
+		if canManage(opts.Owner, existing) {
+			l.Clicks, l.CreatedAt = existing.Clicks, existing.CreatedAt
+			return l, false, nil
+		}
+	}
+	return nil, false, ErrCodeExists
+}
+
+// resolveConflict applies opts.OnConflict to the link already stored under
+// want's key. It returns ErrNotFound if that link has disappeared.
+func (s *Store) resolveConflict(ctx context.Context, want *Link, opts LinkOptions) (*Link, error) {
+	switch opts.OnConflict {
+	case ConflictReturnExisting:
+		l, err := s.backend.Get(ctx, want.Key())
+		if err != nil {
+			return nil, err
+		}
+		if !canManage(opts.Owner, l) || l.Deleted() {
+			return nil, ErrCodeExists
+		}
+		return l, nil
+	case ConflictOverwrite:
+		l, err := s.backend.Update(ctx, want.Key(), func(l *Link) error {
+			if !canManage(opts.Owner, l) {
+				return ErrCodeExists
+			}
+			kept := *l
+			*l = *want.Clone()
+			l.Clicks, l.CreatedAt, l.ClickSeq = kept.Clicks, kept.CreatedAt, kept.ClickSeq
+			// Overwriting must not lift a takedown.
+			l.TakenDownAt, l.TakedownReason = kept.TakenDownAt, kept.TakedownReason
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		logrus.WithFields(logrus.Fields{
+			"action":     "overwrite",
+			"short_code": l.ShortCode,
+			"long_url":   l.LongURL,
+			"owner":      l.Owner,
+		}).Info("link overwritten")
+		return l, nil
+	default:
+		return nil, ErrCodeExists
+	}
+}
+
+// emit hands ev to the publisher, if one is configured.
+func (s *Store) emit(ctx context.Context, ev LinkEvent) {
+	if s.publisher != nil {
+		s.publisher.Publish(ctx, ev)
+	}
+}
+
+// clicked records a counted click, as returned by Increment or Consume,
+// in the time series, the archive and on the event bus.
+func (s *Store) clicked(ctx context.Context, l *Link, rec ClickRecord) {
+	if l == nil {
+		return
+	}
+	rec.Geo = s.locate(rec.ClientIP)
+	s.checkFraud(ctx, l, &rec)
+	if !s.flags.Enabled(FlagAnalytics, l.Owner) {
+		return
+	}
+	s.recordSeries(ctx, l, rec.At)
+	s.recordReferrer(ctx, l, rec)
+	if s.privacy.suppress(&rec) {
+		return
+	}
+	if s.privacy.applies(l) {
+		s.privacy.scrub(ctx, &rec)
+	}
+	s.archive.Add(rec)
+	ev := newLinkEvent(EventLinkClicked, l)
+	ev.Click = &rec
+	s.emit(ctx, ev)
+}
+
+// defaultTTL is how long links live when the request does not say.
+func (s *Store) defaultTTL() time.Duration {
+	if d := time.Duration(s.defaultValidity.Load()); d > 0 {
+		return d
+	}
+	return time.Duration(DefaultValidityMinutes) * time.Minute
+}
+
+// Get returns a copy of the link, or ErrNotFound. Deleted links and
+// reservations are not found.
+func (s *Store) Get(ctx context.Context, code string) (*Link, error) {
+	l, err := s.backend.Get(ctx, s.key(ctx, code))
+	if err == nil && (l.Deleted() || l.Reserved) {
+		err = ErrNotFound
+	}
+	metricLookups.Add(1)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			metricLookupMisses.Add(1)
+		}
+		return nil, err
+	}
+	return l, nil
+}
+
+// exists reports whether code is taken; backend errors count as taken.
+func (s *Store) exists(ctx context.Context, code string) bool {
+	_, err := s.backend.Get(ctx, s.key(ctx, code))
+	return !errors.Is(err, ErrNotFound)
+}
+
+// SetDraft moves a link between the draft and published states.
+func (s *Store) SetDraft(ctx context.Context, code, owner string, draft bool) (*Link, error) {
+	l, err := s.backend.Update(ctx, s.key(ctx, code), func(l *Link) error {
+		if !s.canWrite(ctx, owner, l) || l.Deleted() || l.Reserved {
+			return ErrNotFound
+		}
+		l.Draft = draft
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"action":     "set_draft",
+		"short_code": code,
+		"draft":      draft,
+	}).Info("link state changed")
+	return l, nil
+}
+
+// ListFilter narrows Store.List.
+type ListFilter struct {
+	Query    string            // case-insensitive substring of code or destination
+	Folder   string            // only codes in this folder (see FolderSeparator)
+	Deleted  bool              // list the trash instead of live links
+	Metadata map[string]string // every pair must be present on the link
+}
+
+// List returns the links visible to owner (all of the tenant's links when
+// owner is "", and those in folders shared with owner) that match f,
+// newest first.
+func (s *Store) List(ctx context.Context, owner string, f ListFilter) ([]*Link, error) {
+	out := []*Link{}
+	err := s.scanList(ctx, owner, f, nil, func(l *Link) bool {
+		out = append(out, l)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListPage returns the page of List's links after the cursor, at most
+// limit of them.
+func (s *Store) ListPage(ctx context.Context, owner string, f ListFilter, after *pageCursor, limit int) (*linkPage, error) {
+	page := newLinkPage(limit)
+	return page, s.scanList(ctx, owner, f, after, page.add)
+}
+
+// scanList calls fn, in listing order from the cursor, with every link
+// List would return until fn returns false.
+func (s *Store) scanList(ctx context.Context, owner string, f ListFilter, after *pageCursor, fn func(*Link) bool) error {
+	query := strings.ToLower(f.Query)
+	visible, err := s.visibleTo(ctx, owner)
+	if err != nil {
+		return err
+	}
+	return s.backend.ScanFrom(ctx, after.position(), func(l *Link) bool {
+		if !visible(l) {
+			return true
+		}
+		if l.Deleted() != f.Deleted || !matchesMetadata(l.Metadata, f.Metadata) ||
+			(f.Folder != "" && folderOf(l.ShortCode) != f.Folder) {
+			return true
+		}
+		if query != "" && !strings.Contains(strings.ToLower(l.ShortCode), query) &&
+			!strings.Contains(strings.ToLower(l.LongURL), query) {
+			return true
+		}
+		return fn(l)
+	})
+}
+
+// Delete moves a link owner may write to the trash, or removes it
+// outright when no grace period is configured.
+func (s *Store) Delete(ctx context.Context, code, owner string) error {
+	return s.deleteKey(ctx, s.key(ctx, code), owner)
+}
+
+// deleteKey is Delete for the link stored under key.
+func (s *Store) deleteKey(ctx context.Context, key, owner string) error {
+	if s.deleteGrace > 0 {
+		l, err := s.backend.Update(ctx, key, func(l *Link) error {
+			if !s.canWrite(ctx, owner, l) || l.Deleted() || l.Reserved {
+				return ErrNotFound
+			}
+			now := s.now()
+			l.DeletedAt = &now
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{
+			"action":     "delete",
+			"short_code": l.ShortCode,
+			"owner":      owner,
+			"restorable": s.deleteGrace.String(),
+		}).Info("link moved to trash")
+		ev := newLinkEvent(EventLinkDeleted, l)
+		until := l.DeletedAt.Add(s.deleteGrace)
+		ev.RestorableUntil = &until
+		s.emit(ctx, ev)
+		return nil
+	}
+	l, err := s.backend.Get(ctx, key)
+	if err == nil && (l.Deleted() || l.Reserved) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !s.canWrite(ctx, owner, l) {
+		return ErrNotFound
+	}
+	if err := s.purge(ctx, key, true); err != nil {
+		return err
+	}
+	s.emit(ctx, newLinkEvent(EventLinkDeleted, l))
+	return nil
+}
+
+// Restore takes a link owner may write back out of the trash.
+func (s *Store) Restore(ctx context.Context, code, owner string) (*Link, error) {
+	l, err := s.backend.Update(ctx, s.key(ctx, code), func(l *Link) error {
+		if !s.canWrite(ctx, owner, l) || !l.Deleted() || s.purgeable(l, s.now()) {
+			return ErrNotFound
+		}
+		l.DeletedAt = nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"action":     "restore",
+		"short_code": code,
+		"owner":      owner,
+	}).Info("link restored")
+	return l, nil
+}
+
+// purgeable reports whether a trashed link's grace period has run out.
+func (s *Store) purgeable(l *Link, now time.Time) bool {
+	return l.Deleted() && now.After(l.DeletedAt.Add(s.deleteGrace))
+}
+
+// purge removes the link stored under key and, if dropCounter is set,
+// its shared click total.
+func (s *Store) purge(ctx context.Context, key string, dropCounter bool) error {
+	if err := s.backend.Delete(ctx, key); err != nil {
+		return err
+	}
+	if dropCounter && s.clicks != nil {
+		_ = s.clicks.Delete(ctx, key)
+	}
+	if dropCounter && s.series != nil {
+		_ = s.series.Delete(ctx, key)
+	}
+	s.fraud.Forget(key)
+	s.aliases.forget(key)
+	s.rotations.forget(key)
+	logrus.WithFields(logrus.Fields{
+		"action":      "delete",
+		"storage_key": key,
+	}).Info("link deleted")
+	return nil
+}
+
+// pendingExpiryNotices returns live, owned links whose owner has not yet
+// been told they are expiring.
+func (s *Store) pendingExpiryNotices(ctx context.Context) []*Link {
+	now := s.now()
+	var out []*Link
+	err := s.backend.Scan(ctx, func(l *Link) bool {
+		if l.Owner != "" && !l.ExpiryNotified && !l.Draft && !l.Deleted() && !l.Reserved && now.Before(l.ExpiresAt) {
+			out = append(out, l)
+		}
+		return true
+	})
+	if err != nil {
+		logrus.WithError(err).Warn("scanning for expiring links failed")
+	}
+	return out
+}
+
+var errAlreadyNotified = errors.New("already notified")
+
+// markExpiryNotified flags the link stored under key as notified,
+// returning false if it is gone or was already flagged.
+func (s *Store) markExpiryNotified(ctx context.Context, key string) bool {
+	_, err := s.backend.Update(ctx, key, func(l *Link) error {
+		if l.ExpiryNotified {
+			return errAlreadyNotified
+		}
+		l.ExpiryNotified = true
+		return nil
+	})
+	return err == nil
+}
+
+// clearExpiryNotified undoes markExpiryNotified after a failed notice.
+func (s *Store) clearExpiryNotified(ctx context.Context, key string) {
+	_, err := s.backend.Update(ctx, key, func(l *Link) error {
+		l.ExpiryNotified = false
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		logrus.WithError(err).WithField("storage_key", key).Warn("clearing expiry notice mark failed")
+	}
+}
+
+// Increment records a click with breakdown b and, for sliding-TTL links,
+// pushes ExpiresAt out to a full TTL from now in the same atomic update.
+// It returns the updated link, or nil if the click could not be recorded.
+func (s *Store) Increment(ctx context.Context, code string, b *clickBreakdown) *Link {
+	key := s.key(ctx, code)
+	if s.batch != nil {
+		return s.incrementBatched(ctx, code, key, b)
+	}
+	shared := int64(-1)
+	if s.clicks != nil {
+		n, err := s.clicks.Incr(ctx, key)
+		if err == nil {
+			shared = n
+		} else {
+			logrus.WithError(err).WithField("short_code", code).Warn("shared click counter failed, counting locally")
+		}
+	}
+	prev := shared - 1
+	l, err := s.backend.Update(ctx, key, func(l *Link) error {
+		if shared >= 0 {
+			l.Clicks = shared
+		} else {
+			prev = l.Clicks
+			l.Clicks++
+		}
+		b.apply(l)
+		if l.SlidingTTL {
+			if exp := s.now().Add(time.Duration(l.TTLSeconds) * time.Second); exp.After(l.ExpiresAt) {
+				l.ExpiresAt = exp
+				l.ExpiryNotified = false
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			logrus.WithError(err).WithField("short_code", code).Warn("recording click failed")
+		}
+		return nil
+	}
+	s.publishClick(ctx, l)
+	s.checkMilestones(l, prev)
+	return l
+}
+
+// incrementBatched journals the click and leaves the backend update to
+// the next flush; the returned link counts the clicks still pending.
+func (s *Store) incrementBatched(ctx context.Context, code, key string, b *clickBreakdown) *Link {
+	l, err := s.backend.Get(ctx, key)
+	if err != nil {
+		return nil
+	}
+	if err := s.batch.Add(key, b); err != nil {
+		logrus.WithError(err).WithField("short_code", code).Warn("journaling click failed")
+		return nil
+	}
+	l.Clicks += s.batch.Pending(key)
+	s.publishClick(ctx, l)
+	return l
+}
+
+func (s *Store) publishClick(ctx context.Context, l *Link) {
+	if s.events != nil {
+		s.events.Publish(ctx, ClickEvent{ShortCode: l.ShortCode, Tenant: l.Tenant, Clicks: l.Clicks, At: s.now()})
+	}
+}
+
+// Consume atomically burns a burn-after-read link and counts the click
+// with breakdown b.
+// Only the first caller succeeds; later ones get ErrConsumed.
+func (s *Store) Consume(ctx context.Context, code string, b *clickBreakdown) (*Link, error) {
+	l, err := s.backend.Update(ctx, s.key(ctx, code), func(l *Link) error {
+		if l.Burned {
+			return ErrConsumed
+		}
+		l.Burned = true
+		l.Clicks++
+		b.apply(l)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.clicks != nil {
+		if _, err := s.clicks.Incr(ctx, l.Key()); err != nil {
+			logrus.WithError(err).WithField("short_code", code).Warn("shared click counter failed")
+		}
+	}
+	s.publishClick(ctx, l)
+	logrus.WithFields(logrus.Fields{
+		"action":     "burn",
+		"short_code": code,
+	}).Info("burn-after-read link consumed")
+	return l, nil
+}
+
+// Stats is Get with the click total refreshed from the shared counter, so
+// every instance reports cluster-wide numbers, and with clicks still
+// waiting for a batch flush included.
+func (s *Store) Stats(ctx context.Context, code string) (*Link, error) {
+	l, err := s.Get(ctx, code)
+	if err != nil {
+		return l, err
+	}
+	l.Clicks += s.batch.Pending(l.Key())
+	if s.clicks == nil {
+		return l, nil
+	}
+	n, err := s.clicks.Get(ctx, l.Key())
+	if err != nil {
+		logrus.WithError(err).WithField("short_code", code).Warn("shared click counter failed, serving local count")
+		return l, nil
+	}
+	l.Clicks = n
+	return l, nil
+}
+
+// CleanupExpired evicts expired links every interval, as cleanup does.
+func (s *Store) CleanupExpired(interval time.Duration, elector Elector) {
+	for {
+		time.Sleep(interval)
+		s.cleanup(context.Background(), elector)
+	}
+}
+
+// cleanup runs the expiry sweep if it is this instance's to run. With a
+// backend of its own each instance sheds its own links, but state shared
+// across the cluster (the Redis click counters) is only purged by the
+// elected leader so instances don't stampede the shared store. With a
+// shared backend the leader alone sweeps at all.
+func (s *Store) cleanup(ctx context.Context, elector Elector) (removed, purged int) {
+	leader := elector.IsLeader()
+	if s.sharedBackend && !leader {
+		return 0, 0
+	}
+	return s.sweep(ctx, leader)
+}
+
+// sweep removes expired links and purges trashed ones past their grace
+// period, returning how many of each it removed.
+func (s *Store) sweep(ctx context.Context, leader bool) (removed, purgedN int) {
+	now := s.now()
+	var expired []*Link
+	var purged []string
+	err := s.backend.Scan(ctx, func(l *Link) bool {
+		if now.After(l.ExpiresAt) {
+			expired = append(expired, l)
+		} else if s.purgeable(l, now) {
+			purged = append(purged, l.Key())
+		}
+		return true
+	})
+	if err != nil {
+		logrus.WithError(err).Warn("expiry sweep failed")
+		return 0, 0
+	}
+	for _, l := range expired {
+		k := l.Key()
+		if err := s.backend.Delete(ctx, k); err != nil {
+			continue
+		}
+		removed++
+		if leader && s.clicks != nil {
+			_ = s.clicks.Delete(ctx, k)
+		}
+		if leader && s.series != nil {
+			_ = s.series.Delete(ctx, k)
+		}
+		s.fraud.Forget(k)
+		s.aliases.forget(k)
+		s.rotations.forget(k)
+		logrus.WithField("storage_key", k).Info("expired and removed")
+		if !l.Deleted() && !l.Reserved {
+			s.emit(ctx, newLinkEvent(EventLinkExpired, l))
+		}
+	}
+	for _, k := range purged {
+		if s.purge(ctx, k, leader) == nil {
+			purgedN++
+		}
+	}
+	return removed, purgedN
+}
+
+func generateCode(n int) string {
+	b := make([]rune, n)
+	for i := range b {
+		b[i] = base62[rand.Intn(len(base62))]
+	}
+	return string(b)
+}
+
+/* --- HTTP Handlers --- */
+
+type ShortenRequest struct {
+	URL            string `json:"url"`
+	CustomCode     string `json:"custom_code,omitempty"`
+	ValidityMinute int    `json:"validity_minutes,omitempty"`
+	Draft          bool   `json:"draft,omitempty"`
+	SlidingTTL     bool   `json:"sliding_ttl,omitempty"`
+	CampaignID     string `json:"campaign_id,omitempty"`
+	BurnAfterRead  bool   `json:"burn_after_read,omitempty"`
+	Passthrough    bool   `json:"passthrough,omitempty"`
+
+	// ExpiresAt is an absolute alternative to ValidityMinute, RFC 3339
+	// with any offset.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	Signed bool              `json:"signed,omitempty"`
+	Claims map[string]string `json:"claims,omitempty"`
+
+	// Style picks how a generated code looks: "random" (default) or
+	// "words" for codes like blue-tiger-42.
+	Style string `json:"style,omitempty"`
+
+	// FallbackURL is used while health checks report URL as down.
+	FallbackURL string `json:"fallback_url,omitempty"`
+
+	// OnConflict decides what happens when custom_code is taken: "error"
+	// (default, 409), "overwrite" or "return_existing". Either of the
+	// latter only applies to links the caller owns and answers 200.
+	OnConflict string `json:"on_conflict,omitempty"`
+
+	Notes    string            `json:"notes,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Privacy scrubs personal data from this link's click records.
+	Privacy bool `json:"privacy,omitempty"`
+
+	// Milestones are click totals, e.g. [100, 1000, 10000], that notify
+	// the owner's configured channels when passed.
+	Milestones []int64 `json:"milestones,omitempty"`
+
+	// Flatten overrides FLATTEN_REDIRECTS: when url is itself a short
+	// link, store the destination it finally leads to.
+	Flatten *bool `json:"flatten,omitempty"`
+
+	// Destinations rotate a link between 2 to 20 URLs per Rotation:
+	// "round_robin" (default) or "weighted". url may be left out, and is
+	// otherwise the first destination.
+	Destinations []DestinationRequest `json:"destinations,omitempty"`
+	Rotation     string               `json:"rotation,omitempty"`
+
+	// AllowedIPs restricts who may follow the link to clients in these
+	// IPs or CIDR ranges, e.g. ["10.0.0.0/8"]; others get a 403 page.
+	AllowedIPs []string `json:"allowed_ips,omitempty"`
+
+	// Schedule limits redirects to opening hours, e.g. 09:00-18:00
+	// mon-fri in Europe/Berlin; outside them visitors are asked to come
+	// back later.
+	Schedule *storage.Schedule `json:"schedule,omitempty"`
+
+	// Public lists the link in the /links.json and /links.xml directory.
+	Public bool `json:"public,omitempty"`
+
+	// Headers are added to the redirect response, e.g.
+	// {"Referrer-Policy": "no-referrer", "X-Robots-Tag": "noindex"},
+	// after and over the server-wide REDIRECT_HEADERS.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// NoIndex sends X-Robots-Tag: noindex with the redirect so that
+	// search engines leave the link out, and keeps it out of the public
+	// directory.
+	NoIndex bool `json:"noindex,omitempty"`
+
+	// Card is the title, description and image_url that Slack, Twitter
+	// and other preview crawlers are shown for the short link; people
+	// are still redirected.
+	Card *storage.Card `json:"card,omitempty"`
+
+	// Interstitial shows browsers a notice, e.g. an exit notice, with a
+	// countdown of seconds (default 5) before the redirect. It overrides
+	// the tenant's.
+	Interstitial *storage.Interstitial `json:"interstitial,omitempty"`
+
+	// ClientHints sends Accept-CH on the link's interstitial page and
+	// breaks its clicks down by the browser, platform, device model and
+	// language the requests report; see GET /api/stats/{code}/devices.
+	ClientHints bool `json:"client_hints,omitempty"`
+
+	// ValidateOnly, like ?dry_run=true, checks the request and answers
+	// with the link that would be created without creating it.
+	ValidateOnly bool `json:"validate_only,omitempty"`
+}
+
+type ShortenResponse struct {
+	ShortURL      string    `json:"short_url"`
+	ShortCode     string    `json:"short_code"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	LongURL       string    `json:"long_url"`
+	Draft         bool      `json:"draft,omitempty"`
+	SlidingTTL    bool      `json:"sliding_ttl,omitempty"`
+	BurnAfterRead bool      `json:"burn_after_read,omitempty"`
+	Passthrough   bool      `json:"passthrough,omitempty"`
+	Signed        bool      `json:"signed,omitempty"`
+	FallbackURL   string    `json:"fallback_url,omitempty"`
+
+	Notes    string            `json:"notes,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Privacy  bool              `json:"privacy,omitempty"`
+
+	Milestones    []int64  `json:"milestones,omitempty"`
+	RedirectChain []string `json:"redirect_chain,omitempty"`
+
+	Destinations []storage.Destination `json:"destinations,omitempty"`
+	Rotation     string                `json:"rotation,omitempty"`
+	AllowedIPs   []string              `json:"allowed_ips,omitempty"`
+	Schedule     *storage.Schedule     `json:"schedule,omitempty"`
+	Public       bool                  `json:"public,omitempty"`
+	Headers      map[string]string     `json:"headers,omitempty"`
+	NoIndex      bool                  `json:"noindex,omitempty"`
+	Card         *storage.Card         `json:"card,omitempty"`
+	Interstitial *storage.Interstitial `json:"interstitial,omitempty"`
+	ClientHints  bool                  `json:"client_hints,omitempty"`
+
+	// ValidityClamped is set when the requested validity_minutes fell
+	// outside the server's limits and ExpiresAt reflects the nearest bound.
+	ValidityClamped bool `json:"validity_clamped,omitempty"`
+
+	// DryRun marks a validation-only response; nothing was stored.
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// isDryRun reports whether ?dry_run asks for validation only.
+func isDryRun(r *http.Request) bool {
+	v, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	return v
+}
+
+// shortenHandler serves POST /api/shorten. Dry runs go through the same
+// validation, availability and quota checks and answer 200 with the link
+// that would have been created. Behind attachReservationHandler the code
+// comes from the path.
+func shortenHandler(store *Store, campaigns *Campaigns, quotas *Quotas, signer *Signer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ShortenRequest
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		dryRun := req.ValidateOnly || isDryRun(r)
+		if code := codeVar(r); code != "" {
+			req.CustomCode = code
+		}
+		if len(req.Destinations) > 0 {
+			if req.URL == "" {
+				req.URL = req.Destinations[0].URL
+			}
+			if apiErr := rotationConflict(req); apiErr != nil {
+				writeAPIError(w, r, apiErr)
+				return
+			}
+		} else if req.Rotation != "" {
+			writeAPIError(w, r, fieldError("rotation", "rotation requires destinations"))
+			return
+		}
+		if req.URL == "" {
+			writeAPIError(w, r, fieldError("url", "url is required"))
+			return
+		}
+		if req.Style != "" && req.Style != StyleRandom && req.Style != StyleWords {
+			writeAPIError(w, r, fieldError("style", "style must be random or words"))
+			return
+		}
+		switch req.OnConflict {
+		case "", ConflictError, ConflictOverwrite, ConflictReturnExisting:
+		default:
+			writeAPIError(w, r, fieldError("on_conflict", "on_conflict must be error, overwrite or return_existing"))
+			return
+		}
+		if req.Style != "" && req.CustomCode != "" {
+			writeAPIError(w, r, fieldError("style", "style cannot be combined with custom_code"))
+			return
+		}
+		if req.Signed && signer == nil {
+			writeAPIError(w, r, fieldError("signed", "link signing is not configured on this server"))
+			return
+		}
+		if len(req.Claims) > 0 && !req.Signed {
+			writeAPIError(w, r, fieldError("claims", "claims require signed to be true"))
+			return
+		}
+		if err := validateClaims(req.Claims); err != nil {
+			writeAPIError(w, r, fieldError("claims", err.Error()))
+			return
+		}
+		if req.CampaignID != "" {
+			if _, err := campaigns.Get(req.CampaignID, ownerFrom(r.Context())); err != nil {
+				writeAPIError(w, r, fieldError("campaign_id", "campaign_id does not match any of your campaigns"))
+				return
+			}
+		}
+		owner := ownerFrom(r.Context())
+		validity, clamped, err := store.requestedValidity(owner, req.ValidityMinute, req.ExpiresAt)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		if validity == 0 {
+			validity = store.clampValidity(owner, store.defaultTTL())
+		}
+		if !dryRun && plainRequest(req) && store.flags.Enabled(FlagDedupe, owner) {
+			if l, err := store.findDuplicate(r.Context(), owner, req.URL); err == nil {
+				writeJSON(w, http.StatusOK, store.shortenResponse(l))
+				return
+			}
+		}
+		if apiErr := quotas.CheckCreate(r.Context(), store, owner); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		link, created, err := store.CreateOrResolve(r.Context(), req.URL, req.CustomCode, validity, LinkOptions{
+			Draft:         req.Draft,
+			Owner:         owner,
+			SlidingTTL:    req.SlidingTTL,
+			CampaignID:    req.CampaignID,
+			BurnAfterRead: req.BurnAfterRead,
+			Passthrough:   req.Passthrough,
+			Signed:        req.Signed,
+			Claims:        req.Claims,
+			Style:         req.Style,
+			FallbackURL:   req.FallbackURL,
+			OnConflict:    req.OnConflict,
+			Notes:         req.Notes,
+			Metadata:      req.Metadata,
+			Privacy:       req.Privacy,
+			Milestones:    req.Milestones,
+			Flatten:       store.flattener.wanted(req.Flatten) && len(req.Destinations) == 0,
+			Destinations:  req.Destinations,
+			Rotation:      req.Rotation,
+			AllowedIPs:    req.AllowedIPs,
+			Schedule:      req.Schedule,
+			Public:        req.Public,
+			Headers:       req.Headers,
+			NoIndex:       req.NoIndex,
+			Card:          req.Card,
+			Interstitial:  req.Interstitial,
+			ClientHints:   req.ClientHints,
+			DryRun:        dryRun,
+		})
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		resp := store.shortenResponse(link)
+		resp.ValidityClamped = clamped && created
+		if dryRun {
+			resp.DryRun = true
+			if link.ShortCode == "" {
+				resp.ShortURL = ""
+			}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		if !created {
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		quotas.RecordCreate(r.Context(), owner)
+		writeJSON(w, http.StatusCreated, resp)
+	}
+}
+
+func (s *Store) shortenResponse(link *Link) ShortenResponse {
+	return ShortenResponse{
+		ShortURL:      s.shortURL(link),
+		ShortCode:     link.ShortCode,
+		ExpiresAt:     link.ExpiresAt,
+		LongURL:       link.LongURL,
+		Draft:         link.Draft,
+		SlidingTTL:    link.SlidingTTL,
+		BurnAfterRead: link.BurnAfterRead,
+		Passthrough:   link.Passthrough,
+		Signed:        link.Signed,
+		FallbackURL:   link.FallbackURL,
+		Notes:         link.Notes,
+		Metadata:      link.Metadata,
+		Privacy:       link.Privacy,
+		Milestones:    link.Milestones,
+		RedirectChain: link.RedirectChain,
+		Destinations:  link.Destinations,
+		Rotation:      link.Rotation,
+		AllowedIPs:    link.AllowedIPs,
+		Schedule:      link.Schedule,
+		Public:        link.Public,
+		Headers:       link.Headers,
+		NoIndex:       link.NoIndex,
+		Card:          link.Card,
+		Interstitial:  link.Interstitial,
+		ClientHints:   link.ClientHints,
+	}
+}
+
+func statsHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, err := store.Stats(r.Context(), codeVar(r))
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeCachedJSON(w, r, link, link.UpdatedAt)
+	}
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+/* --- helpers --- */
+
+func httpError(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	writeAPIError(w, r, newAPIError(status, code, msg))
+}
+
+// decodeJSON strictly decodes a single JSON object from the request body into
+// v. Unknown fields, trailing data and oversized bodies are rejected; the
+// returned error is ready to be written with writeAPIError.
+func decodeJSON(r *http.Request, v interface{}) *APIError {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		var maxErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxErr):
+			return newAPIError(http.StatusRequestEntityTooLarge, ErrCodeBodyTooLarge,
+				fmt.Sprintf("request body must not exceed %d bytes", maxErr.Limit))
+		case errors.Is(err, io.EOF):
+			return newAPIError(http.StatusBadRequest, ErrCodeInvalidJSON, "request body must not be empty")
+		case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+			return newAPIError(http.StatusBadRequest, ErrCodeInvalidJSON, "request body contains malformed json")
+		case errors.As(err, &typeErr) && typeErr.Field != "":
+			return fieldError(typeErr.Field, fmt.Sprintf("%s must be %s", typeErr.Field, describeKind(typeErr.Type.Kind())))
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+			return fieldError(field, fmt.Sprintf("unknown field %q", field))
+		default:
+			return newAPIError(http.StatusBadRequest, ErrCodeInvalidJSON, "invalid json")
+		}
+	}
+	if dec.More() {
+		return newAPIError(http.StatusBadRequest, ErrCodeInvalidJSON, "request body must contain a single json object")
+	}
+	return nil
+}
+
+func describeKind(k reflect.Kind) string {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// writeJSON encodes v into a pooled buffer before sending it, which also
+// gives the response a Content-Length.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	if err := jsonpool.Write(w, status, v); err != nil {
+		logrus.WithError(err).Error("encoding response failed")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func main() {
+	rand.Seed(time.Now().UnixNano())
+	file, err := loadConfigFile()
+	if err != nil {
+		logrus.WithError(err).Fatal("cannot read CONFIG_FILE")
+	}
+	cfg := loadConfig()
+	check := flag.Bool("check", false, "validate the configuration, storage and stored links, print a JSON report and exit")
+	flag.Parse()
+	if *check {
+		rep := selfCheck(context.Background(), cfg)
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(rep)
+		if !rep.OK {
+			os.Exit(1)
+		}
+		return
+	}
+	setupLogging(cfg.Log)
+	accessWriter, err := newAccessLogWriter(cfg.AccessLog, cfg.Log)
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid access log settings")
+	}
+	var accessLog *AccessLog
+	if accessWriter != nil {
+		accessLog = NewAccessLog(accessWriter, cfg.AccessLog.Buffer, cfg.AccessLog.BatchSize, cfg.AccessLog.FlushInterval)
+		go accessLog.Run()
+	}
+
+	shutdownTracing, err := setupTracing(context.Background(), cfg.Tracing)
+	if err != nil {
+		logrus.WithError(err).Fatal("cannot set up tracing")
+	}
+	defer shutdownTracing(context.Background())
+
+	domain := "http://localhost:8080" // change if deploying
+	backendName := cfg.StorageBackend
+	backend, err := openBackend(cfg)
+	if err != nil {
+		logrus.WithError(err).Fatal("cannot open storage")
+	}
+	if cfg.StorageBackend == "sqlite" {
+		logrus.WithField("path", cfg.SQLitePath).Info("storing links in sqlite")
+	}
+	if cfg.MirrorBackend != "" {
+		logrus.WithField("mirror", cfg.MirrorBackend).Info("mirroring every write to a second backend")
+	}
+	node := newClusterNode(cfg.Cluster)
+	var clustered *cluster.Storage
+	if node != nil {
+		if cfg.Cluster.Secret == "" {
+			logrus.Fatal("CLUSTER_SECRET is required in cluster mode")
+		}
+		clustered = cluster.NewStorage(backend, node)
+		backend, backendName = clustered, "cluster"
+		startCluster(clustered)
+		logrus.WithFields(logrus.Fields{"self": node.Self(), "replicas": node.Replicas()}).Info("cluster mode")
+	}
+	encrypted := newEncryptedStorage(cfg.Encryption, backend)
+	if encrypted != nil {
+		backend = encrypted
+		logrus.WithField("active_key", encrypted.ActiveKey()).Info("destination URLs are encrypted at rest")
+	}
+	store := NewStore(domain, storage.Traced(backend, backendName))
+	store.sharedBackend = clustered != nil
+	if cache := newEdgeCache(cfg.Edge); cache != nil {
+		store.edge = cache
+		store.backend = newEdgeSync(store.backend, store, cache)
+	}
+	info := newVersionInfo(cfg, backendName)
+	logrus.WithFields(logrus.Fields{
+		"version": info.Version,
+		"commit":  info.Commit,
+	}).Info("url-shortener build")
+	store.deleteGrace = cfg.DeleteGrace
+	blocked, err := blocklistTerms(cfg.Codes.Blocklist, cfg.Codes.BlocklistFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("cannot read CODE_BLOCKLIST_FILE")
+	}
+	store.filter = NewCodeFilter(blocked)
+
+	var limiter ratelimit.Limiter = ratelimit.NewMemory(cfg.RateLimitPerMinute, time.Minute)
+	var elector Elector = soloElector{}
+	var idem IdempotencyStore = newMemoryIdempotency()
+	var usage UsageCounter = newMemoryUsage()
+	var modeStore ModeStore = &memoryModeStore{}
+	var tokens TokenStore = newMemoryTokens()
+	var reports ReportStore = newMemoryReports()
+	var reportLimiter ratelimit.Limiter = ratelimit.NewMemory(cfg.Abuse.RateLimitPerHour, time.Hour)
+	var publicLimiter ratelimit.Limiter = ratelimit.NewMemory(cfg.Public.RateLimitPerHour, time.Hour)
+	store.events = NewClickBus()
+	var rdb *redis.Client
+	if cfg.CoordinationMode == "redis" {
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			logrus.WithError(err).Fatal("invalid REDIS_URL")
+		}
+		rdb = redis.NewClient(opts)
+		if err := rdb.Ping(context.Background()).Err(); err != nil {
+			logrus.WithError(err).Fatal("cannot reach redis")
+		}
+		limiter = ratelimit.NewRedis(rdb, cfg.RedisPrefix, cfg.RateLimitPerMinute, time.Minute)
+		store.clicks = newRedisCounter(rdb, cfg.RedisPrefix)
+		idem = newRedisIdempotency(rdb, cfg.RedisPrefix)
+		usage = &redisUsage{client: rdb, prefix: cfg.RedisPrefix}
+		modeStore = &redisModeStore{client: rdb, key: cfg.RedisPrefix + "mode"}
+		tokens = &redisTokens{client: rdb, prefix: cfg.RedisPrefix}
+		reports = &redisReports{client: rdb, prefix: cfg.RedisPrefix}
+		store.folders = &redisFolders{client: rdb, prefix: cfg.RedisPrefix}
+		reportLimiter = ratelimit.NewRedis(rdb, cfg.RedisPrefix+"report:", cfg.Abuse.RateLimitPerHour, time.Hour)
+		publicLimiter = ratelimit.NewRedis(rdb, cfg.RedisPrefix+"public:", cfg.Public.RateLimitPerHour, time.Hour)
+		store.events.UseRedis(context.Background(), rdb, cfg.RedisPrefix+"events:clicks")
+		re := newRedisElector(rdb, cfg.RedisPrefix+"leader:cleanup", cfg.InstanceID, 3*cfg.CleanupInterval)
+		go re.Run(context.Background())
+		elector = re
+		logrus.Info("coordination mode: redis")
+	}
+	if node != nil && rdb == nil {
+		elector = node
+	}
+	if store.codes, err = newCodeGenerator(cfg.Codes, rdb, cfg.RedisPrefix); err != nil {
+		logrus.WithError(err).Fatal("invalid code strategy")
+	}
+	modes := NewModes(modeStore)
+	if err := applyStartupMode(modes, cfg.ServiceMode); err != nil {
+		logrus.WithError(err).Fatal("invalid SERVICE_MODE")
+	}
+	if rdb != nil {
+		go modes.Run(context.Background(), 2*time.Second)
+	}
+	go store.CleanupExpired(cfg.CleanupInterval, elector)
+	campaigns := NewCampaigns()
+	tenants := NewTenants()
+	store.tenants = tenants
+	pages := &Pages{tenants: tenants}
+	store.pages = pages
+	modes.pages = pages
+	if cfg.Validity.Policy != ValidityClamp && cfg.Validity.Policy != ValidityReject {
+		logrus.Fatalf("invalid VALIDITY_POLICY %q: must be clamp or reject", cfg.Validity.Policy)
+	}
+	store.validity = NewValidityLimits(cfg.Validity, parseValidityLimits(cfg.ValidityLimits, cfg.Validity))
+	quotas := NewQuotas(cfg.DefaultQuota, parseQuotas(cfg.Quotas, cfg.DefaultQuota), usage)
+	quotas.tenants = tenants
+	notifier := NewNotifier(cfg.ExpiryNotice, cfg.SMTP)
+	notifier.tenants = tenants
+	quotas.notifier = notifier
+	signer, err := NewSigner(cfg.Signing.Keys, cfg.Signing.TokenTTL, cfg.Signing.Param)
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid SIGNING_KEYS")
+	}
+	go notifier.RunExpiryNotices(store, cfg.CleanupInterval)
+	digests, err := cfg.Digest.schedule()
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid digest schedule")
+	}
+	go notifier.RunDigests(store, digests, time.Minute)
+	store.notifier = notifier
+	store.flattener = NewFlattener(cfg.Flatten)
+	if cfg.Preview.Enabled {
+		store.previews = NewPreviewFetcher(cfg.Preview)
+	}
+	switch cfg.LoopProtection {
+	case LoopReject, LoopWarn, LoopOff:
+		store.loopMode = cfg.LoopProtection
+	default:
+		logrus.Fatalf("invalid LOOP_PROTECTION %q: must be reject, warn or off", cfg.LoopProtection)
+	}
+	if cfg.Fraud.Enabled {
+		store.fraud = NewFraudDetector(cfg.Fraud)
+	}
+	if store.redirectHeaders, err = parseRedirectHeaders(cfg.RedirectHeaders); err != nil {
+		logrus.WithError(err).Fatal("invalid REDIRECT_HEADERS")
+	}
+	store.destPolicy = cfg.DestinationPolicy.policy()
+	if err := store.destPolicy.normalize(); err != nil {
+		logrus.WithError(err).Fatal("invalid DESTINATION_POLICY or DESTINATION_DOMAINS")
+	}
+	flags, err := NewFlags(cfg.Flags)
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid feature flags")
+	}
+	store.flags = flags
+	store.defaultValidity.Store(int64(cfg.DefaultValidity))
+	reloader := NewReloader(cfg, file, store, notifier, flags, limiter, reportLimiter)
+	go reloader.ReloadOnSIGHUP(context.Background())
+	drainer := NewDrainer(cfg.Server.DrainGrace, cfg.Server.DrainTimeout)
+	go drainer.DrainOnSignal(syscall.SIGTERM, os.Interrupt)
+	if cfg.Clicks.SeriesEnabled && cfg.Clicks.SeriesRetention > 0 {
+		kept := cfg.Clicks.Retention().Longest()
+		store.series = newMemorySeries(kept)
+		store.referrers = newMemoryReferrers(kept)
+		if rdb != nil {
+			store.series = &redisSeries{client: rdb, prefix: cfg.RedisPrefix, retention: kept}
+			store.referrers = &redisReferrers{client: rdb, prefix: cfg.RedisPrefix, retention: kept}
+		}
+	}
+	if cfg.Events.KafkaBrokers != "" {
+		publisher := newKafkaPublisher(cfg.Events.KafkaBrokers, cfg.Events.KafkaTopic, cfg.Events.KafkaClickTopic)
+		defer publisher.Close()
+		store.publisher = publisher
+	}
+	var salts SaltSource = memorySalts{}
+	if rdb != nil {
+		salts = &redisSalts{client: rdb, prefix: cfg.RedisPrefix, ttl: 2 * cfg.Privacy.SaltRotation}
+	}
+	store.privacy = NewPrivacy(cfg.Privacy.Global, cfg.Privacy.HonorDNT, cfg.Privacy.SaltRotation, salts)
+	if cfg.GeoIP.Path != "" {
+		mm, err := OpenMaxMind(cfg.GeoIP.Path)
+		if err != nil {
+			logrus.WithError(err).Fatal("cannot open GEOIP_DB_PATH")
+		}
+		go mm.Watch(cfg.GeoIP.ReloadInterval)
+		store.geo = mm
+	}
+	if cfg.Clicks.FlushInterval > 0 {
+		if store.clicks != nil {
+			logrus.Fatal("CLICK_FLUSH_INTERVAL cannot be used with the shared redis click counter")
+		}
+		journal, leftover, err := OpenClickJournal(cfg.Clicks.JournalDir)
+		if err != nil {
+			logrus.WithError(err).Fatal("cannot open CLICK_JOURNAL_DIR")
+		}
+		store.batch = NewClickBatcher(journal)
+		if err := store.ReplayClickJournal(context.Background(), leftover); err != nil {
+			logrus.WithError(err).Fatal("click journal replay failed")
+		}
+		go store.RunClickFlush(cfg.Clicks.FlushInterval)
+	}
+	var manifest ExportManifest = &memoryManifest{}
+	if rdb != nil {
+		manifest = &redisManifest{client: rdb, key: cfg.RedisPrefix + "exports:manifest"}
+	}
+	if cfg.Export.Enabled {
+		if cfg.Export.Bucket == "" {
+			logrus.Fatal("EXPORT_ENABLED requires S3_BUCKET")
+		}
+		uploader := &objectstore.S3{
+			Endpoint:  cfg.Export.Endpoint,
+			Region:    cfg.Export.Region,
+			Bucket:    cfg.Export.Bucket,
+			AccessKey: cfg.Export.AccessKey,
+			SecretKey: cfg.Export.SecretKey,
+			PathStyle: cfg.Export.PathStyle,
+			Client:    &http.Client{Timeout: time.Minute},
+		}
+		store.archive = NewClickArchive(uploader, manifest, cfg.Export.Prefix, cfg.InstanceID, cfg.Export.BufferSize)
+		go store.archive.Run(cfg.Export.Interval)
+	}
+	if cfg.Clicks.PruneInterval > 0 {
+		go store.RunRetention(cfg.Clicks.Retention(), cfg.Clicks.PruneInterval, elector)
+	}
+	if cfg.Health.Enabled {
+		hc := NewHealthChecker(store, notifier, cfg.Health.Timeout, cfg.Health.Concurrency)
+		go hc.Run(cfg.Health.Interval, elector)
+	}
+
+	r := mux.NewRouter()
+	if cfg.Tracing.Enabled {
+		r.Use(otelmux.Middleware(cfg.Tracing.ServiceName))
+	}
+
+	// 👇 Apply the configured middleware globally
+	trusted, err := middleware.ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid TRUSTED_PROXIES")
+	}
+	// Snapshots hold a whole store, far past MAX_BODY_BYTES.
+	bodyLimit := middleware.MaxBodySizeFor(cfg.MaxBodyBytes, map[string]int64{
+		"/api/admin/storage/snapshot": cfg.SnapshotMaxBytes,
+	})
+	global, err := buildChain(cfg.Middleware, map[string]middlewareFunc{
+		"recovery": middleware.Recover(func(w http.ResponseWriter, r *http.Request) {
+			metricPanics.Add(1)
+			httpError(w, r, http.StatusInternalServerError, ErrCodeInternal, "internal error")
+		}),
+		"request_id": middleware.RequestID,
+		"real_ip":    middleware.RealIP(trusted),
+		"logging": middleware.Logging(middleware.LoggingOptions{
+			RedirectSampleRate: cfg.Log.RedirectSampleRate,
+			SlowThreshold:      cfg.Log.SlowThreshold,
+			RedactQuery:        cfg.Log.URLRedaction == RedactQuery || cfg.Log.URLRedaction == RedactFull,
+			Sink:               accessSink(accessLog),
+		}),
+		"host": middleware.CanonicalHost(middleware.HostOptions{
+			Canonical: cfg.Host.Canonical,
+			Aliases:   strings.Split(cfg.Host.Aliases, ","),
+			Served:    func(host string) bool { return tenants.ForHost(host) != "" },
+			HTTPS:     cfg.Host.ForceHTTPS,
+			Trusted:   trusted,
+			Exempt:    []string{"/health", "/ready"},
+			Reject: func(w http.ResponseWriter, r *http.Request) {
+				httpError(w, r, http.StatusMisdirectedRequest, ErrCodeMisdirected, "this server does not serve that host")
+			},
+		}),
+		"body_limit": bodyLimit,
+		"cors":       middleware.CORS(strings.Split(cfg.CORSOrigins, ",")),
+		"gzip":       middleware.Gzip,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid MIDDLEWARE")
+	}
+	r.Use(modes.Guard)
+	r.Use(hostTenant(tenants))
+	r.Use(rejectSuspended(tenants))
+
+	apiKeys := parseAPIKeys(cfg.APIKeys)
+	admins := parseAdmins(cfg.Admins)
+	if len(apiKeys) == 0 || len(admins) == 0 {
+		logrus.Warn("API_KEYS or ADMINS is empty: /api/admin refuses every request")
+	}
+	for _, owner := range apiKeys {
+		if t := tenantOf(owner); t != "" {
+			tenants.ensure(t)
+		}
+	}
+	rateLimit := func(next http.Handler) http.Handler { return next }
+	if cfg.RateLimitPerMinute > 0 {
+		rateLimit = middleware.RateLimit(limiter, middleware.ClientIP, func(w http.ResponseWriter, r *http.Request) {
+			httpError(w, r, http.StatusTooManyRequests, ErrCodeRateLimited, "rate limit exceeded")
+		})
+	}
+	apiChain, err := buildChain(cfg.APIMiddleware, map[string]middlewareFunc{
+		"auth":       requireAPIKey(apiKeys, admins, tokens),
+		"rate_limit": rateLimit,
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid API_MIDDLEWARE")
+	}
+	// large wraps the list and export routes, whose bodies can run to
+	// megabytes.
+	large := func(h http.Handler) http.Handler { return h }
+	if cfg.GzipMinBytes > 0 {
+		large = middleware.GzipOver(cfg.GzipMinBytes)
+	}
+	api := r.PathPrefix("/api").Subrouter()
+	api.UseEncodedPath() // so folder codes can be sent as folder%2Fname
+	for _, mw := range apiChain {
+		api.Use(mw)
+	}
+	api.Use(rejectSuspended(tenants))
+	api.Use(quotas.Headers)
+	api.HandleFunc("/shorten", requireScope(ScopeLinksCreate, idempotent(idem, cfg.IdempotencyTTL, shortenHandler(store, campaigns, quotas, signer)))).Methods("POST")
+	api.HandleFunc("/quick", requireScope(ScopeLinksCreate, quickHandler(store, quotas))).Methods("GET")
+	api.HandleFunc("/reserve", requireScope(ScopeLinksCreate, reserveHandler(store, cfg.Reservations))).Methods("POST")
+	api.HandleFunc("/reserve", requireScope(ScopeStatsRead, listReservationsHandler(store))).Methods("GET")
+	api.HandleFunc("/reserve/{code}/attach", requireScope(ScopeLinksCreate, attachReservationHandler(store, shortenHandler(store, campaigns, quotas, signer)))).Methods("POST")
+	api.HandleFunc("/reserve/{code}", requireScope(ScopeLinksDelete, releaseReservationHandler(store))).Methods("DELETE")
+	api.HandleFunc("/stats/{code}", requireScope(ScopeStatsRead, statsHandler(store))).Methods("GET")
+	api.Handle("/stats/{code}/timeseries", large(requireScope(ScopeStatsRead, timeSeriesHandler(store)))).Methods("GET")
+	api.Handle("/analytics/summary", large(requireScope(ScopeStatsRead, analyticsSummaryHandler(store)))).Methods("GET")
+	api.HandleFunc("/stats/{code}/reset", requireScope(ScopeLinksUpdate, resetStatsHandler(store))).Methods("POST")
+	api.HandleFunc("/stats/{code}/sources", requireScope(ScopeStatsRead, sourcesHandler(store))).Methods("GET")
+	api.HandleFunc("/stats/{code}/devices", requireScope(ScopeStatsRead, devicesHandler(store))).Methods("GET")
+	api.HandleFunc("/stats/{code}/anomalies", requireScope(ScopeStatsRead, anomaliesHandler(store))).Methods("GET")
+	api.HandleFunc("/stats/{code}/stream", requireScope(ScopeStatsRead, clickStreamHandler(store, store.events))).Methods("GET")
+	api.HandleFunc("/suggest", requireScope(ScopeLinksCreate, suggestHandler(store))).Methods("GET")
+	api.HandleFunc("/lookup", requireScope(ScopeStatsRead, lookupHandler(store))).Methods("GET")
+	api.HandleFunc("/quota", requireScope(ScopeStatsRead, quotaHandler(store, quotas))).Methods("GET")
+	api.HandleFunc("/tenant", requireScope(ScopeStatsRead, tenantHandler(store, tenants))).Methods("GET")
+	api.HandleFunc("/notifications", requireScope(ScopeLinksUpdate, notificationPrefsHandler(notifier))).Methods("GET", "PUT")
+	api.HandleFunc("/notifications/digest", requireScope(ScopeStatsRead, digestPreviewHandler(store, notifier))).Methods("GET")
+	api.Handle("/links", large(requireScope(ScopeStatsRead, listLinksHandler(store)))).Methods("GET")
+	api.HandleFunc("/folders", requireScope(ScopeStatsRead, foldersHandler(store))).Methods("GET")
+	api.HandleFunc("/folders/{name}/members", requireScope(ScopeStatsRead, folderMembersHandler(store))).Methods("GET")
+	api.HandleFunc("/folders/{name}/members/{member}", requireScope(ScopeLinksUpdate, setFolderMemberHandler(store, false))).Methods("PUT")
+	api.HandleFunc("/folders/{name}/members/{member}", requireScope(ScopeLinksUpdate, setFolderMemberHandler(store, true))).Methods("DELETE")
+	api.HandleFunc("/links/{code}", requireScope(ScopeLinksUpdate, patchLinkHandler(store))).Methods("PATCH")
+	api.HandleFunc("/links/{code}", requireScope(ScopeLinksDelete, deleteLinkHandler(store))).Methods("DELETE")
+	api.HandleFunc("/links/{code}/aliases", requireScope(ScopeStatsRead, listAliasesHandler(store))).Methods("GET")
+	api.HandleFunc("/links/{code}/aliases", requireScope(ScopeLinksUpdate, addAliasHandler(store))).Methods("POST")
+	api.HandleFunc("/links/{code}/aliases/{alias}", requireScope(ScopeLinksUpdate, removeAliasHandler(store))).Methods("DELETE")
+	api.HandleFunc("/links/{code}/clone", requireScope(ScopeLinksCreate, cloneLinkHandler(store, quotas))).Methods("POST")
+	api.HandleFunc("/links/{code}/restore", requireScope(ScopeLinksDelete, restoreLinkHandler(store))).Methods("POST")
+	api.HandleFunc("/links/{code}/prewarm", requireScope(ScopeLinksUpdate, prewarmHandler(store))).Methods("POST")
+	api.HandleFunc("/links/{code}/timeline", requireScope(ScopeStatsRead, timelineHandler(store))).Methods("GET")
+	api.HandleFunc("/links/{code}/timeline", requireScope(ScopeLinksUpdate, setTimelineHandler(store))).Methods("PUT")
+	api.HandleFunc("/links/{code}/timeline", requireScope(ScopeLinksUpdate, clearTimelineHandler(store))).Methods("DELETE")
+	api.HandleFunc("/links/{code}/transfer", requireScope(ScopeLinksUpdate, transferHandler(store, admins, len(apiKeys) > 0))).Methods("POST")
+	api.HandleFunc("/links/{code}/transfer/accept", requireScope(ScopeLinksUpdate, answerTransferHandler(store, true))).Methods("POST")
+	api.HandleFunc("/links/{code}/transfer/decline", requireScope(ScopeLinksUpdate, answerTransferHandler(store, false))).Methods("POST")
+	api.HandleFunc("/transfers", requireScope(ScopeStatsRead, listTransfersHandler(store))).Methods("GET")
+	api.HandleFunc("/links/{code}/publish", requireScope(ScopeLinksUpdate, publishHandler(store, false))).Methods("POST")
+	api.HandleFunc("/links/{code}/unpublish", requireScope(ScopeLinksUpdate, publishHandler(store, true))).Methods("POST")
+	api.HandleFunc("/campaigns", requireScope(ScopeLinksUpdate, createCampaignHandler(campaigns))).Methods("POST")
+	api.HandleFunc("/campaigns", requireScope(ScopeStatsRead, listCampaignsHandler(campaigns))).Methods("GET")
+	api.HandleFunc("/campaigns/{id}/links", requireScope(ScopeLinksUpdate, attachCampaignLinksHandler(store, campaigns))).Methods("POST")
+	api.HandleFunc("/campaigns/{id}/links/{code}", requireScope(ScopeLinksUpdate, detachCampaignLinkHandler(store, campaigns))).Methods("DELETE")
+	api.HandleFunc("/campaigns/{id}/stats", requireScope(ScopeStatsRead, campaignStatsHandler(store, campaigns))).Methods("GET")
+	api.HandleFunc("/tokens", requireScope(ScopeTokensManage, createTokenHandler(tokens))).Methods("POST")
+	api.HandleFunc("/tokens", requireScope(ScopeTokensManage, listTokensHandler(tokens))).Methods("GET")
+	api.HandleFunc("/tokens/{id}", requireScope(ScopeTokensManage, revokeTokenHandler(tokens))).Methods("DELETE")
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.Use(requireAdmin(admins))
+	admin.HandleFunc("/mode", modeHandler(modes)).Methods("GET", "PUT")
+	admin.Handle("/exports", large(exportsHandler(manifest))).Methods("GET")
+	admin.HandleFunc("/links/search", searchLinksHandler(store)).Methods("POST")
+	admin.HandleFunc("/links/bulk", bulkLinksHandler(store)).Methods("POST")
+	admin.HandleFunc("/stats/{code}/adjust", adjustStatsHandler(store)).Methods("POST")
+	admin.HandleFunc("/storage", storageHandler(store)).Methods("GET")
+	admin.HandleFunc("/storage/compact", compactStorageHandler(store, elector)).Methods("POST")
+	admin.Handle("/storage/snapshot", large(snapshotHandler(store))).Methods("GET")
+	admin.HandleFunc("/storage/snapshot", loadSnapshotHandler(store)).Methods("POST")
+	if encrypted != nil {
+		admin.HandleFunc("/storage/rekey", rekeyHandler(encrypted)).Methods("POST")
+	}
+	if node != nil {
+		admin.HandleFunc("/cluster", clusterHandler(node)).Methods("GET")
+	}
+	admin.HandleFunc("/reload", reloadConfigHandler(reloader)).Methods("POST")
+	admin.HandleFunc("/drain", drainHandler(drainer)).Methods("POST")
+	admin.Handle("/debug/vars", expvar.Handler()).Methods("GET")
+	admin.HandleFunc("/flags", flagsHandler(flags)).Methods("GET")
+	admin.HandleFunc("/flags/reload", reloadFlagsHandler(flags)).Methods("POST")
+	admin.HandleFunc("/flags/{name}", overrideFlagHandler(flags)).Methods("PUT", "DELETE")
+	admin.Handle("/reports", large(listReportsHandler(reports))).Methods("GET")
+	admin.HandleFunc("/reports/{id}/{action}", resolveReportHandler(store, reports, notifier)).Methods("POST")
+	admin.HandleFunc("/tenants", createTenantHandler(tenants)).Methods("POST")
+	admin.HandleFunc("/tenants", listTenantsHandler(tenants)).Methods("GET")
+	admin.HandleFunc("/tenants/{id}", tenantHandler(store, tenants)).Methods("GET")
+	admin.HandleFunc("/tenants/{id}", updateTenantHandler(tenants)).Methods("PUT")
+	admin.HandleFunc("/tenants/{id}/suspend", suspendTenantHandler(tenants, true)).Methods("POST")
+	admin.HandleFunc("/tenants/{id}/resume", suspendTenantHandler(tenants, false)).Methods("POST")
+	r.HandleFunc("/health", healthHandler).Methods("GET")
+	r.HandleFunc("/ready", readyHandler(drainer)).Methods("GET")
+	r.HandleFunc("/version", versionHandler(info, flags)).Methods("GET")
+	robots, err := loadRobotsTxt(cfg.RobotsTxtFile)
+	if err != nil {
+		logrus.WithError(err).Fatal("cannot read ROBOTS_TXT_FILE")
+	}
+	r.HandleFunc("/robots.txt", robotsHandler(robots)).Methods("GET", "HEAD")
+	r.Handle("/links.json", large(directoryHandler(store, "json"))).Methods("GET", "HEAD")
+	r.Handle("/links.xml", large(directoryHandler(store, "xml"))).Methods("GET", "HEAD")
+	r.Handle("/ui", http.RedirectHandler("/ui/", http.StatusMovedPermanently))
+	r.PathPrefix("/ui/").Handler(uiHandler())
+	captcha, err := newCaptcha(cfg.Abuse)
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid captcha settings")
+	}
+	var report http.Handler = reportHandler(store, reports, captcha)
+	if cfg.Abuse.RateLimitPerHour > 0 {
+		report = middleware.RateLimit(reportLimiter, middleware.ClientIP, func(w http.ResponseWriter, r *http.Request) {
+			httpError(w, r, http.StatusTooManyRequests, ErrCodeRateLimited, "too many reports, try again later")
+		})(report)
+	}
+	r.Handle("/report/{code:.+}", report).Methods("POST")
+	if cfg.Public.Enabled {
+		if captcha == nil {
+			logrus.Fatal("PUBLIC_SHORTEN_ENABLED requires CAPTCHA_PROVIDER or CAPTCHA_VERIFY_URL")
+		}
+		var public http.Handler = publicShortenHandler(store, captcha, cfg.Public.MaxValidity)
+		if cfg.Public.RateLimitPerHour > 0 {
+			public = middleware.RateLimit(publicLimiter, middleware.ClientIP, func(w http.ResponseWriter, r *http.Request) {
+				httpError(w, r, http.StatusTooManyRequests, ErrCodeRateLimited, "too many links, try again later")
+			})(public)
+		}
+		r.Handle("/public/shorten", public).Methods("POST")
+	}
+	var redirect http.Handler = redirectHandler(store, quotas, signer, cfg.CountHeadClicks)
+	if node != nil {
+		redirect = forwardToOwner(node, store)(redirect)
+	}
+	r.Handle("/{code}", redirect).Methods("GET", "HEAD")
+	r.Handle("/{code}/{rest:.*}", redirect).Methods("GET", "HEAD")
+	r.HandleFunc("/{code}", optionsHandler("GET", "HEAD", "OPTIONS")).Methods("OPTIONS")
+
+	if (cfg.Server.TLSCertFile == "") != (cfg.Server.TLSKeyFile == "") {
+		logrus.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	handler := hideQuickKey(wrap(r, global))
+	if clustered != nil {
+		// Node-to-node calls bypass the service mode guard and API auth:
+		// replication must go on in read-only and maintenance mode.
+		outer := http.NewServeMux()
+		outer.Handle("/internal/cluster/", clustered.Handler())
+		outer.Handle("/", handler)
+		handler = outer
+	}
+	srv, err := newServer(cfg.Server, handler)
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid HTTP/2 settings")
+	}
+	go drainer.Run(srv, func(ctx context.Context) {
+		store.Flush(ctx)
+		if accessLog != nil {
+			if err := accessLog.Close(ctx); err != nil {
+				logrus.WithError(err).Warn("flushing access log failed")
+			}
+		}
+		if err := store.backend.Close(); err != nil {
+			logrus.WithError(err).Warn("closing storage failed")
+		}
+	})
+	if err := serve(srv, cfg.Server); errors.Is(err, http.ErrServerClosed) {
+		<-drainer.Done()
+	} else if err != nil {
+		logrus.Error(err)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func BenchmarkWriteJSON(b *testing.B) {
+	now := time.Now().UTC()
+	links := make([]*Link, 100)
+	for i := range links {
+		code := strconv.Itoa(i)
+		links[i] = &Link{LongURL: "https://example.com/" + code, ShortCode: code, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	}
+	body := map[string]interface{}{"links": links, "total": len(links)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writeJSON(discardWriter{header: http.Header{}}, http.StatusOK, body)
+	}
+}
+
+// discardWriter is a ResponseWriter that keeps nothing but headers.
+type discardWriter struct{ header http.Header }
+
+func (d discardWriter) Header() http.Header         { return d.header }
+func (d discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d discardWriter) WriteHeader(int)             {}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/storage"
+)
+
+// Limits on the free-form data integrations attach to links.
+const (
+	maxMetadataKeys   = 32
+	maxMetadataValue  = 512
+	maxMetadataBytes  = 4096
+	maxNotesLength    = 2000
+	metadataFilterSep = ":"
+)
+
+var metadataKeyRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// validateMetadata enforces the size limits on a link's complete metadata.
+func validateMetadata(md map[string]string) error {
+	if len(md) > maxMetadataKeys {
+		return fmt.Errorf("at most %d metadata keys are allowed", maxMetadataKeys)
+	}
+	total := 0
+	for k, v := range md {
+		if !metadataKeyRe.MatchString(k) {
+			return fmt.Errorf("metadata key %q must be 1-64 letters, digits, '_', '.' or '-'", k)
+		}
+		if len(v) > maxMetadataValue {
+			return fmt.Errorf("metadata value for %q must not exceed %d bytes", k, maxMetadataValue)
+		}
+		total += len(k) + len(v)
+	}
+	if total > maxMetadataBytes {
+		return fmt.Errorf("metadata must not exceed %d bytes in total", maxMetadataBytes)
+	}
+	return nil
+}
+
+func validateNotes(notes string) error {
+	if utf8.RuneCountInString(notes) > maxNotesLength {
+		return fmt.Errorf("notes must not exceed %d characters", maxNotesLength)
+	}
+	return nil
+}
+
+// parseMetadataFilter reads repeated meta=key:value query parameters.
+func parseMetadataFilter(values []string) (map[string]string, error) {
+	filter := map[string]string{}
+	for _, v := range values {
+		k, val, ok := strings.Cut(v, metadataFilterSep)
+		if !ok || k == "" {
+			return nil, errors.New("meta must be key:value")
+		}
+		filter[k] = val
+	}
+	return filter, nil
+}
+
+// matchesMetadata reports whether md has every key in filter with the
+// same value.
+func matchesMetadata(md, filter map[string]string) bool {
+	for k, v := range filter {
+		if got, ok := md[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// LinkPatch is a partial update. Nil fields are left alone; a nil value
+// in Metadata removes that key, others are set.
+type LinkPatch struct {
+	Notes    *string            `json:"notes,omitempty"`
+	Metadata map[string]*string `json:"metadata,omitempty"`
+
+	// Milestones replaces the link's click alerts; [] clears them.
+	Milestones *[]int64 `json:"milestones,omitempty"`
+
+	// AllowedIPs replaces the link's IP restriction; [] lifts it.
+	AllowedIPs *[]string `json:"allowed_ips,omitempty"`
+
+	// Schedule replaces the link's opening hours; {"windows": []} removes
+	// them.
+	Schedule *storage.Schedule `json:"schedule,omitempty"`
+
+	// Public adds the link to or removes it from the public directory.
+	Public *bool `json:"public,omitempty"`
+
+	// Headers replaces the headers added to the redirect; {} removes them.
+	Headers *map[string]string `json:"headers,omitempty"`
+
+	NoIndex *bool `json:"noindex,omitempty"`
+
+	// Card replaces what preview crawlers are shown; {} removes it.
+	Card *storage.Card `json:"card,omitempty"`
+
+	// Interstitial replaces the notice shown before the redirect; {}
+	// removes it.
+	Interstitial *storage.Interstitial `json:"interstitial,omitempty"`
+
+	// ClientHints turns the device breakdown on or off; counts so far
+	// are kept.
+	ClientHints *bool `json:"client_hints,omitempty"`
+}
+
+// Patch applies p to a link owned by owner.
+func (s *Store) Patch(ctx context.Context, code, owner string, p LinkPatch) (*Link, error) {
+	if p.Notes != nil {
+		if err := validateNotes(*p.Notes); err != nil {
+			return nil, fieldError("notes", err.Error())
+		}
+	}
+	var milestones []int64
+	if p.Milestones != nil {
+		var err error
+		if milestones, err = validateMilestones(*p.Milestones); err != nil {
+			return nil, fieldError("milestones", err.Error())
+		}
+	}
+	var allowedIPs []string
+	if p.AllowedIPs != nil {
+		var err error
+		if allowedIPs, err = parseAllowedIPs(*p.AllowedIPs); err != nil {
+			return nil, err
+		}
+	}
+	var schedule *storage.Schedule
+	if p.Schedule != nil {
+		var err error
+		if schedule, err = validateSchedule(p.Schedule); err != nil {
+			return nil, err
+		}
+	}
+	var headers map[string]string
+	if p.Headers != nil {
+		var err error
+		if headers, err = validateRedirectHeaders("headers", *p.Headers, false); err != nil {
+			return nil, err
+		}
+	}
+	var card *storage.Card
+	if p.Card != nil {
+		var err error
+		if card, err = validateCard(p.Card); err != nil {
+			return nil, err
+		}
+	}
+	var interstitial *storage.Interstitial
+	if p.Interstitial != nil {
+		var err error
+		if interstitial, err = validateInterstitial("interstitial", p.Interstitial); err != nil {
+			return nil, err
+		}
+	}
+	l, err := s.backend.Update(ctx, s.key(ctx, code), func(l *Link) error {
+		if !s.canWrite(ctx, owner, l) || l.Deleted() || l.Reserved {
+			return ErrNotFound
+		}
+		if p.Card != nil {
+			l.Card = card
+		}
+		if p.Interstitial != nil {
+			l.Interstitial = interstitial
+		}
+		if p.ClientHints != nil {
+			l.ClientHints = *p.ClientHints
+		}
+		if p.Headers != nil {
+			l.Headers = headers
+		}
+		if p.NoIndex != nil {
+			l.NoIndex = *p.NoIndex
+		}
+		if p.Schedule != nil {
+			l.Schedule = schedule
+		}
+		if p.Public != nil {
+			l.Public = *p.Public
+		}
+		if p.AllowedIPs != nil {
+			l.AllowedIPs = allowedIPs
+		}
+		if p.Notes != nil {
+			l.Notes = *p.Notes
+		}
+		if p.Milestones != nil {
+			l.Milestones = milestones
+		}
+		if len(p.Metadata) > 0 {
+			if l.Metadata == nil {
+				l.Metadata = make(map[string]string, len(p.Metadata))
+			}
+			for k, v := range p.Metadata {
+				if v == nil {
+					delete(l.Metadata, k)
+				} else {
+					l.Metadata[k] = *v
+				}
+			}
+			if len(l.Metadata) == 0 {
+				l.Metadata = nil
+			}
+			if err := validateMetadata(l.Metadata); err != nil {
+				return fieldError("metadata", err.Error())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"action":     "patch",
+		"short_code": code,
+		"owner":      owner,
+	}).Info("link updated")
+	return l, nil
+}
+
+// patchLinkHandler serves PATCH /api/links/{code}.
+func patchLinkHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var p LinkPatch
+		if apiErr := decodeJSON(r, &p); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		link, err := store.Patch(r.Context(), codeVar(r), ownerFrom(r.Context()), p)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, link)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import "expvar"
+
+// Process metrics, published by expvar at /api/admin/debug/vars.
+var (
+	metricCodeCollisions  = expvar.NewInt("code_collisions_total")
+	metricCodeBlocked     = expvar.NewInt("code_blocked_total")
+	metricCodeEscalations = expvar.NewInt("code_length_escalations_total")
+	metricCodeLength      = expvar.NewInt("code_length")
+
+	metricExportedClicks = expvar.NewInt("export_clicks_total")
+	metricExportDropped  = expvar.NewInt("export_dropped_total")
+
+	metricEventsPublished = expvar.NewInt("events_published_total")
+	metricEventsFailed    = expvar.NewInt("events_failed_total")
+
+	metricPanics = expvar.NewInt("http_panics_total")
+
+	metricAccessLogShipped = expvar.NewInt("access_log_shipped_total")
+	metricAccessLogDropped = expvar.NewInt("access_log_dropped_total")
+	metricAccessLogFailed  = expvar.NewInt("access_log_failed_total")
+
+	metricConnsAccepted = expvar.NewInt("http_connections_total")
+	metricConnsOpen     = expvar.NewInt("http_connections_open")
+	metricConnsIdle     = expvar.NewInt("http_connections_idle")
+
+	metricClicksFlushed    = expvar.NewInt("clicks_flushed_total")
+	metricSuspiciousClicks = expvar.NewInt("clicks_suspicious_total")
+
+	metricRetentionRolled    = expvar.NewInt("retention_buckets_rolled_total")
+	metricRetentionDeleted   = expvar.NewInt("retention_buckets_deleted_total")
+	metricRetentionReferrers = expvar.NewInt("retention_referrer_days_deleted_total")
+	metricRetentionRaw       = expvar.NewInt("retention_raw_objects_deleted_total")
+
+	metricAbuseReports = expvar.NewInt("abuse_reports_total")
+
+	metricLookups      = expvar.NewInt("link_lookups_total")
+	metricLookupMisses = expvar.NewInt("link_lookup_misses_total")
+
+	metricMirrorFailures = expvar.NewInt("storage_mirror_failures_total")
+)
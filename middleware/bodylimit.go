@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// MaxBodySize caps the number of bytes a handler may read from the request
+// body. Reads past the limit fail with *http.MaxBytesError, which handlers
+// translate into a 413 response.
+func MaxBodySize(limit int64) func(http.Handler) http.Handler {
+	return MaxBodySizeFor(limit, nil)
+}
+
+// MaxBodySizeFor is MaxBodySize with other limits for the paths in paths,
+// for routes such as bulk imports whose bodies are legitimately larger. A
+// limit of zero or less lifts the cap.
+func MaxBodySizeFor(limit int64, paths map[string]int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := limit
+			if l, ok := paths[r.URL.Path]; ok {
+				limit = l
+			}
+			if r.Body != nil && limit > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, limit)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaxBodySizeFor(t *testing.T) {
+	h := MaxBodySizeFor(10, map[string]int64{"/import": 100, "/unlimited": 0})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := io.ReadAll(r.Body); err != nil {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+			}
+		}))
+	tests := []struct {
+		path string
+		size int
+		want int
+	}{
+		{"/other", 10, http.StatusOK},
+		{"/other", 11, http.StatusRequestEntityTooLarge},
+		{"/import", 100, http.StatusOK},
+		{"/import", 101, http.StatusRequestEntityTooLarge},
+		{"/unlimited", 1 << 20, http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(strings.Repeat("x", tt.size))))
+		if rec.Code != tt.want {
+			t.Errorf("%s with %d bytes: status = %d, want %d", tt.path, tt.size, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+// gzipWriter decides at WriteHeader time whether to compress: streams
+// (text/event-stream), bodiless statuses and responses that already carry
+// a Content-Encoding go out untouched.
+type gzipWriter struct {
+	http.ResponseWriter
+	zw      *gzip.Writer
+	decided bool
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	if !g.decided {
+		g.decided = true
+		h := g.Header()
+		if code != http.StatusNoContent && code != http.StatusNotModified && code >= 200 &&
+			h.Get("Content-Encoding") == "" &&
+			!strings.HasPrefix(h.Get("Content-Type"), "text/event-stream") {
+			h.Set("Content-Encoding", "gzip")
+			h.Del("Content-Length")
+			// The compressed bytes differ from those the ETag was taken
+			// over; a weak tag still validates them.
+			if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+				h.Set("ETag", "W/"+etag)
+			}
+			g.zw = gzipWriters.Get().(*gzip.Writer)
+			g.zw.Reset(g.ResponseWriter)
+		}
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if !g.decided {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.zw != nil {
+		return g.zw.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// Flush pushes compressed bytes written so far to the client.
+func (g *gzipWriter) Flush() {
+	if !g.decided {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.zw != nil {
+		_ = g.zw.Flush()
+	}
+	_ = http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+func (g *gzipWriter) Unwrap() http.ResponseWriter { return g.ResponseWriter }
+
+func (g *gzipWriter) close() {
+	if g.zw != nil {
+		_ = g.zw.Close()
+		gzipWriters.Put(g.zw)
+	}
+}
+
+// Gzip compresses responses for clients that accept it.
+func Gzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		varyAcceptEncoding(w.Header())
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// GzipOver is Gzip for responses of at least minSize bytes; smaller ones
+// are not worth the CPU and go out as they are. It holds back up to
+// minSize bytes of the body to decide, so it suits list and export
+// routes. Inside Gzip it only compresses what Gzip would have anyway.
+func GzipOver(minSize int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			varyAcceptEncoding(w.Header())
+			if r.Method == http.MethodHead || !acceptsGzip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			sw := &sizedGzipWriter{ResponseWriter: w, min: minSize}
+			defer sw.finish()
+			next.ServeHTTP(sw, r)
+		})
+	}
+}
+
+// sizedGzipWriter buffers the start of a body until it has seen min
+// bytes, which settles on compression, or the handler returns.
+type sizedGzipWriter struct {
+	http.ResponseWriter
+	min    int
+	status int
+	buf    []byte
+	out    http.ResponseWriter // once decided: the client, or a gzipWriter
+	gz     *gzipWriter
+}
+
+func (s *sizedGzipWriter) WriteHeader(code int) {
+	if s.status != 0 {
+		return
+	}
+	s.status = code
+	h := s.Header()
+	if code < 200 || code == http.StatusNoContent || code == http.StatusNotModified ||
+		h.Get("Content-Encoding") != "" ||
+		strings.HasPrefix(h.Get("Content-Type"), "text/event-stream") {
+		s.commit(false)
+	}
+}
+
+func (s *sizedGzipWriter) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		if s.Header().Get("Content-Type") == "" {
+			s.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		s.WriteHeader(http.StatusOK)
+	}
+	if s.out != nil {
+		return s.out.Write(b)
+	}
+	s.buf = append(s.buf, b...)
+	if len(s.buf) >= s.min {
+		if err := s.commit(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// commit sends the header and whatever body is held back.
+func (s *sizedGzipWriter) commit(compress bool) error {
+	if compress {
+		s.gz = &gzipWriter{ResponseWriter: s.ResponseWriter}
+		s.out = s.gz
+	} else {
+		s.out = s.ResponseWriter
+	}
+	s.out.WriteHeader(s.status)
+	buf := s.buf
+	s.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := s.out.Write(buf)
+	return err
+}
+
+// Flush settles on sending the body as it is when too little has been
+// written to compress.
+func (s *sizedGzipWriter) Flush() {
+	if s.status == 0 {
+		s.WriteHeader(http.StatusOK)
+	}
+	if s.out == nil {
+		_ = s.commit(false)
+	}
+	if s.gz != nil {
+		s.gz.Flush()
+		return
+	}
+	_ = http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+func (s *sizedGzipWriter) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+func (s *sizedGzipWriter) finish() {
+	if s.status != 0 && s.out == nil {
+		_ = s.commit(false)
+	}
+	if s.gz != nil {
+		s.gz.close()
+	}
+}
+
+func varyAcceptEncoding(h http.Header) {
+	for _, v := range h.Values("Vary") {
+		if strings.EqualFold(v, "Accept-Encoding") {
+			return
+		}
+	}
+	h.Add("Vary", "Accept-Encoding")
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(enc), "gzip") && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
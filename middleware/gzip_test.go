@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipOver(t *testing.T) {
+	const threshold = 1024
+	tests := []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		size           int
+		wantGzip       bool
+	}{
+		{"small body", http.MethodGet, "gzip", threshold - 1, false},
+		{"at threshold", http.MethodGet, "gzip", threshold, true},
+		{"large body", http.MethodGet, "gzip, deflate, br", 4 * threshold, true},
+		{"no Accept-Encoding", http.MethodGet, "", 4 * threshold, false},
+		{"other encoding", http.MethodGet, "br", 4 * threshold, false},
+		{"gzip refused", http.MethodGet, "gzip;q=0, br", 4 * threshold, false},
+		{"HEAD", http.MethodHead, "gzip", 4 * threshold, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := strings.Repeat("a", tt.size)
+			h := GzipOver(threshold)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				// Written in pieces, so the threshold is crossed mid-body.
+				for rest := body; rest != ""; {
+					n := len(rest)
+					if n > 100 {
+						n = 100
+					}
+					io.WriteString(w, rest[:n])
+					rest = rest[n:]
+				}
+			}))
+			req := httptest.NewRequest(tt.method, "/api/links", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+			gzipped := rec.Header().Get("Content-Encoding") == "gzip"
+			if gzipped != tt.wantGzip {
+				t.Fatalf("Content-Encoding = %q, want gzip %v", rec.Header().Get("Content-Encoding"), tt.wantGzip)
+			}
+			if tt.method == http.MethodHead {
+				return
+			}
+			got := rec.Body.String()
+			if gzipped {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = string(b)
+			}
+			if got != body {
+				t.Errorf("body is %d bytes, want %d", len(got), len(body))
+			}
+		})
+	}
+}
+
+func TestGzipOverSkipsNotModified(t *testing.T) {
+	h := GzipOver(1)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/api/links", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified || rec.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("got %d with Content-Encoding %q, want 304 without one", rec.Code, rec.Header().Get("Content-Encoding"))
+	}
+}
@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// HostOptions configures CanonicalHost.
+type HostOptions struct {
+	// Canonical is the host requests should arrive on, with a port only
+	// if it is not the default one. Empty turns host checking off.
+	Canonical string
+	// Aliases are redirected to Canonical; "www." + Canonical always is.
+	Aliases []string
+	// Served, if set, names further hosts answered as they are, such as
+	// tenant domains.
+	Served func(host string) bool
+	// HTTPS redirects plain-http requests to https.
+	HTTPS bool
+	// Trusted are the proxies whose Forwarded proto= and
+	// X-Forwarded-Proto headers are believed.
+	Trusted []netip.Prefix
+	// Exempt paths are answered on any host and scheme, for load balancer
+	// probes that address the instance directly.
+	Exempt []string
+	// Reject answers requests for any other host.
+	Reject http.HandlerFunc
+}
+
+// CanonicalHost keeps every request on one host and scheme, so caches and
+// analytics are not split across variants of the same URL and forged Host
+// headers never reach a handler. Redirects keep the path and query, and
+// use 308 for anything but GET and HEAD so the method and body survive.
+func CanonicalHost(opts HostOptions) func(http.Handler) http.Handler {
+	canonical := normalHost(opts.Canonical)
+	aliases := make(map[string]bool, len(opts.Aliases)+1)
+	if canonical != "" {
+		aliases["www."+canonical] = true
+	}
+	for _, a := range opts.Aliases {
+		if a = normalHost(a); a != "" {
+			aliases[a] = true
+		}
+	}
+	exempt := make(map[string]bool, len(opts.Exempt))
+	for _, p := range opts.Exempt {
+		exempt[p] = true
+	}
+	return func(next http.Handler) http.Handler {
+		if canonical == "" && !opts.HTTPS {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if exempt[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			host := normalHost(r.Host)
+			target := host
+			if canonical != "" && host != canonical && !matchesPortless(host, canonical) {
+				switch {
+				case aliases[host] || aliases[stripPort(host)]:
+					target = canonical
+				case opts.Served != nil && opts.Served(host):
+				default:
+					opts.Reject(w, r)
+					return
+				}
+			}
+			insecure := opts.HTTPS && requestScheme(r, opts.Trusted) != "https"
+			if target == host && !insecure {
+				next.ServeHTTP(w, r)
+				return
+			}
+			scheme := requestScheme(r, opts.Trusted)
+			if opts.HTTPS {
+				scheme = "https"
+				target = stripPort(target)
+			}
+			status := http.StatusMovedPermanently
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				status = http.StatusPermanentRedirect
+			}
+			http.Redirect(w, r, scheme+"://"+target+r.URL.RequestURI(), status)
+		})
+	}
+}
+
+// requestScheme is the scheme the client used: https if the connection
+// is TLS or a trusted proxy says it terminated TLS.
+func requestScheme(r *http.Request, trusted []netip.Prefix) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	peer, ok := parseHostAddr(r.RemoteAddr)
+	if !ok || !isTrusted(peer, trusted) {
+		return "http"
+	}
+	if f := r.Header.Get("Forwarded"); f != "" {
+		for _, pair := range strings.Split(strings.Split(f, ",")[0], ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(k, "proto") {
+				return strings.ToLower(strings.Trim(v, `"`))
+			}
+		}
+	}
+	if p := r.Header.Get("X-Forwarded-Proto"); p != "" {
+		p, _, _ = strings.Cut(p, ",")
+		return strings.ToLower(strings.TrimSpace(p))
+	}
+	return "http"
+}
+
+// normalHost lowercases h and drops a trailing dot.
+func normalHost(h string) string {
+	h = strings.ToLower(strings.TrimSpace(h))
+	if host, port, err := net.SplitHostPort(h); err == nil {
+		return strings.TrimSuffix(host, ".") + ":" + port
+	}
+	return strings.TrimSuffix(h, ".")
+}
+
+func stripPort(h string) string {
+	if host, _, err := net.SplitHostPort(h); err == nil {
+		return host
+	}
+	return h
+}
+
+// matchesPortless reports whether host is canonical on an explicit port,
+// which a canonical host without a port allows.
+func matchesPortless(host, canonical string) bool {
+	return !strings.Contains(canonical, ":") && stripPort(host) == canonical
+}
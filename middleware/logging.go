@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// responseWriter wrapper to capture status code and body size
+type responseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	bytes      int64
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	rw.statusCode = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g.
+// to flush streamed responses.
+func (rw *responseWriter) Unwrap() http.ResponseWriter { return rw.ResponseWriter }
+
+// LoggingOptions tunes the access log.
+type LoggingOptions struct {
+	// RedirectSampleRate logs one in every N requests answered with a 3xx
+	// status; values <= 1 log every redirect. Other statuses, and slow
+	// redirects, are always logged. Sampled lines carry sample_rate so
+	// counts can be scaled back up.
+	RedirectSampleRate int
+
+	// SlowThreshold marks requests taking at least this long with
+	// slow=true; zero disables the flag.
+	SlowThreshold time.Duration
+
+	// RedactQuery logs the path without its query string, which for
+	// passthrough links is copied to the destination and may carry
+	// tokens.
+	RedactQuery bool
+
+	// Sink, if set, receives the access log instead of logrus, which then
+	// keeps only application logs.
+	Sink AccessSink
+}
+
+// AccessEntry is one request as the access log records it.
+type AccessEntry struct {
+	Time       time.Time     `json:"time"`
+	Method     string        `json:"method"`
+	Host       string        `json:"host"`
+	Path       string        `json:"path"`
+	Status     int           `json:"status"`
+	Duration   time.Duration `json:"-"`
+	DurationMS float64       `json:"duration_ms"`
+	Bytes      int64         `json:"bytes"`
+	Client     string        `json:"client"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+	RequestID  string        `json:"request_id,omitempty"`
+	Slow       bool          `json:"slow,omitempty"`
+	SampleRate int           `json:"sample_rate,omitempty"`
+}
+
+// AccessSink takes access log entries. Log is called on the request's
+// goroutine after the response is written, so it must not block.
+type AccessSink interface {
+	Log(e *AccessEntry)
+}
+
+// LoggingMiddleware logs each request with method, URI, status, and duration
+func LoggingMiddleware(next http.Handler) http.Handler {
+	return Logging(LoggingOptions{})(next)
+}
+
+// Logging returns an access-log middleware configured by opts.
+func Logging(opts LoggingOptions) func(http.Handler) http.Handler {
+	var redirects atomic.Uint64
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			// wrap response writer
+			rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+
+			// call next handler
+			next.ServeHTTP(rw, r)
+
+			duration := time.Since(start)
+			// Event streams are long-lived by design, not slow.
+			slow := opts.SlowThreshold > 0 && duration >= opts.SlowThreshold &&
+				!strings.HasPrefix(rw.Header().Get("Content-Type"), "text/event-stream")
+			sampled := !slow && rw.statusCode >= 300 && rw.statusCode < 400 && opts.RedirectSampleRate > 1
+			if sampled && redirects.Add(1)%uint64(opts.RedirectSampleRate) != 1 {
+				return
+			}
+
+			path := r.RequestURI
+			if opts.RedactQuery {
+				path = r.URL.EscapedPath()
+			}
+			if opts.Sink != nil {
+				e := &AccessEntry{
+					Time:       start.UTC(),
+					Method:     r.Method,
+					Host:       r.Host,
+					Path:       path,
+					Status:     rw.statusCode,
+					Duration:   duration,
+					DurationMS: float64(duration) / float64(time.Millisecond),
+					Bytes:      rw.bytes,
+					Client:     ClientIP(r),
+					UserAgent:  r.UserAgent(),
+					RequestID:  GetRequestID(r.Context()),
+					Slow:       slow,
+				}
+				if sampled {
+					e.SampleRate = opts.RedirectSampleRate
+				}
+				opts.Sink.Log(e)
+				return
+			}
+			fields := logrus.Fields{
+				"method":     r.Method,
+				"path":       path,
+				"status":     rw.statusCode,
+				"duration":   duration,
+				"bytes":      rw.bytes,
+				"client":     ClientIP(r),
+				"request_id": GetRequestID(r.Context()),
+			}
+			if sampled {
+				fields["sample_rate"] = opts.RedirectSampleRate
+			}
+			entry := logrus.WithFields(fields)
+			if slow {
+				entry.WithField("slow", true).Warn("incoming request")
+				return
+			}
+			entry.Info("incoming request")
+		})
+	}
+}
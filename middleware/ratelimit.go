@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/ratelimit"
+)
+
+// RateLimit rejects requests once the limiter says the key returned by
+// keyFn is over its budget, delegating the response to onLimited. Limiter
+// failures (e.g. Redis being down) fail open.
+func RateLimit(l ratelimit.Limiter, keyFn func(*http.Request) string, onLimited http.HandlerFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			res, err := l.Allow(r.Context(), keyFn(r))
+			if err != nil {
+				logrus.WithError(err).Warn("rate limiter unavailable, allowing request")
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			if !res.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(res.ResetIn.Seconds()))))
+				onLimited(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
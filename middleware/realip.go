@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ParseTrustedProxies parses a comma-separated list of IPs and CIDRs.
+func ParseTrustedProxies(raw string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, s := range strings.Split(raw, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			addr = addr.Unmap()
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
+
+// RealIP resolves the client address once per request. Forwarding headers
+// (Forwarded, then X-Forwarded-For, then X-Real-IP) are only honoured when
+// the direct peer is a trusted proxy, and the forwarded chain is walked
+// from the right so a client cannot spoof an address by prepending hops.
+func RealIP(trusted []netip.Prefix) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := resolveClientIP(r, trusted)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey, ip)))
+		})
+	}
+}
+
+// ClientIP returns the address resolved by RealIP, falling back to the
+// peer address for requests that did not pass through it.
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey).(string); ok {
+		return ip
+	}
+	if addr, ok := parseHostAddr(r.RemoteAddr); ok {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
+
+func resolveClientIP(r *http.Request, trusted []netip.Prefix) string {
+	peer, ok := parseHostAddr(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !isTrusted(peer, trusted) {
+		return peer.String()
+	}
+	var hops []string
+	if f := r.Header.Values("Forwarded"); len(f) > 0 {
+		hops = forwardedFor(f)
+	} else if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		for _, h := range xff {
+			hops = append(hops, strings.Split(h, ",")...)
+		}
+	} else if xr := r.Header.Get("X-Real-IP"); xr != "" {
+		hops = []string{xr}
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHostAddr(strings.TrimSpace(hops[i]))
+		if !ok {
+			break
+		}
+		client = addr
+		if !isTrusted(addr, trusted) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwardedFor extracts the for= values from RFC 7239 Forwarded headers.
+func forwardedFor(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					out = append(out, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+	return out
+}
+
+// parseHostAddr accepts "ip", "ip:port", "[ipv6]" and "[ipv6]:port",
+// dropping zones and unmapping IPv4-in-IPv6 addresses.
+func parseHostAddr(s string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.WithZone("").Unmap(), true
+}
+
+func isTrusted(addr netip.Addr, trusted []netip.Prefix) bool {
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"10.0.0.1", []string{"10.0.0.1/32"}, false},
+		{" 10.0.0.0/8 , ::1 ", []string{"10.0.0.0/8", "::1/128"}, false},
+		{"10.1.2.3/8", []string{"10.0.0.0/8"}, false},
+		{"::ffff:10.0.0.1", []string{"10.0.0.1/32"}, false},
+		{"proxy.local", nil, true},
+		{"10.0.0.0/33", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTrustedProxies(tt.raw)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTrustedProxies(%q) error = %v, want error %v", tt.raw, err, tt.wantErr)
+			continue
+		}
+		var gotStrs []string
+		for _, p := range got {
+			gotStrs = append(gotStrs, p.String())
+		}
+		if !reflect.DeepEqual(gotStrs, tt.want) {
+			t.Errorf("ParseTrustedProxies(%q) = %v, want %v", tt.raw, gotStrs, tt.want)
+		}
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		remote string
+		header http.Header
+		want   string
+	}{
+		{"untrusted peer ignores headers", "203.0.113.9:1234",
+			http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.9"},
+		{"trusted peer without headers", "10.0.0.2:1234", nil, "10.0.0.2"},
+		{"trusted peer, X-Forwarded-For", "10.0.0.2:1234",
+			http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"spoofed hop prepended by the client", "10.0.0.2:1234",
+			http.Header{"X-Forwarded-For": {"1.2.3.4, 198.51.100.1"}}, "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.2:1234",
+			http.Header{"X-Forwarded-For": {"198.51.100.1, 10.0.0.5, 10.0.0.3"}}, "198.51.100.1"},
+		{"X-Forwarded-For over several headers", "10.0.0.2:1234",
+			http.Header{"X-Forwarded-For": {"1.2.3.4", "198.51.100.1, 10.0.0.3"}}, "198.51.100.1"},
+		{"garbage hop stops the walk", "10.0.0.2:1234",
+			http.Header{"X-Forwarded-For": {"198.51.100.1, unknown, 10.0.0.3"}}, "10.0.0.3"},
+		{"Forwarded wins over X-Forwarded-For", "10.0.0.2:1234",
+			http.Header{"Forwarded": {"for=198.51.100.7;proto=https"}, "X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.7"},
+		{"Forwarded IPv6 with port", "10.0.0.2:1234",
+			http.Header{"Forwarded": {`for="[2001:db8::1]:4711", for=10.0.0.3`}}, "2001:db8::1"},
+		{"X-Real-IP", "10.0.0.2:1234",
+			http.Header{"X-Real-Ip": {"198.51.100.1"}}, "198.51.100.1"},
+		{"IPv6 trusted peer", "[fd00::1]:1234",
+			http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"IPv4-mapped peer is trusted", "[::ffff:10.0.0.2]:1234",
+			http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"unparsable peer", "pipe", nil, "pipe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := RealIP(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = ClientIP(r)
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			if got != tt.want {
+				t.Errorf("ClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIPWithoutRealIP(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "[2001:db8::1%eth0]:80"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if got := ClientIP(r); got != "2001:db8::1" {
+		t.Errorf("ClientIP = %q, want the peer address 2001:db8::1", got)
+	}
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/sirupsen/logrus"
+)
+
+// startedWriter records whether a response has begun, after which a panic
+// can no longer be turned into a clean error response.
+type startedWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (sw *startedWriter) WriteHeader(code int) {
+	sw.started = true
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *startedWriter) Write(b []byte) (int, error) {
+	sw.started = true
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *startedWriter) Unwrap() http.ResponseWriter { return sw.ResponseWriter }
+
+// Recover logs a panicking handler's stack and delegates the response to
+// onPanic. If the handler had already started its response the connection
+// is aborted instead, since the client would otherwise take a truncated
+// body for a complete one. http.ErrAbortHandler passes through untouched.
+// Place it inside RequestID so the log line and response carry the ID.
+func Recover(onPanic http.HandlerFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sw := &startedWriter{ResponseWriter: w}
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				logrus.WithFields(logrus.Fields{
+					"action":     "panic",
+					"panic":      v,
+					"method":     r.Method,
+					"path":       r.URL.Path,
+					"request_id": GetRequestID(r.Context()),
+					"stack":      string(debug.Stack()),
+				}).Error("handler panicked")
+				if sw.started {
+					panic(http.ErrAbortHandler)
+				}
+				onPanic(w, r)
+			}()
+			next.ServeHTTP(sw, r)
+		})
+	}
+}
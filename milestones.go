@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const maxMilestones = 10
+
+// validateMilestones checks click thresholds set on a link and returns
+// them sorted and without duplicates.
+func validateMilestones(m []int64) ([]int64, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	if len(m) > maxMilestones {
+		return nil, fmt.Errorf("at most %d milestones are allowed", maxMilestones)
+	}
+	out := make([]int64, 0, len(m))
+	for _, t := range m {
+		if t <= 0 {
+			return nil, errors.New("milestones must be positive click counts")
+		}
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	n := 1
+	for _, t := range out[1:] {
+		if t != out[n-1] {
+			out[n] = t
+			n++
+		}
+	}
+	return out[:n], nil
+}
+
+// crossedMilestones returns the thresholds a click total passed on its
+// way from prev to now. With the shared counter prev is the value each
+// INCR replaced, so exactly one instance in the cluster sees a crossing.
+func crossedMilestones(milestones []int64, prev, now int64) []int64 {
+	var out []int64
+	for _, t := range milestones {
+		if prev < t && t <= now {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// checkMilestones alerts l's owner about every milestone the click total
+// crossed since prev. Delivery runs in the background so redirects and
+// flushes never wait on a webhook.
+func (s *Store) checkMilestones(l *Link, prev int64) {
+	if l == nil || s.notifier == nil || l.Owner == "" || !s.flags.Enabled(FlagMilestones, l.Owner) {
+		return
+	}
+	crossed := crossedMilestones(l.Milestones, prev, l.Clicks)
+	if len(crossed) == 0 {
+		return
+	}
+	p := s.notifier.Prefs(l.Owner)
+	shortURL := s.shortURL(l)
+	go func() {
+		for _, t := range crossed {
+			s.notifier.sendMilestone(p, l, shortURL, t)
+		}
+	}()
+}
+
+type milestoneEvent struct {
+	Event     string    `json:"event"`
+	ShortCode string    `json:"short_code"`
+	ShortURL  string    `json:"short_url"`
+	LongURL   string    `json:"long_url"`
+	Owner     string    `json:"owner"`
+	Milestone int64     `json:"milestone"`
+	Clicks    int64     `json:"clicks"`
+	At        time.Time `json:"at"`
+}
+
+// sendMilestone goes out on the owner's configured channels; setting
+// milestones on a link is the opt-in, so prefs.Enabled is not required.
+func (n *Notifier) sendMilestone(p NotificationPrefs, l *Link, shortURL string, milestone int64) {
+	ev := milestoneEvent{
+		Event:     "link.milestone",
+		ShortCode: l.ShortCode,
+		ShortURL:  shortURL,
+		LongURL:   l.LongURL,
+		Owner:     l.Owner,
+		Milestone: milestone,
+		Clicks:    l.Clicks,
+		At:        time.Now().UTC(),
+	}
+	text := fmt.Sprintf("Short link %s (→ %s) passed %d clicks.", ev.ShortURL, ev.LongURL, milestone)
+	log := logrus.WithFields(logrus.Fields{"action": "milestone", "short_code": l.ShortCode, "owner": l.Owner, "milestone": milestone})
+	if n.deliver(l.Owner, p, ev, fmt.Sprintf("Short link %s passed %d clicks", l.ShortCode, milestone), text, log) == nil {
+		log.Info("milestone alert sent")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// Service modes. In read-only mode redirects keep working but the API
+// refuses writes; in maintenance mode every request gets a 503.
+const (
+	ModeNormal      = "normal"
+	ModeReadOnly    = "read_only"
+	ModeMaintenance = "maintenance"
+)
+
+// ServiceMode is the cluster-wide operating mode.
+type ServiceMode struct {
+	Mode    string    `json:"mode"`
+	Message string    `json:"message,omitempty"`
+	Since   time.Time `json:"since"`
+}
+
+// ModeStore persists the mode where every instance can see it.
+type ModeStore interface {
+	Load(ctx context.Context) (*ServiceMode, error) // nil if never set
+	Save(ctx context.Context, m *ServiceMode) error
+}
+
+type memoryModeStore struct{ m atomic.Pointer[ServiceMode] }
+
+func (s *memoryModeStore) Load(context.Context) (*ServiceMode, error) { return s.m.Load(), nil }
+
+func (s *memoryModeStore) Save(_ context.Context, m *ServiceMode) error {
+	s.m.Store(m)
+	return nil
+}
+
+type redisModeStore struct {
+	client *redis.Client
+	key    string
+}
+
+func (s *redisModeStore) Load(ctx context.Context) (*ServiceMode, error) {
+	raw, err := s.client.Get(ctx, s.key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m ServiceMode
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *redisModeStore) Save(ctx context.Context, m *ServiceMode) error {
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, s.key, raw, 0).Err()
+}
+
+// Modes caches the shared mode so the per-request check stays in memory;
+// Run refreshes it from the store.
+type Modes struct {
+	store   ModeStore
+	current atomic.Pointer[ServiceMode]
+	pages   *Pages // optional; renders the maintenance page
+}
+
+func NewModes(store ModeStore) *Modes {
+	m := &Modes{store: store}
+	m.current.Store(&ServiceMode{Mode: ModeNormal})
+	m.refresh(context.Background())
+	return m
+}
+
+func (m *Modes) Current() ServiceMode { return *m.current.Load() }
+
+// Set switches the whole cluster to mode.
+func (m *Modes) Set(ctx context.Context, mode, message string) (*ServiceMode, error) {
+	sm := &ServiceMode{Mode: mode, Message: message, Since: time.Now().UTC()}
+	if err := m.store.Save(ctx, sm); err != nil {
+		return nil, err
+	}
+	m.current.Store(sm)
+	logrus.WithFields(logrus.Fields{
+		"action": "set_mode",
+		"mode":   mode,
+	}).Warn("service mode changed")
+	return sm, nil
+}
+
+// Run polls the store every interval until ctx is cancelled, so mode
+// changes made on another instance take effect here too.
+func (m *Modes) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.refresh(ctx)
+		}
+	}
+}
+
+func (m *Modes) refresh(ctx context.Context) {
+	sm, err := m.store.Load(ctx)
+	if err != nil {
+		logrus.WithError(err).Warn("loading service mode failed, keeping last known")
+		return
+	}
+	if sm != nil {
+		m.current.Store(sm)
+	}
+}
+
+func validMode(mode string) bool {
+	return mode == ModeNormal || mode == ModeReadOnly || mode == ModeMaintenance
+}
+
+// Guard enforces the current mode. /api/admin and /health always pass so
+// operators can inspect the service and switch the mode back.
+func (m *Modes) Guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cur := m.current.Load()
+		if cur.Mode == ModeNormal || r.URL.Path == "/health" || strings.HasPrefix(r.URL.Path, "/api/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		isAPI := strings.HasPrefix(r.URL.Path, "/api/") || strings.HasPrefix(r.URL.Path, "/public/")
+		switch {
+		case cur.Mode == ModeMaintenance && !isAPI:
+			w.Header().Set("Retry-After", "300")
+			msg := line(msgMaintenanceText)
+			if cur.Message != "" {
+				msg = pageLine{text: cur.Message}
+			}
+			m.pages.render(w, r, http.StatusServiceUnavailable, "", msgMaintenanceTitle, msg)
+			return
+		case cur.Mode == ModeMaintenance,
+			cur.Mode == ModeReadOnly && isAPI && (!isSafeMethod(r.Method) || r.URL.Path == quickPath):
+			msg := "service is in " + strings.ReplaceAll(cur.Mode, "_", "-") + " mode"
+			if cur.Message != "" {
+				msg += ": " + cur.Message
+			}
+			w.Header().Set("Retry-After", "300")
+			httpError(w, r, http.StatusServiceUnavailable, ErrCodeUnavailable, msg)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isSafeMethod reports whether method cannot change anything. Guard still
+// counts GET quickPath as a write, since it creates links.
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// modeHandler serves GET and PUT /api/admin/mode.
+func modeHandler(modes *Modes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			writeJSON(w, http.StatusOK, modes.Current())
+			return
+		}
+		var req struct {
+			Mode    string `json:"mode"`
+			Message string `json:"message,omitempty"`
+		}
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		if !validMode(req.Mode) {
+			writeAPIError(w, r, fieldError("mode", "mode must be one of normal, read_only, maintenance"))
+			return
+		}
+		sm, err := modes.Set(r.Context(), req.Mode, req.Message)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, sm)
+	}
+}
+
+// applyStartupMode honours SERVICE_MODE, which overrides the shared state.
+func applyStartupMode(modes *Modes, mode string) error {
+	if mode == "" {
+		return nil
+	}
+	if !validMode(mode) {
+		return errors.New("SERVICE_MODE must be one of normal, read_only, maintenance")
+	}
+	_, err := modes.Set(context.Background(), mode, "")
+	return err
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/notify"
+)
+
+// NotificationChannels are the destinations notifications go to.
+type NotificationChannels struct {
+	WebhookURL      string `json:"webhook_url,omitempty"`
+	WebhookSecret   string `json:"webhook_secret,omitempty"` // signs deliveries; see package webhookverify
+	SlackWebhookURL string `json:"slack_webhook_url,omitempty"`
+	Email           string `json:"email,omitempty"`
+}
+
+func (c NotificationChannels) empty() bool {
+	return c.WebhookURL == "" && c.SlackWebhookURL == "" && c.Email == ""
+}
+
+// validate reports a channel that cannot be delivered to safely: webhooks
+// must be http(s) URLs, and email a bare address, which keeps CR and LF
+// from smuggling extra headers into the mail.
+func (c NotificationChannels) validate(field string) *APIError {
+	for name, raw := range map[string]string{"webhook_url": c.WebhookURL, "slack_webhook_url": c.SlackWebhookURL} {
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fieldError(field+name, name+" must be an http or https URL")
+		}
+	}
+	if c.Email != "" {
+		addr, err := mail.ParseAddress(c.Email)
+		if err != nil || addr.Address != c.Email || strings.ContainsAny(c.Email, "\r\n") {
+			return fieldError(field+"email", "email must be a plain address such as name@example.com")
+		}
+	}
+	return nil
+}
+
+// NotificationPrefs is an owner's opt-in for expiry notices and digests,
+// and the channels to deliver them on.
+type NotificationPrefs struct {
+	Enabled bool `json:"enabled"`
+	NotificationChannels
+	NoticeHours int `json:"notice_hours,omitempty"` // overrides the global lead time
+
+	// Digest is DigestDaily or DigestWeekly for a regular summary of the
+	// owner's links, sent whether or not Enabled is set.
+	Digest string `json:"digest,omitempty"`
+}
+
+// SMTPConfig configures email delivery; an empty Addr disables email.
+type SMTPConfig = notify.SMTPConfig
+
+// Notifier tells link owners that their links are about to expire.
+type Notifier struct {
+	mu     sync.RWMutex
+	prefs  map[string]NotificationPrefs // by owner
+	notice time.Duration                // default lead time before expiry
+	smtp   SMTPConfig
+	client *http.Client
+
+	dispatch notify.Dispatcher
+	tenants  *Tenants // optional; supplies tenant-wide channels
+
+	digestSent map[string]time.Time // by owner
+}
+
+func NewNotifier(notice time.Duration, smtpCfg SMTPConfig) *Notifier {
+	return &Notifier{
+		prefs:      make(map[string]NotificationPrefs),
+		notice:     notice,
+		smtp:       smtpCfg,
+		client:     newOutboundClient(5 * time.Second),
+		dispatch:   notify.Dispatcher{Attempts: 3, Backoff: time.Second},
+		digestSent: make(map[string]time.Time),
+	}
+}
+
+// Configure replaces the default lead time and the SMTP settings.
+func (n *Notifier) Configure(notice time.Duration, smtpCfg SMTPConfig) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.notice = notice
+	n.smtp = smtpCfg
+}
+
+func (n *Notifier) smtpConfig() SMTPConfig {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.smtp
+}
+
+func (n *Notifier) Prefs(owner string) NotificationPrefs {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.prefs[owner]
+}
+
+func (n *Notifier) SetPrefs(owner string, p NotificationPrefs) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.prefs[owner] = p
+}
+
+// leadTime is how long before expiry owner wants to hear about it.
+func (n *Notifier) leadTime(p NotificationPrefs) time.Duration {
+	if p.NoticeHours > 0 {
+		return time.Duration(p.NoticeHours) * time.Hour
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.notice
+}
+
+// RunExpiryNotices checks every interval for links entering their owner's
+// notice window and notifies each one once.
+func (n *Notifier) RunExpiryNotices(store *Store, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		n.notifyExpiring(store)
+	}
+}
+
+func (n *Notifier) notifyExpiring(store *Store) {
+	ctx := context.Background()
+	now := store.now()
+	for _, l := range store.pendingExpiryNotices(ctx) {
+		p := n.Prefs(l.Owner)
+		if !p.Enabled || l.ExpiresAt.Sub(now) > n.leadTime(p) {
+			continue
+		}
+		// Marking first keeps two instances from both sending; a failed
+		// send clears the mark so the next round tries again.
+		if !store.markExpiryNotified(ctx, l.Key()) {
+			continue
+		}
+		if n.sendExpiryNotice(p, l, store.shortURL(l)) != nil {
+			store.clearExpiryNotified(ctx, l.Key())
+		}
+	}
+}
+
+type expiryEvent struct {
+	Event     string    `json:"event"`
+	ShortCode string    `json:"short_code"`
+	ShortURL  string    `json:"short_url"`
+	LongURL   string    `json:"long_url"`
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (n *Notifier) sendExpiryNotice(p NotificationPrefs, l *Link, shortURL string) error {
+	ev := expiryEvent{
+		Event:     "link.expiring",
+		ShortCode: l.ShortCode,
+		ShortURL:  shortURL,
+		LongURL:   l.LongURL,
+		Owner:     l.Owner,
+		ExpiresAt: l.ExpiresAt,
+	}
+	text := fmt.Sprintf("Short link %s (→ %s) expires at %s.", ev.ShortURL, ev.LongURL, ev.ExpiresAt.Format(time.RFC3339))
+	log := logrus.WithFields(logrus.Fields{"action": "expiry_notice", "short_code": l.ShortCode, "owner": l.Owner})
+	if err := n.deliver(l.Owner, p, ev, "Short link "+l.ShortCode+" is about to expire", text, log); err != nil {
+		return err
+	}
+	log.Info("expiry notice sent")
+	return nil
+}
+
+// channels returns where owner's notifications go: the channels in p or,
+// if p names none, those of owner's tenant.
+func (n *Notifier) channels(owner string, p NotificationPrefs) []notify.Channel {
+	c := p.NotificationChannels
+	if c.empty() && n.tenants != nil {
+		if t, err := n.tenants.Get(tenantOf(owner)); err == nil && t.Notifications != nil {
+			c = *t.Notifications
+		}
+	}
+	var out []notify.Channel
+	if c.WebhookURL != "" {
+		out = append(out, &notify.Webhook{URL: c.WebhookURL, Secret: c.WebhookSecret, Client: n.client})
+	}
+	if c.SlackWebhookURL != "" {
+		out = append(out, &notify.Slack{URL: c.SlackWebhookURL, Client: n.client})
+	}
+	if cfg := n.smtpConfig(); c.Email != "" && cfg.Addr != "" {
+		out = append(out, &notify.Email{SMTP: cfg, To: c.Email})
+	}
+	return out
+}
+
+// deliver sends ev to the webhook and text to Slack and email, on every
+// channel owner has, retrying each a few times. A failure is logged to
+// log and returned.
+func (n *Notifier) deliver(owner string, p NotificationPrefs, ev interface{}, subject, text string, log *logrus.Entry) error {
+	m := notify.Message{Event: ev, Subject: subject, Text: text}
+	err := n.dispatch.Send(context.Background(), n.channels(owner, p), m)
+	if err != nil {
+		log.WithError(err).Warn("notification delivery failed")
+	}
+	return err
+}
+
+// notificationPrefsHandler serves GET and PUT /api/notifications for the
+// calling owner.
+func notificationPrefsHandler(n *Notifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner := ownerFrom(r.Context())
+		if r.Method == http.MethodGet {
+			writeJSON(w, http.StatusOK, n.Prefs(owner))
+			return
+		}
+		var p NotificationPrefs
+		if apiErr := decodeJSON(r, &p); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		if p.NoticeHours < 0 {
+			writeAPIError(w, r, fieldError("notice_hours", "notice_hours must be a positive integer"))
+			return
+		}
+		switch p.Digest {
+		case "", DigestDaily, DigestWeekly:
+		default:
+			writeAPIError(w, r, fieldError("digest", "digest must be daily or weekly"))
+			return
+		}
+		if apiErr := p.NotificationChannels.validate(""); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		n.SetPrefs(owner, p)
+		writeJSON(w, http.StatusOK, p)
+	}
+}
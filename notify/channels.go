@@ -0,0 +1,110 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/smtp"
+	"strings"
+
+	"url-shortener/webhookverify"
+)
+
+// Webhook POSTs the message's event as JSON. With a Secret, each delivery
+// is signed as package webhookverify checks.
+type Webhook struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+func (w *Webhook) Name() string { return "webhook" }
+
+func (w *Webhook) Send(ctx context.Context, m Message) error {
+	var secret []byte
+	if w.Secret != "" {
+		secret = []byte(w.Secret)
+	}
+	return postJSON(ctx, w.Client, w.URL, m.Event, secret)
+}
+
+// Slack posts the message's text to a Slack incoming webhook.
+type Slack struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *Slack) Name() string { return "slack" }
+
+func (s *Slack) Send(ctx context.Context, m Message) error {
+	return postJSON(ctx, s.Client, s.URL, map[string]string{"text": m.Text}, nil)
+}
+
+// postJSON sends v, signed with secret unless it is nil.
+func postJSON(ctx context.Context, client *http.Client, url string, v interface{}, secret []byte) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != nil {
+		if err := webhookverify.SignHeaders(req.Header, secret, body); err != nil {
+			return err
+		}
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return &StatusError{Code: resp.StatusCode}
+	}
+	return nil
+}
+
+// SMTPConfig configures email delivery; an empty Addr disables email.
+type SMTPConfig struct {
+	Addr     string // SMTP_ADDR, host:port
+	From     string // SMTP_FROM
+	Username string // SMTP_USERNAME
+	Password string // SMTP_PASSWORD
+}
+
+// Email sends the message's subject and text as a plain-text mail.
+type Email struct {
+	SMTP SMTPConfig
+	To   string
+}
+
+func (e *Email) Name() string { return "email" }
+
+func (e *Email) Send(_ context.Context, m Message) error {
+	if strings.ContainsAny(e.To+m.Subject, "\r\n") {
+		return errors.New("email: line break in recipient or subject")
+	}
+	cfg := e.SMTP
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		host := cfg.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, host)
+	}
+	msg := "From: " + cfg.From + "\r\n" +
+		"To: " + e.To + "\r\n" +
+		"Subject: " + m.Subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		m.Text + "\r\n"
+	return smtp.SendMail(cfg.Addr, auth, cfg.From, []string{e.To}, []byte(msg))
+}
@@ -0,0 +1,78 @@
+// Package notify delivers notifications over pluggable channels (webhook,
+// Slack, email) with retries, so features that notify people only decide
+// what to say and to whom.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Message is one notification. Event is the machine-readable payload
+// webhooks receive as JSON; Subject and Text are for people.
+type Message struct {
+	Event   interface{}
+	Subject string
+	Text    string
+}
+
+// Channel delivers messages to one destination.
+type Channel interface {
+	// Name identifies the channel in logs, e.g. "webhook" or "email".
+	Name() string
+	Send(ctx context.Context, m Message) error
+}
+
+// StatusError is a non-2xx answer from an HTTP channel.
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string { return fmt.Sprintf("unexpected status %d", e.Code) }
+
+// retryable reports whether err may go away on its own: anything but a
+// 4xx answer other than 408 and 429.
+func retryable(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Code >= 500 || se.Code == 408 || se.Code == 429
+	}
+	return true
+}
+
+// Dispatcher sends messages to channels, retrying transient failures.
+type Dispatcher struct {
+	Attempts int           // per channel; 0 means 1
+	Backoff  time.Duration // before the first retry, doubling after
+}
+
+// Send delivers m on every channel. A channel that keeps failing does
+// not stop the others; their errors are joined, each prefixed with the
+// channel's name.
+func (d Dispatcher) Send(ctx context.Context, channels []Channel, m Message) error {
+	var errs []error
+	for _, ch := range channels {
+		if err := d.sendOne(ctx, ch, m); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", ch.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (d Dispatcher) sendOne(ctx context.Context, ch Channel, m Message) error {
+	backoff := d.Backoff
+	for attempt := 1; ; attempt++ {
+		err := ch.Send(ctx, m)
+		if err == nil || attempt >= d.Attempts || !retryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,177 @@
+// Package objectstore uploads objects to S3-compatible storage (AWS S3,
+// MinIO, GCS interoperability mode, ...) without pulling in a cloud SDK.
+package objectstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Uploader stores objects by key.
+type Uploader interface {
+	Put(ctx context.Context, key string, body []byte, contentType string) error
+}
+
+// Deleter is implemented by stores that can remove objects.
+type Deleter interface {
+	Delete(ctx context.Context, key string) error
+}
+
+// S3 signs requests with AWS Signature Version 4.
+type S3 struct {
+	Endpoint  string // e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses objects as endpoint/bucket/key rather than
+	// bucket.endpoint/key; MinIO and most self-hosted stores need it.
+	PathStyle bool
+
+	Client *http.Client
+}
+
+func (s *S3) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	escaped := escapePath(key)
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket + "/" + key
+		u.RawPath = "/" + s.Bucket + "/" + escaped
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = "/" + key
+		u.RawPath = "/" + escaped
+	}
+	return u, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	s.sign(req, body, time.Now().UTC())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("objectstore: PUT %s: %s: %s", key, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// Delete removes key. Deleting a missing object is not an error.
+func (s *S3) Delete(ctx context.Context, key string) error {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	s.sign(req, nil, time.Now().UTC())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("objectstore: DELETE %s: %s: %s", key, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// sign adds SigV4 headers for a request carrying payload.
+func (s *S3) sign(req *http.Request, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	k := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	k = hmacSHA256(k, s.Region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signed, sig))
+}
+
+// escapePath URI-encodes each segment of key the way SigV4 expects.
+func escapePath(key string) string {
+	segs := strings.Split(key, "/")
+	for i, seg := range segs {
+		segs[i] = strings.ReplaceAll(url.PathEscape(seg), "+", "%2B")
+	}
+	return strings.Join(segs, "/")
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
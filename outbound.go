@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// maxOutboundRedirects bounds the redirects an outbound request follows.
+const maxOutboundRedirects = 5
+
+// errBlockedAddress is the dial error for addresses outbound requests to
+// user-supplied URLs must not reach.
+var errBlockedAddress = errors.New("destination resolves to a loopback, private or link-local address")
+
+// blockedPrefixes are the ranges netip has no predicate for: "this
+// network" and carrier-grade NAT.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// blockedIP reports whether ip is internal to the server's network: the
+// server itself, private ranges, link-local ones such as the cloud
+// metadata endpoint 169.254.169.254, and unspecified or multicast ones.
+func blockedIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, p := range blockedPrefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newOutboundClient returns the client for requests to URLs that API
+// callers supply: page titles, previews, health checks, redirect chains
+// and notification webhooks. Its dialer checks each address after DNS
+// resolution, so neither a name resolving to an internal address nor a
+// redirect to one gets through, and it ignores proxy settings, which
+// would hide the real destination from that check. Redirects are limited
+// to http and https.
+func newOutboundClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip, err := netip.ParseAddr(host)
+			if err != nil || blockedIP(ip) {
+				return errBlockedAddress
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxOutboundRedirects {
+				return errors.New("stopped after too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errors.New("redirect to a non-http URL")
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+
+	"url-shortener/storage"
+)
+
+// PreviewConfig controls fetching destination titles for link previews.
+type PreviewConfig struct {
+	Enabled     bool          // PREVIEW_FETCH
+	Timeout     time.Duration // PREVIEW_FETCH_TIMEOUT per page
+	Concurrency int           // PREVIEW_FETCH_CONCURRENCY pages fetched at once
+}
+
+var errStalePreview = errors.New("destination changed since the preview was fetched")
+
+const (
+	maxPreviewBytes = 256 << 10
+	maxPreviewText  = 300
+)
+
+// PreviewFetcher reads the title, description and favicon of new links'
+// destinations in the background.
+type PreviewFetcher struct {
+	client *http.Client
+	slots  chan struct{}
+}
+
+func NewPreviewFetcher(cfg PreviewConfig) *PreviewFetcher {
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	return &PreviewFetcher{
+		client: newOutboundClient(cfg.Timeout),
+		slots:  make(chan struct{}, cfg.Concurrency),
+	}
+}
+
+// Fetch reads target's head. Pages that are not HTML yield nothing.
+func (f *PreviewFetcher) Fetch(ctx context.Context, target string) (*storage.Preview, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return nil, nil
+	}
+	p := parsePreview(io.LimitReader(resp.Body, maxPreviewBytes), resp.Request.URL)
+	p.FetchedAt = time.Now().UTC()
+	return p, nil
+}
+
+// parsePreview reads the document head, preferring Open Graph tags to
+// <title> and the plain description. The favicon defaults to /favicon.ico.
+func parsePreview(r io.Reader, base *url.URL) *storage.Preview {
+	var title, ogTitle, desc, ogDesc, icon string
+	z := html.NewTokenizer(r)
+	inTitle := false
+loop:
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			break loop
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			attr := func(name string) string {
+				for _, a := range t.Attr {
+					if a.Key == name {
+						return a.Val
+					}
+				}
+				return ""
+			}
+			switch t.Data {
+			case "title":
+				inTitle = title == ""
+			case "meta":
+				switch strings.ToLower(attr("name") + attr("property")) {
+				case "description":
+					desc = attr("content")
+				case "og:title":
+					ogTitle = attr("content")
+				case "og:description":
+					ogDesc = attr("content")
+				}
+			case "link":
+				for _, rel := range strings.Fields(strings.ToLower(attr("rel"))) {
+					if rel == "icon" && icon == "" {
+						icon = attr("href")
+					}
+				}
+			case "body":
+				break loop
+			}
+		case html.TextToken:
+			if inTitle {
+				title += string(z.Text())
+			}
+		case html.EndTagToken:
+			if t := z.Token(); t.Data == "title" {
+				inTitle = false
+			} else if t.Data == "head" {
+				break loop
+			}
+		}
+	}
+	p := &storage.Preview{
+		Title:       previewText(firstOf(ogTitle, title)),
+		Description: previewText(firstOf(ogDesc, desc)),
+	}
+	if icon == "" {
+		icon = "/favicon.ico"
+	}
+	if u, err := base.Parse(icon); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		p.FaviconURL = u.String()
+	}
+	return p
+}
+
+func firstOf(vals ...string) string {
+	for _, v := range vals {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// previewText collapses whitespace and trims s to maxPreviewText runes.
+func previewText(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) > maxPreviewText {
+		s = string([]rune(s)[:maxPreviewText-1]) + "…"
+	}
+	return s
+}
+
+// fetchPreview fills in l's preview in the background. Fetches beyond the
+// configured concurrency are skipped rather than queued.
+func (s *Store) fetchPreview(l *Link) {
+	if s.previews == nil || l.Reserved {
+		return
+	}
+	select {
+	case s.previews.slots <- struct{}{}:
+	default:
+		return
+	}
+	key, code, target := l.Key(), l.ShortCode, l.LongURL
+	go func() {
+		defer func() { <-s.previews.slots }()
+		p, err := s.previews.Fetch(context.Background(), target)
+		if err != nil {
+			logrus.WithError(err).WithField("short_code", code).Debug("fetching link preview failed")
+			return
+		}
+		if p == nil {
+			return
+		}
+		_, err = s.backend.Update(context.Background(), key, func(l *Link) error {
+			if l.LongURL != target {
+				return errStalePreview
+			}
+			l.Preview = p
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStalePreview) && !errors.Is(err, ErrNotFound) {
+			logrus.WithError(err).WithField("short_code", code).Warn("storing link preview failed")
+		}
+	}()
+}
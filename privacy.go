@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// Privacy scrubs click records for GDPR-conscious deployments. Records of
+// links with Privacy set, or all records when Global is set, keep only a
+// truncated client network, a salted hash of the address for counting
+// unique visitors, a browser/OS family instead of the user agent and the
+// referrer's origin. The salt changes every Rotation, after which hashes
+// can no longer be linked to earlier ones.
+type Privacy struct {
+	Global   bool
+	HonorDNT bool // skip recording clicks sent with DNT: 1 or Sec-GPC: 1
+	Rotation time.Duration
+	salts    SaltSource
+	mu       sync.Mutex
+	epoch    int64
+	salt     []byte
+}
+
+// SaltSource returns the hashing salt for a rotation epoch. Instances
+// sharing one hash space must share the source.
+type SaltSource interface {
+	Salt(ctx context.Context, epoch int64) ([]byte, error)
+}
+
+type memorySalts struct{}
+
+func (memorySalts) Salt(context.Context, int64) ([]byte, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+// redisSalts agrees on one salt per epoch across the cluster; it expires
+// with the epoch so old salts are not kept around.
+type redisSalts struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+func (r *redisSalts) Salt(ctx context.Context, epoch int64) ([]byte, error) {
+	key := r.prefix + "privacy:salt:" + strconv.FormatInt(epoch, 10)
+	fresh, err := memorySalts{}.Salt(ctx, epoch)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.client.SetNX(ctx, key, fresh, r.ttl).Err(); err != nil {
+		return nil, err
+	}
+	return r.client.Get(ctx, key).Bytes()
+}
+
+func NewPrivacy(global, honorDNT bool, rotation time.Duration, salts SaltSource) *Privacy {
+	return &Privacy{Global: global, HonorDNT: honorDNT, Rotation: rotation, salts: salts}
+}
+
+// doNotTrack reports whether the client asked not to be tracked.
+func doNotTrack(r *http.Request) bool {
+	return r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
+}
+
+// suppress reports whether rec must not be recorded at all.
+func (p *Privacy) suppress(rec *ClickRecord) bool {
+	return p != nil && p.HonorDNT && rec.doNotTrack
+}
+
+// applies reports whether l's clicks are scrubbed.
+func (p *Privacy) applies(l *Link) bool {
+	return l.Privacy || (p != nil && p.Global)
+}
+
+func (p *Privacy) currentSalt(ctx context.Context) []byte {
+	rotation := p.Rotation
+	if rotation <= 0 {
+		rotation = 24 * time.Hour
+	}
+	epoch := time.Now().Unix() / int64(rotation/time.Second)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.salt == nil || p.epoch != epoch {
+		salt, err := p.salts.Salt(ctx, epoch)
+		if err != nil {
+			logrus.WithError(err).Warn("fetching privacy salt failed, using a local one")
+			salt, _ = memorySalts{}.Salt(ctx, epoch)
+		}
+		p.salt, p.epoch = salt, epoch
+	}
+	return p.salt
+}
+
+// scrub rewrites rec in place. The location is resolved beforehand from
+// the full address; only country and region are kept.
+func (p *Privacy) scrub(ctx context.Context, rec *ClickRecord) {
+	if rec.ClientIP != "" {
+		m := hmac.New(sha256.New, p.currentSalt(ctx))
+		m.Write([]byte(rec.ClientIP))
+		rec.ClientHash = hex.EncodeToString(m.Sum(nil)[:16])
+		rec.ClientIP = truncateIP(rec.ClientIP)
+	}
+	rec.UserAgent = generalizeUserAgent(rec.UserAgent)
+	rec.Referrer = refererOrigin(rec.Referrer)
+	if rec.Geo != nil {
+		rec.Geo = &GeoLocation{Country: rec.Geo.Country, Region: rec.Geo.Region}
+	}
+	rec.Hints = rec.Hints.generalize()
+}
+
+// truncateIP keeps the /24 of an IPv4 address or the /48 of an IPv6 one.
+func truncateIP(raw string) string {
+	ip := net.ParseIP(raw)
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// generalizeUserAgent reduces a user agent to "browser/os" families.
+func generalizeUserAgent(ua string) string {
+	if ua == "" {
+		return ""
+	}
+	l := strings.ToLower(ua)
+	browser := "other"
+	switch {
+	case strings.Contains(l, "bot") || strings.Contains(l, "spider") || strings.Contains(l, "crawl"):
+		return "bot"
+	case strings.Contains(l, "edg/"):
+		browser = "edge"
+	case strings.Contains(l, "opr/") || strings.Contains(l, "opera"):
+		browser = "opera"
+	case strings.Contains(l, "firefox/"):
+		browser = "firefox"
+	case strings.Contains(l, "chrome/") || strings.Contains(l, "crios/"):
+		browser = "chrome"
+	case strings.Contains(l, "safari/"):
+		browser = "safari"
+	case strings.HasPrefix(l, "curl/") || strings.HasPrefix(l, "wget/"):
+		browser = "cli"
+	}
+	platform := "other"
+	switch {
+	case strings.Contains(l, "android"):
+		platform = "android"
+	case strings.Contains(l, "iphone") || strings.Contains(l, "ipad") || strings.Contains(l, "ios"):
+		platform = "ios"
+	case strings.Contains(l, "windows"):
+		platform = "windows"
+	case strings.Contains(l, "mac os") || strings.Contains(l, "macintosh"):
+		platform = "macos"
+	case strings.Contains(l, "linux"):
+		platform = "linux"
+	}
+	return browser + "/" + platform
+}
+
+// refererOrigin keeps only scheme and host of a referrer.
+func refererOrigin(ref string) string {
+	u, err := url.Parse(ref)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// anonymousOwner owns links made through POST /public/shorten. API_KEYS
+// owners cannot contain ':', so no key can manage these links.
+const anonymousOwner = ":anonymous"
+
+// publicShortenHandler serves POST /public/shorten, open to visitors
+// without an API key. Each request needs a captcha token and gets a
+// random code; validity_minutes, if given, is capped at maxValidity,
+// which is also the default.
+func publicShortenHandler(store *Store, captcha Captcha, maxValidity time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			URL            string `json:"url"`
+			ValidityMinute int    `json:"validity_minutes,omitempty"`
+			CaptchaToken   string `json:"captcha_token"`
+		}
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		if req.URL == "" {
+			writeAPIError(w, r, fieldError("url", "url is required"))
+			return
+		}
+		if !checkCaptcha(w, r, captcha, req.CaptchaToken) {
+			return
+		}
+		validity, clamped, err := store.requestedValidity(anonymousOwner, req.ValidityMinute, nil)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		if validity == 0 {
+			validity = store.clampValidity(anonymousOwner, maxValidity)
+		}
+		if validity > maxValidity {
+			validity, clamped = maxValidity, true
+		}
+		link, err := store.Create(r.Context(), req.URL, "", validity, LinkOptions{Owner: anonymousOwner})
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		resp := store.shortenResponse(link)
+		resp.ValidityClamped = clamped
+		writeJSON(w, http.StatusCreated, resp)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// quickPath is the bookmarklet endpoint. It alone accepts the API key as
+// the key query parameter, since a bookmarklet cannot set headers; use a
+// token limited to links:create with it. hideQuickKey keeps the key out
+// of the access log and trace spans.
+const quickPath = "/api/quick"
+
+// hideQuickKey moves the key query parameter of quickPath requests into
+// the context before any middleware sees the URL, so that the access log
+// and trace spans never record the credential, whatever
+// LOG_URL_REDACTION is set to. It wraps the whole handler.
+func hideQuickKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != quickPath || !q.Has("key") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := q.Get("key")
+		q.Del("key")
+		r = r.WithContext(context.WithValue(r.Context(), quickKeyKey, key))
+		u := *r.URL
+		u.RawQuery = q.Encode()
+		r.URL = &u
+		r.RequestURI = u.RequestURI()
+		next.ServeHTTP(w, r)
+	})
+}
+
+var quickTemplate = template.Must(template.New("quick").Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><meta name="robots" content="noindex"><title>{{.ShortURL}}</title></head>
+<body style="font-family:sans-serif;text-align:center;margin-top:15vh">
+<input id="u" value="{{.ShortURL}}" readonly size="{{len .ShortURL}}" style="font-size:1.5em;text-align:center" onclick="this.select()">
+<p id="s">&nbsp;</p>
+<p><a href="{{.LongURL}}">{{.LongURL}}</a></p>
+<script>
+(function () {
+	var u = document.getElementById("u"), s = document.getElementById("s");
+	u.select();
+	if (navigator.clipboard) {
+		navigator.clipboard.writeText(u.value).then(function () { s.textContent = "Copied to clipboard"; }, function () {});
+	}
+})();
+</script>
+</body></html>
+`))
+
+// quickHandler serves GET /api/quick?url=...&key=...: it shortens url with
+// the default lifetime, or hands back the caller's existing plain link to
+// it, and answers with the short URL alone. Browsers, or format=html, get
+// a page that copies it to the clipboard; format=text gets plain text.
+// Errors are plain text too. Being a GET, it could be set off from any
+// page by an <img>, so it is refused unless a key names the owner, even
+// with authentication disabled.
+func quickHandler(store *Store, quotas *Quotas) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner := ownerFrom(r.Context())
+		if owner == "" {
+			quickError(w, newAPIError(http.StatusForbidden, ErrCodeForbidden, "quick shortening requires API_KEYS and a key"))
+			return
+		}
+		q := r.URL.Query()
+		asHTML := wantsHTML(r)
+		switch q.Get("format") {
+		case "":
+		case "html":
+			asHTML = true
+		case "text":
+			asHTML = false
+		default:
+			quickError(w, fieldError("format", "format must be html or text"))
+			return
+		}
+		longURL := strings.TrimSpace(q.Get("url"))
+		if longURL == "" {
+			quickError(w, fieldError("url", "url is required"))
+			return
+		}
+		link, err := store.findDuplicate(r.Context(), owner, longURL)
+		status := http.StatusOK
+		if err != nil {
+			if apiErr := quotas.CheckCreate(r.Context(), store, owner); apiErr != nil {
+				quickError(w, apiErr)
+				return
+			}
+			validity := store.clampValidity(owner, store.defaultTTL())
+			if link, err = store.Create(r.Context(), longURL, "", validity, LinkOptions{Owner: owner}); err != nil {
+				quickError(w, apiErrorFrom(err))
+				return
+			}
+			quotas.RecordCreate(r.Context(), owner)
+			status = http.StatusCreated
+		}
+		short := store.shortURL(link)
+		w.Header().Set("Cache-Control", "no-store")
+		if !asHTML {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(short + "\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		_ = quickTemplate.Execute(w, struct{ ShortURL, LongURL string }{short, link.LongURL})
+	}
+}
+
+// quickError answers with e's message as plain text.
+func quickError(w http.ResponseWriter, e *APIError) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	_, _ = w.Write([]byte(e.Message + "\n"))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"url-shortener/middleware"
+)
+
+type recordingSink struct{ entries []*middleware.AccessEntry }
+
+func (s *recordingSink) Log(e *middleware.AccessEntry) { s.entries = append(s.entries, e) }
+
+func TestHideQuickKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		wantKey  string // as apiKeyFrom sees it
+		wantPath string // as the access log records it
+	}{
+		{"quick", "/api/quick?url=https%3A%2F%2Fexample.com%2F&key=slt_secret",
+			"slt_secret", "/api/quick?url=https%3A%2F%2Fexample.com%2F"},
+		{"quick, key first", "/api/quick?key=slt_secret&url=https%3A%2F%2Fexample.com%2F",
+			"slt_secret", "/api/quick?url=https%3A%2F%2Fexample.com%2F"},
+		{"quick without key", "/api/quick?url=https%3A%2F%2Fexample.com%2F",
+			"", "/api/quick?url=https%3A%2F%2Fexample.com%2F"},
+		{"other route", "/api/links?key=x", "", "/api/links?key=x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{}
+			var gotKey, gotURL string
+			h := hideQuickKey(middleware.Logging(middleware.LoggingOptions{Sink: sink})(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					gotKey, gotURL = apiKeyFrom(r), r.URL.Query().Get("url")
+				})))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+			if gotKey != tt.wantKey {
+				t.Errorf("apiKeyFrom = %q, want %q", gotKey, tt.wantKey)
+			}
+			if strings.HasPrefix(tt.target, quickPath) && gotURL != "https://example.com/" {
+				t.Errorf("url parameter = %q, want https://example.com/", gotURL)
+			}
+			if len(sink.entries) != 1 {
+				t.Fatalf("%d access log entries, want 1", len(sink.entries))
+			}
+			if got := sink.entries[0].Path; got != tt.wantPath {
+				t.Errorf("logged path = %q, want %q", got, tt.wantPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// Quota caps what a single API key owner may do; zero means unlimited.
+type Quota struct {
+	ActiveLinks   int64 `json:"active_links"`
+	DailyCreates  int64 `json:"daily_creates"`
+	TrackedClicks int64 `json:"tracked_clicks"`
+}
+
+// parseQuotas reads QUOTAS, e.g.
+// "alice=active_links:100,daily_creates:50;bob=tracked_clicks:100000".
+func parseQuotas(raw string, def Quota) map[string]Quota {
+	out := make(map[string]Quota)
+	for _, entry := range strings.Split(raw, ";") {
+		owner, limits, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || owner == "" {
+			continue
+		}
+		q := def
+		for _, kv := range strings.Split(limits, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(kv), ":")
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				logrus.Warnf("ignoring invalid quota %q for %s", kv, owner)
+				continue
+			}
+			switch k {
+			case "active_links":
+				q.ActiveLinks = n
+			case "daily_creates":
+				q.DailyCreates = n
+			case "tracked_clicks":
+				q.TrackedClicks = n
+			default:
+				logrus.Warnf("ignoring unknown quota %q for %s", k, owner)
+			}
+		}
+		out[owner] = q
+	}
+	return out
+}
+
+// UsageCounter keeps quota usage, optionally shared across instances.
+type UsageCounter interface {
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	Get(ctx context.Context, key string) (int64, error)
+}
+
+type memUsage struct {
+	n       int64
+	expires time.Time
+}
+
+type memoryUsage struct {
+	mu     sync.Mutex
+	counts map[string]*memUsage
+}
+
+func newMemoryUsage() *memoryUsage {
+	return &memoryUsage{counts: make(map[string]*memUsage)}
+}
+
+func (m *memoryUsage) Incr(_ context.Context, key string, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	u, ok := m.counts[key]
+	if !ok || (!u.expires.IsZero() && now.After(u.expires)) {
+		u = &memUsage{}
+		if ttl > 0 {
+			u.expires = now.Add(ttl)
+		}
+		m.counts[key] = u
+	}
+	u.n++
+	return u.n, nil
+}
+
+func (m *memoryUsage) Get(_ context.Context, key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, ok := m.counts[key]
+	if !ok || (!u.expires.IsZero() && time.Now().After(u.expires)) {
+		return 0, nil
+	}
+	return u.n, nil
+}
+
+type redisUsage struct {
+	client *redis.Client
+	prefix string
+}
+
+func (r *redisUsage) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	pipe := r.client.TxPipeline()
+	incr := pipe.Incr(ctx, r.prefix+key)
+	if ttl > 0 {
+		pipe.ExpireNX(ctx, r.prefix+key, ttl)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+func (r *redisUsage) Get(ctx context.Context, key string) (int64, error) {
+	n, err := r.client.Get(ctx, r.prefix+key).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+// Quotas enforces per-owner limits and, for owners in a tenant, the
+// tenant's own limits on top.
+type Quotas struct {
+	defaults Quota
+	perOwner map[string]Quota
+	usage    UsageCounter
+	tenants  *Tenants  // optional
+	notifier *Notifier // optional; warns owners nearing a limit
+}
+
+func NewQuotas(defaults Quota, perOwner map[string]Quota, usage UsageCounter) *Quotas {
+	return &Quotas{defaults: defaults, perOwner: perOwner, usage: usage}
+}
+
+func (q *Quotas) For(owner string) Quota {
+	if l, ok := q.perOwner[owner]; ok {
+		return l
+	}
+	return q.defaults
+}
+
+func dayKey(owner string, now time.Time) string {
+	return "quota:creates:" + owner + ":" + now.Format("2006-01-02")
+}
+
+func clicksKey(owner string) string { return "quota:clicks:" + owner }
+
+// untilTomorrow is how long the current UTC day's creation count lives.
+func untilTomorrow(now time.Time) time.Duration {
+	y, m, d := now.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC).Sub(now)
+}
+
+// QuotaUsage is the body of GET /api/quota.
+type QuotaUsage struct {
+	Owner        string    `json:"owner"`
+	Limits       Quota     `json:"limits"`
+	Usage        Quota     `json:"usage"`
+	DailyResetAt time.Time `json:"daily_reset_at"`
+}
+
+func (q *Quotas) Usage(ctx context.Context, store *Store, owner string) (*QuotaUsage, error) {
+	now := store.now()
+	active, err := store.countActive(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	creates, err := q.usage.Get(ctx, dayKey(owner, now))
+	if err != nil {
+		return nil, err
+	}
+	clicks, err := q.usage.Get(ctx, clicksKey(owner))
+	if err != nil {
+		return nil, err
+	}
+	return &QuotaUsage{
+		Owner:        owner,
+		Limits:       q.For(owner),
+		Usage:        Quota{ActiveLinks: active, DailyCreates: creates, TrackedClicks: clicks},
+		DailyResetAt: now.Add(untilTomorrow(now)),
+	}, nil
+}
+
+func quotaError(status int, msg, quota string, limit, used int64) *APIError {
+	e := newAPIError(status, ErrCodeQuotaExceeded, msg)
+	e.Details = map[string]interface{}{"quota": quota, "limit": limit, "used": used}
+	return e
+}
+
+// tenantQuota returns the limits of owner's tenant, if it has any.
+func (q *Quotas) tenantQuota(owner string) (string, Quota, bool) {
+	id := tenantOf(owner)
+	if id == "" || q.tenants == nil {
+		return "", Quota{}, false
+	}
+	t, err := q.tenants.Get(id)
+	if err != nil {
+		return "", Quota{}, false
+	}
+	return id, t.Quota, true
+}
+
+// tenantSubject names a tenant in usage keys; owners never contain ':'.
+func tenantSubject(id string) string { return "tenant:" + id }
+
+// CheckCreate returns an error if owner, or owner's tenant, may not create
+// another link.
+func (q *Quotas) CheckCreate(ctx context.Context, store *Store, owner string) *APIError {
+	if e := q.checkCreate(ctx, q.For(owner), owner, "", func() (int64, error) { return store.countActive(ctx, owner) }); e != nil {
+		return e
+	}
+	if id, lim, ok := q.tenantQuota(owner); ok {
+		return q.checkCreate(ctx, lim, tenantSubject(id), "tenant ", func() (int64, error) { return store.countTenantActive(ctx, id) })
+	}
+	return nil
+}
+
+func (q *Quotas) checkCreate(ctx context.Context, lim Quota, subject, scope string, countActive func() (int64, error)) *APIError {
+	now := time.Now().UTC()
+	if lim.ActiveLinks > 0 {
+		active, err := countActive()
+		if err != nil {
+			return apiErrorFrom(err)
+		}
+		if active >= lim.ActiveLinks {
+			return quotaError(http.StatusForbidden, scope+"active link quota exceeded", "active_links", lim.ActiveLinks, active)
+		}
+		if scope == "" {
+			q.warnIfNear(ctx, subject, "active_links", lim.ActiveLinks, active+1, 24*time.Hour)
+		}
+	}
+	if lim.DailyCreates > 0 {
+		used, err := q.usage.Get(ctx, dayKey(subject, now))
+		if err != nil {
+			return apiErrorFrom(err)
+		}
+		if used >= lim.DailyCreates {
+			e := quotaError(http.StatusTooManyRequests, scope+"daily creation quota exceeded", "daily_creates", lim.DailyCreates, used)
+			e.Details["resets_at"] = now.Add(untilTomorrow(now))
+			return e
+		}
+	}
+	return nil
+}
+
+// RecordCreate counts a successful creation against today's allowance.
+func (q *Quotas) RecordCreate(ctx context.Context, owner string) {
+	now := time.Now().UTC()
+	subjects := []string{owner}
+	if id, _, ok := q.tenantQuota(owner); ok {
+		subjects = append(subjects, tenantSubject(id))
+	}
+	for _, subject := range subjects {
+		used, err := q.usage.Incr(ctx, dayKey(subject, now), untilTomorrow(now))
+		if err != nil {
+			logrus.WithError(err).Warn("recording creation quota usage failed")
+			continue
+		}
+		if subject == owner {
+			q.warnIfNear(ctx, owner, "daily_creates", q.For(owner).DailyCreates, used, untilTomorrow(now))
+		}
+	}
+}
+
+// TrackClick reports whether a click on owner's link should still be
+// counted, consuming one unit of the tracked-click allowance if so.
+// Redirects keep working once the allowance is used up.
+func (q *Quotas) TrackClick(ctx context.Context, owner string) bool {
+	type allowance struct {
+		key   string
+		limit int64
+	}
+	var checks []allowance
+	if lim := q.For(owner).TrackedClicks; lim > 0 {
+		checks = append(checks, allowance{clicksKey(owner), lim})
+	}
+	if id, lim, ok := q.tenantQuota(owner); ok && lim.TrackedClicks > 0 {
+		checks = append(checks, allowance{clicksKey(tenantSubject(id)), lim.TrackedClicks})
+	}
+	for _, c := range checks {
+		if used, err := q.usage.Get(ctx, c.key); err == nil && used >= c.limit {
+			return false
+		}
+	}
+	for _, c := range checks {
+		used, err := q.usage.Incr(ctx, c.key, 0)
+		if err == nil && c.key == clicksKey(owner) {
+			q.warnIfNear(ctx, owner, "tracked_clicks", c.limit, used, 0)
+		}
+	}
+	return true
+}
+
+// countActive counts owner's links that have not expired.
+func (s *Store) countActive(ctx context.Context, owner string) (int64, error) {
+	now := s.now()
+	var n int64
+	err := s.backend.Scan(ctx, func(l *Link) bool {
+		if l.Owner == owner && !l.Deleted() && !l.Reserved && now.Before(l.ExpiresAt) {
+			n++
+		}
+		return true
+	})
+	return n, err
+}
+
+// countTenantActive counts the tenant's links that have not expired.
+func (s *Store) countTenantActive(ctx context.Context, tenant string) (int64, error) {
+	now := s.now()
+	var n int64
+	err := s.backend.Scan(ctx, func(l *Link) bool {
+		if l.Tenant == tenant && !l.Deleted() && !l.Reserved && now.Before(l.ExpiresAt) {
+			n++
+		}
+		return true
+	})
+	return n, err
+}
+
+func quotaHandler(store *Store, quotas *Quotas) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := quotas.Usage(r.Context(), store, ownerFrom(r.Context()))
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, u)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseQuotas(t *testing.T) {
+	def := Quota{ActiveLinks: 10, DailyCreates: 5}
+	tests := []struct {
+		raw  string
+		want map[string]Quota
+	}{
+		{"", map[string]Quota{}},
+		{"alice=active_links:100,daily_creates:50",
+			map[string]Quota{"alice": {ActiveLinks: 100, DailyCreates: 50}}},
+		{"alice=tracked_clicks:7; bob=daily_creates:0",
+			map[string]Quota{"alice": {ActiveLinks: 10, DailyCreates: 5, TrackedClicks: 7}, "bob": {ActiveLinks: 10}}},
+		{"alice=active_links:-1,colour:3,daily_creates:x",
+			map[string]Quota{"alice": def}},
+		{"=active_links:1;bob", map[string]Quota{}},
+	}
+	for _, tt := range tests {
+		if got := parseQuotas(tt.raw, def); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseQuotas(%q) = %+v, want %+v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCreate(t *testing.T) {
+	tests := []struct {
+		name      string
+		quota     Quota
+		tenant    Quota
+		owner     string
+		active    int // links the owner already has
+		expired   int // further links of the owner, expired
+		created   int // creations already recorded today
+		wantCode  int
+		wantQuota string
+	}{
+		{"unlimited", Quota{}, Quota{}, "alice", 3, 0, 3, 0, ""},
+		{"under the active link quota", Quota{ActiveLinks: 3}, Quota{}, "alice", 2, 0, 0, 0, ""},
+		{"at the active link quota", Quota{ActiveLinks: 3}, Quota{}, "alice", 3, 0, 0, http.StatusForbidden, "active_links"},
+		{"expired links do not count", Quota{ActiveLinks: 3}, Quota{}, "alice", 2, 2, 0, 0, ""},
+		{"under the daily quota", Quota{DailyCreates: 2}, Quota{}, "alice", 0, 0, 1, 0, ""},
+		{"at the daily quota", Quota{DailyCreates: 2}, Quota{}, "alice", 0, 0, 2, http.StatusTooManyRequests, "daily_creates"},
+		{"tenant daily quota on top", Quota{DailyCreates: 5}, Quota{DailyCreates: 2}, "acme/alice", 0, 0, 2, http.StatusTooManyRequests, "daily_creates"},
+		{"tenant quota leaves others alone", Quota{}, Quota{DailyCreates: 1}, "alice", 0, 0, 1, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, clock := newClockedStore(t)
+			q := NewQuotas(tt.quota, nil, newMemoryUsage())
+			q.tenants = NewTenants()
+			if _, err := q.tenants.Create(Tenant{ID: "acme", Quota: tt.tenant}); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tt.expired; i++ {
+				if _, err := s.Create(ctx, "https://example.com/old", "", time.Minute, LinkOptions{Owner: tt.owner}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			clock.Advance(time.Hour)
+			for i := 0; i < tt.active; i++ {
+				if _, err := s.Create(ctx, "https://example.com/new", "", time.Hour, LinkOptions{Owner: tt.owner}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < tt.created; i++ {
+				q.RecordCreate(ctx, tt.owner)
+			}
+
+			e := q.CheckCreate(ctx, s, tt.owner)
+			if tt.wantCode == 0 {
+				if e != nil {
+					t.Fatalf("CheckCreate = %v, want no error", e)
+				}
+				return
+			}
+			if e == nil || e.Status != tt.wantCode || e.Code != ErrCodeQuotaExceeded {
+				t.Fatalf("CheckCreate = %+v, want %d %s", e, tt.wantCode, ErrCodeQuotaExceeded)
+			}
+			if e.Details["quota"] != tt.wantQuota {
+				t.Errorf("quota = %v, want %s", e.Details["quota"], tt.wantQuota)
+			}
+			if _, ok := e.Details["resets_at"]; ok != (tt.wantQuota == "daily_creates") {
+				t.Errorf("resets_at present = %v, want it only for daily_creates", ok)
+			}
+		})
+	}
+}
+
+func TestTrackClick(t *testing.T) {
+	tests := []struct {
+		name   string
+		quota  Quota
+		tenant Quota
+		clicks []string // owner of each click
+		want   []bool
+	}{
+		{"unlimited", Quota{}, Quota{}, []string{"alice", "alice"}, []bool{true, true}},
+		{"owner allowance used up", Quota{TrackedClicks: 2}, Quota{},
+			[]string{"alice", "alice", "alice", "bob"}, []bool{true, true, false, true}},
+		{"tenant allowance shared by its owners", Quota{}, Quota{TrackedClicks: 2},
+			[]string{"acme/alice", "acme/bob", "acme/alice", "carol"}, []bool{true, true, false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewQuotas(tt.quota, nil, newMemoryUsage())
+			q.tenants = NewTenants()
+			if _, err := q.tenants.Create(Tenant{ID: "acme", Quota: tt.tenant}); err != nil {
+				t.Fatal(err)
+			}
+			for i, owner := range tt.clicks {
+				if got := q.TrackClick(context.Background(), owner); got != tt.want[i] {
+					t.Errorf("click %d by %s: tracked = %v, want %v", i+1, owner, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestQuotasFor(t *testing.T) {
+	def := Quota{ActiveLinks: 10}
+	q := NewQuotas(def, map[string]Quota{"alice": {ActiveLinks: 100}}, newMemoryUsage())
+	if got := q.For("alice"); got.ActiveLinks != 100 {
+		t.Errorf("For(alice) = %+v, want the override", got)
+	}
+	if got := q.For("bob"); got != def {
+		t.Errorf("For(bob) = %+v, want the defaults", got)
+	}
+}
+
+func TestMemoryUsageExpiry(t *testing.T) {
+	ctx := context.Background()
+	m := newMemoryUsage()
+	for i := 0; i < 2; i++ {
+		if _, err := m.Incr(ctx, "short", time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Incr(ctx, "forever", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(2 * time.Millisecond)
+	if n, _ := m.Get(ctx, "short"); n != 0 {
+		t.Errorf("Get(short) = %d after its TTL, want 0", n)
+	}
+	if n, _ := m.Incr(ctx, "short", time.Minute); n != 1 {
+		t.Errorf("Incr(short) = %d after its TTL, want a fresh count of 1", n)
+	}
+	if n, _ := m.Get(ctx, "forever"); n != 2 {
+		t.Errorf("Get(forever) = %d, want 2", n)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// quotaWarnPercent is the share of a quota at which its owner is warned.
+const quotaWarnPercent = 80
+
+// Headers reports how much of the caller's own quotas is left on every
+// API response, so client automation can back off before it is refused:
+//
+//	X-Quota-Limit: daily_creates=50, tracked_clicks=100000
+//	X-Quota-Remaining: daily_creates=12, tracked_clicks=40210
+//
+// Active links take a scan to count, so only GET /api/quota reports them.
+// Owners without such limits get no headers.
+func (q *Quotas) Headers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		owner := ownerFrom(r.Context())
+		lim := q.For(owner)
+		if owner == "" || (lim.DailyCreates == 0 && lim.TrackedClicks == 0) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var limits, remaining []string
+		add := func(name string, limit int64, key string) {
+			if limit == 0 {
+				return
+			}
+			used, err := q.usage.Get(r.Context(), key)
+			if err != nil {
+				return
+			}
+			limits = append(limits, name+"="+strconv.FormatInt(limit, 10))
+			remaining = append(remaining, name+"="+strconv.FormatInt(max(limit-used, 0), 10))
+		}
+		add("daily_creates", lim.DailyCreates, dayKey(owner, time.Now().UTC()))
+		add("tracked_clicks", lim.TrackedClicks, clicksKey(owner))
+		if len(limits) > 0 {
+			w.Header().Set("X-Quota-Limit", strings.Join(limits, ", "))
+			w.Header().Set("X-Quota-Remaining", strings.Join(remaining, ", "))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type quotaWarningEvent struct {
+	Event   string    `json:"event"`
+	Owner   string    `json:"owner"`
+	Quota   string    `json:"quota"`
+	Limit   int64     `json:"limit"`
+	Used    int64     `json:"used"`
+	Percent int       `json:"percent"`
+	At      time.Time `json:"at"`
+}
+
+// warnIfNear tells owner, once per period, that used has reached
+// quotaWarnPercent of limit. period is the lifetime of the usage being
+// measured (zero if it never resets) and keeps the warning from being
+// repeated before it does.
+func (q *Quotas) warnIfNear(ctx context.Context, owner, quota string, limit, used int64, period time.Duration) {
+	if q.notifier == nil || owner == "" || limit == 0 || used*100 < limit*quotaWarnPercent {
+		return
+	}
+	key := "quota:warned:" + quota + ":" + owner
+	if quota == "daily_creates" {
+		key += ":" + time.Now().UTC().Format("2006-01-02")
+	}
+	if n, err := q.usage.Incr(ctx, key, period); err != nil || n != 1 {
+		return
+	}
+	ev := quotaWarningEvent{
+		Event:   "quota.warning",
+		Owner:   owner,
+		Quota:   quota,
+		Limit:   limit,
+		Used:    used,
+		Percent: int(used * 100 / limit),
+		At:      time.Now().UTC(),
+	}
+	p := q.notifier.Prefs(owner)
+	go func() {
+		text := fmt.Sprintf("%s has used %d of its %d %s (%d%%).", owner, used, limit, strings.ReplaceAll(quota, "_", " "), ev.Percent)
+		log := logrus.WithFields(logrus.Fields{"action": "quota_warning", "owner": owner, "quota": quota, "used": used, "limit": limit})
+		if q.notifier.deliver(owner, p, ev, "Quota "+quota+" is nearly used up", text, log) == nil {
+			log.Info("quota warning sent")
+		}
+	}()
+}
@@ -0,0 +1,90 @@
+// Package ratelimit implements fixed-window request limiting, either per
+// process or shared across instances through Redis.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Result describes the outcome of a single Allow call.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	ResetIn   time.Duration
+}
+
+// Limiter decides whether the caller identified by key may proceed.
+type Limiter interface {
+	Allow(ctx context.Context, key string) (Result, error)
+}
+
+// Adjustable limiters can change their limit while in use. Windows
+// already open keep their count and are judged against the new limit.
+type Adjustable interface {
+	SetLimit(limit int)
+}
+
+type window struct {
+	count int
+	reset time.Time
+}
+
+// Memory is a per-process fixed-window limiter.
+type Memory struct {
+	mu      sync.Mutex
+	limit   int
+	period  time.Duration
+	windows map[string]*window
+}
+
+// NewMemory allows limit requests per key in every period.
+func NewMemory(limit int, period time.Duration) *Memory {
+	return &Memory{
+		limit:   limit,
+		period:  period,
+		windows: make(map[string]*window),
+	}
+}
+
+func (m *Memory) Allow(_ context.Context, key string) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if len(m.windows) > 10000 {
+		for k, w := range m.windows {
+			if now.After(w.reset) {
+				delete(m.windows, k)
+			}
+		}
+	}
+	w, ok := m.windows[key]
+	if !ok || now.After(w.reset) {
+		w = &window{reset: now.Add(m.period)}
+		m.windows[key] = w
+	}
+	w.count++
+	return result(m.limit, w.count, w.reset.Sub(now)), nil
+}
+
+func (m *Memory) SetLimit(limit int) {
+	m.mu.Lock()
+	m.limit = limit
+	m.mu.Unlock()
+}
+
+func result(limit, count int, resetIn time.Duration) Result {
+	remaining := limit - count
+	if remaining < 0 {
+		remaining = 0
+	}
+	return Result{
+		Allowed:   count <= limit,
+		Limit:     limit,
+		Remaining: remaining,
+		ResetIn:   resetIn,
+	}
+}
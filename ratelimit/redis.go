@@ -0,0 +1,45 @@
+package ratelimit
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fixedWindow increments the window counter and starts its expiry on the
+// first hit, atomically, returning the count and the remaining TTL in ms.
+var fixedWindow = redis.NewScript(`
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return {n, redis.call('PTTL', KEYS[1])}
+`)
+
+// Redis is a fixed-window limiter whose buckets live in Redis, so every
+// instance behind a load balancer shares the same limits.
+type Redis struct {
+	client redis.Scripter
+	prefix string
+	limit  atomic.Int64
+	period time.Duration
+}
+
+// NewRedis allows limit requests per key in every period, cluster-wide.
+func NewRedis(client redis.Scripter, prefix string, limit int, period time.Duration) *Redis {
+	r := &Redis{client: client, prefix: prefix, period: period}
+	r.limit.Store(int64(limit))
+	return r
+}
+
+func (r *Redis) Allow(ctx context.Context, key string) (Result, error) {
+	res, err := fixedWindow.Run(ctx, r.client, []string{r.prefix + "rl:" + key}, r.period.Milliseconds()).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	return result(int(r.limit.Load()), int(res[0]), time.Duration(res[1])*time.Millisecond), nil
+}
+
+func (r *Redis) SetLimit(limit int) { r.limit.Store(int64(limit)) }
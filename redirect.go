@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/middleware"
+)
+
+// redirectHandler serves GET and HEAD /{code}, /{folder}/{code} and, for
+// passthrough links, /{code}/{rest}. Links whose destination is down go to
+// their fallback. HEAD answers with the Location header only and, unless
+// countHead is set, does not count as a click: link checkers and chat
+// unfurlers probe links this way. Preview crawlers get a link's card,
+// if it has one, instead of the redirect, and browsers its interstitial.
+// Signed links get a fresh token from signer on every redirect.
+func redirectHandler(store *Store, quotas *Quotas, signer *Signer, countHead bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		code := vars["code"]
+		rest, deep := vars["rest"]
+		if deep {
+			code, rest = store.resolveDeepPath(r.Context(), code, rest)
+			deep = !strings.Contains(code, FolderSeparator) || rest != ""
+		}
+		link, err := store.Get(r.Context(), code)
+		if err != nil {
+			serveUnavailable(w, r, store, nil, apiErrorFrom(err))
+			return
+		}
+		if link.Draft {
+			serveUnavailable(w, r, store, link, newAPIError(http.StatusNotFound, ErrCodeLinkNotFound, "short link not found"))
+			return
+		}
+		if store.now().After(link.ExpiresAt) {
+			serveUnavailable(w, r, store, link, newAPIError(http.StatusGone, ErrCodeLinkExpired, "short link expired"))
+			return
+		}
+		if link.TakenDownAt != nil {
+			serveUnavailable(w, r, store, link, newAPIError(http.StatusGone, ErrCodeLinkDisabled, "short link has been disabled"))
+			return
+		}
+		if len(link.AllowedIPs) > 0 && !ipAllowed(link.AllowedIPs, middleware.ClientIP(r)) {
+			serveIPRestricted(w, r, store, link)
+			return
+		}
+		if link.Schedule != nil && !scheduleOpen(link.Schedule, store.now()) {
+			serveClosed(w, r, store, link, store.now())
+			return
+		}
+		base, pick := destinationAt(link, store.now()), -1
+		if len(link.Destinations) > 0 {
+			pick = store.rotations.pick(link)
+			base = link.Destinations[pick].URL
+		}
+		if link.FallbackURL != "" && link.Health.Down() {
+			base, pick = link.FallbackURL, -1
+		}
+		dest := base
+		if deep {
+			if !link.Passthrough {
+				httpError(w, r, http.StatusNotFound, ErrCodeLinkNotFound, "short link not found")
+				return
+			}
+			if dest, err = passthroughURL(base, r, code); err != nil {
+				writeAPIError(w, r, newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, err.Error()))
+				return
+			}
+		}
+		if link.Signed {
+			if signer == nil {
+				httpError(w, r, http.StatusServiceUnavailable, ErrCodeUnavailable, "link signing is not configured")
+				return
+			}
+			if dest, err = signer.SignURL(dest, link); err != nil {
+				writeAPIError(w, r, apiErrorFrom(err))
+				return
+			}
+		}
+		if link.BurnAfterRead {
+			serveBurnAfterRead(w, r, store, link, dest)
+			return
+		}
+		if link.Card != nil {
+			if isCardCrawler(r) {
+				serveCard(w, r, store, link, dest)
+				return
+			}
+			w.Header().Add("Vary", "User-Agent")
+		}
+		count := func() {
+			if quotas.TrackClick(r.Context(), link.Owner) {
+				rec := newClickRecord(r, link, dest)
+				b := newClickBreakdown(link, pick, shareSource(r), rec.Hints)
+				store.clicked(r.Context(), store.Increment(r.Context(), code, b), rec)
+			}
+		}
+		if in := store.interstitial(link); in != nil && showInterstitial(r) {
+			count()
+			serveInterstitial(w, r, store, link, in, dest)
+			return
+		}
+		if r.Method == http.MethodHead {
+			if countHead {
+				count()
+			}
+			store.setRedirectHeaders(w, link)
+			w.Header().Set("Location", dest)
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+		count()
+		logrus.WithFields(logrus.Fields{
+			"action":     "redirect",
+			"short_code": code,
+			"to":         dest,
+		}).Debug("redirecting")
+		store.setRedirectHeaders(w, link)
+		http.Redirect(w, r, dest, http.StatusFound)
+	}
+}
+
+// unavailablePages maps the errors of the redirect path to the page
+// browsers get instead.
+var unavailablePages = map[string][2]string{
+	ErrCodeLinkNotFound: {msgNotFoundTitle, msgNotFoundText},
+	ErrCodeNotFound:     {msgNotFoundTitle, msgNotFoundText},
+	ErrCodeLinkExpired:  {msgExpiredTitle, msgExpiredText},
+	ErrCodeLinkDisabled: {msgDisabledTitle, msgDisabledText},
+}
+
+// serveUnavailable answers a click that cannot be redirected: browsers get
+// a page in their language, anything else the JSON error e. link is nil
+// if there is none.
+func serveUnavailable(w http.ResponseWriter, r *http.Request, store *Store, link *Link, e *APIError) {
+	keys, ok := unavailablePages[e.Code]
+	if !ok || !wantsHTML(r) {
+		writeAPIError(w, r, e)
+		return
+	}
+	brand := ""
+	if link != nil {
+		brand = store.tenantName(link)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	store.pages.render(w, r, e.Status, brand, keys[0], line(keys[1]))
+}
+
+// serveBurnAfterRead redirects exactly one human visitor. HEAD requests
+// and preview bots get an empty 200 without the destination, so unfurling
+// a shared one-time link in chat neither burns nor leaks it.
+func serveBurnAfterRead(w http.ResponseWriter, r *http.Request, store *Store, link *Link, dest string) {
+	if link.Burned {
+		writeAPIError(w, r, apiErrorFrom(ErrConsumed))
+		return
+	}
+	if r.Method == http.MethodHead || isBot(r) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Robots-Tag", "noindex")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	rec := newClickRecord(r, link, dest)
+	consumed, err := store.Consume(r.Context(), link.ShortCode, newClickBreakdown(link, -1, shareSource(r), rec.Hints))
+	if err != nil {
+		writeAPIError(w, r, apiErrorFrom(err))
+		return
+	}
+	store.clicked(r.Context(), consumed, rec)
+	store.setRedirectHeaders(w, link)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, dest, http.StatusFound)
+}
+
+// optionsHandler advertises the methods a route supports.
+func optionsHandler(methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// passthroughURL appends the part of the request path after /{code}, and
+// the request query, to base. The suffix keeps its original escaping and
+// may not contain dot segments, so it cannot climb above base's path.
+func passthroughURL(base string, r *http.Request, code string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	rest := strings.TrimPrefix(r.URL.EscapedPath(), "/"+strings.ReplaceAll(url.PathEscape(code), "%2F", FolderSeparator))
+	rest = strings.TrimPrefix(rest, "/")
+	for _, seg := range strings.Split(rest, "/") {
+		if unescaped, _ := url.PathUnescape(seg); unescaped == "." || unescaped == ".." {
+			return "", errors.New("path must not contain dot segments")
+		}
+	}
+	if rest != "" {
+		basePath := strings.TrimSuffix(u.EscapedPath(), "/")
+		joined := basePath + "/" + rest
+		p, err := url.PathUnescape(joined)
+		if err != nil {
+			return "", err
+		}
+		u.Path, u.RawPath = p, joined
+	}
+	if r.URL.RawQuery != "" {
+		if u.RawQuery != "" {
+			u.RawQuery += "&" + r.URL.RawQuery
+		} else {
+			u.RawQuery = r.URL.RawQuery
+		}
+	}
+	return u.String(), nil
+}
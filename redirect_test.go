@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPassthroughURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    string
+		code    string
+		target  string
+		want    string
+		wantErr bool
+	}{
+		{"path and query", "https://example.com/docs", "abc", "/abc/guide/intro?lang=en",
+			"https://example.com/docs/guide/intro?lang=en", false},
+		{"base with trailing slash", "https://example.com/docs/", "abc", "/abc/guide",
+			"https://example.com/docs/guide", false},
+		{"queries merged", "https://example.com/docs?ref=short", "abc", "/abc/guide?lang=en",
+			"https://example.com/docs/guide?ref=short&lang=en", false},
+		{"query only", "https://example.com/docs", "abc", "/abc?lang=en",
+			"https://example.com/docs?lang=en", false},
+		{"code in a folder", "https://example.com/docs", "team/abc", "/team/abc/guide",
+			"https://example.com/docs/guide", false},
+		{"escaped slash kept escaped", "https://example.com/files", "abc", "/abc/a%2Fb",
+			"https://example.com/files/a%2Fb", false},
+		{"escaped space kept", "https://example.com/files", "abc", "/abc/my%20file",
+			"https://example.com/files/my%20file", false},
+		{"escaped base path kept", "https://example.com/a%2Fb", "abc", "/abc/c",
+			"https://example.com/a%2Fb/c", false},
+		{"dot dot", "https://example.com/docs", "abc", "/abc/../admin", "", true},
+		{"dot dot further down", "https://example.com/docs", "abc", "/abc/guide/../../admin", "", true},
+		{"single dot", "https://example.com/docs", "abc", "/abc/./guide", "", true},
+		{"escaped dot dot", "https://example.com/docs", "abc", "/abc/%2e%2e/admin", "", true},
+		{"upper-case escaped dot dot", "https://example.com/docs", "abc", "/abc/%2E%2E", "", true},
+		{"half-escaped dot dot", "https://example.com/docs", "abc", "/abc/.%2e/admin", "", true},
+		{"dots inside a name allowed", "https://example.com/docs", "abc", "/abc/v1..2/file.txt",
+			"https://example.com/docs/v1..2/file.txt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.target, nil)
+			got, err := passthroughURL(tt.base, r, tt.code)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("passthroughURL(%q, %q) error = %v, want error %v", tt.base, tt.target, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("passthroughURL(%q, %q) = %q, want %q", tt.base, tt.target, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/storage"
+)
+
+// defaultShorteners are the public URL shorteners FLATTEN_SHORTENERS
+// starts from.
+const defaultShorteners = "bit.ly,t.co,tinyurl.com,goo.gl,ow.ly,is.gd,buff.ly,rebrand.ly,cutt.ly,tiny.cc,s.id,lnkd.in"
+
+// FlattenConfig controls resolving short-link destinations at create time.
+type FlattenConfig struct {
+	Enabled bool          // FLATTEN_REDIRECTS, the default for requests that don't say
+	MaxHops int           // FLATTEN_MAX_HOPS before the chain is treated as a loop
+	Timeout time.Duration // FLATTEN_TIMEOUT for the whole chain
+
+	// Shorteners is FLATTEN_SHORTENERS, comma-separated hosts whose links
+	// are followed. This service's own domains always are.
+	Shorteners string
+}
+
+// Flattener follows a destination through URL shorteners to the page they
+// finally point at. Only hosts known to be shorteners are contacted.
+type Flattener struct {
+	byDefault  bool
+	maxHops    int
+	timeout    time.Duration
+	shorteners map[string]bool
+	client     *http.Client
+}
+
+func NewFlattener(cfg FlattenConfig) *Flattener {
+	f := &Flattener{
+		byDefault:  cfg.Enabled,
+		maxHops:    cfg.MaxHops,
+		timeout:    cfg.Timeout,
+		shorteners: make(map[string]bool),
+		client:     newOutboundClient(0),
+	}
+	// Hops are followed one by one, each through the outbound dialer.
+	f.client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	for _, h := range strings.Split(cfg.Shorteners, ",") {
+		if h = normalizeHost(strings.TrimSpace(h)); h != "" {
+			f.shorteners[h] = true
+		}
+	}
+	return f
+}
+
+// wanted applies a request's flatten setting over the server default.
+func (f *Flattener) wanted(req *bool) bool {
+	if f == nil {
+		return false
+	}
+	if req != nil {
+		return *req
+	}
+	return f.byDefault
+}
+
+// ownKeys returns the storage keys a URL on one of this service's domains
+// could be served from, most specific first: a folder code spans two path
+// segments, a passthrough link only the first.
+func (s *Store) ownKeys(u *url.URL) []string {
+	host := normalizeHost(u.Host)
+	tenant := ""
+	if own, err := url.Parse(s.domain); err != nil || normalizeHost(own.Host) != host {
+		if s.tenants == nil {
+			return nil
+		}
+		if tenant = s.tenants.ForHost(host); tenant == "" {
+			return nil
+		}
+	}
+	path := strings.Trim(u.Path, "/")
+	if path == "" {
+		return nil
+	}
+	keys := []string{storage.Key(tenant, path)}
+	if first, _, ok := strings.Cut(path, "/"); ok {
+		keys = append(keys, storage.Key(tenant, first))
+	}
+	return keys
+}
+
+// ownLink returns the link on this service that u points at, if any.
+func (s *Store) ownLink(ctx context.Context, u *url.URL) (*Link, bool) {
+	for _, key := range s.ownKeys(u) {
+		l, err := s.backend.Get(ctx, key)
+		if err == nil && !l.Deleted() && !l.Reserved {
+			return l, true
+		}
+	}
+	return nil, false
+}
+
+// Loop protection modes (LOOP_PROTECTION) for destinations that lead back
+// to the link itself.
+const (
+	LoopReject = "reject"
+	LoopWarn   = "warn" // log and create the link anyway
+	LoopOff    = "off"
+)
+
+// maxOwnHops bounds how far ownTargets follows links on this service.
+const maxOwnHops = 32
+
+// ownTargets follows longURL through links on this service and returns
+// every storage key it passes, including keys nothing is stored under
+// yet. A link created under one of them would redirect, eventually, to
+// itself. cyclic is set if the existing links already loop.
+func (s *Store) ownTargets(ctx context.Context, longURL string) (keys map[string]bool, cyclic bool) {
+	keys = make(map[string]bool)
+	cur := longURL
+	for hop := 0; hop < maxOwnHops; hop++ {
+		u, err := url.Parse(cur)
+		if err != nil {
+			return keys, false
+		}
+		candidates := s.ownKeys(u)
+		if len(candidates) == 0 {
+			return keys, false
+		}
+		var next *Link
+		for _, key := range candidates {
+			if l, err := s.backend.Get(ctx, key); err == nil && !l.Deleted() {
+				next = l
+				break
+			}
+		}
+		if next == nil {
+			for _, key := range candidates {
+				keys[key] = true
+			}
+			return keys, false
+		}
+		if keys[next.Key()] {
+			return keys, true
+		}
+		keys[next.Key()] = true
+		if next.Reserved {
+			return keys, false
+		}
+		cur = next.LongURL
+	}
+	return keys, true
+}
+
+// loopFound fails the create under LoopReject and only logs under
+// LoopWarn.
+func (s *Store) loopFound(longURL, reason string) error {
+	if s.loopMode == LoopReject {
+		return fmt.Errorf("%w: %s", ErrRedirectLoop, reason)
+	}
+	logrus.WithFields(logrus.Fields{
+		"action":   "loop_detected",
+		"long_url": longURL,
+	}).Warn("creating a link that redirects in a loop: " + reason)
+	return nil
+}
+
+// flatten follows longURL while it points at a short link, here or at a
+// known shortener, and returns the final destination and the URLs passed
+// through on the way (none if longURL is not a short link). A chain that
+// revisits a URL or exceeds the hop limit fails with ErrRedirectLoop; one
+// that cannot be followed to the end is left as submitted.
+func (s *Store) flatten(ctx context.Context, longURL string) (string, []string, error) {
+	f := s.flattener
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+	seen := map[string]bool{}
+	var chain []string
+	cur := longURL
+	for {
+		u, err := url.Parse(cur)
+		if err != nil {
+			return longURL, nil, nil
+		}
+		var next string
+		if l, ok := s.ownLink(ctx, u); ok {
+			if l.Draft || s.now().After(l.ExpiresAt) {
+				// It answers 404 or 410 already; flattening would revive it.
+				return longURL, nil, nil
+			}
+			next = l.LongURL
+		} else if f.shorteners[normalizeHost(u.Host)] {
+			next, err = f.follow(ctx, u)
+			if err != nil {
+				logrus.WithError(err).WithField("url", cur).Warn("could not follow short link, keeping it")
+				return longURL, nil, nil
+			}
+			if next == "" {
+				break
+			}
+		} else {
+			break
+		}
+		if seen[cur] {
+			return "", nil, fmt.Errorf("%w: %s is reached twice", ErrRedirectLoop, cur)
+		}
+		seen[cur] = true
+		chain = append(chain, cur)
+		if len(chain) > f.maxHops {
+			return "", nil, fmt.Errorf("%w: more than %d short links in a row", ErrRedirectLoop, f.maxHops)
+		}
+		cur = next
+	}
+	if len(chain) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"action": "flatten",
+			"hops":   len(chain),
+		}).Info("short link destination flattened")
+	}
+	return cur, chain, nil
+}
+
+// follow asks a shortener where u redirects, returning "" if it does not.
+// Some shorteners refuse HEAD, so GET is tried next.
+func (f *Flattener) follow(ctx context.Context, u *url.URL) (string, error) {
+	var resp *http.Response
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("User-Agent", "url-shortener-flatten/1.0")
+		resp, err = f.client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusMethodNotAllowed, http.StatusNotImplemented, http.StatusForbidden:
+			continue
+		}
+		break
+	}
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return "", nil
+	}
+	loc, err := u.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return "", err
+	}
+	if loc.Scheme != "http" && loc.Scheme != "https" {
+		return "", errors.New("redirect to a non-HTTP URL")
+	}
+	return loc.String(), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// Limits on the response headers a link may add to its redirect.
+const (
+	maxRedirectHeaders   = 10
+	maxRedirectHeaderLen = 1024
+)
+
+// reservedRedirectHeaders are the headers links may not set: those the
+// redirect itself or the HTTP framing depends on, and those that would
+// let a link creator change how browsers treat the shortener's origin.
+var reservedRedirectHeaders = map[string]bool{
+	"Location": true, "Content-Length": true, "Content-Type": true, "Content-Encoding": true,
+	"Transfer-Encoding": true, "Connection": true, "Keep-Alive": true, "Upgrade": true,
+	"Trailer": true, "Te": true, "Date": true, "Server": true, "Vary": true,
+	"Set-Cookie": true, "Strict-Transport-Security": true, "Alt-Svc": true,
+	"Www-Authenticate": true, "X-Request-Id": true, "Clear-Site-Data": true,
+}
+
+// validateRedirectHeaders checks a link's headers and returns them with
+// canonical names. Operator-configured headers (trusted) skip the
+// reserved list.
+func validateRedirectHeaders(field string, headers map[string]string, trusted bool) (map[string]string, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	if len(headers) > maxRedirectHeaders {
+		return nil, fieldError(field, fmt.Sprintf("%s may set at most %d headers", field, maxRedirectHeaders))
+	}
+	out := make(map[string]string, len(headers))
+	for name, value := range headers {
+		canonical := http.CanonicalHeaderKey(strings.TrimSpace(name))
+		value = strings.TrimSpace(value)
+		if !httpguts.ValidHeaderFieldName(canonical) {
+			return nil, fieldError(field, fmt.Sprintf("%q is not a valid header name", name))
+		}
+		if !trusted && (reservedRedirectHeaders[canonical] || strings.HasPrefix(canonical, "Access-Control-") ||
+			strings.HasPrefix(canonical, "Proxy-") || strings.HasPrefix(canonical, "Content-")) {
+			return nil, fieldError(field, fmt.Sprintf("header %s cannot be set on a link", canonical))
+		}
+		if value == "" || len(value) > maxRedirectHeaderLen || !httpguts.ValidHeaderFieldValue(value) {
+			return nil, fieldError(field, fmt.Sprintf("header %s needs a value of at most %d printable characters", canonical, maxRedirectHeaderLen))
+		}
+		out[canonical] = value
+	}
+	return out, nil
+}
+
+// parseRedirectHeaders reads REDIRECT_HEADERS: "Name: value" pairs
+// separated by ";", e.g. "X-Robots-Tag: noindex; Referrer-Policy: no-referrer".
+func parseRedirectHeaders(raw string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(raw, ";") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("%q must be Name: value", pair)
+		}
+		headers[name] = value
+	}
+	return validateRedirectHeaders("REDIRECT_HEADERS", headers, true)
+}
+
+// setRedirectHeaders adds the configured headers, then the link's own,
+// which win, to a redirect response. A NoIndex link gets X-Robots-Tag
+// unless its Headers say otherwise.
+func (s *Store) setRedirectHeaders(w http.ResponseWriter, l *Link) {
+	s.addRedirectHeaders(w.Header(), l)
+}
+
+func (s *Store) addRedirectHeaders(h http.Header, l *Link) {
+	for name, value := range s.redirectHeaders {
+		h.Set(name, value)
+	}
+	if l.NoIndex {
+		h.Set("X-Robots-Tag", "noindex")
+	}
+	for name, value := range l.Headers {
+		h.Set(name, value)
+	}
+}
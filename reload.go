@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/ratelimit"
+)
+
+// reloadableKeys are the settings a reload applies in place. A change to
+// any other key is reported as needing a restart.
+var reloadableKeys = map[string]bool{
+	"RATE_LIMIT_PER_MINUTE":      true,
+	"REPORT_RATE_LIMIT_PER_HOUR": true,
+	"DEFAULT_VALIDITY":           true,
+	"CODE_BLOCKLIST":             true,
+	"CODE_BLOCKLIST_FILE":        true,
+	"LOG_LEVEL":                  true,
+	"EXPIRY_NOTICE":              true,
+	"SMTP_ADDR":                  true,
+	"SMTP_FROM":                  true,
+	"SMTP_USERNAME":              true,
+	"SMTP_PASSWORD":              true,
+	"FEATURE_FLAGS":              true,
+	"FEATURE_FLAGS_FILE":         true,
+}
+
+// loadConfigFile reads CONFIG_FILE, if set, ahead of loadConfig.
+func loadConfigFile() (map[string]string, error) {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	m, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	configFile.Store(&m)
+	return m, nil
+}
+
+// Reloader re-reads CONFIG_FILE on SIGHUP or POST /api/admin/reload and
+// applies the reloadable settings. Per-owner notification webhooks are
+// set through /api/notifications and never need one.
+type Reloader struct {
+	path          string
+	boot          Config
+	bootFile      map[string]string
+	store         *Store
+	notifier      *Notifier
+	flags         *Flags
+	limiter       ratelimit.Limiter
+	reportLimiter ratelimit.Limiter
+
+	mu   sync.Mutex
+	cfg  Config
+	file map[string]string
+}
+
+func NewReloader(cfg Config, file map[string]string, store *Store, notifier *Notifier, flags *Flags, limiter, reportLimiter ratelimit.Limiter) *Reloader {
+	return &Reloader{
+		path:          os.Getenv("CONFIG_FILE"),
+		boot:          cfg,
+		bootFile:      file,
+		store:         store,
+		notifier:      notifier,
+		flags:         flags,
+		limiter:       limiter,
+		reportLimiter: reportLimiter,
+		cfg:           cfg,
+		file:          file,
+	}
+}
+
+// ReloadResult lists the keys whose value changed. Applied ones are in
+// effect; RestartRequired ones differ from what the process started with
+// and wait for a restart.
+type ReloadResult struct {
+	Applied         []string  `json:"applied"`
+	RestartRequired []string  `json:"restart_required"`
+	ReloadedAt      time.Time `json:"reloaded_at"`
+}
+
+// effective is key's value with file layered over the environment.
+func effective(file map[string]string, key string) string {
+	if v, ok := file[key]; ok {
+		return v
+	}
+	return os.Getenv(key)
+}
+
+// Reload re-reads the config file and applies it. Nothing is applied if
+// any reloadable setting is invalid.
+func (rl *Reloader) Reload() (*ReloadResult, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	file := map[string]string{}
+	if rl.path != "" {
+		m, err := readConfigFile(rl.path)
+		if err != nil {
+			return nil, err
+		}
+		file = m
+	}
+	configFile.Store(&file)
+	cfg := loadConfig()
+	level, err := logrus.ParseLevel(cfg.Log.Level)
+	if err == nil {
+		var blocked []string
+		if blocked, err = blocklistTerms(cfg.Codes.Blocklist, cfg.Codes.BlocklistFile); err == nil {
+			if err = rl.flags.Configure(cfg.Flags); err == nil {
+				rl.store.filter.SetExtra(blocked)
+			}
+		}
+	}
+	if err != nil {
+		configFile.Store(&rl.file)
+		return nil, err
+	}
+
+	keys := map[string]bool{}
+	for k := range file {
+		keys[k] = true
+	}
+	for k := range rl.file {
+		keys[k] = true
+	}
+	for k := range rl.bootFile {
+		keys[k] = true
+	}
+	res := &ReloadResult{Applied: []string{}, RestartRequired: []string{}, ReloadedAt: time.Now().UTC()}
+	for k := range keys {
+		switch {
+		case !reloadableKeys[k] || !rl.adjustable(k, cfg):
+			if effective(file, k) != effective(rl.bootFile, k) {
+				res.RestartRequired = append(res.RestartRequired, k)
+			}
+		case effective(file, k) != effective(rl.file, k):
+			res.Applied = append(res.Applied, k)
+		}
+	}
+	sort.Strings(res.Applied)
+	sort.Strings(res.RestartRequired)
+
+	logrus.SetLevel(level)
+	rl.store.defaultValidity.Store(int64(cfg.DefaultValidity))
+	rl.notifier.Configure(cfg.ExpiryNotice, cfg.SMTP)
+	if rl.adjustable("RATE_LIMIT_PER_MINUTE", cfg) {
+		setLimit(rl.limiter, cfg.RateLimitPerMinute)
+	}
+	if rl.adjustable("REPORT_RATE_LIMIT_PER_HOUR", cfg) {
+		setLimit(rl.reportLimiter, cfg.Abuse.RateLimitPerHour)
+	}
+	rl.cfg, rl.file = cfg, file
+
+	log := logrus.WithFields(logrus.Fields{
+		"action":           "reload_config",
+		"applied":          res.Applied,
+		"restart_required": res.RestartRequired,
+	})
+	if len(res.RestartRequired) > 0 {
+		log.Warn("config reloaded; some changes need a restart")
+	} else {
+		log.Info("config reloaded")
+	}
+	return res, nil
+}
+
+// adjustable reports whether key can take cfg's value in place. A rate
+// limit that was, or would become, zero adds or removes the limiting
+// middleware, which is only built at startup.
+func (rl *Reloader) adjustable(key string, cfg Config) bool {
+	switch key {
+	case "RATE_LIMIT_PER_MINUTE":
+		return rl.boot.RateLimitPerMinute > 0 && cfg.RateLimitPerMinute > 0
+	case "REPORT_RATE_LIMIT_PER_HOUR":
+		return rl.boot.Abuse.RateLimitPerHour > 0 && cfg.Abuse.RateLimitPerHour > 0
+	}
+	return true
+}
+
+func setLimit(l ratelimit.Limiter, limit int) {
+	if a, ok := l.(ratelimit.Adjustable); ok {
+		a.SetLimit(limit)
+	}
+}
+
+// ReloadOnSIGHUP reloads whenever the process gets SIGHUP, until ctx is
+// cancelled.
+func (rl *Reloader) ReloadOnSIGHUP(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			if _, err := rl.Reload(); err != nil {
+				logrus.WithError(err).Error("config reload failed, keeping the running config")
+			}
+		}
+	}
+}
+
+// reloadConfigHandler serves POST /api/admin/reload.
+func reloadConfigHandler(rl *Reloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, err := rl.Reload()
+		if err != nil {
+			writeAPIError(w, r, newAPIError(http.StatusUnprocessableEntity, ErrCodeInvalidRequest, err.Error()))
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
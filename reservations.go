@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/storage"
+)
+
+// errNotReserved is claimReservation reporting that the key holds a real
+// link, which is left to the OnConflict policy.
+var errNotReserved = errors.New("code is not reserved")
+
+// claimable reports whether owner may turn the reservation l into a link:
+// its own, or anyone's once it has lapsed but not yet been swept.
+func claimable(owner string, l *Link, now time.Time) bool {
+	return canManage(owner, l) || now.After(l.ExpiresAt)
+}
+
+// Reserve holds code for owner until hold from now. The code follows the
+// custom_code rules and fails with ErrCodeExists if it is taken.
+func (s *Store) Reserve(ctx context.Context, code, owner string, hold time.Duration) (*Link, error) {
+	if strings.Contains(code, storage.KeySeparator) {
+		return nil, fieldError("custom_code", "custom_code must not contain "+storage.KeySeparator)
+	}
+	if apiErr := validateFolderCode(code); apiErr != nil {
+		return nil, apiErr
+	}
+	if s.filter.Blocked(code) {
+		return nil, ErrCodeBlocked
+	}
+	if s.aliases.taken(storage.Key(tenantFrom(ctx), code)) {
+		return nil, ErrCodeExists
+	}
+	now := s.now()
+	l := &Link{
+		ShortCode: code,
+		Tenant:    tenantFrom(ctx),
+		Owner:     owner,
+		CreatedAt: now,
+		ExpiresAt: now.Add(hold),
+		Reserved:  true,
+	}
+	if err := s.backend.Create(ctx, l); err != nil {
+		if errors.Is(err, storage.ErrExists) {
+			return nil, ErrCodeExists
+		}
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"action":         "reserve",
+		"short_code":     code,
+		"owner":          owner,
+		"reserved_until": l.ExpiresAt,
+	}).Info("code reserved")
+	return l, nil
+}
+
+// claimReservation replaces the reservation stored under want's key with
+// want, if the owner may claim it.
+func (s *Store) claimReservation(ctx context.Context, want *Link, owner string) (*Link, error) {
+	l, err := s.backend.Update(ctx, want.Key(), func(l *Link) error {
+		if !l.Reserved {
+			return errNotReserved
+		}
+		if !claimable(owner, l, s.now()) {
+			return ErrCodeExists
+		}
+		*l = *want.Clone()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"action":     "claim_reservation",
+		"short_code": l.ShortCode,
+		"owner":      owner,
+	}).Info("reservation claimed")
+	return l, nil
+}
+
+// Reservations returns owner's live reservations in the current tenant,
+// soonest to lapse first.
+func (s *Store) Reservations(ctx context.Context, owner string) ([]*Link, error) {
+	out := []*Link{}
+	err := s.scanReservations(ctx, owner, nil, func(l *Link) bool {
+		out = append(out, l)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ExpiresAt.Before(out[j].ExpiresAt) })
+	return out, nil
+}
+
+// ReservationsPage returns the page of owner's live reservations after
+// the cursor, at most limit of them, newest first.
+func (s *Store) ReservationsPage(ctx context.Context, owner string, after *pageCursor, limit int) (*linkPage, error) {
+	page := newLinkPage(limit)
+	return page, s.scanReservations(ctx, owner, after, page.add)
+}
+
+// scanReservations calls fn, in listing order from the cursor, with
+// owner's live reservations in the current tenant until fn returns false.
+func (s *Store) scanReservations(ctx context.Context, owner string, after *pageCursor, fn func(*Link) bool) error {
+	tenant := tenantFrom(ctx)
+	now := s.now()
+	return s.backend.ScanFrom(ctx, after.position(), func(l *Link) bool {
+		if l.Reserved && l.Tenant == tenant && l.Owner == owner && now.Before(l.ExpiresAt) {
+			return fn(l)
+		}
+		return true
+	})
+}
+
+// Release gives up owner's reservation of code.
+func (s *Store) Release(ctx context.Context, code, owner string) error {
+	l, err := s.backend.Get(ctx, s.key(ctx, code))
+	if err != nil {
+		return err
+	}
+	if !l.Reserved || !canManage(owner, l) {
+		return ErrNotFound
+	}
+	if err := s.backend.Delete(ctx, l.Key()); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"action":     "release_reservation",
+		"short_code": code,
+		"owner":      owner,
+	}).Info("reservation released")
+	return nil
+}
+
+type reservationResponse struct {
+	ShortCode     string    `json:"short_code"`
+	ShortURL      string    `json:"short_url"`
+	ReservedUntil time.Time `json:"reserved_until"`
+}
+
+func (s *Store) reservationResponse(l *Link) reservationResponse {
+	return reservationResponse{ShortCode: l.ShortCode, ShortURL: s.shortURL(l), ReservedUntil: l.ExpiresAt}
+}
+
+// reserveHandler serves POST /api/reserve with {"custom_code": ...,
+// "hold_minutes": N}. The code answers 404 until a destination is
+// attached, and is released when the hold runs out.
+func reserveHandler(store *Store, cfg ReservationConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			CustomCode  string `json:"custom_code"`
+			HoldMinutes int    `json:"hold_minutes,omitempty"`
+		}
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		if req.CustomCode == "" {
+			writeAPIError(w, r, fieldError("custom_code", "custom_code is required"))
+			return
+		}
+		hold := cfg.DefaultHold
+		if req.HoldMinutes != 0 {
+			hold = time.Duration(req.HoldMinutes) * time.Minute
+		}
+		if req.HoldMinutes < 0 || hold > cfg.MaxHold {
+			writeAPIError(w, r, fieldError("hold_minutes", "hold_minutes must be between 1 and "+strconv.Itoa(int(cfg.MaxHold/time.Minute))))
+			return
+		}
+		owner := ownerFrom(r.Context())
+		if cfg.MaxPerOwner > 0 {
+			held, err := store.Reservations(r.Context(), owner)
+			if err != nil {
+				writeAPIError(w, r, apiErrorFrom(err))
+				return
+			}
+			if len(held) >= cfg.MaxPerOwner {
+				e := newAPIError(http.StatusTooManyRequests, ErrCodeQuotaExceeded, "reservation limit reached")
+				e.Details = map[string]interface{}{"limit": cfg.MaxPerOwner}
+				writeAPIError(w, r, e)
+				return
+			}
+		}
+		l, err := store.Reserve(r.Context(), req.CustomCode, owner, hold)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusCreated, store.reservationResponse(l))
+	}
+}
+
+// listReservationsHandler serves GET /api/reserve, a page of the
+// caller's reservations at a time, newest first.
+func listReservationsHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, after, apiErr := pageParams(r.URL.Query())
+		if apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		page, err := store.ReservationsPage(r.Context(), ownerFrom(r.Context()), after, limit)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		held, next := page.links()
+		out := make([]reservationResponse, 0, len(held))
+		for _, l := range held {
+			out = append(out, store.reservationResponse(l))
+		}
+		writeJSON(w, http.StatusOK, withNext(map[string]interface{}{"reservations": out}, next))
+	}
+}
+
+// attachReservationHandler serves POST /api/reserve/{code}/attach: the
+// body is a shorten request, and the link it creates takes over the
+// caller's reservation of code.
+func attachReservationHandler(store *Store, shorten http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l, err := store.backend.Get(r.Context(), store.key(r.Context(), codeVar(r)))
+		if err == nil && (!l.Reserved || !canManage(ownerFrom(r.Context()), l) || store.now().After(l.ExpiresAt)) {
+			err = ErrNotFound
+		}
+		if errors.Is(err, ErrNotFound) {
+			httpError(w, r, http.StatusNotFound, ErrCodeNotFound, "no such reservation")
+			return
+		}
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		shorten(w, r)
+	}
+}
+
+// releaseReservationHandler serves DELETE /api/reserve/{code}.
+func releaseReservationHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := store.Release(r.Context(), codeVar(r), ownerFrom(r.Context())); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				httpError(w, r, http.StatusNotFound, ErrCodeNotFound, "no such reservation")
+				return
+			}
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
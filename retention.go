@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RetentionPolicy ages click data. Time series buckets are kept at full
+// resolution for Fine, then as hours until Hourly and as days until
+// Daily; referrer rollups, which are daily already, also live for Daily.
+// Raw is how long exported click archives are kept. A zero Hourly, Daily
+// or Raw keeps that data forever.
+type RetentionPolicy struct {
+	Fine   time.Duration
+	Hourly time.Duration
+	Daily  time.Duration
+	Raw    time.Duration
+}
+
+// Longest is how long any rollup lives, zero for forever. The series and
+// referrer stores are created with it so they don't drop data the pruning
+// job is still meant to keep.
+func (p RetentionPolicy) Longest() time.Duration {
+	return p.Daily
+}
+
+// RetentionStats counts what one pruning run removed.
+type RetentionStats struct {
+	Rolled    int // series buckets merged into coarser ones
+	Deleted   int // series buckets past the daily retention
+	Referrers int // referrer rollup days
+	Raw       int // archive objects
+}
+
+// RunRetention enforces p every interval on the leader.
+func (s *Store) RunRetention(p RetentionPolicy, interval time.Duration, elector Elector) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if elector.IsLeader() {
+			s.enforceRetention(context.Background(), p)
+		}
+	}
+}
+
+// enforceRetention rolls up and deletes the click data p has aged out.
+// Failures are logged and retried on the next run.
+func (s *Store) enforceRetention(ctx context.Context, p RetentionPolicy) RetentionStats {
+	now := s.now()
+	var st RetentionStats
+	log := logrus.WithField("action", "retention")
+	if s.series != nil {
+		var keys []string
+		err := s.backend.Scan(ctx, func(l *Link) bool {
+			keys = append(keys, l.Key())
+			return true
+		})
+		if err != nil {
+			log.WithError(err).Warn("listing links for retention failed")
+		}
+		for _, k := range keys {
+			if err := s.ageSeries(ctx, k, p, now, &st); err != nil {
+				log.WithError(err).WithField("storage_key", k).Warn("click series retention failed")
+			}
+		}
+	}
+	if s.referrers != nil && p.Daily > 0 {
+		n, err := s.referrers.Prune(ctx, now.Add(-p.Daily))
+		if err != nil {
+			log.WithError(err).Warn("referrer rollup retention failed")
+		}
+		st.Referrers = n
+	}
+	if s.archive != nil && p.Raw > 0 {
+		n, err := s.archive.Prune(ctx, now.Add(-p.Raw))
+		if err != nil {
+			log.WithError(err).Warn("click archive retention failed")
+		}
+		st.Raw = n
+	}
+	metricRetentionRolled.Add(int64(st.Rolled))
+	metricRetentionDeleted.Add(int64(st.Deleted))
+	metricRetentionReferrers.Add(int64(st.Referrers))
+	metricRetentionRaw.Add(int64(st.Raw))
+	if st != (RetentionStats{}) {
+		log.WithFields(logrus.Fields{
+			"rolled":    st.Rolled,
+			"deleted":   st.Deleted,
+			"referrers": st.Referrers,
+			"raw":       st.Raw,
+		}).Info("click data pruned")
+	}
+	return st
+}
+
+// ageSeries applies p to the time series stored under key.
+func (s *Store) ageSeries(ctx context.Context, key string, p RetentionPolicy, now time.Time, st *RetentionStats) error {
+	if p.Fine > 0 {
+		n, err := s.series.Rollup(ctx, key, now.Add(-p.Fine), time.Hour)
+		st.Rolled += n
+		if err != nil {
+			return err
+		}
+	}
+	if p.Hourly > 0 {
+		n, err := s.series.Rollup(ctx, key, now.Add(-p.Hourly), 24*time.Hour)
+		st.Rolled += n
+		if err != nil {
+			return err
+		}
+	}
+	if p.Daily > 0 {
+		n, err := s.series.Prune(ctx, key, now.Add(-p.Daily))
+		st.Deleted += n
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultRobotsTxt keeps crawlers off the short links, which all live at
+// the root, while leaving the public directory feeds open to them.
+const defaultRobotsTxt = `User-agent: *
+Allow: /links.json
+Allow: /links.xml
+Disallow: /
+`
+
+// robotsMaxAge is how long crawlers and caches may keep robots.txt.
+const robotsMaxAge = 24 * time.Hour
+
+// loadRobotsTxt returns the contents of path, or the default when path
+// is empty.
+func loadRobotsTxt(path string) ([]byte, error) {
+	if path == "" {
+		return []byte(defaultRobotsTxt), nil
+	}
+	return os.ReadFile(path)
+}
+
+// robotsHandler serves GET /robots.txt.
+func robotsHandler(body []byte) http.HandlerFunc {
+	cacheControl := "public, max-age=" + strconv.Itoa(int(robotsMaxAge.Seconds()))
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeCached(w, r, body, "text/plain; charset=utf-8", cacheControl, time.Time{})
+	}
+}
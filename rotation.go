@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"url-shortener/storage"
+)
+
+// Rotation policies for links with several destinations. Neither is
+// sticky: every click is assigned afresh.
+const (
+	RotationRoundRobin = "round_robin" // in order, each destination Weight times per cycle
+	RotationWeighted   = "weighted"    // at random, in proportion to Weight
+)
+
+const maxDestinations = 20
+
+// DestinationRequest is one entry of a shorten request's destinations.
+type DestinationRequest struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight,omitempty"` // default 1
+}
+
+// validateDestinations checks a rotation request and returns the stored
+// form, with unset weights as 1.
+func (s *Store) validateDestinations(ctx context.Context, rotation string, reqs []DestinationRequest) ([]storage.Destination, string, error) {
+	switch rotation {
+	case "":
+		rotation = RotationRoundRobin
+	case RotationRoundRobin, RotationWeighted:
+	default:
+		return nil, "", fieldError("rotation", "rotation must be round_robin or weighted")
+	}
+	if len(reqs) < 2 || len(reqs) > maxDestinations {
+		return nil, "", fieldError("destinations", "destinations must list between 2 and "+strconv.Itoa(maxDestinations)+" URLs")
+	}
+	out := make([]storage.Destination, len(reqs))
+	for i, d := range reqs {
+		field := "destinations[" + strconv.Itoa(i) + "]"
+		if _, err := url.ParseRequestURI(d.URL); err != nil {
+			e := fieldError(field+".url", "each destination url must be an absolute URL")
+			e.Code = ErrCodeInvalidURL
+			return nil, "", e
+		}
+		if err := s.checkDestination(ctx, field+".url", d.URL); err != nil {
+			return nil, "", err
+		}
+		if d.Weight < 0 || d.Weight > 1000 {
+			return nil, "", fieldError(field+".weight", "weight must be between 1 and 1000")
+		}
+		if d.Weight == 0 {
+			d.Weight = 1
+		}
+		out[i] = storage.Destination{URL: d.URL, Weight: d.Weight}
+	}
+	return out, rotation, nil
+}
+
+// rotations holds the round-robin position of each rotating link on this
+// instance.
+type rotations struct {
+	next sync.Map // storage key -> *atomic.Uint64
+}
+
+// pick returns the index of the destination l's next click goes to.
+func (rs *rotations) pick(l *Link) int {
+	total := 0
+	for _, d := range l.Destinations {
+		total += d.Weight
+	}
+	if total <= 0 {
+		return 0
+	}
+	var n int
+	if l.Rotation == RotationWeighted {
+		n = rand.Intn(total)
+	} else {
+		v, _ := rs.next.LoadOrStore(l.Key(), new(atomic.Uint64))
+		n = int((v.(*atomic.Uint64).Add(1) - 1) % uint64(total))
+	}
+	for i, d := range l.Destinations {
+		if n < d.Weight {
+			return i
+		}
+		n -= d.Weight
+	}
+	return len(l.Destinations) - 1
+}
+
+// forget drops key's round-robin position once the link is gone.
+func (rs *rotations) forget(key string) {
+	rs.next.Delete(key)
+}
+
+// countDestination adds n clicks to destination i of l; an index l no
+// longer has, after its destinations were edited, counts nowhere.
+func countDestination(l *Link, i int, n int64) {
+	if i < len(l.Destinations) {
+		l.Destinations[i].Clicks += n
+	}
+}
+
+// rotationConflict rejects settings that cannot apply to a rotating link.
+func rotationConflict(req ShortenRequest) *APIError {
+	switch {
+	case req.URL != req.Destinations[0].URL:
+		return fieldError("url", "url must be left out or match the first destination")
+	case req.BurnAfterRead:
+		return fieldError("burn_after_read", "burn_after_read cannot be combined with destinations")
+	case req.Flatten != nil && *req.Flatten:
+		return fieldError("flatten", "flatten cannot be combined with destinations")
+	}
+	return nil
+}
+
+// destinationRequests turns stored destinations back into a request, for
+// copying a link; click counts start over.
+func destinationRequests(ds []storage.Destination) []DestinationRequest {
+	var out []DestinationRequest
+	for _, d := range ds {
+		out = append(out, DestinationRequest{URL: d.URL, Weight: d.Weight})
+	}
+	return out
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"url-shortener/storage"
+)
+
+// maxScheduleWindows caps the windows in one link's schedule.
+const maxScheduleWindows = 14
+
+var scheduleDays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseClock reads "HH:MM" as minutes after midnight; "24:00" is allowed
+// as an end.
+func parseClock(s string) (int, bool) {
+	h, m, ok := strings.Cut(s, ":")
+	if !ok || len(h) != 2 || len(m) != 2 {
+		return 0, false
+	}
+	hh, err1 := strconv.Atoi(h)
+	mm, err2 := strconv.Atoi(m)
+	if err1 != nil || err2 != nil || hh < 0 || mm < 0 || mm > 59 || hh*60+mm > 24*60 {
+		return 0, false
+	}
+	return hh*60 + mm, true
+}
+
+// validateSchedule checks sc and lower-cases its days in place. A
+// schedule without windows is no schedule, and nil is returned.
+func validateSchedule(sc *storage.Schedule) (*storage.Schedule, error) {
+	if sc == nil || len(sc.Windows) == 0 {
+		return nil, nil
+	}
+	if _, err := time.LoadLocation(sc.Timezone); err != nil {
+		return nil, fieldError("schedule.timezone", "schedule.timezone must be an IANA time zone such as Europe/Berlin")
+	}
+	if len(sc.Windows) > maxScheduleWindows {
+		return nil, fieldError("schedule.windows", "a schedule can have at most "+strconv.Itoa(maxScheduleWindows)+" windows")
+	}
+	for i := range sc.Windows {
+		w := &sc.Windows[i]
+		field := "schedule.windows[" + strconv.Itoa(i) + "]"
+		for j, d := range w.Days {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if len(d) > 3 {
+				d = d[:3]
+			}
+			if _, ok := scheduleDays[d]; !ok {
+				return nil, fieldError(field+".days", fmt.Sprintf("%q is not a day; use mon to sun", w.Days[j]))
+			}
+			w.Days[j] = d
+		}
+		start, ok := parseClock(w.Start)
+		if !ok || start == 24*60 {
+			return nil, fieldError(field+".start", "start must be a time from 00:00 to 23:59")
+		}
+		end, ok := parseClock(w.End)
+		if !ok || end == start {
+			return nil, fieldError(field+".end", "end must be a time from 00:01 to 24:00 other than start")
+		}
+	}
+	return sc, nil
+}
+
+func scheduleLocation(sc *storage.Schedule) *time.Location {
+	if loc, err := time.LoadLocation(sc.Timezone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+func onDay(w storage.Window, d time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, name := range w.Days {
+		if scheduleDays[name] == d {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduleOpen reports whether sc is open at now.
+func scheduleOpen(sc *storage.Schedule, now time.Time) bool {
+	t := now.In(scheduleLocation(sc))
+	minute := t.Hour()*60 + t.Minute()
+	yesterday := t.AddDate(0, 0, -1).Weekday()
+	for _, w := range sc.Windows {
+		start, _ := parseClock(w.Start)
+		end, _ := parseClock(w.End)
+		if start < end {
+			if onDay(w, t.Weekday()) && minute >= start && minute < end {
+				return true
+			}
+			continue
+		}
+		// Overnight: from start today, or until end on a day that began
+		// yesterday.
+		if (onDay(w, t.Weekday()) && minute >= start) || (onDay(w, yesterday) && minute < end) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextOpening returns when sc next opens after now, or the zero time if
+// it never does within a week.
+func nextOpening(sc *storage.Schedule, now time.Time) time.Time {
+	t := now.In(scheduleLocation(sc))
+	var next time.Time
+	for offset := 0; offset <= 7; offset++ {
+		day := t.AddDate(0, 0, offset)
+		for _, w := range sc.Windows {
+			if !onDay(w, day.Weekday()) {
+				continue
+			}
+			start, _ := parseClock(w.Start)
+			at := time.Date(day.Year(), day.Month(), day.Day(), start/60, start%60, 0, 0, t.Location())
+			if at.After(now) && (next.IsZero() || at.Before(next)) {
+				next = at
+			}
+		}
+		if !next.IsZero() {
+			return next
+		}
+	}
+	return next
+}
+
+// serveClosed answers a click outside link's schedule with a 403 page
+// saying when it opens next.
+func serveClosed(w http.ResponseWriter, r *http.Request, store *Store, link *Link, now time.Time) {
+	lines := []pageLine{line(msgClosedText)}
+	if next := nextOpening(link.Schedule, now); !next.IsZero() {
+		lines = append(lines, line(msgClosedOpens, next.Format("Monday 15:04 MST")))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	store.pages.render(w, r, http.StatusForbidden, store.tenantName(link), msgClosedTitle, lines...)
+}
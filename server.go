@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newServer builds the HTTP server from cfg. HTTP/2 is negotiated over
+// TLS when a certificate is configured, or spoken in cleartext (h2c) for
+// deployments behind a proxy that terminates TLS, if HTTP2_CLEARTEXT is
+// set.
+func newServer(cfg ServerConfig, h http.Handler) (*http.Server, error) {
+	srv := &http.Server{
+		Addr:              cfg.Addr,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		ConnState:         newConnTracker().track,
+	}
+	if !cfg.HTTP2 {
+		// A non-nil, empty map keeps net/http from enabling HTTP/2 on TLS.
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		srv.Handler = h
+		return srv, nil
+	}
+	h2 := &http2.Server{
+		MaxConcurrentStreams: cfg.HTTP2MaxStreams,
+		IdleTimeout:          cfg.IdleTimeout,
+	}
+	if err := http2.ConfigureServer(srv, h2); err != nil {
+		return nil, err
+	}
+	srv.Handler = h
+	if cfg.HTTP2Cleartext {
+		srv.Handler = countH2C(h2c.NewHandler(h, h2))
+	}
+	return srv, nil
+}
+
+// countH2C keeps h2c connections in http_connections_open. h2c hijacks
+// the HTTP/1 connection and serves it inside this call, and the HTTP/2
+// server never reports it closed through ConnState.
+func countH2C(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PRI" || strings.EqualFold(r.Header.Get("Upgrade"), "h2c") {
+			metricConnsOpen.Add(1)
+			defer metricConnsOpen.Add(-1)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serve listens with TLS when a certificate is configured.
+func serve(srv *http.Server, cfg ServerConfig) error {
+	logrus.WithFields(logrus.Fields{
+		"addr":  srv.Addr,
+		"tls":   cfg.TLSCertFile != "",
+		"http2": cfg.HTTP2,
+	}).Info("starting server")
+	if cfg.TLSCertFile != "" {
+		return srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+	return srv.ListenAndServe()
+}
+
+// connTracker feeds the connection metrics from http.Server.ConnState.
+type connTracker struct {
+	mu    sync.Mutex
+	state map[net.Conn]http.ConnState
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{state: make(map[net.Conn]http.ConnState)}
+}
+
+// track keeps a gauge of open and idle connections. TLS HTTP/2
+// connections report their states through the same hook; connections it
+// has not seen accepted, such as h2c ones after the hand-over, are left
+// to countH2C.
+func (t *connTracker) track(c net.Conn, s http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prev, known := t.state[c]
+	if !known && s != http.StateNew {
+		return
+	}
+	if prev == http.StateIdle {
+		metricConnsIdle.Add(-1)
+	}
+	switch s {
+	case http.StateNew:
+		metricConnsAccepted.Add(1)
+		metricConnsOpen.Add(1)
+	case http.StateIdle:
+		metricConnsIdle.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		metricConnsOpen.Add(-1)
+		delete(t.state, c)
+		return
+	}
+	t.state[c] = s
+}
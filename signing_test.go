@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verifyToken checks a token the way a destination does, by the format
+// documented on Signer, with keys it has been given.
+func verifyToken(keys map[string]string, token string, now time.Time) (*TokenPayload, error) {
+	body, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errors.New("no signature")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return nil, err
+	}
+	var p TokenPayload
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, err
+	}
+	secret, ok := keys[p.KeyID]
+	if !ok {
+		return nil, errors.New("unknown kid")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	want := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return nil, errors.New("bad signature")
+	}
+	if now.Unix() >= p.ExpiresAt {
+		return nil, errors.New("expired")
+	}
+	return &p, nil
+}
+
+func TestNewSigner(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantNil bool
+		wantKid string
+		wantErr bool
+	}{
+		{"empty disables signing", "", true, "", false},
+		{"blank entries only", " , ", true, "", false},
+		{"first key is active", "new:s2, old:s1", false, "new", false},
+		{"missing secret", "k1:", false, "", true},
+		{"missing kid", ":secret", false, "", true},
+		{"no separator", "k1", false, "", true},
+		{"duplicate kid", "k1:a,k1:b", false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewSigner(tt.raw, time.Minute, "sig")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewSigner(%q) error = %v, want error %v", tt.raw, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (s == nil) != tt.wantNil {
+				t.Fatalf("NewSigner(%q) = %v, want nil %v", tt.raw, s, tt.wantNil)
+			}
+			if s != nil && s.kid != tt.wantKid {
+				t.Errorf("active key %q, want %q", s.kid, tt.wantKid)
+			}
+		})
+	}
+}
+
+func TestSignURL(t *testing.T) {
+	link := &Link{ShortCode: "abc", Claims: map[string]string{"plan": "pro"}}
+	tests := []struct {
+		name      string
+		dest      string
+		wantQuery url.Values // besides the token
+	}{
+		{"no query", "https://example.com/page", url.Values{}},
+		{"keeps the query", "https://example.com/page?a=1&b=two", url.Values{"a": {"1"}, "b": {"two"}}},
+		{"replaces a stale token", "https://example.com/page?sig=forged&a=1", url.Values{"a": {"1"}}},
+	}
+	s, err := NewSigner("new:s2,old:s1", time.Minute, "sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signed, err := s.SignURL(tt.dest, link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prefix := strings.SplitN(tt.dest, "?", 2)[0]; !strings.HasPrefix(signed, prefix+"?") {
+				t.Errorf("SignURL = %q, want it to keep %q", signed, prefix)
+			}
+			q := u.Query()
+			tokens := q["sig"]
+			if len(tokens) != 1 {
+				t.Fatalf("SignURL = %q, want exactly one token", signed)
+			}
+			q.Del("sig")
+			if !reflect.DeepEqual(q, tt.wantQuery) {
+				t.Errorf("query besides the token = %v, want %v", q, tt.wantQuery)
+			}
+			p, err := verifyToken(map[string]string{"new": "s2"}, tokens[0], time.Now())
+			if err != nil {
+				t.Fatalf("token does not verify: %v", err)
+			}
+			if p.KeyID != "new" || p.ShortCode != "abc" || !reflect.DeepEqual(p.Claims, link.Claims) {
+				t.Errorf("payload = %+v, want kid new, code abc, claims %v", p, link.Claims)
+			}
+		})
+	}
+}
+
+func TestSignedTokenVerification(t *testing.T) {
+	s, err := NewSigner("new:s2,old:s1", time.Minute, "sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.Sign("abc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, sig, _ := strings.Cut(token, ".")
+	forged, _ := json.Marshal(TokenPayload{KeyID: "new", ShortCode: "other", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+
+	tests := []struct {
+		name    string
+		keys    map[string]string
+		token   string
+		now     time.Time
+		wantErr bool
+	}{
+		{"valid", map[string]string{"new": "s2"}, token, time.Now(), false},
+		{"verifier still lists the old key", map[string]string{"old": "s1", "new": "s2"}, token, time.Now(), false},
+		{"verifier only has the old key", map[string]string{"old": "s1"}, token, time.Now(), true},
+		{"wrong secret", map[string]string{"new": "s1"}, token, time.Now(), true},
+		{"expired", map[string]string{"new": "s2"}, token, time.Now().Add(2 * time.Minute), true},
+		{"payload swapped", map[string]string{"new": "s2"}, base64.RawURLEncoding.EncodeToString(forged) + "." + sig, time.Now(), true},
+		{"signature dropped", map[string]string{"new": "s2"}, body, time.Now(), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := verifyToken(tt.keys, tt.token, tt.now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verify error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
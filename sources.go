@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+)
+
+// shareSourceParam is the query parameter naming where a link was shared:
+// /{code}?s=twitter and /{code}?s=newsletter count towards one link, broken
+// down by source. On passthrough links it is forwarded like any other.
+const shareSourceParam = "s"
+
+// maxSources caps the distinct sources counted per link; clicks from any
+// further sources are counted under otherSource.
+const (
+	maxSources  = 50
+	otherSource = "other"
+)
+
+var shareSourceRe = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,31}$`)
+
+// shareSource returns the request's share source, or "" if it has none or
+// one that is not a short lower-case token.
+func shareSource(r *http.Request) string {
+	s := r.URL.Query().Get(shareSourceParam)
+	if !shareSourceRe.MatchString(s) {
+		return ""
+	}
+	return s
+}
+
+// countSource adds n clicks from source to l's breakdown.
+func countSource(l *Link, source string, n int64) {
+	if l.Sources == nil {
+		l.Sources = make(map[string]int64)
+	}
+	if _, ok := l.Sources[source]; !ok && len(l.Sources) >= maxSources {
+		source = otherSource
+	}
+	l.Sources[source] += n
+}
+
+// SourceClicks is one row of a share source breakdown.
+type SourceClicks struct {
+	Source   string `json:"source"`
+	ShareURL string `json:"share_url"`
+	Clicks   int64  `json:"clicks"`
+}
+
+type sourcesResponse struct {
+	ShortCode    string         `json:"short_code"`
+	Clicks       int64          `json:"clicks"`
+	Unattributed int64          `json:"unattributed"`
+	Sources      []SourceClicks `json:"sources"`
+}
+
+// shareURL is the variant of l's short URL that attributes clicks to
+// source.
+func (s *Store) shareURL(l *Link, source string) string {
+	return s.shortURL(l) + "?" + shareSourceParam + "=" + url.QueryEscape(source)
+}
+
+// sourcesHandler serves GET /api/stats/{code}/sources: clicks per share
+// source, most clicked first, and the clicks that came without one.
+func sourcesHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, err := store.Stats(r.Context(), codeVar(r))
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		resp := sourcesResponse{ShortCode: link.ShortCode, Clicks: link.Clicks, Sources: []SourceClicks{}}
+		var attributed int64
+		for src, n := range link.Sources {
+			resp.Sources = append(resp.Sources, SourceClicks{Source: src, ShareURL: store.shareURL(link, src), Clicks: n})
+			attributed += n
+		}
+		sort.Slice(resp.Sources, func(i, j int) bool {
+			if resp.Sources[i].Clicks != resp.Sources[j].Clicks {
+				return resp.Sources[i].Clicks > resp.Sources[j].Clicks
+			}
+			return resp.Sources[i].Source < resp.Sources[j].Source
+		})
+		resp.Unattributed = max(link.Clicks-attributed, 0)
+		writeCachedJSON(w, r, resp, link.UpdatedAt)
+	}
+}
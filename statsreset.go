@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxStatsReason caps the reason recorded with a click adjustment.
+const maxStatsReason = 500
+
+// ResetStats zeroes the click statistics of a link managed by owner: its
+// total, per-destination, per-source and per-device counts and its time
+// series.
+// Clicks still waiting for a batch flush are counted afterwards.
+func (s *Store) ResetStats(ctx context.Context, code, owner string) (*Link, error) {
+	var before int64
+	l, err := s.backend.Update(ctx, s.key(ctx, code), func(l *Link) error {
+		if !s.canWrite(ctx, owner, l) || l.Deleted() || l.Reserved {
+			return ErrNotFound
+		}
+		before = l.Clicks
+		l.Clicks, l.SuspiciousClicks, l.Sources, l.Devices = 0, 0, nil, nil
+		for i := range l.Destinations {
+			l.Destinations[i].Clicks = 0
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.clicks != nil {
+		if err := s.clicks.Delete(ctx, l.Key()); err != nil {
+			logrus.WithError(err).WithField("short_code", code).Warn("resetting shared click counter failed")
+		}
+	}
+	if s.series != nil {
+		if err := s.series.Delete(ctx, l.Key()); err != nil {
+			logrus.WithError(err).WithField("short_code", code).Warn("resetting click series failed")
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"action":     "stats_reset",
+		"short_code": code,
+		"by":         owner,
+		"before":     before,
+	}).Info("link stats reset")
+	return l, nil
+}
+
+// AdjustClicks sets a link's click total to clicks or, if clicks is nil,
+// moves it by delta, never below zero. Only the total changes; the time
+// series keeps the clicks it actually saw. reason is logged with the
+// change.
+func (s *Store) AdjustClicks(ctx context.Context, code string, clicks *int64, delta int64, by, reason string) (*Link, error) {
+	key := s.key(ctx, code)
+	before, err := s.Stats(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	after := before.Clicks + delta
+	if clicks != nil {
+		after = *clicks
+	}
+	if after < 0 {
+		after = 0
+	}
+	l, err := s.backend.Update(ctx, key, func(l *Link) error {
+		l.Clicks = after
+		if l.SuspiciousClicks > after {
+			l.SuspiciousClicks = after
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.clicks != nil {
+		if err := s.clicks.Set(ctx, key, after); err != nil {
+			logrus.WithError(err).WithField("short_code", code).Warn("adjusting shared click counter failed")
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"action":     "stats_adjust",
+		"short_code": code,
+		"by":         by,
+		"before":     before.Clicks,
+		"after":      after,
+		"reason":     reason,
+	}).Info("link clicks adjusted")
+	return l, nil
+}
+
+// resetStatsHandler serves POST /api/stats/{code}/reset.
+func resetStatsHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, err := store.ResetStats(r.Context(), codeVar(r), ownerFrom(r.Context()))
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, link)
+	}
+}
+
+// adjustStatsHandler serves POST /api/admin/stats/{code}/adjust with
+// {"clicks": n} to set the total or {"delta": n} to correct it, and a
+// reason for the audit log, e.g. "bot flood on 2024-05-01" or "imported
+// from the old shortener".
+func adjustStatsHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Clicks *int64 `json:"clicks,omitempty"`
+			Delta  int64  `json:"delta,omitempty"`
+			Reason string `json:"reason"`
+		}
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		switch {
+		case (req.Clicks == nil) == (req.Delta == 0):
+			writeAPIError(w, r, fieldError("clicks", "give either clicks or a non-zero delta"))
+			return
+		case req.Clicks != nil && *req.Clicks < 0:
+			writeAPIError(w, r, fieldError("clicks", "clicks must not be negative"))
+			return
+		case req.Reason == "" || len(req.Reason) > maxStatsReason:
+			writeAPIError(w, r, fieldError("reason", "reason is required and at most 500 characters"))
+			return
+		}
+		link, err := store.AdjustClicks(r.Context(), codeVar(r), req.Clicks, req.Delta, ownerFrom(r.Context()), req.Reason)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, link)
+	}
+}
@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"net/url"
+	"strings"
+)
+
+// CanonicalURL normalises a destination for equality lookups: scheme and
+// host are lower-cased, default ports and fragments dropped, and an empty
+// path becomes "/". Inputs that do not parse are returned unchanged.
+func CanonicalURL(raw string) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Host == "" {
+		return raw
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	if port := u.Port(); port != "" && !(u.Scheme == "http" && port == "80") && !(u.Scheme == "https" && port == "443") {
+		host += ":" + port
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	u.Host = host
+	u.Fragment, u.RawFragment = "", ""
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u.String()
+}
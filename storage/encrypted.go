@@ -0,0 +1,334 @@
+package storage
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// encryptedPrefix starts every encrypted value: "enc:" + key ID + ":" +
+// base64url(nonce || AES-GCM ciphertext). Destinations are absolute
+// http(s) URLs, so no URL stored in plain text can look like this; page
+// titles and descriptions can, which is why seal encrypts whatever it is
+// given.
+const encryptedPrefix = "enc:"
+
+// ErrUnknownKey means a URL was encrypted with a key no longer supplied.
+var ErrUnknownKey = errors.New("destination is encrypted with an unknown key")
+
+// KeyProvider supplies the keys destination URLs are encrypted with,
+// from the environment or a key management service. Keys are 32 bytes
+// (AES-256) under short IDs; active names the one new writes use, and
+// the others are kept to read what they encrypted until it is rekeyed.
+type KeyProvider interface {
+	Keys(ctx context.Context) (active string, keys map[string][]byte, err error)
+}
+
+type keyring struct {
+	active string
+	aeads  map[string]cipher.AEAD
+}
+
+func newKeyring(active string, keys map[string][]byte) (*keyring, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("active key %q is not among the keys", active)
+	}
+	kr := &keyring{active: active, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("key ID %q must be non-empty and free of ':'", id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes, not %d", id, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if kr.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return kr, nil
+}
+
+// seal encrypts plain with the active key, binding it to the link's
+// storage key so that ciphertexts cannot be swapped between links.
+func (kr *keyring) seal(plain, aad string) (string, error) {
+	if plain == "" {
+		return plain, nil
+	}
+	aead := kr.aeads[kr.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plain), []byte(aad))
+	return encryptedPrefix + kr.active + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts stored, passing through values stored in plain text
+// before encryption was turned on.
+func (kr *keyring) open(stored, aad string) (string, error) {
+	rest, ok := strings.CutPrefix(stored, encryptedPrefix)
+	if !ok {
+		return stored, nil
+	}
+	id, data, ok := strings.Cut(rest, ":")
+	aead, known := kr.aeads[id]
+	if !ok || !known {
+		return "", ErrUnknownKey
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted destination")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(aad))
+	if err != nil {
+		return "", fmt.Errorf("decrypting destination: %w", err)
+	}
+	return string(plain), nil
+}
+
+// current reports whether stored is encrypted under the active key.
+func (kr *keyring) current(stored string) bool {
+	return stored == "" || strings.HasPrefix(stored, encryptedPrefix+kr.active+":")
+}
+
+// EncryptedStorage keeps destination URLs (LongURL, rotating destinations,
+// the timeline, the fallback and the redirect chain that led to LongURL)
+// and what the destination page says about itself (the preview's title,
+// description and favicon URL) encrypted in the backend it wraps.
+// Callers see plain links: these fields are decrypted as links are read,
+// and only in memory.
+//
+// FindByURL cannot use the backend's index over ciphertexts, so it scans
+// and decrypts every link.
+type EncryptedStorage struct {
+	next     Storage
+	provider KeyProvider
+	keys     atomic.Pointer[keyring]
+}
+
+// Encrypted wraps next, loading keys from provider.
+func Encrypted(ctx context.Context, next Storage, provider KeyProvider) (*EncryptedStorage, error) {
+	e := &EncryptedStorage{next: next, provider: provider}
+	if err := e.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reload fetches the keys from the provider again, so that a new active
+// key takes over without a restart.
+func (e *EncryptedStorage) Reload(ctx context.Context) error {
+	active, keys, err := e.provider.Keys(ctx)
+	if err != nil {
+		return err
+	}
+	kr, err := newKeyring(active, keys)
+	if err != nil {
+		return err
+	}
+	e.keys.Store(kr)
+	return nil
+}
+
+// ActiveKey returns the ID of the key new writes are encrypted with.
+func (e *EncryptedStorage) ActiveKey() string { return e.keys.Load().active }
+
+// secrets returns pointers to every field of l kept encrypted.
+func secrets(l *Link) []*string {
+	out := []*string{&l.LongURL, &l.FallbackURL}
+	for i := range l.Destinations {
+		out = append(out, &l.Destinations[i].URL)
+	}
+	for i := range l.Timeline {
+		out = append(out, &l.Timeline[i].URL)
+	}
+	for i := range l.RedirectChain {
+		out = append(out, &l.RedirectChain[i])
+	}
+	if p := l.Preview; p != nil {
+		out = append(out, &p.Title, &p.Description, &p.FaviconURL)
+	}
+	return out
+}
+
+func (e *EncryptedStorage) encrypt(kr *keyring, l *Link) error {
+	aad := l.Key()
+	for _, u := range secrets(l) {
+		sealed, err := kr.seal(*u, aad)
+		if err != nil {
+			return err
+		}
+		*u = sealed
+	}
+	return nil
+}
+
+func (e *EncryptedStorage) decrypt(kr *keyring, l *Link) error {
+	aad := l.Key()
+	for _, u := range secrets(l) {
+		plain, err := kr.open(*u, aad)
+		if err != nil {
+			return fmt.Errorf("link %s: %w", aad, err)
+		}
+		*u = plain
+	}
+	return nil
+}
+
+func (e *EncryptedStorage) Get(ctx context.Context, key string) (*Link, error) {
+	l, err := e.next.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.decrypt(e.keys.Load(), l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Create stores an encrypted copy; l itself keeps its plain URLs.
+func (e *EncryptedStorage) Create(ctx context.Context, l *Link) error {
+	c := l.Clone()
+	if err := e.encrypt(e.keys.Load(), c); err != nil {
+		return err
+	}
+	if err := e.next.Create(ctx, c); err != nil {
+		return err
+	}
+	l.UpdatedAt = c.UpdatedAt
+	return nil
+}
+
+func (e *EncryptedStorage) Update(ctx context.Context, key string, fn func(*Link) error) (*Link, error) {
+	kr := e.keys.Load()
+	l, err := e.next.Update(ctx, key, func(l *Link) error {
+		if err := e.decrypt(kr, l); err != nil {
+			return err
+		}
+		if err := fn(l); err != nil {
+			return err
+		}
+		return e.encrypt(kr, l)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := e.decrypt(kr, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (e *EncryptedStorage) Delete(ctx context.Context, key string) error {
+	return e.next.Delete(ctx, key)
+}
+
+func (e *EncryptedStorage) FindByURL(ctx context.Context, longURL string) ([]*Link, error) {
+	want := CanonicalURL(longURL)
+	var out []*Link
+	err := e.Scan(ctx, func(l *Link) bool {
+		if CanonicalURL(l.LongURL) == want {
+			out = append(out, l)
+		}
+		return true
+	})
+	return out, err
+}
+
+// Scan skips links that cannot be decrypted rather than failing: one
+// link under a retired key must not stop sweeps and listings.
+func (e *EncryptedStorage) Scan(ctx context.Context, fn func(*Link) bool) error {
+	kr := e.keys.Load()
+	return e.next.Scan(ctx, func(l *Link) bool {
+		if e.decrypt(kr, l) != nil {
+			return true
+		}
+		return fn(l)
+	})
+}
+
+// ScanFrom skips undecryptable links as Scan does. Keys and CreatedAt are
+// stored in the clear, so the backend's order is the listing order.
+func (e *EncryptedStorage) ScanFrom(ctx context.Context, after *Position, fn func(*Link) bool) error {
+	kr := e.keys.Load()
+	return e.next.ScanFrom(ctx, after, func(l *Link) bool {
+		if e.decrypt(kr, l) != nil {
+			return true
+		}
+		return fn(l)
+	})
+}
+
+func (e *EncryptedStorage) Close() error { return e.next.Close() }
+
+func (e *EncryptedStorage) Usage(ctx context.Context) (Usage, error) {
+	if u, ok := e.next.(UsageReporter); ok {
+		return u.Usage(ctx)
+	}
+	return Usage{}, ErrUnsupported
+}
+
+func (e *EncryptedStorage) Compact(ctx context.Context) error {
+	if c, ok := e.next.(Compactor); ok {
+		return c.Compact(ctx)
+	}
+	return ErrUnsupported
+}
+
+// RekeyResult counts what Rekey did.
+type RekeyResult struct {
+	Rekeyed int `json:"rekeyed"`
+	Current int `json:"current"` // already under the active key
+	Failed  int `json:"failed"`  // unreadable, typically under a key no longer supplied
+}
+
+// Rekey re-encrypts under the active key every link stored in plain text
+// or under an older key. Once it reports no failures, older keys may be
+// dropped from the provider.
+func (e *EncryptedStorage) Rekey(ctx context.Context) (RekeyResult, error) {
+	kr := e.keys.Load()
+	var res RekeyResult
+	var stale []string
+	err := e.next.Scan(ctx, func(l *Link) bool {
+		for _, u := range secrets(l) {
+			if !kr.current(*u) {
+				stale = append(stale, l.Key())
+				return true
+			}
+		}
+		res.Current++
+		return true
+	})
+	if err != nil {
+		return res, err
+	}
+	for _, key := range stale {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		_, err := e.next.Update(ctx, key, func(l *Link) error {
+			if err := e.decrypt(kr, l); err != nil {
+				return err
+			}
+			return e.encrypt(kr, l)
+		})
+		switch {
+		case err == nil:
+			res.Rekeyed++
+		case errors.Is(err, ErrNotFound):
+		default:
+			res.Failed++
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// orderBatch is how many links ScanFrom clones per hold of the lock.
+const orderBatch = 256
+
+// Memory keeps links in a map; everything is lost on restart.
+type Memory struct {
+	mu    sync.RWMutex
+	data  map[string]*Link
+	byURL map[string]map[string]struct{} // CanonicalURL -> keys
+
+	// order is the listing order index, oldest first so that new links
+	// are appended. Positions that arrive out of order wait in pending
+	// until the next ScanFrom sorts them in; deleted links and replaced
+	// CreatedAts leave stale entries, dropped once they are half of it.
+	order   []Position
+	pending []Position
+	stale   int
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		data:  make(map[string]*Link),
+		byURL: make(map[string]map[string]struct{}),
+	}
+}
+
+// index and unindex maintain byURL; callers hold mu for writing.
+func (m *Memory) index(l *Link) {
+	u := CanonicalURL(l.LongURL)
+	keys, ok := m.byURL[u]
+	if !ok {
+		keys = make(map[string]struct{})
+		m.byURL[u] = keys
+	}
+	keys[l.Key()] = struct{}{}
+}
+
+func (m *Memory) unindex(l *Link) {
+	u := CanonicalURL(l.LongURL)
+	delete(m.byURL[u], l.Key())
+	if len(m.byURL[u]) == 0 {
+		delete(m.byURL, u)
+	}
+}
+
+// place adds l's position to the order index, and unplace notes that a
+// position no longer matches its link; callers hold mu for writing.
+func (m *Memory) place(l *Link) {
+	p := PositionOf(l)
+	n := len(m.order)
+	switch {
+	case n == 0 || p.Before(m.order[n-1]):
+		m.order = append(m.order, p)
+	case m.order[n-1].equal(p):
+		m.stale-- // recreated where it was deleted from
+	default:
+		m.pending = append(m.pending, p)
+	}
+}
+
+func (m *Memory) unplace() {
+	m.stale++
+	if m.stale > orderBatch && m.stale > len(m.order)/2 {
+		m.reorder()
+	}
+}
+
+// placed reports whether p is the position of a stored link.
+func (m *Memory) placed(p Position) bool {
+	l, ok := m.data[p.Key]
+	return ok && l.CreatedAt.Equal(p.CreatedAt)
+}
+
+// reorder merges pending into order and drops stale and duplicate
+// entries; callers hold mu for writing.
+func (m *Memory) reorder() {
+	sort.Slice(m.pending, func(i, j int) bool { return m.pending[j].Before(m.pending[i]) })
+	merged := make([]Position, 0, len(m.data))
+	i, j := 0, 0
+	for i < len(m.order) || j < len(m.pending) {
+		var p Position
+		if j == len(m.pending) || (i < len(m.order) && m.pending[j].Before(m.order[i])) {
+			p, i = m.order[i], i+1
+		} else {
+			p, j = m.pending[j], j+1
+		}
+		if m.placed(p) && (len(merged) == 0 || !merged[len(merged)-1].equal(p)) {
+			merged = append(merged, p)
+		}
+	}
+	m.order, m.pending, m.stale = merged, nil, 0
+}
+
+func (m *Memory) Get(_ context.Context, key string) (*Link, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	l, ok := m.data[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return l.Clone(), nil
+}
+
+func (m *Memory) Create(_ context.Context, l *Link) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.data[l.Key()]; exists {
+		return ErrExists
+	}
+	if l.UpdatedAt.IsZero() {
+		l.UpdatedAt = time.Now().UTC()
+	}
+	m.data[l.Key()] = l.Clone()
+	m.index(l)
+	m.place(l)
+	return nil
+}
+
+func (m *Memory) Update(_ context.Context, key string, fn func(*Link) error) (*Link, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.data[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := l.Clone()
+	if err := fn(c); err != nil {
+		return nil, err
+	}
+	c.UpdatedAt = time.Now().UTC()
+	if c.LongURL != l.LongURL {
+		m.unindex(l)
+		m.index(c)
+	}
+	m.data[key] = c
+	if !c.CreatedAt.Equal(l.CreatedAt) {
+		m.place(c)
+		m.unplace()
+	}
+	return c.Clone(), nil
+}
+
+func (m *Memory) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.data[key]
+	if !ok {
+		return ErrNotFound
+	}
+	m.unindex(l)
+	delete(m.data, key)
+	m.unplace()
+	return nil
+}
+
+func (m *Memory) FindByURL(_ context.Context, longURL string) ([]*Link, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := m.byURL[CanonicalURL(longURL)]
+	out := make([]*Link, 0, len(keys))
+	for key := range keys {
+		out = append(out, m.data[key].Clone())
+	}
+	return out, nil
+}
+
+func (m *Memory) Scan(ctx context.Context, fn func(*Link) bool) error {
+	m.mu.RLock()
+	links := make([]*Link, 0, len(m.data))
+	for _, l := range m.data {
+		links = append(links, l.Clone())
+	}
+	m.mu.RUnlock()
+	for _, l := range links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !fn(l) {
+			break
+		}
+	}
+	return nil
+}
+
+// ScanFrom walks the order index back from the position, cloning
+// orderBatch links at a time under the read lock, so fn may call back
+// into m. Each batch seeks afresh from the last position it reached.
+func (m *Memory) ScanFrom(ctx context.Context, after *Position, fn func(*Link) bool) error {
+	m.mu.Lock()
+	if len(m.pending) > 0 {
+		m.reorder()
+	}
+	m.mu.Unlock()
+	for {
+		links, next := m.orderedBatch(after)
+		for _, l := range links {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !fn(l) {
+				return nil
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		after = next
+	}
+}
+
+// orderedBatch returns the next links in listing order after the
+// position and where to go on from, nil at the end.
+func (m *Memory) orderedBatch(after *Position) ([]*Link, *Position) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	i := len(m.order)
+	if after != nil {
+		i = sort.Search(len(m.order), func(i int) bool { return !after.Before(m.order[i]) })
+	}
+	links := make([]*Link, 0, orderBatch)
+	for i--; i >= 0; i-- {
+		p := m.order[i]
+		if m.placed(p) {
+			links = append(links, m.data[p.Key].Clone())
+		}
+		if len(links) == orderBatch {
+			return links, &p
+		}
+	}
+	return links, nil
+}
+
+func (m *Memory) Close() error { return nil }
+
+// Usage sums the struct and string sizes of every link and index entry.
+// Map overhead is not counted, so the real footprint is somewhat larger.
+func (m *Memory) Usage(_ context.Context) (Usage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	u := Usage{Links: int64(len(m.data))}
+	for key, l := range m.data {
+		u.Bytes += int64(len(key)) + linkSize(l)
+	}
+	for canon, keys := range m.byURL {
+		u.Bytes += int64(len(canon))
+		for key := range keys {
+			u.Bytes += int64(len(key))
+		}
+	}
+	u.Bytes += int64(len(m.order)+len(m.pending)) * int64(unsafe.Sizeof(Position{}))
+	return u, nil
+}
+
+func linkSize(l *Link) int64 {
+	n := int64(unsafe.Sizeof(*l))
+	n += int64(len(l.LongURL) + len(l.ShortCode) + len(l.Owner) + len(l.Tenant) + len(l.CampaignID))
+	n += int64(len(l.FallbackURL) + len(l.Notes) + len(l.TakedownReason))
+	n += int64(len(l.Milestones)) * 8
+	for k, v := range l.Claims {
+		n += int64(len(k) + len(v))
+	}
+	for k, v := range l.Metadata {
+		n += int64(len(k) + len(v))
+	}
+	if l.Health != nil {
+		n += int64(unsafe.Sizeof(*l.Health)) + int64(len(l.Health.Error))
+	}
+	return n
+}
+
+// Compact copies the maps into fresh ones: Go maps never shrink, so after
+// a mass expiry the old buckets would otherwise stay allocated. The order
+// index is rebuilt without its stale entries too.
+func (m *Memory) Compact(_ context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data := make(map[string]*Link, len(m.data))
+	for k, l := range m.data {
+		data[k] = l
+	}
+	byURL := make(map[string]map[string]struct{}, len(m.byURL))
+	for u, keys := range m.byURL {
+		c := make(map[string]struct{}, len(keys))
+		for k := range keys {
+			c[k] = struct{}{}
+		}
+		byURL[u] = c
+	}
+	m.data, m.byURL = data, byURL
+	m.reorder()
+	return nil
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"errors"
+)
+
+// Mirror wraps primary so that every write is also applied to secondary,
+// the dual-write mode of a live migration: reads are served by primary
+// alone, while secondary is kept in step until traffic can be cut over to
+// it. A write to secondary that fails does not fail the call; onError, if
+// set, hears about it, and a later copy with overwrite repairs the gap.
+func Mirror(primary, secondary Storage, onError func(op, key string, err error)) Storage {
+	return &mirror{primary: primary, secondary: secondary, onError: onError}
+}
+
+type mirror struct {
+	primary, secondary Storage
+	onError            func(op, key string, err error)
+}
+
+func (m *mirror) failed(op, key string, err error) {
+	if err != nil && m.onError != nil {
+		m.onError(op, key, err)
+	}
+}
+
+func (m *mirror) Get(ctx context.Context, key string) (*Link, error) {
+	return m.primary.Get(ctx, key)
+}
+
+func (m *mirror) Create(ctx context.Context, l *Link) error {
+	if err := m.primary.Create(ctx, l); err != nil {
+		return err
+	}
+	m.failed("create", l.Key(), m.put(ctx, l))
+	return nil
+}
+
+func (m *mirror) Update(ctx context.Context, key string, fn func(*Link) error) (*Link, error) {
+	l, err := m.primary.Update(ctx, key, fn)
+	if err != nil {
+		return nil, err
+	}
+	m.failed("update", key, m.put(ctx, l))
+	return l, nil
+}
+
+// put makes secondary's copy of l match it, whether or not secondary has
+// one yet.
+func (m *mirror) put(ctx context.Context, l *Link) error {
+	_, err := m.secondary.Update(ctx, l.Key(), func(dst *Link) error {
+		*dst = *l.Clone()
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		err = m.secondary.Create(ctx, l.Clone())
+	}
+	return err
+}
+
+func (m *mirror) Delete(ctx context.Context, key string) error {
+	if err := m.primary.Delete(ctx, key); err != nil {
+		return err
+	}
+	if err := m.secondary.Delete(ctx, key); !errors.Is(err, ErrNotFound) {
+		m.failed("delete", key, err)
+	}
+	return nil
+}
+
+func (m *mirror) FindByURL(ctx context.Context, longURL string) ([]*Link, error) {
+	return m.primary.FindByURL(ctx, longURL)
+}
+
+func (m *mirror) Scan(ctx context.Context, fn func(*Link) bool) error {
+	return m.primary.Scan(ctx, fn)
+}
+
+func (m *mirror) ScanFrom(ctx context.Context, after *Position, fn func(*Link) bool) error {
+	return m.primary.ScanFrom(ctx, after, fn)
+}
+
+func (m *mirror) Close() error {
+	return errors.Join(m.primary.Close(), m.secondary.Close())
+}
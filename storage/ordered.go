@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Position is a link's place in listing order: newest CreatedAt first,
+// ties broken by ascending key. Listings page through ScanFrom by
+// handing back the position of the last link they showed.
+type Position struct {
+	CreatedAt time.Time
+	Key       string
+}
+
+// PositionOf returns l's position in listing order.
+func PositionOf(l *Link) Position {
+	return Position{CreatedAt: l.CreatedAt, Key: l.Key()}
+}
+
+// Before reports whether p is listed before q.
+func (p Position) Before(q Position) bool {
+	if p.CreatedAt.Equal(q.CreatedAt) {
+		return p.Key < q.Key
+	}
+	return p.CreatedAt.After(q.CreatedAt)
+}
+
+func (p Position) equal(q Position) bool {
+	return p.Key == q.Key && p.CreatedAt.Equal(q.CreatedAt)
+}
+
+// ScanSorted is ScanFrom for backends without an index in listing
+// order: it runs s.Scan to the end, keeps the links after the position
+// and sorts them, so it costs a full scan however early fn stops.
+func ScanSorted(ctx context.Context, s Storage, after *Position, fn func(*Link) bool) error {
+	var links []*Link
+	err := s.Scan(ctx, func(l *Link) bool {
+		if after == nil || after.Before(PositionOf(l)) {
+			links = append(links, l)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(links, func(i, j int) bool { return PositionOf(links[i]).Before(PositionOf(links[j])) })
+	for _, l := range links {
+		if !fn(l) {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Snapshots are newline-delimited JSON, one Link per line, so any backend
+// can be dumped into and loaded from the same format.
+
+// WriteSnapshot writes every link in s to w, passing each through adjust
+// first if it is set, and returns how many it wrote.
+func WriteSnapshot(ctx context.Context, w io.Writer, s Storage, adjust func(*Link)) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	n := 0
+	var encErr error
+	err := s.Scan(ctx, func(l *Link) bool {
+		if adjust != nil {
+			adjust(l)
+		}
+		if encErr = enc.Encode(l); encErr != nil {
+			return false
+		}
+		n++
+		return true
+	})
+	if err == nil {
+		err = encErr
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	return n, err
+}
+
+// LoadResult counts what LoadSnapshot or Copy did.
+type LoadResult struct {
+	Created     int `json:"created"`
+	Overwritten int `json:"overwritten"`
+	Skipped     int `json:"skipped"` // already present and not overwritten
+	Deleted     int `json:"deleted"` // missing from the source, with overwrite
+}
+
+// LoadSnapshot reads a snapshot from r into s. Links whose key is taken
+// are skipped unless overwrite is set, so an interrupted load can be
+// repeated. With overwrite, s is made a copy of the snapshot instead:
+// taken keys are replaced and, once the whole snapshot has been read,
+// links it does not have are deleted. A replaced link keeps the larger of
+// the two click counts, since s may have counted clicks of its own.
+// progress, if set, is called after every link.
+func LoadSnapshot(ctx context.Context, r io.Reader, s Storage, overwrite bool, progress func(LoadResult)) (LoadResult, error) {
+	ld := newLoader(s, overwrite, progress)
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for line := 1; ; line++ {
+		var l Link
+		if err := dec.Decode(&l); err == io.EOF {
+			break
+		} else if err != nil {
+			return ld.res, fmt.Errorf("snapshot record %d: %w", line, err)
+		}
+		if l.ShortCode == "" {
+			return ld.res, fmt.Errorf("snapshot record %d: missing short_code", line)
+		}
+		if err := ld.put(ctx, &l); err != nil {
+			return ld.res, err
+		}
+	}
+	return ld.res, ld.finish(ctx)
+}
+
+// Copy copies every link in src to dst directly, with the same rules as
+// LoadSnapshot.
+func Copy(ctx context.Context, src, dst Storage, overwrite bool, progress func(LoadResult)) (LoadResult, error) {
+	ld := newLoader(dst, overwrite, progress)
+	var putErr error
+	err := src.Scan(ctx, func(l *Link) bool {
+		putErr = ld.put(ctx, l)
+		return putErr == nil
+	})
+	if err == nil {
+		err = putErr
+	}
+	if err != nil {
+		return ld.res, err
+	}
+	return ld.res, ld.finish(ctx)
+}
+
+type loader struct {
+	dst       Storage
+	overwrite bool
+	progress  func(LoadResult)
+	seen      map[string]bool // keys in the source, with overwrite
+	res       LoadResult
+}
+
+func newLoader(dst Storage, overwrite bool, progress func(LoadResult)) *loader {
+	ld := &loader{dst: dst, overwrite: overwrite, progress: progress}
+	if overwrite {
+		ld.seen = make(map[string]bool)
+	}
+	return ld
+}
+
+func (ld *loader) put(ctx context.Context, l *Link) error {
+	if ld.seen != nil {
+		ld.seen[l.Key()] = true
+	}
+	err := ld.dst.Create(ctx, l)
+	switch {
+	case err == nil:
+		ld.res.Created++
+	case errors.Is(err, ErrExists) && ld.overwrite:
+		if _, err := ld.dst.Update(ctx, l.Key(), func(dst *Link) error {
+			clicks, suspicious := dst.Clicks, dst.SuspiciousClicks
+			*dst = *l.Clone()
+			if clicks > dst.Clicks {
+				dst.Clicks, dst.SuspiciousClicks = clicks, suspicious
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		ld.res.Overwritten++
+	case errors.Is(err, ErrExists):
+		ld.res.Skipped++
+	default:
+		return err
+	}
+	if ld.progress != nil {
+		ld.progress(ld.res)
+	}
+	return nil
+}
+
+// finish deletes, with overwrite, the links the source did not have.
+func (ld *loader) finish(ctx context.Context) error {
+	if !ld.overwrite {
+		return nil
+	}
+	var gone []string
+	if err := ld.dst.Scan(ctx, func(l *Link) bool {
+		if !ld.seen[l.Key()] {
+			gone = append(gone, l.Key())
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	for _, key := range gone {
+		if err := ld.dst.Delete(ctx, key); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		ld.res.Deleted++
+	}
+	return nil
+}
+
+// Diff compares every link in src with its copy in dst and returns the
+// keys that are missing from dst or differ. UpdatedAt is ignored, since
+// writing a link stamps it afresh, and so are clicks dst counted on top of
+// src's while it was already serving.
+func Diff(ctx context.Context, src, dst Storage) ([]string, error) {
+	var diff []string
+	var innerErr error
+	err := src.Scan(ctx, func(l *Link) bool {
+		d, err := dst.Get(ctx, l.Key())
+		if errors.Is(err, ErrNotFound) {
+			diff = append(diff, l.Key())
+			return true
+		}
+		if err != nil {
+			innerErr = err
+			return false
+		}
+		if d.Clicks >= l.Clicks {
+			d.Clicks = l.Clicks
+		}
+		a, b := l.Clone(), d.Clone()
+		a.UpdatedAt, b.UpdatedAt = time.Time{}, time.Time{}
+		ja, _ := json.Marshal(a)
+		jb, _ := json.Marshal(b)
+		if string(ja) != string(jb) {
+			diff = append(diff, l.Key())
+		}
+		return true
+	})
+	if err == nil {
+		err = innerErr
+	}
+	sort.Strings(diff)
+	return diff, err
+}
@@ -0,0 +1,174 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"url-shortener/storage"
+)
+
+func snapshotLink(code string, clicks int64) *storage.Link {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &storage.Link{
+		LongURL:   "https://example.com/" + code,
+		ShortCode: code,
+		CreatedAt: now,
+		ExpiresAt: now.Add(24 * time.Hour),
+		Clicks:    clicks,
+	}
+}
+
+func fill(t *testing.T, s storage.Storage, links ...*storage.Link) {
+	t.Helper()
+	for _, l := range links {
+		if err := s.Create(context.Background(), l); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func snapshotOf(t *testing.T, links ...*storage.Link) *bytes.Buffer {
+	t.Helper()
+	src := storage.NewMemory()
+	fill(t, src, links...)
+	var buf bytes.Buffer
+	if _, err := storage.WriteSnapshot(context.Background(), &buf, src, nil); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestLoadSnapshot(t *testing.T) {
+	tests := []struct {
+		name      string
+		overwrite bool
+		want      storage.LoadResult
+		wantCodes map[string]int64 // code → clicks in the target afterwards
+	}{
+		{
+			name: "keep existing",
+			want: storage.LoadResult{Created: 1, Skipped: 2},
+			wantCodes: map[string]int64{
+				"kept": 50, "counted": 3, "new": 7, "removed": 1,
+			},
+		},
+		{
+			name:      "overwrite",
+			overwrite: true,
+			want:      storage.LoadResult{Created: 1, Overwritten: 2, Deleted: 1},
+			wantCodes: map[string]int64{
+				"kept":    50, // the target counted more clicks than the source had
+				"counted": 9,
+				"new":     7,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dst := storage.NewMemory()
+			fill(t, dst, snapshotLink("kept", 50), snapshotLink("counted", 3), snapshotLink("removed", 1))
+			snap := snapshotOf(t, snapshotLink("kept", 40), snapshotLink("counted", 9), snapshotLink("new", 7))
+
+			res, err := storage.LoadSnapshot(ctx, snap, dst, tt.overwrite, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res != tt.want {
+				t.Errorf("result = %+v, want %+v", res, tt.want)
+			}
+			got := map[string]int64{}
+			dst.Scan(ctx, func(l *storage.Link) bool {
+				got[l.ShortCode] = l.Clicks
+				return true
+			})
+			if len(got) != len(tt.wantCodes) {
+				t.Errorf("target holds %v, want %v", got, tt.wantCodes)
+			}
+			for code, clicks := range tt.wantCodes {
+				if got[code] != clicks {
+					t.Errorf("%s: clicks = %d, want %d", code, got[code], clicks)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadSnapshotBrokenDoesNotDelete(t *testing.T) {
+	ctx := context.Background()
+	dst := storage.NewMemory()
+	fill(t, dst, snapshotLink("old", 1))
+	snap := snapshotOf(t, snapshotLink("new", 1))
+	snap.WriteString(`{"short_code":`)
+
+	res, err := storage.LoadSnapshot(ctx, snap, dst, true, nil)
+	if err == nil {
+		t.Fatal("loading a truncated snapshot succeeded")
+	}
+	if res.Deleted != 0 {
+		t.Errorf("deleted %d links after a failed load", res.Deleted)
+	}
+	if _, err := dst.Get(ctx, "old"); err != nil {
+		t.Errorf("Get(old) after a failed load: %v", err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	src, dst := storage.NewMemory(), storage.NewMemory()
+	fill(t, src, snapshotLink("a", 1), snapshotLink("b", 2))
+	fill(t, dst, snapshotLink("stale", 3))
+
+	res, err := storage.Copy(ctx, src, dst, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (storage.LoadResult{Created: 2, Deleted: 1}); res != want {
+		t.Errorf("result = %+v, want %+v", res, want)
+	}
+	diff, err := storage.Diff(ctx, src, dst)
+	if err != nil || len(diff) != 0 {
+		t.Fatalf("Diff = %v, %v; want no differences", diff, err)
+	}
+	if _, err := dst.Get(ctx, "stale"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Get(stale) error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMirrorWrites(t *testing.T) {
+	ctx := context.Background()
+	primary, secondary := storage.NewMemory(), storage.NewMemory()
+	var failures []string
+	m := storage.Mirror(primary, secondary, func(op, key string, err error) {
+		failures = append(failures, op+" "+key+": "+err.Error())
+	})
+	// A link the secondary already has, as after a first copy.
+	fill(t, secondary, snapshotLink("copied", 0))
+	fill(t, primary, snapshotLink("copied", 0))
+
+	fill(t, m, snapshotLink("a", 0), snapshotLink("b", 0))
+	for _, code := range []string{"a", "copied"} {
+		if _, err := m.Update(ctx, code, func(l *storage.Link) error { l.Clicks += 5; return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) > 0 {
+		t.Fatalf("mirroring failed: %s", strings.Join(failures, "; "))
+	}
+	if diff, err := storage.Diff(ctx, primary, secondary); err != nil || len(diff) != 0 {
+		t.Fatalf("Diff(primary, secondary) = %v, %v; want none", diff, err)
+	}
+	if diff, err := storage.Diff(ctx, secondary, primary); err != nil || len(diff) != 0 {
+		t.Fatalf("Diff(secondary, primary) = %v, %v; want none", diff, err)
+	}
+	if l, err := secondary.Get(ctx, "copied"); err != nil || l.Clicks != 5 {
+		t.Fatalf("secondary copied = %+v, %v; want 5 clicks", l, err)
+	}
+}
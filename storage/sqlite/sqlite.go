@@ -0,0 +1,325 @@
+// Package sqlite stores links in a single SQLite file, for single-node
+// deployments that want durability without running Redis or Postgres. It
+// uses the pure-Go modernc.org/sqlite driver, so no CGO is needed.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"url-shortener/storage"
+)
+
+// scanBatch is how many links Scan reads per query. No transaction is
+// held while fn runs, so fn may write to the store.
+const scanBatch = 500
+
+const schema = `
+CREATE TABLE IF NOT EXISTS links (
+	key             TEXT PRIMARY KEY,
+	canonical_url   TEXT NOT NULL,
+	data            TEXT NOT NULL,
+	expiry_notified INTEGER NOT NULL DEFAULT 0,
+	click_seq       INTEGER NOT NULL DEFAULT 0,
+	created_at      TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS links_canonical_url ON links (canonical_url);
+`
+
+// orderIndex serves ScanFrom. It is created once migrate has filled in
+// created_at for databases from before the column existed.
+const orderIndex = `CREATE INDEX IF NOT EXISTS links_listing ON links (created_at DESC, key)`
+
+// createdFormat stores CreatedAt in UTC at a fixed width, so that the
+// created_at column sorts as the times do.
+const createdFormat = "2006-01-02T15:04:05.000000000Z"
+
+func createdAt(l *storage.Link) string {
+	return l.CreatedAt.UTC().Format(createdFormat)
+}
+
+// Store keeps each link as a JSON document keyed by Link.Key, with the
+// fields JSON leaves out in columns of their own.
+type Store struct {
+	db *sql.DB
+}
+
+// Open opens or creates the database at path in WAL mode, so redirects
+// keep reading while a write is in progress. Writes wait up to
+// busyTimeout for each other.
+func Open(path string, busyTimeout time.Duration) (*Store, error) {
+	q := url.Values{}
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Add("_pragma", "synchronous(NORMAL)")
+	q.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", busyTimeout.Milliseconds()))
+	q.Set("_txlock", "immediate")
+	db, err := sql.Open("sqlite", "file:"+path+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite %s: %w", path, err)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite %s: %w", path, err)
+	}
+	if _, err := db.Exec(orderIndex); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite %s: %w", path, err)
+	}
+	return &Store{db: db}, nil
+}
+
+// migrate adds the created_at column to a database that predates it and
+// fills it in from each link's JSON.
+func migrate(db *sql.DB) error {
+	var found int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('links') WHERE name = 'created_at'`).Scan(&found)
+	if err != nil || found > 0 {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`ALTER TABLE links ADD COLUMN created_at TEXT NOT NULL DEFAULT ''`); err != nil {
+		return err
+	}
+	rows, err := tx.Query(`SELECT key, data FROM links`)
+	if err != nil {
+		return err
+	}
+	created := map[string]string{}
+	for rows.Next() {
+		var key, data string
+		var l storage.Link
+		if err := rows.Scan(&key, &data); err != nil {
+			rows.Close()
+			return err
+		}
+		if err := json.Unmarshal([]byte(data), &l); err != nil {
+			rows.Close()
+			return fmt.Errorf("link %s: %w", key, err)
+		}
+		created[key] = createdAt(&l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for key, at := range created {
+		if _, err := tx.Exec(`UPDATE links SET created_at = ? WHERE key = ?`, at, key); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func encode(l *storage.Link) (string, error) {
+	b, err := json.Marshal(l)
+	return string(b), err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func decode(row scanner) (*storage.Link, error) {
+	var (
+		data     string
+		notified bool
+		seq      int64
+	)
+	if err := row.Scan(&data, &notified, &seq); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, storage.ErrNotFound
+		}
+		return nil, err
+	}
+	var l storage.Link
+	if err := json.Unmarshal([]byte(data), &l); err != nil {
+		return nil, err
+	}
+	l.ExpiryNotified, l.ClickSeq = notified, uint64(seq)
+	return &l, nil
+}
+
+const selectLink = `SELECT data, expiry_notified, click_seq FROM links`
+
+func (s *Store) Get(ctx context.Context, key string) (*storage.Link, error) {
+	return decode(s.db.QueryRowContext(ctx, selectLink+` WHERE key = ?`, key))
+}
+
+func (s *Store) Create(ctx context.Context, l *storage.Link) error {
+	if l.UpdatedAt.IsZero() {
+		l.UpdatedAt = time.Now().UTC()
+	}
+	data, err := encode(l)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO links (key, canonical_url, data, expiry_notified, click_seq, created_at) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (key) DO NOTHING`,
+		l.Key(), storage.CanonicalURL(l.LongURL), data, l.ExpiryNotified, int64(l.ClickSeq), createdAt(l))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return storage.ErrExists
+	}
+	return err
+}
+
+// Update runs fn inside a write transaction, which SQLite serialises, so
+// concurrent updates of a link never lose each other's changes.
+func (s *Store) Update(ctx context.Context, key string, fn func(*storage.Link) error) (*storage.Link, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	l, err := decode(tx.QueryRowContext(ctx, selectLink+` WHERE key = ?`, key))
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(l); err != nil {
+		return nil, err
+	}
+	l.UpdatedAt = time.Now().UTC()
+	data, err := encode(l)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx,
+		`UPDATE links SET canonical_url = ?, data = ?, expiry_notified = ?, click_seq = ?, created_at = ? WHERE key = ?`,
+		storage.CanonicalURL(l.LongURL), data, l.ExpiryNotified, int64(l.ClickSeq), createdAt(l), key)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (s *Store) Delete(ctx context.Context, key string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM links WHERE key = ?`, key)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return storage.ErrNotFound
+	}
+	return err
+}
+
+func (s *Store) FindByURL(ctx context.Context, longURL string) ([]*storage.Link, error) {
+	return s.query(ctx, selectLink+` WHERE canonical_url = ?`, storage.CanonicalURL(longURL))
+}
+
+func (s *Store) query(ctx context.Context, q string, args ...interface{}) ([]*storage.Link, error) {
+	rows, err := s.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*storage.Link{}
+	for rows.Next() {
+		l, err := decode(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, l)
+	}
+	return out, rows.Err()
+}
+
+// Scan reads links in key order, scanBatch at a time. Links written
+// during a scan may or may not be seen.
+func (s *Store) Scan(ctx context.Context, fn func(*storage.Link) bool) error {
+	after := ""
+	for {
+		links, err := s.query(ctx, selectLink+` WHERE key > ? ORDER BY key LIMIT ?`, after, scanBatch)
+		if err != nil {
+			return err
+		}
+		for _, l := range links {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !fn(l) {
+				return nil
+			}
+		}
+		if len(links) < scanBatch {
+			return nil
+		}
+		after = links[len(links)-1].Key()
+	}
+}
+
+// ScanFrom reads links in listing order off the links_listing index,
+// scanBatch at a time, each batch seeking past the last link of the one
+// before.
+func (s *Store) ScanFrom(ctx context.Context, after *storage.Position, fn func(*storage.Link) bool) error {
+	for {
+		var (
+			links []*storage.Link
+			err   error
+		)
+		if after == nil {
+			links, err = s.query(ctx, selectLink+` ORDER BY created_at DESC, key LIMIT ?`, scanBatch)
+		} else {
+			at := after.CreatedAt.UTC().Format(createdFormat)
+			links, err = s.query(ctx, selectLink+` WHERE created_at <= ? AND (created_at < ? OR key > ?) ORDER BY created_at DESC, key LIMIT ?`,
+				at, at, after.Key, scanBatch)
+		}
+		if err != nil {
+			return err
+		}
+		for _, l := range links {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !fn(l) {
+				return nil
+			}
+		}
+		if len(links) < scanBatch {
+			return nil
+		}
+		p := storage.PositionOf(links[len(links)-1])
+		after = &p
+	}
+}
+
+// Close checkpoints the write-ahead log into the database file.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Usage counts the links and reports the database file's size.
+func (s *Store) Usage(ctx context.Context) (storage.Usage, error) {
+	var u storage.Usage
+	err := s.db.QueryRowContext(ctx,
+		`SELECT (SELECT COUNT(*) FROM links), (SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size())`,
+	).Scan(&u.Links, &u.Bytes)
+	return u, err
+}
+
+// Compact rewrites the database file without the pages deleted links
+// left free.
+func (s *Store) Compact(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `VACUUM`)
+	return err
+}
@@ -0,0 +1,118 @@
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"url-shortener/bench"
+	"url-shortener/storage"
+	"url-shortener/storage/sqlite"
+	"url-shortener/storage/storetest"
+)
+
+func TestSQLite(t *testing.T) {
+	storetest.TestStorage(t, func() storage.Storage {
+		s, err := sqlite.Open(filepath.Join(t.TempDir(), "links.db"), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func BenchmarkSQLite(b *testing.B) {
+	bench.Storage(b, func() storage.Storage {
+		s, err := sqlite.Open(filepath.Join(b.TempDir(), "links.db"), time.Second)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestCopyToSQLite(t *testing.T) {
+	ctx := context.Background()
+	src := storage.NewMemory()
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, code := range []string{"a", "b", "c"} {
+		if err := src.Create(ctx, &storage.Link{LongURL: "https://example.com/" + code, ShortCode: code, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst, err := sqlite.Open(filepath.Join(t.TempDir(), "links.db"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	for run := 1; run <= 2; run++ {
+		if _, err := storage.Copy(ctx, src, dst, true, nil); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+		if diff, err := storage.Diff(ctx, src, dst); err != nil || len(diff) != 0 {
+			t.Fatalf("run %d: Diff = %v, %v; want none", run, diff, err)
+		}
+		// Between runs the source loses a link, which the second
+		// run must delete from the target.
+		if run == 1 {
+			if err := src.Delete(ctx, "b"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := dst.Get(ctx, "b"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Get(b) after the second copy: error = %v, want ErrNotFound", err)
+	}
+}
+
+// TestOpenAddsCreatedAt opens a database from before the created_at
+// column, which ScanFrom orders by, and expects it filled in.
+func TestOpenAddsCreatedAt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE links (
+		key             TEXT PRIMARY KEY,
+		canonical_url   TEXT NOT NULL,
+		data            TEXT NOT NULL,
+		expiry_notified INTEGER NOT NULL DEFAULT 0,
+		click_seq       INTEGER NOT NULL DEFAULT 0
+	)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for code, hours := range map[string]int{"old": 0, "mid": 1, "new": 2} {
+		l := storage.Link{ShortCode: code, LongURL: "https://example.com/", CreatedAt: base.Add(time.Duration(hours) * time.Hour)}
+		data, _ := json.Marshal(l)
+		if _, err := db.Exec(`INSERT INTO links (key, canonical_url, data) VALUES (?, ?, ?)`, code, l.LongURL, string(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	s, err := sqlite.Open(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var got []string
+	err = s.ScanFrom(context.Background(), nil, func(l *storage.Link) bool {
+		got = append(got, l.ShortCode)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"new", "mid", "old"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ScanFrom after migrating = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,394 @@
+// Package storage defines how short links are persisted. The HTTP layer
+// and its business rules live above it and only talk to the Storage
+// interface, so backends can be swapped or decorated (e.g. with tracing).
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotFound    = errors.New("short link not found")
+	ErrExists      = errors.New("code already exists")
+	ErrUnsupported = errors.New("not supported by this storage backend")
+)
+
+type Link struct {
+	LongURL   string    `json:"long_url"`
+	ShortCode string    `json:"short_code"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"` // stamped by the backend on every write
+	ExpiresAt time.Time `json:"expires_at"`
+	Clicks    int64     `json:"clicks"`
+	Draft     bool      `json:"draft"`
+	Owner     string    `json:"owner,omitempty"`
+
+	// Tenant namespaces ShortCode: the same code may exist once per
+	// tenant. The default tenant is "".
+	Tenant string `json:"tenant,omitempty"`
+
+	// SuspiciousClicks is the part of Clicks that fraud detection flagged.
+	SuspiciousClicks int64 `json:"suspicious_clicks,omitempty"`
+
+	// SlidingTTL links are extended to TTLSeconds from the latest click.
+	SlidingTTL bool  `json:"sliding_ttl,omitempty"`
+	TTLSeconds int64 `json:"ttl_seconds,omitempty"`
+
+	CampaignID string `json:"campaign_id,omitempty"`
+
+	// BurnAfterRead links redirect a single human visitor, after which
+	// Burned is set and they answer 410 until they expire.
+	BurnAfterRead bool `json:"burn_after_read,omitempty"`
+	Burned        bool `json:"burned,omitempty"`
+
+	// Passthrough links forward any path and query after the code to the
+	// destination: /docs/guide/install?x=1 → LongURL + /guide/install?x=1.
+	Passthrough bool `json:"passthrough,omitempty"`
+
+	// Signed links carry a fresh HMAC token, covering the code, its
+	// expiry and Claims, on every redirect.
+	Signed bool              `json:"signed,omitempty"`
+	Claims map[string]string `json:"claims,omitempty"`
+
+	// Privacy links have their click records scrubbed of personal data.
+	Privacy bool `json:"privacy,omitempty"`
+
+	// Milestones are ascending click totals the owner is alerted about
+	// when the link passes them.
+	Milestones []int64 `json:"milestones,omitempty"`
+
+	// RedirectChain lists the short links, starting with the submitted
+	// URL, that were followed at creation to reach LongURL.
+	RedirectChain []string `json:"redirect_chain,omitempty"`
+
+	// Destinations, when set, are served in turn instead of LongURL
+	// (which is the first of them), per Rotation: "round_robin" or
+	// "weighted" random.
+	Destinations []Destination `json:"destinations,omitempty"`
+	Rotation     string        `json:"rotation,omitempty"`
+
+	// AllowedIPs, when set, are the CIDR ranges whose clients may follow
+	// the link; others are refused.
+	AllowedIPs []string `json:"allowed_ips,omitempty"`
+	// Schedule, when set, limits the redirect to its opening hours.
+	Schedule *Schedule `json:"schedule,omitempty"`
+	// Timeline lists future changes of LongURL, oldest first. From each
+	// entry's At on, redirects go to its URL instead.
+	Timeline []Swap `json:"timeline,omitempty"`
+	// Headers are added to the redirect response, e.g. Referrer-Policy.
+	Headers map[string]string `json:"headers,omitempty"`
+	// NoIndex asks search engines not to index the link.
+	NoIndex bool `json:"noindex,omitempty"`
+
+	// Aliases are further codes, in the same tenant, that resolve to this
+	// link and count their clicks on it.
+	Aliases []string `json:"aliases,omitempty"`
+
+	// Sources counts clicks per share source, the s query parameter of
+	// variants like /{code}?s=twitter. Clicks without one are not in it.
+	Sources map[string]int64 `json:"sources,omitempty"`
+
+	// ClientHints asks browsers for client hints, with Accept-CH on the
+	// link's interstitial page, and counts its clicks in Devices.
+	ClientHints bool `json:"client_hints,omitempty"`
+	// Devices counts clicks per client hint dimension (platform, browser,
+	// mobile, model, language), then per value.
+	Devices map[string]map[string]int64 `json:"devices,omitempty"`
+
+	// Public links are listed in the /links.json and /links.xml feeds.
+	Public bool `json:"public,omitempty"`
+
+	// Preview describes the destination page, fetched after creation.
+	Preview *Preview `json:"preview,omitempty"`
+	// Card, when set, is what social-media crawlers are shown for the
+	// short link instead of being redirected.
+	Card *Card `json:"card,omitempty"`
+	// Interstitial, when set, shows visitors a notice with a countdown
+	// before they are sent on.
+	Interstitial *Interstitial `json:"interstitial,omitempty"`
+
+	// Health is the latest destination check, if monitoring is enabled.
+	Health *Health `json:"health,omitempty"`
+	// FallbackURL is served instead of LongURL while Health reports the
+	// destination down.
+	FallbackURL string `json:"fallback_url,omitempty"`
+
+	// Notes and Metadata are free-form data for people and integrations;
+	// the shortener never interprets them.
+	Notes    string            `json:"notes,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// DeletedAt marks a soft-deleted link. It stays reserved, and can be
+	// restored, until the grace period after DeletedAt runs out.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	// TakenDownAt marks a link disabled after an abuse report. It keeps
+	// its code and data but no longer redirects.
+	TakenDownAt    *time.Time `json:"taken_down_at,omitempty"`
+	TakedownReason string     `json:"takedown_reason,omitempty"`
+
+	// PendingTransfer is an offer of the link to another owner, awaiting
+	// their answer.
+	PendingTransfer *Transfer `json:"pending_transfer,omitempty"`
+
+	// EdgeCached is set once the link has been pushed to edge caches,
+	// which must then hear of every change to its redirect.
+	EdgeCached bool `json:"edge_cached,omitempty"`
+
+	// Reserved links hold a code for their owner without a destination
+	// until ExpiresAt; creating a link with that custom code claims it.
+	Reserved bool `json:"reserved,omitempty"`
+
+	// ExpiryNotified is set once the owner has been warned of expiry.
+	ExpiryNotified bool `json:"-"`
+
+	// ClickSeq is the last click journal sequence counted in Clicks, so a
+	// replayed journal batch is never counted twice.
+	ClickSeq uint64 `json:"-"`
+}
+
+// Destination health states.
+const (
+	HealthAlive       = "alive"
+	HealthNotFound    = "not_found"    // 404 or 410
+	HealthServerError = "server_error" // 5xx
+	HealthClientError = "client_error" // other 4xx, often bot protection
+	HealthTLSError    = "tls_error"
+	HealthUnreachable = "unreachable" // DNS, connect or timeout failures
+)
+
+// Transfer is an offer to hand a link from one owner to another.
+type Transfer struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	OfferedAt time.Time `json:"offered_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Destination is one of a rotating link's targets. Clicks counts the
+// redirects it was chosen for.
+type Destination struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight,omitempty"`
+	Clicks int64  `json:"clicks"`
+}
+
+// Preview is what the destination page says about itself.
+type Preview struct {
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	FaviconURL  string    `json:"favicon_url,omitempty"`
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+// Card is a link's own Open Graph and Twitter card metadata.
+type Card struct {
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	ImageURL    string `json:"image_url,omitempty"`
+}
+
+// Interstitial is a notice page shown before the redirect. Notice, e.g.
+// "you are leaving our site", goes above the standard text naming the
+// destination.
+type Interstitial struct {
+	Notice  string `json:"notice,omitempty"`
+	Seconds int    `json:"seconds"`
+}
+
+// Schedule is a link's weekly opening hours.
+type Schedule struct {
+	Timezone string   `json:"timezone,omitempty"` // IANA name; UTC if empty
+	Windows  []Window `json:"windows"`
+}
+
+// Window is a daily span, "09:00" to "18:00", on Days ("mon" to "sun",
+// every day if empty). An End before Start runs past midnight.
+type Window struct {
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+// Swap is a scheduled change of destination.
+type Swap struct {
+	At  time.Time `json:"at"`
+	URL string    `json:"url"`
+}
+
+// Health records how a link's destination answered its last check.
+type Health struct {
+	Status     string     `json:"status"`
+	HTTPStatus int        `json:"http_status,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	CheckedAt  time.Time  `json:"checked_at"`
+	DownSince  *time.Time `json:"down_since,omitempty"`
+}
+
+// Down reports whether the destination is considered broken. Client
+// errors other than 404/410 are not: many sites refuse automated checks.
+func (h *Health) Down() bool {
+	return h != nil && h.Status != HealthAlive && h.Status != HealthClientError
+}
+
+// Key is the identifier a link is stored under: its code, qualified by
+// its tenant.
+func (l *Link) Key() string { return Key(l.Tenant, l.ShortCode) }
+
+// KeySeparator joins tenant and code in a storage key; codes may not
+// contain it.
+const KeySeparator = ":"
+
+// Key builds the storage key for code in tenant.
+func Key(tenant, code string) string {
+	if tenant == "" {
+		return code
+	}
+	return tenant + KeySeparator + code
+}
+
+// Clone returns a copy that shares no mutable state with l.
+func (l *Link) Clone() *Link {
+	c := *l
+	if l.DeletedAt != nil {
+		t := *l.DeletedAt
+		c.DeletedAt = &t
+	}
+	if l.TakenDownAt != nil {
+		t := *l.TakenDownAt
+		c.TakenDownAt = &t
+	}
+	if l.Health != nil {
+		h := *l.Health
+		c.Health = &h
+	}
+	if l.PendingTransfer != nil {
+		t := *l.PendingTransfer
+		c.PendingTransfer = &t
+	}
+	if l.Claims != nil {
+		c.Claims = make(map[string]string, len(l.Claims))
+		for k, v := range l.Claims {
+			c.Claims[k] = v
+		}
+	}
+	if l.Milestones != nil {
+		c.Milestones = append([]int64(nil), l.Milestones...)
+	}
+	if l.RedirectChain != nil {
+		c.RedirectChain = append([]string(nil), l.RedirectChain...)
+	}
+	if l.Destinations != nil {
+		c.Destinations = append([]Destination(nil), l.Destinations...)
+	}
+	if l.Timeline != nil {
+		c.Timeline = append([]Swap(nil), l.Timeline...)
+	}
+	if l.Aliases != nil {
+		c.Aliases = append([]string(nil), l.Aliases...)
+	}
+	if l.AllowedIPs != nil {
+		c.AllowedIPs = append([]string(nil), l.AllowedIPs...)
+	}
+	if l.Preview != nil {
+		p := *l.Preview
+		c.Preview = &p
+	}
+	if l.Card != nil {
+		cd := *l.Card
+		c.Card = &cd
+	}
+	if l.Interstitial != nil {
+		in := *l.Interstitial
+		c.Interstitial = &in
+	}
+	if l.Schedule != nil {
+		sc := *l.Schedule
+		sc.Windows = make([]Window, len(l.Schedule.Windows))
+		for i, w := range l.Schedule.Windows {
+			w.Days = append([]string(nil), w.Days...)
+			sc.Windows[i] = w
+		}
+		c.Schedule = &sc
+	}
+	if l.Metadata != nil {
+		c.Metadata = make(map[string]string, len(l.Metadata))
+		for k, v := range l.Metadata {
+			c.Metadata[k] = v
+		}
+	}
+	if l.Headers != nil {
+		c.Headers = make(map[string]string, len(l.Headers))
+		for k, v := range l.Headers {
+			c.Headers[k] = v
+		}
+	}
+	if l.Sources != nil {
+		c.Sources = make(map[string]int64, len(l.Sources))
+		for k, v := range l.Sources {
+			c.Sources[k] = v
+		}
+	}
+	if l.Devices != nil {
+		c.Devices = make(map[string]map[string]int64, len(l.Devices))
+		for dim, counts := range l.Devices {
+			c.Devices[dim] = make(map[string]int64, len(counts))
+			for k, v := range counts {
+				c.Devices[dim][k] = v
+			}
+		}
+	}
+	return &c
+}
+
+// Deleted reports whether l is in the trash.
+func (l *Link) Deleted() bool { return l.DeletedAt != nil }
+
+// Storage persists links under their Key. Implementations must be safe
+// for concurrent use and must never hand out pointers to their internal
+// state: Get, Scan and ScanFrom return copies, and Create stores a copy
+// of its argument.
+type Storage interface {
+	// Get returns the link stored under key or ErrNotFound.
+	Get(ctx context.Context, key string) (*Link, error)
+	// Create inserts l, failing with ErrExists if its key is taken. It
+	// sets l.UpdatedAt if unset.
+	Create(ctx context.Context, l *Link) error
+	// Update atomically applies fn to the stored link, sets UpdatedAt and
+	// returns the result. If fn returns an error nothing is written and
+	// that error is returned. fn must not change the link's key.
+	Update(ctx context.Context, key string, fn func(*Link) error) (*Link, error)
+	// Delete removes key, returning ErrNotFound if it does not exist.
+	Delete(ctx context.Context, key string) error
+	// FindByURL returns every link whose destination has the same
+	// CanonicalURL as longURL, in no particular order.
+	FindByURL(ctx context.Context, longURL string) ([]*Link, error)
+	// Scan calls fn for every link until fn returns false.
+	Scan(ctx context.Context, fn func(*Link) bool) error
+	// ScanFrom calls fn, in listing order (see Position), for every link
+	// listed after the position, or every link if after is nil, until fn
+	// returns false. Backends should serve it from an index in that
+	// order, so that a page of a listing does not cost a full scan.
+	ScanFrom(ctx context.Context, after *Position, fn func(*Link) bool) error
+	Close() error
+}
+
+// Usage is a backend's estimate of what it holds.
+type Usage struct {
+	Links int64 `json:"links"`
+	// Bytes approximates the memory or disk taken by links and indexes.
+	Bytes int64 `json:"bytes"`
+}
+
+// UsageReporter is implemented by backends that can estimate their size.
+type UsageReporter interface {
+	Usage(ctx context.Context) (Usage, error)
+}
+
+// Compactor is implemented by backends that can release the space left
+// behind by deleted links.
+type Compactor interface {
+	Compact(ctx context.Context) error
+}
@@ -0,0 +1,133 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"url-shortener/bench"
+	"url-shortener/storage"
+	"url-shortener/storage/storetest"
+)
+
+func TestMemory(t *testing.T) {
+	storetest.TestStorage(t, func() storage.Storage { return storage.NewMemory() })
+}
+
+func BenchmarkMemory(b *testing.B) {
+	bench.Storage(b, func() storage.Storage { return storage.NewMemory() })
+}
+
+func TestTraced(t *testing.T) {
+	storetest.TestStorage(t, func() storage.Storage { return storage.Traced(storage.NewMemory(), "memory") })
+}
+
+func BenchmarkTraced(b *testing.B) {
+	bench.Storage(b, func() storage.Storage { return storage.Traced(storage.NewMemory(), "memory") })
+}
+
+// staticKeys is one fixed AES-256 key.
+type staticKeys struct{}
+
+func (staticKeys) Keys(context.Context) (string, map[string][]byte, error) {
+	return "k1", map[string][]byte{"k1": bytes.Repeat([]byte{7}, 32)}, nil
+}
+
+func TestEncrypted(t *testing.T) {
+	storetest.TestStorage(t, func() storage.Storage {
+		enc, err := storage.Encrypted(context.Background(), storage.NewMemory(), staticKeys{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return enc
+	})
+}
+
+// TestEncryptedAtRest checks that every encrypted field reaches the
+// wrapped backend sealed, and reads back in plain text after Create and
+// after an Update that leaves it alone.
+func TestEncryptedAtRest(t *testing.T) {
+	fields := []struct {
+		name string
+		get  func(*storage.Link) string
+	}{
+		{"long_url", func(l *storage.Link) string { return l.LongURL }},
+		{"fallback_url", func(l *storage.Link) string { return l.FallbackURL }},
+		{"destination", func(l *storage.Link) string { return l.Destinations[1].URL }},
+		{"timeline", func(l *storage.Link) string { return l.Timeline[0].URL }},
+		{"redirect_chain", func(l *storage.Link) string { return l.RedirectChain[0] }},
+		{"preview title", func(l *storage.Link) string { return l.Preview.Title }},
+		{"preview description", func(l *storage.Link) string { return l.Preview.Description }},
+		{"favicon_url", func(l *storage.Link) string { return l.Preview.FaviconURL }},
+	}
+	ctx := context.Background()
+	plain := &storage.Link{
+		ShortCode:     "secret",
+		LongURL:       "https://example.com/a",
+		FallbackURL:   "https://example.com/fallback",
+		Destinations:  []storage.Destination{{URL: "https://example.com/a"}, {URL: "https://example.com/b"}},
+		Timeline:      []storage.Swap{{URL: "https://example.com/later"}},
+		RedirectChain: []string{"https://sho.rt/x"},
+		Preview: &storage.Preview{
+			Title:       "enc: a title that looks sealed",
+			Description: "What the page says",
+			FaviconURL:  "https://example.com/favicon.ico",
+		},
+	}
+	raw := storage.NewMemory()
+	enc, err := storage.Encrypted(ctx, raw, staticKeys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Create(ctx, plain.Clone()); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := enc.Update(ctx, plain.Key(), func(l *storage.Link) error {
+		l.Clicks++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := enc.Get(ctx, plain.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := raw.Get(ctx, plain.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fields {
+		t.Run(f.name, func(t *testing.T) {
+			want := f.get(plain)
+			if v := f.get(stored); v == want || !strings.HasPrefix(v, "enc:k1:") {
+				t.Errorf("stored %q, want it sealed under k1", v)
+			}
+			if v := f.get(got); v != want {
+				t.Errorf("Get returned %q, want %q", v, want)
+			}
+			if v := f.get(updated); v != want {
+				t.Errorf("Update returned %q, want %q", v, want)
+			}
+		})
+	}
+}
+
+func BenchmarkEncrypted(b *testing.B) {
+	bench.Storage(b, func() storage.Storage {
+		enc, err := storage.Encrypted(context.Background(), storage.NewMemory(), staticKeys{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		return enc
+	})
+}
+
+func TestMirror(t *testing.T) {
+	storetest.TestStorage(t, func() storage.Storage { return storage.Mirror(storage.NewMemory(), storage.NewMemory(), nil) })
+}
+
+func TestFake(t *testing.T) {
+	storetest.TestStorage(t, func() storage.Storage { return storetest.NewFake(nil) })
+}
@@ -0,0 +1,33 @@
+package storetest
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+)
+
+const base62 = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// Codes generates short codes from a seeded source, so the same seed
+// yields the same codes on every run. It has the method set of the
+// service's code generators.
+type Codes struct {
+	mu     sync.Mutex
+	rnd    *rand.Rand
+	length int
+}
+
+// NewCodes returns a generator of length-character base62 codes.
+func NewCodes(seed int64, length int) *Codes {
+	return &Codes{rnd: rand.New(rand.NewSource(seed)), length: length}
+}
+
+func (c *Codes) Next(context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := make([]byte, c.length)
+	for i := range b {
+		b[i] = base62[c.rnd.Intn(len(base62))]
+	}
+	return string(b), nil
+}
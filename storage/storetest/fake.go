@@ -0,0 +1,237 @@
+// Package storetest provides deterministic fixtures for tests of code
+// built on package storage: a fake backend driven by a controllable
+// clock, a seeded code generator, helpers for exercising HTTP handlers
+// with httptest, and a suite checking any backend against the Storage
+// contract.
+package storetest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"url-shortener/storage"
+)
+
+// Clock is a manually advanced time source. Its zero value starts at the
+// Unix epoch; it is safe for concurrent use.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a clock standing at start.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start.UTC()}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.now.IsZero() {
+		c.now = time.Unix(0, 0).UTC()
+	}
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to t.
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t.UTC()
+}
+
+// Operations that Fake.Fail can make fail.
+const (
+	OpGet       = "get"
+	OpCreate    = "create"
+	OpUpdate    = "update"
+	OpDelete    = "delete"
+	OpFindByURL = "find_by_url"
+	OpScan      = "scan"
+)
+
+// Fake is an in-memory storage.Storage for tests. Unlike storage.Memory
+// it is deterministic: UpdatedAt comes from its Clock and Scan visits
+// links in key order. Errors can be injected per operation.
+type Fake struct {
+	Clock *Clock
+
+	mu    sync.Mutex
+	data  map[string]*storage.Link
+	fails map[string][]error
+}
+
+// NewFake returns an empty fake backend using clock, or a new clock at
+// the Unix epoch if clock is nil.
+func NewFake(clock *Clock) *Fake {
+	if clock == nil {
+		clock = &Clock{}
+	}
+	return &Fake{Clock: clock, data: make(map[string]*storage.Link), fails: make(map[string][]error)}
+}
+
+// Fail makes the next call of op return err, after any failures already
+// queued for it.
+func (f *Fake) Fail(op string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fails[op] = append(f.fails[op], err)
+}
+
+// failure pops the next injected error for op; callers hold mu.
+func (f *Fake) failure(op string) error {
+	q := f.fails[op]
+	if len(q) == 0 {
+		return nil
+	}
+	f.fails[op] = q[1:]
+	return q[0]
+}
+
+// Len returns the number of stored links.
+func (f *Fake) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.data)
+}
+
+// Put stores l as is, replacing any link under its key, without stamping
+// UpdatedAt: for seeding a test with links in a given state.
+func (f *Fake) Put(l *storage.Link) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data[l.Key()] = l.Clone()
+}
+
+func (f *Fake) Get(_ context.Context, key string) (*storage.Link, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure(OpGet); err != nil {
+		return nil, err
+	}
+	l, ok := f.data[key]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return l.Clone(), nil
+}
+
+func (f *Fake) Create(_ context.Context, l *storage.Link) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure(OpCreate); err != nil {
+		return err
+	}
+	if _, exists := f.data[l.Key()]; exists {
+		return storage.ErrExists
+	}
+	if l.UpdatedAt.IsZero() {
+		l.UpdatedAt = f.Clock.Now()
+	}
+	f.data[l.Key()] = l.Clone()
+	return nil
+}
+
+func (f *Fake) Update(_ context.Context, key string, fn func(*storage.Link) error) (*storage.Link, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure(OpUpdate); err != nil {
+		return nil, err
+	}
+	l, ok := f.data[key]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	c := l.Clone()
+	if err := fn(c); err != nil {
+		return nil, err
+	}
+	c.UpdatedAt = f.Clock.Now()
+	f.data[key] = c
+	return c.Clone(), nil
+}
+
+func (f *Fake) Delete(_ context.Context, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure(OpDelete); err != nil {
+		return err
+	}
+	if _, ok := f.data[key]; !ok {
+		return storage.ErrNotFound
+	}
+	delete(f.data, key)
+	return nil
+}
+
+// FindByURL returns its matches in key order.
+func (f *Fake) FindByURL(ctx context.Context, longURL string) ([]*storage.Link, error) {
+	f.mu.Lock()
+	err := f.failure(OpFindByURL)
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	want := storage.CanonicalURL(longURL)
+	out := []*storage.Link{}
+	err = f.scan(ctx, func(l *storage.Link) bool {
+		if storage.CanonicalURL(l.LongURL) == want {
+			out = append(out, l)
+		}
+		return true
+	})
+	return out, err
+}
+
+// Scan visits links in key order. Like storage.Memory it works on a
+// snapshot, so fn may call back into the fake.
+func (f *Fake) Scan(ctx context.Context, fn func(*storage.Link) bool) error {
+	f.mu.Lock()
+	err := f.failure(OpScan)
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return f.scan(ctx, fn)
+}
+
+func (f *Fake) scan(ctx context.Context, fn func(*storage.Link) bool) error {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.data))
+	for k := range f.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	links := make([]*storage.Link, len(keys))
+	for i, k := range keys {
+		links[i] = f.data[k].Clone()
+	}
+	f.mu.Unlock()
+	for _, l := range links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !fn(l) {
+			break
+		}
+	}
+	return nil
+}
+
+// ScanFrom sorts a full Scan, and fails when Scan would.
+func (f *Fake) ScanFrom(ctx context.Context, after *storage.Position, fn func(*storage.Link) bool) error {
+	return storage.ScanSorted(ctx, f, after, fn)
+}
+
+func (f *Fake) Close() error { return nil }
+
+var _ storage.Storage = (*Fake)(nil)
@@ -0,0 +1,75 @@
+package storetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Request describes one call of a handler.
+type Request struct {
+	Method string
+	Path   string
+	// Body is sent as JSON unless it is a string or []byte.
+	Body   interface{}
+	Header http.Header
+	// APIKey, if set, is sent as a bearer token.
+	APIKey string
+}
+
+// Do serves req with h and returns the recorded response. Failing to
+// build the request fails the test.
+func Do(t testing.TB, h http.Handler, req Request) *httptest.ResponseRecorder {
+	t.Helper()
+	var body io.Reader
+	switch b := req.Body.(type) {
+	case nil:
+	case string:
+		body = bytes.NewBufferString(b)
+	case []byte:
+		body = bytes.NewReader(b)
+	default:
+		raw, err := json.Marshal(b)
+		if err != nil {
+			t.Fatalf("encoding request body: %v", err)
+		}
+		body = bytes.NewReader(raw)
+	}
+	method := req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	r := httptest.NewRequest(method, req.Path, body)
+	for k, vs := range req.Header {
+		for _, v := range vs {
+			r.Header.Add(k, v)
+		}
+	}
+	if body != nil && r.Header.Get("Content-Type") == "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if req.APIKey != "" {
+		r.Header.Set("Authorization", "Bearer "+req.APIKey)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+// DecodeJSON fails the test unless rec has status want and a JSON body,
+// which it decodes into v (if v is not nil).
+func DecodeJSON(t testing.TB, rec *httptest.ResponseRecorder, want int, v interface{}) {
+	t.Helper()
+	if rec.Code != want {
+		t.Fatalf("status = %d, want %d; body: %s", rec.Code, want, rec.Body.String())
+	}
+	if v == nil {
+		return
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding response: %v; body: %s", err, rec.Body.String())
+	}
+}
@@ -0,0 +1,308 @@
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"url-shortener/storage"
+)
+
+// TestStorage checks a backend against the storage.Storage contract.
+// newStorage must return an empty backend on every call; TestStorage
+// closes it. Call it from a test of the backend's own package:
+//
+//	func TestMemory(t *testing.T) {
+//		storetest.TestStorage(t, func() storage.Storage { return storage.NewMemory() })
+//	}
+func TestStorage(t *testing.T, newStorage func() storage.Storage) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, storage.Storage)
+	}{
+		{"CreateGet", testCreateGet},
+		{"CreateExists", testCreateExists},
+		{"Update", testUpdate},
+		{"UpdateError", testUpdateError},
+		{"Delete", testDelete},
+		{"FindByURL", testFindByURL},
+		{"Scan", testScan},
+		{"ScanFrom", testScanFrom},
+		{"ScanFromChanges", testScanFromChanges},
+		{"Copies", testCopies},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStorage()
+			defer s.Close()
+			tt.fn(t, s)
+		})
+	}
+}
+
+// newLink returns a link to seed a backend with.
+func newLink(tenant, code, longURL string) *storage.Link {
+	now := time.Now().UTC().Truncate(time.Second)
+	return &storage.Link{
+		LongURL:   longURL,
+		ShortCode: code,
+		Tenant:    tenant,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+		Metadata:  map[string]string{"k": "v"},
+	}
+}
+
+func mustCreate(t *testing.T, s storage.Storage, l *storage.Link) {
+	t.Helper()
+	if err := s.Create(context.Background(), l); err != nil {
+		t.Fatalf("Create(%s): %v", l.Key(), err)
+	}
+}
+
+func testCreateGet(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	l := newLink("", "abc", "https://example.com/a")
+	mustCreate(t, s, l)
+	if l.UpdatedAt.IsZero() {
+		t.Error("Create did not set UpdatedAt")
+	}
+	got, err := s.Get(ctx, l.Key())
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got.LongURL != l.LongURL || got.ShortCode != l.ShortCode || got.Metadata["k"] != "v" {
+		t.Errorf("Get = %+v, want %+v", got, l)
+	}
+	if _, err := s.Get(ctx, "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Get(missing) error = %v, want ErrNotFound", err)
+	}
+	// The same code in another tenant is another link.
+	mustCreate(t, s, newLink("acme", "abc", "https://example.com/b"))
+}
+
+func testCreateExists(t *testing.T, s storage.Storage) {
+	mustCreate(t, s, newLink("", "abc", "https://example.com/a"))
+	err := s.Create(context.Background(), newLink("", "abc", "https://example.com/b"))
+	if !errors.Is(err, storage.ErrExists) {
+		t.Errorf("second Create error = %v, want ErrExists", err)
+	}
+}
+
+func testUpdate(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	l := newLink("", "abc", "https://example.com/a")
+	mustCreate(t, s, l)
+	got, err := s.Update(ctx, l.Key(), func(l *storage.Link) error {
+		l.Clicks = 7
+		l.LongURL = "https://example.com/new"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if got.Clicks != 7 || got.UpdatedAt.Before(l.UpdatedAt) {
+		t.Errorf("Update returned %+v", got)
+	}
+	if got, _ := s.Get(ctx, l.Key()); got == nil || got.Clicks != 7 {
+		t.Errorf("Get after Update = %+v, want 7 clicks", got)
+	}
+	if found, _ := s.FindByURL(ctx, "https://example.com/new"); len(found) != 1 {
+		t.Errorf("FindByURL(new destination) found %d links, want 1", len(found))
+	}
+	if _, err := s.Update(ctx, "missing", func(*storage.Link) error { return nil }); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Update(missing) error = %v, want ErrNotFound", err)
+	}
+}
+
+func testUpdateError(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	l := newLink("", "abc", "https://example.com/a")
+	mustCreate(t, s, l)
+	boom := errors.New("boom")
+	_, err := s.Update(ctx, l.Key(), func(l *storage.Link) error {
+		l.Clicks = 7
+		return boom
+	})
+	if !errors.Is(err, boom) {
+		t.Errorf("Update error = %v, want fn's error", err)
+	}
+	if got, _ := s.Get(ctx, l.Key()); got == nil || got.Clicks != 0 {
+		t.Errorf("failed Update was written: %+v", got)
+	}
+}
+
+func testDelete(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	l := newLink("", "abc", "https://example.com/a")
+	mustCreate(t, s, l)
+	if err := s.Delete(ctx, l.Key()); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Get(ctx, l.Key()); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("Get after Delete error = %v, want ErrNotFound", err)
+	}
+	if err := s.Delete(ctx, l.Key()); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("second Delete error = %v, want ErrNotFound", err)
+	}
+	if found, _ := s.FindByURL(ctx, l.LongURL); len(found) != 0 {
+		t.Errorf("FindByURL after Delete found %d links", len(found))
+	}
+}
+
+func testFindByURL(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	mustCreate(t, s, newLink("", "a", "https://Example.com/x"))
+	mustCreate(t, s, newLink("acme", "b", "https://example.com/x"))
+	mustCreate(t, s, newLink("", "c", "https://example.com/y"))
+	found, err := s.FindByURL(ctx, "https://example.com/x")
+	if err != nil {
+		t.Fatalf("FindByURL: %v", err)
+	}
+	if len(found) != 2 {
+		t.Errorf("FindByURL found %d links, want 2", len(found))
+	}
+}
+
+func testScan(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	for _, code := range []string{"a", "b", "c"} {
+		mustCreate(t, s, newLink("", code, "https://example.com/"+code))
+	}
+	seen := map[string]bool{}
+	if err := s.Scan(ctx, func(l *storage.Link) bool { seen[l.ShortCode] = true; return true }); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if len(seen) != 3 {
+		t.Errorf("Scan visited %v, want a, b and c", seen)
+	}
+	n := 0
+	_ = s.Scan(ctx, func(*storage.Link) bool { n++; return false })
+	if n != 1 {
+		t.Errorf("Scan went on after fn returned false: %d calls", n)
+	}
+}
+
+// scanFrom returns the keys ScanFrom visits after the position, at
+// most limit of them (all if limit is 0).
+func scanFrom(t *testing.T, s storage.Storage, after *storage.Position, limit int) []string {
+	t.Helper()
+	keys := []string{}
+	err := s.ScanFrom(context.Background(), after, func(l *storage.Link) bool {
+		keys = append(keys, l.Key())
+		return limit == 0 || len(keys) < limit
+	})
+	if err != nil {
+		t.Fatalf("ScanFrom: %v", err)
+	}
+	return keys
+}
+
+func testScanFrom(t *testing.T, s storage.Storage) {
+	// More links than any backend reads per batch, created out of order
+	// and with CreatedAt ties, a few deleted and one recreated as it was.
+	const n = 600
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	want := map[string]storage.Position{}
+	for i := 0; i < n; i++ {
+		j := i * 7919 % n
+		l := newLink("", fmt.Sprintf("c%03d", j), "https://example.com/")
+		l.CreatedAt = base.Add(time.Duration(j/3) * time.Second)
+		mustCreate(t, s, l)
+		want[l.Key()] = storage.PositionOf(l)
+	}
+	ctx := context.Background()
+	for _, code := range []string{"c010", "c011", "c299", "c599"} {
+		if err := s.Delete(ctx, code); err != nil {
+			t.Fatalf("Delete(%s): %v", code, err)
+		}
+		delete(want, code)
+	}
+	again := newLink("", "c011", "https://example.com/")
+	again.CreatedAt = base.Add(3 * time.Second)
+	mustCreate(t, s, again)
+	want["c011"] = storage.PositionOf(again)
+
+	var order []string
+	for key := range want {
+		order = append(order, key)
+	}
+	sort.Slice(order, func(i, j int) bool { return want[order[i]].Before(want[order[j]]) })
+
+	if got := scanFrom(t, s, nil, 0); !reflect.DeepEqual(got, order) {
+		t.Fatalf("ScanFrom(nil) visited %d links out of order:\n got %v\nwant %v", len(got), got, order)
+	}
+	for _, i := range []int{0, 1, 2, 250, 500, len(order) - 2, len(order) - 1} {
+		after := want[order[i]]
+		if got := scanFrom(t, s, &after, 0); !reflect.DeepEqual(got, order[i+1:]) {
+			t.Errorf("ScanFrom(after %s) = %v, want %v", order[i], got, order[i+1:])
+		}
+	}
+	if got := scanFrom(t, s, nil, 3); !reflect.DeepEqual(got, order[:3]) {
+		t.Errorf("ScanFrom stopping after 3 visited %v, want %v", got, order[:3])
+	}
+}
+
+// testScanFromChanges resumes a scan, as a paged listing does, after the
+// store changed: from the position of a link deleted since, and with
+// links created both before and after the cursor in listing order.
+func testScanFromChanges(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	create := func(code string, minutes int) storage.Position {
+		l := newLink("", code, "https://example.com/"+code)
+		l.CreatedAt = base.Add(time.Duration(minutes) * time.Minute)
+		mustCreate(t, s, l)
+		return storage.PositionOf(l)
+	}
+	create("a", 5)
+	cursor := create("b", 4)
+	create("c", 3)
+	create("d", 2)
+	create("e", 1)
+
+	if err := s.Delete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "d"); err != nil {
+		t.Fatal(err)
+	}
+	create("newer", 10) // listed before the cursor: not on later pages
+	create("tie", 4)    // same CreatedAt as b, listed after it by key
+	create("older", 0)
+	if got, want := scanFrom(t, s, &cursor, 0), []string{"tie", "c", "e", "older"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ScanFrom after deleted b = %v, want %v", got, want)
+	}
+
+	// A link whose CreatedAt changes moves to its new place.
+	if _, err := s.Update(ctx, "a", func(l *storage.Link) error {
+		l.CreatedAt = base
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := scanFrom(t, s, nil, 0), []string{"newer", "tie", "c", "e", "a", "older"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ScanFrom after moving a = %v, want %v", got, want)
+	}
+}
+
+func testCopies(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	l := newLink("", "abc", "https://example.com/a")
+	mustCreate(t, s, l)
+	l.Metadata["k"] = "changed after Create"
+	got, _ := s.Get(ctx, l.Key())
+	if got == nil || got.Metadata["k"] != "v" {
+		t.Fatalf("Create kept a reference to its argument: %+v", got)
+	}
+	got.Metadata["k"] = "changed after Get"
+	_ = s.Scan(ctx, func(l *storage.Link) bool { l.Metadata["k"] = "changed in Scan"; return true })
+	_ = s.ScanFrom(ctx, nil, func(l *storage.Link) bool { l.Metadata["k"] = "changed in ScanFrom"; return true })
+	if again, _ := s.Get(ctx, l.Key()); again == nil || again.Metadata["k"] != "v" {
+		t.Errorf("Get, Scan or ScanFrom handed out stored state: %+v", again)
+	}
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("url-shortener/storage")
+
+// Traced wraps s so that every call is recorded as a child span of the
+// caller's context.
+func Traced(s Storage, backend string) Storage {
+	return &traced{next: s, backend: attribute.String("storage.backend", backend)}
+}
+
+type traced struct {
+	next    Storage
+	backend attribute.KeyValue
+}
+
+func (t *traced) start(ctx context.Context, op, key string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{t.backend}
+	if key != "" {
+		attrs = append(attrs, attribute.String("storage.key", key))
+	}
+	return tracer.Start(ctx, "storage."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func end(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (t *traced) Get(ctx context.Context, key string) (*Link, error) {
+	ctx, span := t.start(ctx, "Get", key)
+	l, err := t.next.Get(ctx, key)
+	end(span, err)
+	return l, err
+}
+
+func (t *traced) Create(ctx context.Context, l *Link) error {
+	ctx, span := t.start(ctx, "Create", l.Key())
+	err := t.next.Create(ctx, l)
+	end(span, err)
+	return err
+}
+
+func (t *traced) Update(ctx context.Context, key string, fn func(*Link) error) (*Link, error) {
+	ctx, span := t.start(ctx, "Update", key)
+	l, err := t.next.Update(ctx, key, fn)
+	end(span, err)
+	return l, err
+}
+
+func (t *traced) Delete(ctx context.Context, key string) error {
+	ctx, span := t.start(ctx, "Delete", key)
+	err := t.next.Delete(ctx, key)
+	end(span, err)
+	return err
+}
+
+func (t *traced) FindByURL(ctx context.Context, longURL string) ([]*Link, error) {
+	ctx, span := t.start(ctx, "FindByURL", "")
+	links, err := t.next.FindByURL(ctx, longURL)
+	end(span, err)
+	return links, err
+}
+
+func (t *traced) Scan(ctx context.Context, fn func(*Link) bool) error {
+	ctx, span := t.start(ctx, "Scan", "")
+	err := t.next.Scan(ctx, fn)
+	end(span, err)
+	return err
+}
+
+func (t *traced) ScanFrom(ctx context.Context, after *Position, fn func(*Link) bool) error {
+	ctx, span := t.start(ctx, "ScanFrom", "")
+	err := t.next.ScanFrom(ctx, after, fn)
+	end(span, err)
+	return err
+}
+
+// Usage and Compact pass through to backends that support them.
+func (t *traced) Usage(ctx context.Context) (Usage, error) {
+	u, ok := t.next.(UsageReporter)
+	if !ok {
+		return Usage{}, ErrUnsupported
+	}
+	return u.Usage(ctx)
+}
+
+func (t *traced) Compact(ctx context.Context) error {
+	c, ok := t.next.(Compactor)
+	if !ok {
+		return ErrUnsupported
+	}
+	ctx, span := t.start(ctx, "Compact", "")
+	err := c.Compact(ctx)
+	end(span, err)
+	return err
+}
+
+func (t *traced) Close() error { return t.next.Close() }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/storage"
+)
+
+// StorageReport describes what this instance holds. Links live in the
+// instance's own backend, so each replica reports its own numbers.
+type StorageReport struct {
+	Links    int64 `json:"links"`
+	Drafts   int64 `json:"drafts"`
+	Trashed  int64 `json:"trashed"`
+	Reserved int64 `json:"reserved"`
+	// Expired links and trashed ones past their grace period are still
+	// held until the next sweep.
+	Expired   int64 `json:"expired_unpurged"`
+	Purgeable int64 `json:"purgeable"`
+
+	// EstimatedBytes is the backend's own estimate, absent if it cannot
+	// make one.
+	EstimatedBytes *int64       `json:"estimated_bytes,omitempty"`
+	Heap           heapReport   `json:"heap"`
+	Lookups        lookupReport `json:"lookups"`
+	PendingClicks  int64        `json:"pending_clicks"`
+	GeneratedAt    time.Time    `json:"generated_at"`
+}
+
+type heapReport struct {
+	AllocBytes    uint64 `json:"alloc_bytes"`
+	InuseBytes    uint64 `json:"inuse_bytes"`
+	SysBytes      uint64 `json:"sys_bytes"`
+	ReleasedBytes uint64 `json:"released_bytes"`
+	Objects       uint64 `json:"objects"`
+	NumGC         uint32 `json:"num_gc"`
+}
+
+// lookupReport counts link reads since start. There is no cache in front
+// of the backend, so a hit is a code that resolved to a live link.
+type lookupReport struct {
+	Total   int64   `json:"total"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+// StorageReport scans the backend once to build the report.
+func (s *Store) StorageReport(ctx context.Context) (*StorageReport, error) {
+	now := s.now()
+	rep := &StorageReport{GeneratedAt: now, PendingClicks: s.batch.PendingTotal()}
+	err := s.backend.Scan(ctx, func(l *Link) bool {
+		rep.Links++
+		switch {
+		case now.After(l.ExpiresAt):
+			rep.Expired++
+		case s.purgeable(l, now):
+			rep.Purgeable++
+		}
+		if l.Deleted() {
+			rep.Trashed++
+		}
+		if l.Draft {
+			rep.Drafts++
+		}
+		if l.Reserved {
+			rep.Reserved++
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if u, ok := s.backend.(storage.UsageReporter); ok {
+		usage, err := u.Usage(ctx)
+		switch {
+		case err == nil:
+			rep.EstimatedBytes = &usage.Bytes
+		case !errors.Is(err, storage.ErrUnsupported):
+			return nil, err
+		}
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	rep.Heap = heapReport{
+		AllocBytes:    ms.HeapAlloc,
+		InuseBytes:    ms.HeapInuse,
+		SysBytes:      ms.Sys,
+		ReleasedBytes: ms.HeapReleased,
+		Objects:       ms.HeapObjects,
+		NumGC:         ms.NumGC,
+	}
+	rep.Lookups.Total = metricLookups.Value()
+	rep.Lookups.Misses = metricLookupMisses.Value()
+	if rep.Lookups.Total > 0 {
+		rep.Lookups.HitRate = float64(rep.Lookups.Total-rep.Lookups.Misses) / float64(rep.Lookups.Total)
+	}
+	return rep, nil
+}
+
+// storageHandler serves GET /api/admin/storage.
+func storageHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rep, err := store.StorageReport(r.Context())
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, rep)
+	}
+}
+
+type compactResponse struct {
+	Expired   int            `json:"expired_removed"`
+	Purged    int            `json:"purged"`
+	Compacted bool           `json:"compacted"`
+	Duration  string         `json:"duration"`
+	Storage   *StorageReport `json:"storage"`
+}
+
+// compactStorageHandler serves POST /api/admin/storage/compact: it runs
+// the expiry sweep now, if this instance is one that sweeps, instead of
+// waiting for CLEANUP_INTERVAL, then lets the backend release the space,
+// if it can.
+func compactStorageHandler(store *Store, elector Elector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		resp := compactResponse{}
+		resp.Expired, resp.Purged = store.cleanup(r.Context(), elector)
+		if c, ok := store.backend.(storage.Compactor); ok {
+			err := c.Compact(r.Context())
+			if err != nil && !errors.Is(err, storage.ErrUnsupported) {
+				writeAPIError(w, r, apiErrorFrom(err))
+				return
+			}
+			resp.Compacted = err == nil
+		}
+		resp.Duration = time.Since(start).String()
+		rep, err := store.StorageReport(r.Context())
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		resp.Storage = rep
+		logrus.WithFields(logrus.Fields{
+			"action":          "compact_storage",
+			"expired_removed": resp.Expired,
+			"purged":          resp.Purged,
+			"compacted":       resp.Compacted,
+			"duration":        resp.Duration,
+		}).Info("storage compacted")
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// snapshotAdjust folds clicks still waiting for a batch flush into each
+// exported link. Shared Redis counters are not part of a snapshot: they
+// stay where they are for the instances that use them.
+func (s *Store) snapshotAdjust(l *Link) {
+	l.Clicks += s.batch.Pending(l.Key())
+}
+
+// snapshotHandler serves GET /api/admin/storage/snapshot: every link this
+// instance holds, as newline-delimited JSON, for cmd/migrate-store.
+func snapshotHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Cache-Control", "no-store")
+		n, err := storage.WriteSnapshot(r.Context(), w, store.backend, store.snapshotAdjust)
+		if err != nil {
+			// Headers are gone; a short body is all the client will see.
+			logrus.WithError(err).Error("writing storage snapshot failed")
+			return
+		}
+		logrus.WithFields(logrus.Fields{"action": "export_snapshot", "links": n}).Info("storage snapshot exported")
+	}
+}
+
+// loadSnapshotHandler serves POST /api/admin/storage/snapshot, loading a
+// snapshot into this instance. Existing codes are kept unless
+// ?overwrite=true, which makes this instance a copy of the snapshot:
+// links it lacks are deleted and click counts never go down. The body is
+// limited by SNAPSHOT_MAX_BYTES rather than MAX_BODY_BYTES.
+func loadSnapshotHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		overwrite, _ := strconv.ParseBool(r.URL.Query().Get("overwrite"))
+		res, err := storage.LoadSnapshot(r.Context(), r.Body, store.backend, overwrite, nil)
+		store.aliases.rebuild(r.Context(), store.backend)
+		if err != nil {
+			e := newAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				e = newAPIError(http.StatusRequestEntityTooLarge, ErrCodeBodyTooLarge,
+					fmt.Sprintf("snapshot must not exceed %d bytes; raise SNAPSHOT_MAX_BYTES", maxErr.Limit))
+			}
+			e.Details = map[string]interface{}{
+				"created": res.Created, "overwritten": res.Overwritten, "skipped": res.Skipped, "deleted": res.Deleted,
+			}
+			writeAPIError(w, r, e)
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"action":      "load_snapshot",
+			"created":     res.Created,
+			"overwritten": res.Overwritten,
+			"skipped":     res.Skipped,
+			"deleted":     res.Deleted,
+		}).Info("storage snapshot loaded")
+		writeJSON(w, http.StatusOK, res)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSuggestions = 5
+	maxSuggestions     = 20
+	maxSlugWords       = 4
+	maxSlugLength      = 32
+	maxTitleBytes      = 64 << 10 // of a page read looking for its <title>
+)
+
+var (
+	titleRe    = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	nonSlugRe  = regexp.MustCompile(`[^a-z0-9]+`)
+	titleFetch = newOutboundClient(3 * time.Second)
+)
+
+// suggestHandler serves GET /api/suggest?url=...&count=N with available,
+// human-friendly custom codes derived from the page title or URL path.
+func suggestHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		target := q.Get("url")
+		u, err := url.ParseRequestURI(target)
+		if target == "" || err != nil {
+			e := fieldError("url", "url must be an absolute URL")
+			e.Code = ErrCodeInvalidURL
+			writeAPIError(w, r, e)
+			return
+		}
+		count := defaultSuggestions
+		if c := q.Get("count"); c != "" {
+			n, err := strconv.Atoi(c)
+			if err != nil || n < 1 || n > maxSuggestions {
+				writeAPIError(w, r, fieldError("count", "count must be an integer between 1 and "+strconv.Itoa(maxSuggestions)))
+				return
+			}
+			count = n
+		}
+
+		base := slugify(fetchTitle(r.Context(), target))
+		if base == "" {
+			base = slugify(strings.TrimSuffix(path.Base(u.Path), path.Ext(u.Path)))
+		}
+		if base == "" {
+			base = slugify(strings.TrimPrefix(u.Hostname(), "www."))
+		}
+		if base == "" {
+			base = "link"
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"url":         target,
+			"suggestions": store.availableCodes(r.Context(), base, count),
+		})
+	}
+}
+
+// availableCodes returns up to n free codes built from base: the slug
+// itself, a shortened form, then numbered variants.
+func (s *Store) availableCodes(ctx context.Context, base string, n int) []string {
+	candidates := []string{base}
+	if words := strings.Split(base, "-"); len(words) > 2 {
+		candidates = append(candidates, strings.Join(words[:2], "-"))
+	}
+	out := make([]string, 0, n)
+	seen := make(map[string]bool)
+	try := func(c string) {
+		if len(out) < n && !seen[c] {
+			seen[c] = true
+			if !s.filter.Blocked(c) && !s.exists(ctx, c) {
+				out = append(out, c)
+			}
+		}
+	}
+	for _, c := range candidates {
+		try(c)
+	}
+	for i := 2; len(out) < n && i < 1000; i++ {
+		try(base + "-" + strconv.Itoa(i))
+	}
+	return out
+}
+
+// fetchTitle best-effort reads the <title> of an HTML page, returning "" on
+// any failure so callers fall back to the URL.
+func fetchTitle(ctx context.Context, target string) string {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return ""
+	}
+	resp, err := titleFetch.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return ""
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxTitleBytes))
+	m := titleRe.FindSubmatch(body)
+	if m == nil {
+		return ""
+	}
+	return html.UnescapeString(string(m[1]))
+}
+
+// slugify turns "Summer Sale | Acme" into "summer-sale-acme", keeping at
+// most maxSlugWords words and maxSlugLength bytes.
+func slugify(s string) string {
+	words := strings.Fields(nonSlugRe.ReplaceAllString(strings.ToLower(s), " "))
+	if len(words) > maxSlugWords {
+		words = words[:maxSlugWords]
+	}
+	slug := strings.Join(words, "-")
+	if len(slug) > maxSlugLength {
+		slug = strings.TrimRight(slug[:maxSlugLength], "-")
+	}
+	return slug
+}
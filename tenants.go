@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/storage"
+)
+
+var (
+	ErrTenantNotFound = errors.New("tenant not found")
+	ErrTenantExists   = errors.New("tenant already exists")
+	ErrTenantDomain   = errors.New("domain is already claimed by another tenant")
+)
+
+var tenantIDRe = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// Tenant is an organisation sharing the service. Each tenant has its own
+// code namespace, shared by all of its Domains; its links only redirect
+// on those domains. Its API keys are the API_KEYS entries written
+// tenant/owner:key.
+type Tenant struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Domains   []string  `json:"domains,omitempty"`
+	Quota     Quota     `json:"quota"` // caps the tenant as a whole; zero fields are unlimited
+	Suspended bool      `json:"suspended"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// DomainPolicy limits the destinations its links may have; nil falls
+	// back to DESTINATION_POLICY.
+	DomainPolicy *DomainPolicy `json:"domain_policy,omitempty"`
+	// Notifications are the channels for owners in the tenant who have
+	// not set up their own.
+	Notifications *NotificationChannels `json:"notifications,omitempty"`
+	// Messages override the texts of visitor-facing pages, by language
+	// tag and text key, e.g. {"de": {"expired.title": "Abgelaufen"}}.
+	// Languages not bundled are offered to visitors too.
+	Messages map[string]map[string]string `json:"messages,omitempty"`
+	// Interstitial is shown before the redirect of every link in the
+	// tenant that has none of its own.
+	Interstitial *storage.Interstitial `json:"interstitial,omitempty"`
+}
+
+// Tenants is the in-memory tenant registry.
+type Tenants struct {
+	mu     sync.RWMutex
+	byID   map[string]*Tenant
+	byHost map[string]string
+}
+
+func NewTenants() *Tenants {
+	return &Tenants{byID: make(map[string]*Tenant), byHost: make(map[string]string)}
+}
+
+func (ts *Tenants) Create(t Tenant) (*Tenant, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if _, exists := ts.byID[t.ID]; exists {
+		return nil, ErrTenantExists
+	}
+	if err := ts.claimDomains(t.ID, t.Domains); err != nil {
+		return nil, err
+	}
+	t.CreatedAt = time.Now().UTC()
+	ts.byID[t.ID] = &t
+	c := t
+	return &c, nil
+}
+
+// Update replaces the settings of tenant id with those of u.
+func (ts *Tenants) Update(id string, u Tenant) (*Tenant, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.byID[id]
+	if !ok {
+		return nil, ErrTenantNotFound
+	}
+	old := t.Domains
+	for _, d := range old {
+		delete(ts.byHost, d)
+	}
+	if err := ts.claimDomains(id, u.Domains); err != nil {
+		_ = ts.claimDomains(id, old)
+		return nil, err
+	}
+	t.Name, t.Domains, t.Quota, t.DomainPolicy = u.Name, u.Domains, u.Quota, u.DomainPolicy
+	t.Notifications, t.Messages, t.Interstitial = u.Notifications, u.Messages, u.Interstitial
+	c := *t
+	return &c, nil
+}
+
+// claimDomains normalises domains in place and maps them to id, claiming
+// none if any is taken. Callers hold mu for writing.
+func (ts *Tenants) claimDomains(id string, domains []string) error {
+	for i, d := range domains {
+		domains[i] = normalizeHost(d)
+		if owner, taken := ts.byHost[domains[i]]; taken && owner != id {
+			return ErrTenantDomain
+		}
+	}
+	for _, d := range domains {
+		ts.byHost[d] = id
+	}
+	return nil
+}
+
+// ensure registers id with defaults if it is not known yet.
+func (ts *Tenants) ensure(id string) {
+	if _, err := ts.Get(id); errors.Is(err, ErrTenantNotFound) {
+		_, _ = ts.Create(Tenant{ID: id})
+	}
+}
+
+func (ts *Tenants) Get(id string) (*Tenant, error) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	t, ok := ts.byID[id]
+	if !ok {
+		return nil, ErrTenantNotFound
+	}
+	c := *t
+	return &c, nil
+}
+
+func (ts *Tenants) List() []*Tenant {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	out := make([]*Tenant, 0, len(ts.byID))
+	for _, t := range ts.byID {
+		c := *t
+		out = append(out, &c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// position places tenants in order of ID: they all share the zero
+// CreatedAt, which leaves the key to decide.
+func (t *Tenant) position() storage.Position {
+	return storage.Position{Key: t.ID}
+}
+
+func (ts *Tenants) SetSuspended(id string, suspended bool) (*Tenant, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.byID[id]
+	if !ok {
+		return nil, ErrTenantNotFound
+	}
+	t.Suspended = suspended
+	c := *t
+	return &c, nil
+}
+
+// Suspended reports whether the tenant exists and is suspended.
+func (ts *Tenants) Suspended(id string) bool {
+	t, err := ts.Get(id)
+	return err == nil && t.Suspended
+}
+
+// ForHost returns the tenant serving host, or "" for the default tenant.
+func (ts *Tenants) ForHost(host string) string {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.byHost[normalizeHost(host)]
+}
+
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// tenantOf returns the tenant part of an owner written tenant/owner.
+func tenantOf(owner string) string {
+	tenant, _, ok := strings.Cut(owner, "/")
+	if !ok {
+		return ""
+	}
+	return tenant
+}
+
+// tenantFrom returns the tenant a request acts in: the API key's tenant,
+// else the tenant owning the request's host, else "".
+func tenantFrom(ctx context.Context) string {
+	t, _ := ctx.Value(tenantKey).(string)
+	return t
+}
+
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey, tenant)
+}
+
+// hostTenant resolves the tenant from the Host header so redirects look
+// codes up in the right namespace.
+func hostTenant(tenants *Tenants) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if t := tenants.ForHost(r.Host); t != "" {
+				r = r.WithContext(withTenant(r.Context(), t))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rejectSuspended answers 403 for requests acting in a suspended tenant.
+// /api/admin, /health and /version stay reachable on every host.
+func rejectSuspended(tenants *Tenants) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/health" && r.URL.Path != "/version" && !strings.HasPrefix(r.URL.Path, "/api/admin/") && tenants.Suspended(tenantFrom(r.Context())) {
+				httpError(w, r, http.StatusForbidden, ErrCodeTenantSuspended, "tenant is suspended")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// TenantStats rolls a tenant's links up into totals.
+type TenantStats struct {
+	Links       int   `json:"links"`
+	ActiveLinks int   `json:"active_links"`
+	Clicks      int64 `json:"clicks"`
+	Owners      int   `json:"owners"`
+}
+
+func (s *Store) tenantStats(ctx context.Context, tenant string) (*TenantStats, error) {
+	now := s.now()
+	st := &TenantStats{}
+	owners := make(map[string]bool)
+	var keys []string
+	err := s.backend.Scan(ctx, func(l *Link) bool {
+		if l.Tenant != tenant || l.Deleted() || l.Reserved {
+			return true
+		}
+		st.Links++
+		if now.Before(l.ExpiresAt) {
+			st.ActiveLinks++
+		}
+		if l.Owner != "" {
+			owners[l.Owner] = true
+		}
+		st.Clicks += l.Clicks
+		keys = append(keys, l.Key())
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.clicks != nil {
+		st.Clicks = 0
+		for _, k := range keys {
+			if n, err := s.clicks.Get(ctx, k); err == nil {
+				st.Clicks += n
+			}
+		}
+	}
+	st.Owners = len(owners)
+	return st, nil
+}
+
+// shortURL is the public URL of l, on its tenant's primary domain if it
+// has one.
+func (s *Store) shortURL(l *Link) string {
+	base := s.domain
+	if l.Tenant != "" && s.tenants != nil {
+		if t, err := s.tenants.Get(l.Tenant); err == nil && len(t.Domains) > 0 {
+			scheme, _, _ := strings.Cut(s.domain, "://")
+			base = scheme + "://" + t.Domains[0]
+		}
+	}
+	return base + "/" + l.ShortCode
+}
+
+// tenantName is the display name of l's tenant, or "".
+func (s *Store) tenantName(l *Link) string {
+	if l.Tenant != "" && s.tenants != nil {
+		if t, err := s.tenants.Get(l.Tenant); err == nil {
+			return t.Name
+		}
+	}
+	return ""
+}
+
+// key is the storage key for code in the request's tenant, or for the
+// link code is an alias of.
+func (s *Store) key(ctx context.Context, code string) string {
+	key := storage.Key(tenantFrom(ctx), code)
+	if target, ok := s.aliases.resolve(key); ok {
+		return target
+	}
+	return key
+}
+
+type tenantRequest struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name,omitempty"`
+	Domains []string `json:"domains,omitempty"`
+	Quota   Quota    `json:"quota"`
+
+	DomainPolicy  *DomainPolicy                `json:"domain_policy,omitempty"`
+	Notifications *NotificationChannels        `json:"notifications,omitempty"`
+	Messages      map[string]map[string]string `json:"messages,omitempty"`
+	Interstitial  *storage.Interstitial        `json:"interstitial,omitempty"`
+}
+
+func (req *tenantRequest) tenant() Tenant {
+	return Tenant{ID: req.ID, Name: req.Name, Domains: req.Domains, Quota: req.Quota, DomainPolicy: req.DomainPolicy,
+		Notifications: req.Notifications, Messages: req.Messages, Interstitial: req.Interstitial}
+}
+
+// validPolicy reports a bad domain_policy, notifications, messages or
+// interstitial as a field error. An empty interstitial is dropped.
+func (req *tenantRequest) validPolicy() *APIError {
+	if apiErr := validateMessages(req.Messages); apiErr != nil {
+		return apiErr
+	}
+	if req.Notifications != nil {
+		if apiErr := req.Notifications.validate("notifications."); apiErr != nil {
+			return apiErr
+		}
+	}
+	in, err := validateInterstitial("interstitial", req.Interstitial)
+	if err != nil {
+		return apiErrorFrom(err)
+	}
+	req.Interstitial = in
+	if req.DomainPolicy == nil {
+		return nil
+	}
+	if err := req.DomainPolicy.normalize(); err != nil {
+		return fieldError("domain_policy", "domain_policy: "+err.Error())
+	}
+	return nil
+}
+
+// createTenantHandler serves POST /api/admin/tenants.
+func createTenantHandler(tenants *Tenants) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req tenantRequest
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		if !tenantIDRe.MatchString(req.ID) {
+			writeAPIError(w, r, fieldError("id", "id must be lower-case letters, digits and dashes"))
+			return
+		}
+		if apiErr := req.validPolicy(); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		t, err := tenants.Create(req.tenant())
+		switch {
+		case errors.Is(err, ErrTenantExists):
+			writeAPIError(w, r, newAPIError(http.StatusConflict, ErrCodeConflict, err.Error()))
+			return
+		case errors.Is(err, ErrTenantDomain):
+			writeAPIError(w, r, fieldError("domains", err.Error()))
+			return
+		}
+		logrus.WithFields(logrus.Fields{"action": "create_tenant", "tenant": t.ID}).Info("tenant created")
+		writeJSON(w, http.StatusCreated, t)
+	}
+}
+
+// updateTenantHandler serves PUT /api/admin/tenants/{id}.
+func updateTenantHandler(tenants *Tenants) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req tenantRequest
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		if apiErr := req.validPolicy(); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		t, err := tenants.Update(mux.Vars(r)["id"], req.tenant())
+		if errors.Is(err, ErrTenantDomain) {
+			writeAPIError(w, r, fieldError("domains", err.Error()))
+			return
+		}
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, t)
+	}
+}
+
+// listTenantsHandler serves GET /api/admin/tenants, a page at a time in
+// order of ID.
+func listTenantsHandler(tenants *Tenants) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, after, apiErr := pageParams(r.URL.Query())
+		if apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		list, next := pageOf(tenants.List(), (*Tenant).position, storage.Position.Before, after, limit)
+		writeJSON(w, http.StatusOK, withNext(map[string]interface{}{"tenants": list}, next))
+	}
+}
+
+// tenantHandler serves GET /api/admin/tenants/{id} and, for the caller's
+// own tenant, GET /api/tenant.
+func tenantHandler(store *Store, tenants *Tenants) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, ok := mux.Vars(r)["id"]
+		if !ok {
+			id = tenantFrom(r.Context())
+		}
+		t, err := tenants.Get(id)
+		if err != nil {
+			if id != "" {
+				writeAPIError(w, r, apiErrorFrom(err))
+				return
+			}
+			t = &Tenant{} // the default tenant is never registered
+		}
+		st, err := store.tenantStats(r.Context(), id)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"tenant": t, "stats": st})
+	}
+}
+
+// suspendTenantHandler serves POST /api/admin/tenants/{id}/suspend and
+// .../resume. A suspended tenant's API keys and links answer 403.
+func suspendTenantHandler(tenants *Tenants, suspended bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, err := tenants.SetSuspended(mux.Vars(r)["id"], suspended)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"action":    "suspend_tenant",
+			"tenant":    t.ID,
+			"suspended": suspended,
+		}).Warn("tenant state changed")
+		writeJSON(w, http.StatusOK, t)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/storage"
+)
+
+// maxTimelineSwaps caps the scheduled destination changes of one link.
+const maxTimelineSwaps = 20
+
+// destinationAt is where l points at now: the URL of the latest timeline
+// entry that has come due, else LongURL.
+func destinationAt(l *Link, now time.Time) string {
+	dest := l.LongURL
+	for _, sw := range l.Timeline {
+		if now.Before(sw.At) {
+			break
+		}
+		dest = sw.URL
+	}
+	return dest
+}
+
+// validateTimeline checks a new timeline and returns it sorted. Every
+// entry must lie in the future: a change due now is a PATCH of url.
+func (s *Store) validateTimeline(ctx context.Context, swaps []storage.Swap, now time.Time) ([]storage.Swap, error) {
+	if len(swaps) > maxTimelineSwaps {
+		return nil, fieldError("timeline", "a timeline can have at most "+strconv.Itoa(maxTimelineSwaps)+" entries")
+	}
+	out := append([]storage.Swap(nil), swaps...)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].At.Before(out[j].At) })
+	for i := range out {
+		field := "timeline[" + strconv.Itoa(i) + "]"
+		sw := &out[i]
+		if _, err := url.ParseRequestURI(sw.URL); err != nil {
+			e := fieldError(field+".url", "each timeline url must be an absolute URL")
+			e.Code = ErrCodeInvalidURL
+			return nil, e
+		}
+		if err := s.checkDestination(ctx, field+".url", sw.URL); err != nil {
+			return nil, err
+		}
+		if !sw.At.After(now) {
+			return nil, fieldError(field+".at", "at must be in the future")
+		}
+		if i > 0 && sw.At.Equal(out[i-1].At) {
+			return nil, fieldError(field+".at", "two entries cannot take effect at the same time")
+		}
+		sw.At = sw.At.UTC()
+	}
+	if len(out) == 0 {
+		out = nil
+	}
+	return out, nil
+}
+
+// SetTimeline replaces the scheduled destination changes of code. Rotating
+// links pick among their destinations instead and cannot have one.
+func (s *Store) SetTimeline(ctx context.Context, code, owner string, swaps []storage.Swap) (*Link, error) {
+	timeline, err := s.validateTimeline(ctx, swaps, s.now())
+	if err != nil {
+		return nil, err
+	}
+	l, err := s.backend.Update(ctx, s.key(ctx, code), func(l *Link) error {
+		if !s.canWrite(ctx, owner, l) || l.Deleted() || l.Reserved {
+			return ErrNotFound
+		}
+		if timeline != nil && len(l.Destinations) > 0 {
+			return fieldError("timeline", "rotating links cannot have a timeline")
+		}
+		// Changes already made stay in effect.
+		l.LongURL = destinationAt(l, s.now())
+		l.Timeline = timeline
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{"action": "set_timeline", "short_code": code, "entries": len(timeline)}).Info("link timeline updated")
+	return l, nil
+}
+
+type timelineResponse struct {
+	ShortCode string         `json:"short_code"`
+	Current   string         `json:"current_url"`
+	Timeline  []storage.Swap `json:"timeline"`
+}
+
+func timelineResponseFor(l *Link, now time.Time) timelineResponse {
+	resp := timelineResponse{ShortCode: l.ShortCode, Current: destinationAt(l, now), Timeline: []storage.Swap{}}
+	for _, sw := range l.Timeline {
+		if now.Before(sw.At) {
+			resp.Timeline = append(resp.Timeline, sw)
+		}
+	}
+	return resp
+}
+
+// timelineHandler serves GET /api/links/{code}/timeline: the current
+// destination and the changes still to come.
+func timelineHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, err := store.Get(r.Context(), codeVar(r))
+		if err == nil && !store.canRead(r.Context(), ownerFrom(r.Context()), link) {
+			err = ErrNotFound
+		}
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, timelineResponseFor(link, store.now()))
+	}
+}
+
+// setTimelineHandler serves PUT /api/links/{code}/timeline with
+// {"timeline": [{"at": "2026-06-01T00:00:00Z", "url": "https://..."}]}.
+func setTimelineHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Timeline []storage.Swap `json:"timeline"`
+		}
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		link, err := store.SetTimeline(r.Context(), codeVar(r), ownerFrom(r.Context()), req.Timeline)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, timelineResponseFor(link, store.now()))
+	}
+}
+
+// clearTimelineHandler serves DELETE /api/links/{code}/timeline, cancelling
+// the changes still to come.
+func clearTimelineHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := store.SetTimeline(r.Context(), codeVar(r), ownerFrom(r.Context()), nil); err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	_ "time/tzdata" // tz names must resolve even on hosts without zoneinfo
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// seriesBucket is the resolution clicks are counted at. Fifteen minutes
+// lines up with every UTC offset in use, so buckets can be regrouped into
+// hours or days in any viewer's timezone.
+const seriesBucket = 15 * time.Minute
+
+const maxSeriesPoints = 2000
+
+// ClickSeries counts clicks per link in seriesBucket-sized UTC buckets.
+type ClickSeries interface {
+	Record(ctx context.Context, key string, at time.Time) error
+	// Range returns the bucket counts between from and to, keyed by
+	// bucket start in Unix seconds.
+	Range(ctx context.Context, key string, from, to time.Time) (map[int64]int64, error)
+	Delete(ctx context.Context, key string) error
+	// Rollup merges the buckets that start before cutoff into UTC-aligned
+	// buckets of step and returns how many buckets it removed.
+	Rollup(ctx context.Context, key string, cutoff time.Time, step time.Duration) (int, error)
+	// Prune deletes the buckets that start before cutoff and returns how
+	// many there were.
+	Prune(ctx context.Context, key string, cutoff time.Time) (int, error)
+}
+
+func bucketOf(t time.Time) int64 {
+	return t.Truncate(seriesBucket).Unix()
+}
+
+// rollupBuckets works out a Rollup of b: the buckets to delete and the
+// counts to add to the coarser buckets they merge into. Buckets already
+// aligned to step stay as they are.
+func rollupBuckets(b map[int64]int64, cutoff time.Time, step time.Duration) (del []int64, add map[int64]int64) {
+	add = make(map[int64]int64)
+	lo, n := cutoff.Unix(), int64(step/time.Second)
+	for k, c := range b {
+		if k >= lo || k%n == 0 {
+			continue
+		}
+		del = append(del, k)
+		add[k-k%n] += c
+	}
+	return del, add
+}
+
+type memorySeries struct {
+	mu        sync.Mutex
+	retention time.Duration
+	buckets   map[string]map[int64]int64
+}
+
+func newMemorySeries(retention time.Duration) *memorySeries {
+	return &memorySeries{retention: retention, buckets: make(map[string]map[int64]int64)}
+}
+
+func (m *memorySeries) Record(_ context.Context, key string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := m.buckets[key]
+	if b == nil {
+		b = make(map[int64]int64)
+		m.buckets[key] = b
+	}
+	bucket := bucketOf(at)
+	if _, ok := b[bucket]; !ok && m.retention > 0 {
+		// A new bucket is the moment to drop those past retention.
+		cutoff := bucketOf(at.Add(-m.retention))
+		for k := range b {
+			if k < cutoff {
+				delete(b, k)
+			}
+		}
+	}
+	b[bucket]++
+	return nil
+}
+
+func (m *memorySeries) Range(_ context.Context, key string, from, to time.Time) (map[int64]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[int64]int64)
+	lo, hi := bucketOf(from), to.Unix()
+	for k, n := range m.buckets[key] {
+		if k >= lo && k < hi {
+			out[k] = n
+		}
+	}
+	return out, nil
+}
+
+func (m *memorySeries) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.buckets, key)
+	return nil
+}
+
+func (m *memorySeries) Rollup(_ context.Context, key string, cutoff time.Time, step time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := m.buckets[key]
+	del, add := rollupBuckets(b, cutoff, step)
+	for _, k := range del {
+		delete(b, k)
+	}
+	for k, c := range add {
+		b[k] += c
+	}
+	return len(del), nil
+}
+
+func (m *memorySeries) Prune(_ context.Context, key string, cutoff time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for k := range m.buckets[key] {
+		if k < cutoff.Unix() {
+			delete(m.buckets[key], k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// redisSeries keeps a link's buckets in the hash prefix+"series:"+key,
+// whose expiry is pushed out to the retention on every click. A zero
+// retention keeps it until the link goes.
+type redisSeries struct {
+	client    *redis.Client
+	prefix    string
+	retention time.Duration
+}
+
+func (r *redisSeries) key(key string) string { return r.prefix + "series:" + key }
+
+func (r *redisSeries) Record(ctx context.Context, key string, at time.Time) error {
+	pipe := r.client.Pipeline()
+	pipe.HIncrBy(ctx, r.key(key), strconv.FormatInt(bucketOf(at), 10), 1)
+	if r.retention > 0 {
+		pipe.Expire(ctx, r.key(key), r.retention)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// buckets reads all of key's buckets.
+func (r *redisSeries) buckets(ctx context.Context, key string) (map[int64]int64, error) {
+	raw, err := r.client.HGetAll(ctx, r.key(key)).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[int64]int64, len(raw))
+	for f, v := range raw {
+		k, err1 := strconv.ParseInt(f, 10, 64)
+		n, err2 := strconv.ParseInt(v, 10, 64)
+		if err1 == nil && err2 == nil {
+			out[k] = n
+		}
+	}
+	return out, nil
+}
+
+func (r *redisSeries) Range(ctx context.Context, key string, from, to time.Time) (map[int64]int64, error) {
+	b, err := r.buckets(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	lo, hi := bucketOf(from), to.Unix()
+	for k := range b {
+		if k < lo || k >= hi {
+			delete(b, k)
+		}
+	}
+	return b, nil
+}
+
+func (r *redisSeries) Delete(ctx context.Context, key string) error {
+	return r.client.Del(ctx, r.key(key)).Err()
+}
+
+// Rollup rewrites the old buckets in one transaction. Clicks only ever
+// land in the current bucket, so nothing races with it.
+func (r *redisSeries) Rollup(ctx context.Context, key string, cutoff time.Time, step time.Duration) (int, error) {
+	b, err := r.buckets(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	del, add := rollupBuckets(b, cutoff, step)
+	if len(del) == 0 {
+		return 0, nil
+	}
+	pipe := r.client.TxPipeline()
+	for k, c := range add {
+		pipe.HIncrBy(ctx, r.key(key), strconv.FormatInt(k, 10), c)
+	}
+	fields := make([]string, len(del))
+	for i, k := range del {
+		fields[i] = strconv.FormatInt(k, 10)
+	}
+	pipe.HDel(ctx, r.key(key), fields...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return len(del), nil
+}
+
+func (r *redisSeries) Prune(ctx context.Context, key string, cutoff time.Time) (int, error) {
+	b, err := r.buckets(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	var fields []string
+	for k := range b {
+		if k < cutoff.Unix() {
+			fields = append(fields, strconv.FormatInt(k, 10))
+		}
+	}
+	if len(fields) == 0 {
+		return 0, nil
+	}
+	if err := r.client.HDel(ctx, r.key(key), fields...).Err(); err != nil {
+		return 0, err
+	}
+	return len(fields), nil
+}
+
+// recordSeries adds a click on l to the time series, if enabled.
+func (s *Store) recordSeries(ctx context.Context, l *Link, at time.Time) {
+	if s.series == nil {
+		return
+	}
+	if err := s.series.Record(ctx, l.Key(), at); err != nil {
+		logrus.WithError(err).WithField("short_code", l.ShortCode).Warn("recording click series failed")
+	}
+}
+
+// SeriesPoint is one interval of a time series. Start is UTC; the
+// interval itself begins at a midnight or full hour in the requested tz.
+type SeriesPoint struct {
+	Start  time.Time `json:"start"`
+	Clicks int64     `json:"clicks"`
+}
+
+type timeSeriesResponse struct {
+	ShortCode string        `json:"short_code"`
+	Interval  string        `json:"interval"`
+	TZ        string        `json:"tz"`
+	From      time.Time     `json:"from"`
+	To        time.Time     `json:"to"`
+	Total     int64         `json:"total"`
+	Points    []SeriesPoint `json:"points"`
+}
+
+// bucketStarts returns the interval boundaries in loc that cover
+// [from, to), the first one at or before from. Days follow the calendar,
+// so days across a DST change are 23 or 25 hours long.
+func bucketStarts(interval string, loc *time.Location, from, to time.Time) []time.Time {
+	lf := from.In(loc)
+	var cur time.Time
+	var next func(time.Time) time.Time
+	if interval == "day" {
+		cur = time.Date(lf.Year(), lf.Month(), lf.Day(), 0, 0, 0, 0, loc)
+		next = func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc) }
+	} else {
+		cur = time.Date(lf.Year(), lf.Month(), lf.Day(), lf.Hour(), 0, 0, 0, loc)
+		next = func(t time.Time) time.Time { return t.Add(time.Hour) }
+	}
+	var out []time.Time
+	for ; cur.Before(to); cur = next(cur) {
+		out = append(out, cur)
+	}
+	return append(out, cur)
+}
+
+// timeSeriesHandler serves GET /api/stats/{code}/timeseries: clicks per
+// hour or day (interval, default day) between from and to (RFC 3339,
+// default the last 7 days or 48 hours), with intervals aligned to the
+// IANA timezone tz (default UTC).
+func timeSeriesHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		interval := q.Get("interval")
+		switch interval {
+		case "":
+			interval = "day"
+		case "day", "hour":
+		default:
+			writeAPIError(w, r, fieldError("interval", "interval must be hour or day"))
+			return
+		}
+		tz := q.Get("tz")
+		if tz == "" {
+			tz = "UTC"
+		}
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			writeAPIError(w, r, fieldError("tz", "tz must be an IANA timezone such as Europe/Berlin"))
+			return
+		}
+		to, apiErr := parseTimeParam(q.Get("to"), "to", store.now())
+		if apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		span, step := 7*24*time.Hour, 24*time.Hour
+		if interval == "hour" {
+			span, step = 48*time.Hour, time.Hour
+		}
+		from, apiErr := parseTimeParam(q.Get("from"), "from", to.Add(-span))
+		if apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		if !from.Before(to) {
+			writeAPIError(w, r, fieldError("from", "from must be before to"))
+			return
+		}
+		if to.Sub(from) > maxSeriesPoints*step {
+			writeAPIError(w, r, fieldError("from", "the range covers more than "+strconv.Itoa(maxSeriesPoints)+" intervals"))
+			return
+		}
+		if store.series == nil {
+			httpError(w, r, http.StatusNotFound, ErrCodeNotFound, "click time series are disabled")
+			return
+		}
+		link, err := store.Get(r.Context(), codeVar(r))
+		if err == nil && !store.canRead(r.Context(), ownerFrom(r.Context()), link) {
+			err = ErrNotFound
+		}
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		starts := bucketStarts(interval, loc, from, to)
+		buckets, err := store.series.Range(r.Context(), link.Key(), starts[0], starts[len(starts)-1])
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		resp := timeSeriesResponse{
+			ShortCode: link.ShortCode,
+			Interval:  interval,
+			TZ:        loc.String(),
+			From:      from,
+			To:        to,
+			Points:    make([]SeriesPoint, 0, len(starts)-1),
+		}
+		for i := 0; i < len(starts)-1; i++ {
+			p := SeriesPoint{Start: starts[i].UTC()}
+			for b := starts[i].Unix(); b < starts[i+1].Unix(); b += int64(seriesBucket / time.Second) {
+				p.Clicks += buckets[b]
+			}
+			resp.Total += p.Clicks
+			resp.Points = append(resp.Points, p)
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// parseTimeParam reads an RFC 3339 query parameter as UTC, or def if it
+// is missing.
+func parseTimeParam(v, name string, def time.Time) (time.Time, *APIError) {
+	if v == "" {
+		return def, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fieldError(name, name+" must be an RFC 3339 timestamp")
+	}
+	return t.UTC(), nil
+}
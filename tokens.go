@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/storage"
+)
+
+// Token scopes. Keys from API_KEYS hold every scope except ScopeAdmin,
+// which only owners listed in ADMINS get.
+const (
+	ScopeLinksCreate  = "links:create"  // shorten, clone, suggest
+	ScopeLinksUpdate  = "links:update"  // patch, publish, campaigns, notification settings
+	ScopeLinksDelete  = "links:delete"  // delete and restore
+	ScopeStatsRead    = "stats:read"    // stats, lists, lookups, quota
+	ScopeTokensManage = "tokens:manage" // /api/tokens: issue, list and revoke tokens
+	ScopeAdmin        = "admin"         // /api/admin
+)
+
+var allScopes = []string{ScopeLinksCreate, ScopeLinksUpdate, ScopeLinksDelete, ScopeStatsRead, ScopeTokensManage, ScopeAdmin}
+
+// tokenPrefix marks issued tokens so they are recognisable in logs and
+// secret scanners.
+const tokenPrefix = "slt_"
+
+var ErrTokenNotFound = errors.New("token not found")
+
+// APIToken is an issued credential. Only the SHA-256 of the secret is
+// kept; the secret itself is shown once, on creation.
+type APIToken struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name,omitempty"`
+	Owner     string     `json:"owner"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Parent is the ID of the token that issued this one, or empty if a
+	// static API_KEYS key did. Revoking a token revokes its descendants.
+	Parent string `json:"parent,omitempty"`
+
+	Hash string `json:"-"`
+}
+
+func (t *APIToken) expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// TokenStore persists issued tokens.
+type TokenStore interface {
+	Save(ctx context.Context, t *APIToken) error
+	// Lookup finds the token whose secret hashes to hash.
+	Lookup(ctx context.Context, hash string) (*APIToken, error)
+	List(ctx context.Context, owner string) ([]*APIToken, error)
+	Revoke(ctx context.Context, owner, id string) error
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+type memoryTokens struct {
+	mu     sync.Mutex
+	byHash map[string]*APIToken
+}
+
+func newMemoryTokens() *memoryTokens {
+	return &memoryTokens{byHash: make(map[string]*APIToken)}
+}
+
+func (m *memoryTokens) Save(_ context.Context, t *APIToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := *t
+	m.byHash[t.Hash] = &c
+	return nil
+}
+
+func (m *memoryTokens) Lookup(_ context.Context, hash string) (*APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.byHash[hash]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+	c := *t
+	return &c, nil
+}
+
+func (m *memoryTokens) List(_ context.Context, owner string) ([]*APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []*APIToken{}
+	for _, t := range m.byHash {
+		if t.Owner == owner {
+			c := *t
+			out = append(out, &c)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryTokens) Revoke(_ context.Context, owner, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for h, t := range m.byHash {
+		if t.Owner == owner && t.ID == id {
+			delete(m.byHash, h)
+			return nil
+		}
+	}
+	return ErrTokenNotFound
+}
+
+// redisTokens keeps each token under prefix+"tokens:"+hash, expiring with
+// the token, and indexes them per owner.
+type redisTokens struct {
+	client *redis.Client
+	prefix string
+}
+
+func (r *redisTokens) key(hash string) string       { return r.prefix + "tokens:" + hash }
+func (r *redisTokens) ownerKey(owner string) string { return r.prefix + "tokens:owner:" + owner }
+
+func (r *redisTokens) Save(ctx context.Context, t *APIToken) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	var ttl time.Duration
+	if t.ExpiresAt != nil {
+		ttl = time.Until(*t.ExpiresAt)
+	}
+	pipe := r.client.TxPipeline()
+	pipe.Set(ctx, r.key(t.Hash), b, ttl)
+	pipe.SAdd(ctx, r.ownerKey(t.Owner), t.Hash)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (r *redisTokens) Lookup(ctx context.Context, hash string) (*APIToken, error) {
+	b, err := r.client.Get(ctx, r.key(hash)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var t APIToken
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, err
+	}
+	t.Hash = hash
+	return &t, nil
+}
+
+func (r *redisTokens) List(ctx context.Context, owner string) ([]*APIToken, error) {
+	hashes, err := r.client.SMembers(ctx, r.ownerKey(owner)).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := []*APIToken{}
+	for _, h := range hashes {
+		t, err := r.Lookup(ctx, h)
+		if errors.Is(err, ErrTokenNotFound) {
+			r.client.SRem(ctx, r.ownerKey(owner), h) // expired
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+func (r *redisTokens) Revoke(ctx context.Context, owner, id string) error {
+	tokens, err := r.List(ctx, owner)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if t.ID == id {
+			pipe := r.client.TxPipeline()
+			pipe.Del(ctx, r.key(t.Hash))
+			pipe.SRem(ctx, r.ownerKey(owner), t.Hash)
+			_, err := pipe.Exec(ctx)
+			return err
+		}
+	}
+	return ErrTokenNotFound
+}
+
+// keyScopes are the scopes of a static API_KEYS key.
+func keyScopes(owner string, admins map[string]bool) map[string]bool {
+	scopes := make(map[string]bool, len(allScopes))
+	for _, s := range allScopes {
+		if s != ScopeAdmin || admins[owner] {
+			scopes[s] = true
+		}
+	}
+	return scopes
+}
+
+func scopeSet(list []string) map[string]bool {
+	set := make(map[string]bool, len(list))
+	for _, s := range list {
+		set[s] = true
+	}
+	return set
+}
+
+// hasScope reports whether the caller holds scope. Without authentication
+// everything is allowed.
+func hasScope(ctx context.Context, scope string) bool {
+	scopes, ok := ctx.Value(scopesKey).(map[string]bool)
+	return !ok || scopes[scope]
+}
+
+// requireScope guards a single route.
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasScope(r.Context(), scope) {
+			httpError(w, r, http.StatusForbidden, ErrCodeForbidden, "token lacks the "+scope+" scope")
+			return
+		}
+		next(w, r)
+	}
+}
+
+type createTokenRequest struct {
+	Name      string   `json:"name,omitempty"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int64    `json:"expires_in_seconds,omitempty"`
+}
+
+// createTokenHandler serves POST /api/tokens. A caller can only hand out
+// scopes it holds itself, and a token cannot mint one that outlives it.
+func createTokenHandler(tokens TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner := ownerFrom(r.Context())
+		if owner == "" {
+			httpError(w, r, http.StatusBadRequest, ErrCodeInvalidRequest, "tokens require authentication to be enabled")
+			return
+		}
+		var req createTokenRequest
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		if len(req.Scopes) == 0 {
+			writeAPIError(w, r, fieldError("scopes", "at least one scope is required"))
+			return
+		}
+		known := scopeSet(allScopes)
+		for _, s := range req.Scopes {
+			if !known[s] {
+				writeAPIError(w, r, fieldError("scopes", "unknown scope "+s))
+				return
+			}
+			if !hasScope(r.Context(), s) {
+				httpError(w, r, http.StatusForbidden, ErrCodeForbidden, "cannot grant the "+s+" scope you do not hold")
+				return
+			}
+		}
+		if req.ExpiresIn < 0 {
+			writeAPIError(w, r, fieldError("expires_in_seconds", "expires_in_seconds must be a positive integer"))
+			return
+		}
+
+		raw := make([]byte, 24)
+		id := make([]byte, 8)
+		if _, err := rand.Read(raw); err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		_, _ = rand.Read(id)
+		secret := tokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+		now := time.Now().UTC()
+		t := &APIToken{
+			ID:        hex.EncodeToString(id),
+			Name:      req.Name,
+			Owner:     owner,
+			Scopes:    dedupeScopes(req.Scopes),
+			CreatedAt: now,
+			Parent:    tokenIDFrom(r.Context()),
+			Hash:      hashToken(secret),
+		}
+		if req.ExpiresIn > 0 {
+			exp := now.Add(time.Duration(req.ExpiresIn) * time.Second)
+			t.ExpiresAt = &exp
+		}
+		if limit, _ := r.Context().Value(credentialExpiryKey).(*time.Time); limit != nil &&
+			(t.ExpiresAt == nil || t.ExpiresAt.After(*limit)) {
+			t.ExpiresAt = limit
+		}
+		if err := tokens.Save(r.Context(), t); err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"action":   "create_token",
+			"owner":    owner,
+			"token_id": t.ID,
+			"scopes":   t.Scopes,
+		}).Info("api token issued")
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"token": secret, "info": t})
+	}
+}
+
+// position is the token's place in listings.
+func (t *APIToken) position() storage.Position {
+	return storage.Position{CreatedAt: t.CreatedAt, Key: t.ID}
+}
+
+func dedupeScopes(list []string) []string {
+	set := scopeSet(list)
+	out := make([]string, 0, len(set))
+	for s := range set {
+		out = append(out, s)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// listTokensHandler serves GET /api/tokens with the caller's tokens, a
+// page at a time, newest first.
+func listTokensHandler(tokens TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, after, apiErr := pageParams(r.URL.Query())
+		if apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		list, err := tokens.List(r.Context(), ownerFrom(r.Context()))
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		now := time.Now().UTC()
+		out := []*APIToken{}
+		for _, t := range list {
+			if !t.expired(now) {
+				out = append(out, t)
+			}
+		}
+		out, next := pageOf(out, (*APIToken).position, storage.Position.Before, after, limit)
+		writeJSON(w, http.StatusOK, withNext(map[string]interface{}{"tokens": out}, next))
+	}
+}
+
+// revokeTokenTree revokes owner's token id and every token issued under
+// it, directly or through other tokens, so that a leaked token cannot
+// keep itself alive through children it minted. It returns the IDs
+// revoked, id first.
+func revokeTokenTree(ctx context.Context, tokens TokenStore, owner, id string) ([]string, error) {
+	list, err := tokens.List(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[string][]string)
+	for _, t := range list {
+		if t.Parent != "" {
+			children[t.Parent] = append(children[t.Parent], t.ID)
+		}
+	}
+	if err := tokens.Revoke(ctx, owner, id); err != nil {
+		return nil, err
+	}
+	revoked := []string{id}
+	for i := 0; i < len(revoked); i++ {
+		for _, child := range children[revoked[i]] {
+			if err := tokens.Revoke(ctx, owner, child); err != nil && !errors.Is(err, ErrTokenNotFound) {
+				return revoked, err
+			}
+			revoked = append(revoked, child)
+		}
+	}
+	return revoked, nil
+}
+
+// revokeTokenHandler serves DELETE /api/tokens/{id}, revoking the tokens
+// issued under it too.
+func revokeTokenHandler(tokens TokenStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		owner := ownerFrom(r.Context())
+		id := mux.Vars(r)["id"]
+		revoked, err := revokeTokenTree(r.Context(), tokens, owner, id)
+		if errors.Is(err, ErrTokenNotFound) {
+			httpError(w, r, http.StatusNotFound, ErrCodeNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"action":   "revoke_token",
+			"owner":    owner,
+			"token_id": id,
+			"revoked":  revoked,
+		}).Info("api token revoked")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
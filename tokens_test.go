@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"url-shortener/storage/storetest"
+)
+
+const testStaticKey = "static-key"
+
+// newTokenRouter serves the token routes as main wires them, behind
+// requireAPIKey with one static key for alice.
+func newTokenRouter(tokens TokenStore) http.Handler {
+	r := mux.NewRouter()
+	api := r.PathPrefix("/api").Subrouter()
+	api.Use(requireAPIKey(map[string]string{testStaticKey: "alice"}, nil, tokens))
+	api.HandleFunc("/tokens", requireScope(ScopeTokensManage, createTokenHandler(tokens))).Methods("POST")
+	api.HandleFunc("/tokens", requireScope(ScopeTokensManage, listTokensHandler(tokens))).Methods("GET")
+	api.HandleFunc("/tokens/{id}", requireScope(ScopeTokensManage, revokeTokenHandler(tokens))).Methods("DELETE")
+	return r
+}
+
+type issuedToken struct {
+	Token string   `json:"token"`
+	Info  APIToken `json:"info"`
+}
+
+func issueToken(t *testing.T, h http.Handler, key string, scopes ...string) issuedToken {
+	t.Helper()
+	var out issuedToken
+	rec := storetest.Do(t, h, storetest.Request{
+		Method: http.MethodPost, Path: "/api/tokens", APIKey: key,
+		Body: createTokenRequest{Scopes: scopes},
+	})
+	storetest.DecodeJSON(t, rec, http.StatusCreated, &out)
+	return out
+}
+
+func TestTokenRoutesRequireScope(t *testing.T) {
+	h := newTokenRouter(newMemoryTokens())
+	dashboard := issueToken(t, h, testStaticKey, ScopeStatsRead)
+	manager := issueToken(t, h, testStaticKey, ScopeTokensManage, ScopeStatsRead)
+
+	tests := []struct {
+		name string
+		key  string
+		req  storetest.Request
+		want int
+	}{
+		{"list without scope", dashboard.Token, storetest.Request{Path: "/api/tokens"}, http.StatusForbidden},
+		{"create without scope", dashboard.Token, storetest.Request{Method: http.MethodPost, Path: "/api/tokens",
+			Body: createTokenRequest{Scopes: []string{ScopeStatsRead}}}, http.StatusForbidden},
+		{"revoke without scope", dashboard.Token, storetest.Request{Method: http.MethodDelete,
+			Path: "/api/tokens/" + manager.Info.ID}, http.StatusForbidden},
+		{"list with scope", manager.Token, storetest.Request{Path: "/api/tokens"}, http.StatusOK},
+		{"grant a scope not held", manager.Token, storetest.Request{Method: http.MethodPost, Path: "/api/tokens",
+			Body: createTokenRequest{Scopes: []string{ScopeLinksCreate}}}, http.StatusForbidden},
+		{"create with scope", manager.Token, storetest.Request{Method: http.MethodPost, Path: "/api/tokens",
+			Body: createTokenRequest{Scopes: []string{ScopeStatsRead}}}, http.StatusCreated},
+		{"static key", testStaticKey, storetest.Request{Path: "/api/tokens"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.req.APIKey = tt.key
+			rec := storetest.Do(t, h, tt.req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d; body: %s", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRevokeTokenCascades(t *testing.T) {
+	h := newTokenRouter(newMemoryTokens())
+	parent := issueToken(t, h, testStaticKey, ScopeTokensManage, ScopeStatsRead)
+	child := issueToken(t, h, parent.Token, ScopeTokensManage, ScopeStatsRead)
+	grandchild := issueToken(t, h, child.Token, ScopeStatsRead)
+	sibling := issueToken(t, h, testStaticKey, ScopeTokensManage)
+
+	if child.Info.Parent != parent.Info.ID || grandchild.Info.Parent != child.Info.ID {
+		t.Fatalf("parents = %q, %q; want %q, %q", child.Info.Parent, grandchild.Info.Parent, parent.Info.ID, child.Info.ID)
+	}
+	if parent.Info.Parent != "" {
+		t.Fatalf("token issued by a static key has parent %q", parent.Info.Parent)
+	}
+
+	rec := storetest.Do(t, h, storetest.Request{Method: http.MethodDelete, Path: "/api/tokens/" + parent.Info.ID, APIKey: testStaticKey})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("revoke: status = %d; body: %s", rec.Code, rec.Body.String())
+	}
+	for name, tok := range map[string]issuedToken{"parent": parent, "child": child, "grandchild": grandchild} {
+		if rec := storetest.Do(t, h, storetest.Request{Path: "/api/tokens", APIKey: tok.Token}); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s after revoking the parent: status = %d, want 401", name, rec.Code)
+		}
+	}
+	if rec := storetest.Do(t, h, storetest.Request{Path: "/api/tokens", APIKey: sibling.Token}); rec.Code != http.StatusOK {
+		t.Errorf("unrelated token after the revoke: status = %d, want 200", rec.Code)
+	}
+}
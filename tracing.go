@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// TracingConfig enables OpenTelemetry tracing over OTLP/HTTP.
+type TracingConfig struct {
+	Enabled     bool    // TRACING_ENABLED
+	Endpoint    string  // OTEL_EXPORTER_OTLP_ENDPOINT, e.g. http://collector:4318
+	ServiceName string  // OTEL_SERVICE_NAME
+	SampleRatio float64 // TRACING_SAMPLE_RATIO of root spans to keep
+}
+
+var tracer = otel.Tracer("url-shortener")
+
+// setupTracing installs the global tracer provider and propagator. The
+// returned func flushes pending spans and must be called on shutdown.
+func setupTracing(ctx context.Context, cfg TracingConfig) (func(context.Context) error, error) {
+	if !cfg.Enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+	var opts []otlptracehttp.Option
+	if cfg.Endpoint != "" {
+		opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"url-shortener/storage"
+)
+
+// transferOfferTTL is how long an offer waits for the recipient.
+const transferOfferTTL = 7 * 24 * time.Hour
+
+func errNoTransfer() *APIError {
+	return newAPIError(http.StatusNotFound, ErrCodeNotFound, "no pending transfer for this link")
+}
+
+// pendingTransfer returns l's offer unless it has run out.
+func pendingTransfer(l *Link, now time.Time) *storage.Transfer {
+	if t := l.PendingTransfer; t != nil && now.Before(t.ExpiresAt) {
+		return t
+	}
+	return nil
+}
+
+// OfferTransfer offers a link managed by from to the owner to, who takes
+// it with AcceptTransfer. With immediate, for admins, to owns the link at
+// once. Clicks, time series and everything else stay with the link.
+func (s *Store) OfferTransfer(ctx context.Context, code, from, to string, immediate bool) (*Link, error) {
+	if to == "" {
+		return nil, fieldError("to", "to must name the new owner")
+	}
+	now := s.now()
+	l, err := s.backend.Update(ctx, s.key(ctx, code), func(l *Link) error {
+		if (!immediate && !canManage(from, l)) || l.Deleted() || l.Reserved {
+			return ErrNotFound
+		}
+		if tenantOf(to) != l.Tenant {
+			return fieldError("to", "to must be an owner in the link's tenant")
+		}
+		if l.Owner == to {
+			return fieldError("to", "the link already belongs to "+to)
+		}
+		if immediate {
+			l.Owner, l.PendingTransfer = to, nil
+			return nil
+		}
+		l.PendingTransfer = &storage.Transfer{From: from, To: to, OfferedAt: now, ExpiresAt: now.Add(transferOfferTTL)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fields := logrus.Fields{"action": "transfer_offer", "short_code": code, "from": from, "to": to}
+	if immediate {
+		fields["action"] = "transfer"
+	}
+	logrus.WithFields(fields).Info("link transfer")
+	return l, nil
+}
+
+// AnswerTransfer settles the pending offer of code. The recipient may
+// accept or decline it; whoever can manage the link may withdraw it.
+func (s *Store) AnswerTransfer(ctx context.Context, code, caller string, accept bool) (*Link, error) {
+	now := s.now()
+	var from, to string
+	l, err := s.backend.Update(ctx, s.key(ctx, code), func(l *Link) error {
+		t := pendingTransfer(l, now)
+		if t == nil || l.Deleted() {
+			return errNoTransfer()
+		}
+		switch {
+		case t.To == caller:
+		case !accept && canManage(caller, l):
+		default:
+			return errNoTransfer()
+		}
+		from, to = t.From, t.To
+		if accept {
+			l.Owner = t.To
+		}
+		l.PendingTransfer = nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	action := "transfer_declined"
+	if accept {
+		action = "transfer_accepted"
+	}
+	logrus.WithFields(logrus.Fields{"action": action, "short_code": code, "from": from, "to": to, "by": caller}).Info("link transfer answered")
+	return l, nil
+}
+
+// TransferOffer is a pending transfer as listed to either party.
+type TransferOffer struct {
+	ShortCode string `json:"short_code"`
+	ShortURL  string `json:"short_url"`
+	LongURL   string `json:"long_url"`
+	storage.Transfer
+}
+
+// Transfers returns a page of the pending offers made to owner and by
+// owner in the request's tenant: those of at most limit links after the
+// cursor, newest first, and the cursor of the next page.
+func (s *Store) Transfers(ctx context.Context, owner string, after *pageCursor, limit int) (incoming, outgoing []TransferOffer, next string, err error) {
+	tenant := tenantFrom(ctx)
+	now := s.now()
+	page := newLinkPage(limit)
+	err = s.backend.ScanFrom(ctx, after.position(), func(l *Link) bool {
+		t := pendingTransfer(l, now)
+		if t == nil || l.Tenant != tenant || l.Deleted() || (t.To != owner && t.From != owner) {
+			return true
+		}
+		return page.add(l)
+	})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	links, next := page.links()
+	incoming, outgoing = []TransferOffer{}, []TransferOffer{}
+	for _, l := range links {
+		t := l.PendingTransfer
+		offer := TransferOffer{ShortCode: l.ShortCode, ShortURL: s.shortURL(l), LongURL: l.LongURL, Transfer: *t}
+		if t.To == owner {
+			incoming = append(incoming, offer)
+		}
+		if t.From == owner {
+			outgoing = append(outgoing, offer)
+		}
+	}
+	return incoming, outgoing, next, nil
+}
+
+// isAdmin reports whether the request may use admin powers, as
+// requireAdmin decides. With authentication disabled links have no
+// owners to offer them to each other, so every transfer is immediate.
+func isAdmin(ctx context.Context, admins map[string]bool, authEnabled bool) bool {
+	return !authEnabled || (admins[ownerFrom(ctx)] && hasScope(ctx, ScopeAdmin))
+}
+
+// transferHandler serves POST /api/links/{code}/transfer with
+// {"to": owner}. An admin's transfer takes effect at once (200); anyone
+// else's is an offer the recipient has to accept (202).
+func transferHandler(store *Store, admins map[string]bool, authEnabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			To string `json:"to"`
+		}
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		immediate := isAdmin(r.Context(), admins, authEnabled)
+		link, err := store.OfferTransfer(r.Context(), codeVar(r), ownerFrom(r.Context()), req.To, immediate)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		status := http.StatusOK
+		if !immediate {
+			status = http.StatusAccepted
+		}
+		writeJSON(w, status, link)
+	}
+}
+
+// answerTransferHandler serves POST /api/links/{code}/transfer/accept and
+// .../decline.
+func answerTransferHandler(store *Store, accept bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link, err := store.AnswerTransfer(r.Context(), codeVar(r), ownerFrom(r.Context()), accept)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, link)
+	}
+}
+
+// listTransfersHandler serves GET /api/transfers: the caller's pending
+// offers, received and made, paged together by the links they are for.
+func listTransfersHandler(store *Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, after, apiErr := pageParams(r.URL.Query())
+		if apiErr != nil {
+			writeAPIError(w, r, apiErr)
+			return
+		}
+		incoming, outgoing, next, err := store.Transfers(r.Context(), ownerFrom(r.Context()), after, limit)
+		if err != nil {
+			writeAPIError(w, r, apiErrorFrom(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, withNext(map[string]interface{}{
+			"incoming": incoming,
+			"outgoing": outgoing,
+		}, next))
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// uiHandler serves the embedded single-page management UI under /ui/. The
+// page only talks to the public JSON API using the key the user enters.
+func uiHandler() http.Handler {
+	sub, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/ui/", http.FileServer(http.FS(sub)))
+}
@@ -0,0 +1,132 @@
+// Management UI for the shortener. Everything goes through the JSON API
+// with the API key kept in localStorage.
+(function () {
+  "use strict";
+
+  var $ = function (id) { return document.getElementById(id); };
+  var key = localStorage.getItem("apiKey") || "";
+
+  function api(method, path, body) {
+    var opts = { method: method, headers: {} };
+    if (key) opts.headers["X-API-Key"] = key;
+    if (body) {
+      opts.headers["Content-Type"] = "application/json";
+      opts.body = JSON.stringify(body);
+    }
+    return fetch("/api" + path, opts).then(function (res) {
+      if (res.status === 204) return null;
+      return res.json().then(function (data) {
+        if (!res.ok) throw new Error((data.error && data.error.message) || res.statusText);
+        return data;
+      });
+    });
+  }
+
+  function say(text, isError) {
+    $("message").textContent = text;
+    $("message").className = isError ? "error" : "";
+  }
+
+  function shortURL(code) {
+    return location.origin + "/" + code;
+  }
+
+  function renderChart(links) {
+    var svg = $("chart");
+    var top = links.slice().sort(function (a, b) { return b.clicks - a.clicks; }).slice(0, 20);
+    var max = Math.max.apply(null, top.map(function (l) { return l.clicks; }).concat([1]));
+    var w = svg.clientWidth || 600, h = 140, bw = w / Math.max(top.length, 1);
+    var ns = "http://www.w3.org/2000/svg";
+    svg.innerHTML = "";
+    top.forEach(function (l, i) {
+      var bh = (h - 20) * l.clicks / max;
+      var rect = document.createElementNS(ns, "rect");
+      rect.setAttribute("x", i * bw + 2);
+      rect.setAttribute("y", h - 14 - bh);
+      rect.setAttribute("width", Math.max(bw - 4, 1));
+      rect.setAttribute("height", bh);
+      var title = document.createElementNS(ns, "title");
+      title.textContent = l.short_code + ": " + l.clicks + " clicks";
+      rect.appendChild(title);
+      var label = document.createElementNS(ns, "text");
+      label.setAttribute("x", i * bw + 2);
+      label.setAttribute("y", h - 2);
+      label.textContent = l.short_code.slice(0, 8);
+      svg.appendChild(rect);
+      svg.appendChild(label);
+    });
+  }
+
+  function renderLinks(links) {
+    var body = $("links");
+    var tpl = $("row");
+    body.innerHTML = "";
+    links.forEach(function (l) {
+      var row = tpl.content.cloneNode(true);
+      var a = row.querySelector(".code");
+      a.textContent = l.short_code;
+      a.href = shortURL(l.short_code);
+      row.querySelector(".dest").textContent = l.long_url;
+      row.querySelector(".dest").title = l.long_url;
+      row.querySelector(".clicks").textContent = l.clicks;
+      row.querySelector(".expires").textContent = new Date(l.expires_at).toLocaleString();
+      row.querySelector(".copy").addEventListener("click", function () {
+        navigator.clipboard.writeText(shortURL(l.short_code)).then(function () {
+          say("Copied " + shortURL(l.short_code));
+        });
+      });
+      row.querySelector(".delete").addEventListener("click", function () {
+        if (!confirm("Delete " + l.short_code + "?")) return;
+        api("DELETE", "/links/" + encodeURIComponent(l.short_code))
+          .then(function () { say("Deleted " + l.short_code); refresh(); })
+          .catch(function (err) { say(err.message, true); });
+      });
+      body.appendChild(row);
+    });
+    renderChart(links);
+  }
+
+  function refresh() {
+    var q = $("search").value;
+    api("GET", "/links?q=" + encodeURIComponent(q))
+      .then(function (data) { renderLinks(data.links || []); })
+      .catch(function (err) { say(err.message, true); });
+  }
+
+  function setKey(k) {
+    key = k;
+    if (k) localStorage.setItem("apiKey", k); else localStorage.removeItem("apiKey");
+    $("apikey").hidden = !!k;
+    $("login").querySelector("button[type=submit]").hidden = !!k;
+    $("logout").hidden = !k;
+    refresh();
+  }
+
+  $("login").addEventListener("submit", function (e) {
+    e.preventDefault();
+    setKey($("apikey").value.trim());
+  });
+  $("logout").addEventListener("click", function () { setKey(""); });
+
+  $("create").addEventListener("submit", function (e) {
+    e.preventDefault();
+    var req = { url: $("url").value };
+    if ($("custom").value) req.custom_code = $("custom").value;
+    if ($("validity").value) req.validity_minutes = parseInt($("validity").value, 10);
+    api("POST", "/shorten", req)
+      .then(function (link) {
+        say("Created " + link.short_url);
+        $("create").reset();
+        refresh();
+      })
+      .catch(function (err) { say(err.message, true); });
+  });
+
+  var searchTimer;
+  $("search").addEventListener("input", function () {
+    clearTimeout(searchTimer);
+    searchTimer = setTimeout(refresh, 250);
+  });
+
+  setKey(key);
+})();
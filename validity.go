@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Validity policies decide what happens to a requested validity outside
+// the configured bounds.
+const (
+	ValidityClamp  = "clamp"  // shorten or extend it to the nearest bound
+	ValidityReject = "reject" // fail the request with a 400
+)
+
+// ValidityLimit bounds how long an owner's links may live; zero Min or
+// Max leaves that side open.
+type ValidityLimit struct {
+	Min    time.Duration
+	Max    time.Duration
+	Policy string
+}
+
+// ValidityLimits holds the server-wide limit and per-owner overrides.
+type ValidityLimits struct {
+	def    ValidityLimit
+	owners map[string]ValidityLimit
+}
+
+func NewValidityLimits(def ValidityLimit, owners map[string]ValidityLimit) *ValidityLimits {
+	return &ValidityLimits{def: def, owners: owners}
+}
+
+// For returns the limit that applies to owner.
+func (v *ValidityLimits) For(owner string) ValidityLimit {
+	if l, ok := v.owners[owner]; ok {
+		return l
+	}
+	return v.def
+}
+
+// clamp moves d inside the bounds and reports whether it had to.
+func (l ValidityLimit) clamp(d time.Duration) (time.Duration, bool) {
+	switch {
+	case l.Min > 0 && d < l.Min:
+		return l.Min, true
+	case l.Max > 0 && d > l.Max:
+		return l.Max, true
+	}
+	return d, false
+}
+
+// parseValidityLimits reads VALIDITY_LIMITS, e.g.
+// "alice=max:720h;bob=min:5m,max:24h,policy:reject". Unset fields fall back
+// to def.
+func parseValidityLimits(raw string, def ValidityLimit) map[string]ValidityLimit {
+	out := make(map[string]ValidityLimit)
+	for _, entry := range strings.Split(raw, ";") {
+		owner, limits, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || owner == "" {
+			continue
+		}
+		l := def
+		for _, kv := range strings.Split(limits, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(kv), ":")
+			if k == "policy" {
+				if v != ValidityClamp && v != ValidityReject {
+					logrus.Warnf("ignoring invalid validity policy %q for %s", v, owner)
+					continue
+				}
+				l.Policy = v
+				continue
+			}
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				logrus.Warnf("ignoring invalid validity limit %q for %s", kv, owner)
+				continue
+			}
+			switch k {
+			case "min":
+				l.Min = d
+			case "max":
+				l.Max = d
+			default:
+				logrus.Warnf("ignoring unknown validity limit %q for %s", k, owner)
+			}
+		}
+		out[owner] = l
+	}
+	return out
+}
+
+// limitValidity applies owner's limit to a validity the client asked for.
+// Under the clamp policy it returns the adjusted value and clamped=true;
+// under reject it returns a 400 naming the bounds.
+func (s *Store) limitValidity(owner string, d time.Duration) (time.Duration, bool, error) {
+	if s.validity == nil {
+		return d, false, nil
+	}
+	l := s.validity.For(owner)
+	limited, clamped := l.clamp(d)
+	if clamped && l.Policy == ValidityReject {
+		e := fieldError("validity_minutes", validityBoundsMessage(l))
+		e.Details = map[string]interface{}{}
+		if l.Min > 0 {
+			e.Details["min_minutes"] = ceilMinutes(l.Min)
+		}
+		if l.Max > 0 {
+			e.Details["max_minutes"] = int64(l.Max / time.Minute)
+		}
+		return 0, false, e
+	}
+	if clamped {
+		logrus.WithFields(logrus.Fields{
+			"action":    "validity_clamp",
+			"owner":     owner,
+			"requested": d.String(),
+			"granted":   limited.String(),
+		}).Info("requested validity clamped")
+	}
+	return limited, clamped, nil
+}
+
+// requestedValidity reads the lifetime a create request asked for, as
+// validity_minutes or an absolute expires_at, and applies owner's limit.
+// Zero means neither was given.
+func (s *Store) requestedValidity(owner string, minutes int, expiresAt *time.Time) (time.Duration, bool, error) {
+	switch {
+	case minutes < 0:
+		return 0, false, fieldError("validity_minutes", "validity_minutes must be a positive integer")
+	case minutes > 0 && expiresAt != nil:
+		return 0, false, fieldError("expires_at", "set either validity_minutes or expires_at, not both")
+	case minutes > 0:
+		return s.limitValidity(owner, time.Duration(minutes)*time.Minute)
+	case expiresAt != nil:
+		d := expiresAt.Sub(s.now())
+		if d <= 0 {
+			return 0, false, fieldError("expires_at", "expires_at must be in the future")
+		}
+		return s.limitValidity(owner, d)
+	}
+	return 0, false, nil
+}
+
+// clampValidity is limitValidity for validities the client did not ask
+// for, such as the default or a cloned link's; these are always clamped.
+func (s *Store) clampValidity(owner string, d time.Duration) time.Duration {
+	if s.validity == nil {
+		return d
+	}
+	d, _ = s.validity.For(owner).clamp(d)
+	return d
+}
+
+func validityBoundsMessage(l ValidityLimit) string {
+	switch {
+	case l.Min > 0 && l.Max > 0:
+		return fmt.Sprintf("validity_minutes must be between %d and %d", ceilMinutes(l.Min), int64(l.Max/time.Minute))
+	case l.Min > 0:
+		return fmt.Sprintf("validity_minutes must be at least %d", ceilMinutes(l.Min))
+	default:
+		return fmt.Sprintf("validity_minutes must be at most %d", int64(l.Max/time.Minute))
+	}
+}
+
+// ceilMinutes rounds a lower bound up so the minutes quoted satisfy it.
+func ceilMinutes(d time.Duration) int64 { return int64((d + time.Minute - 1) / time.Minute) }
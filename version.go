@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// Build information, set at link time:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) \
+//	    -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Builds without them fall back to the VCS stamp the go tool embeds.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// VersionInfo is what GET /version reports, so operators can tell which
+// build and configuration each instance runs.
+type VersionInfo struct {
+	Version      string    `json:"version"`
+	Commit       string    `json:"commit,omitempty"`
+	BuildDate    string    `json:"build_date,omitempty"`
+	GoVersion    string    `json:"go_version"`
+	Instance     string    `json:"instance"`
+	Storage      string    `json:"storage"`
+	Coordination string    `json:"coordination"`
+	Features     []string  `json:"features"`
+	Flags        []string  `json:"flags"`
+	StartedAt    time.Time `json:"started_at"`
+}
+
+func newVersionInfo(cfg Config, storageBackend string) VersionInfo {
+	v := VersionInfo{
+		Version:      version,
+		Commit:       commit,
+		BuildDate:    buildDate,
+		GoVersion:    runtime.Version(),
+		Instance:     cfg.InstanceID,
+		Storage:      storageBackend,
+		Coordination: cfg.CoordinationMode,
+		Features:     enabledFeatures(cfg),
+		StartedAt:    time.Now().UTC(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		var dirty bool
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if v.Commit == "" {
+					v.Commit = s.Value
+				}
+			case "vcs.time":
+				if v.BuildDate == "" {
+					v.BuildDate = s.Value
+				}
+			case "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+		if dirty && commit == "" && v.Commit != "" {
+			v.Commit += "-dirty"
+		}
+	}
+	return v
+}
+
+// enabledFeatures lists the optional behaviours cfg switches on.
+func enabledFeatures(cfg Config) []string {
+	on := map[string]bool{
+		"tracing":            cfg.Tracing.Enabled,
+		"click_export":       cfg.Export.Enabled,
+		"health_checks":      cfg.Health.Enabled,
+		"link_previews":      cfg.Preview.Enabled,
+		"cluster":            cfg.Cluster.Self != "",
+		"url_encryption":     cfg.Encryption.Keys != "",
+		"edge_prewarm":       cfg.Edge.Provider != "",
+		"kafka_events":       cfg.Events.KafkaBrokers != "",
+		"geoip":              cfg.GeoIP.Path != "",
+		"privacy_mode":       cfg.Privacy.Global,
+		"honor_dnt":          cfg.Privacy.HonorDNT,
+		"click_batching":     cfg.Clicks.FlushInterval > 0,
+		"click_series":       cfg.Clicks.SeriesEnabled,
+		"signed_links":       cfg.Signing.Keys != "",
+		"flatten_redirects":  cfg.Flatten.Enabled,
+		"loop_protection":    cfg.LoopProtection != LoopOff,
+		"destination_policy": cfg.DestinationPolicy.Mode != "",
+		"fraud_detection":    cfg.Fraud.Enabled,
+		"report_captcha":     cfg.Abuse.CaptchaProvider != "" || cfg.Abuse.CaptchaVerifyURL != "",
+		"public_shorten":     cfg.Public.Enabled,
+		"access_log_sink":    cfg.AccessLog.Sink != "",
+		"canonical_host":     cfg.Host.Canonical != "" || cfg.Host.ForceHTTPS,
+		"soft_delete":        cfg.DeleteGrace > 0,
+		"count_head_clicks":  cfg.CountHeadClicks,
+		"tls":                cfg.Server.TLSCertFile != "",
+		"http2":              cfg.Server.HTTP2,
+		"h2c":                cfg.Server.HTTP2 && cfg.Server.HTTP2Cleartext,
+		"log_url_redaction":  cfg.Log.URLRedaction != "" && cfg.Log.URLRedaction != RedactNone,
+		"validity_limits":    cfg.Validity.Min > 0 || cfg.Validity.Max > 0 || cfg.ValidityLimits != "",
+	}
+	out := []string{}
+	for name, enabled := range on {
+		if enabled {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// versionHandler serves GET /version. It needs no authentication so
+// deploy tooling can poll every instance. Feature flags can change at
+// runtime, so they are read per request.
+func versionHandler(info VersionInfo, flags *Flags) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := info
+		resp.Flags = flags.Names()
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
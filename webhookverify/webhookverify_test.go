@@ -0,0 +1,127 @@
+package webhookverify_test
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"url-shortener/webhookverify"
+)
+
+var secret = []byte("s3cret")
+
+// delivery returns the headers of body signed with key at ts under nonce.
+func delivery(key []byte, ts time.Time, nonce string, body []byte) http.Header {
+	h := http.Header{}
+	h.Set(webhookverify.HeaderTimestamp, strconv.FormatInt(ts.Unix(), 10))
+	h.Set(webhookverify.HeaderNonce, nonce)
+	h.Set(webhookverify.HeaderSignature, webhookverify.Sign(key, ts, nonce, body))
+	return h
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"event":"link.created"}`)
+	tests := []struct {
+		name    string
+		header  http.Header
+		body    []byte
+		wantErr error
+	}{
+		{"valid", delivery(secret, now, "n1", body), body, nil},
+		{"within skew, behind", delivery(secret, now.Add(-4*time.Minute), "n1", body), body, nil},
+		{"within skew, ahead", delivery(secret, now.Add(4*time.Minute), "n1", body), body, nil},
+		{"too old", delivery(secret, now.Add(-6*time.Minute), "n1", body), body, webhookverify.ErrBadTimestamp},
+		{"too far ahead", delivery(secret, now.Add(6*time.Minute), "n1", body), body, webhookverify.ErrBadTimestamp},
+		{"unparsable timestamp", func() http.Header {
+			h := delivery(secret, now, "n1", body)
+			h.Set(webhookverify.HeaderTimestamp, "yesterday")
+			return h
+		}(), body, webhookverify.ErrBadTimestamp},
+		{"missing nonce", func() http.Header {
+			h := delivery(secret, now, "n1", body)
+			h.Del(webhookverify.HeaderNonce)
+			return h
+		}(), body, webhookverify.ErrMissingHeaders},
+		{"body changed", delivery(secret, now, "n1", body), []byte(`{"event":"link.deleted"}`), webhookverify.ErrBadSignature},
+		{"nonce changed", func() http.Header {
+			h := delivery(secret, now, "n1", body)
+			h.Set(webhookverify.HeaderNonce, "n2")
+			return h
+		}(), body, webhookverify.ErrBadSignature},
+		{"wrong secret", delivery([]byte("other"), now, "n1", body), body, webhookverify.ErrBadSignature},
+		{"one of several signatures", func() http.Header {
+			h := delivery(secret, now, "n1", body)
+			h.Set(webhookverify.HeaderSignature, "v1=00, "+h.Get(webhookverify.HeaderSignature))
+			return h
+		}(), body, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := webhookverify.New(secret)
+			v.Now = func() time.Time { return now }
+			if err := v.Verify(tt.header, tt.body); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{}`)
+	tests := []struct {
+		name       string
+		deliveries []http.Header
+		wantErrs   []error
+	}{
+		{"same delivery twice",
+			[]http.Header{delivery(secret, now, "n1", body), delivery(secret, now, "n1", body)},
+			[]error{nil, webhookverify.ErrReplayed}},
+		{"re-signed retry with the same nonce",
+			[]http.Header{delivery(secret, now, "n1", body), delivery(secret, now.Add(time.Second), "n1", body)},
+			[]error{nil, webhookverify.ErrReplayed}},
+		{"fresh nonces",
+			[]http.Header{delivery(secret, now, "n1", body), delivery(secret, now, "n2", body)},
+			[]error{nil, nil}},
+		{"forgery does not burn the nonce",
+			[]http.Header{delivery([]byte("other"), now, "n1", body), delivery(secret, now, "n1", body)},
+			[]error{webhookverify.ErrBadSignature, nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := webhookverify.New(secret)
+			v.Now = func() time.Time { return now }
+			for i, h := range tt.deliveries {
+				if err := v.Verify(h, body); !errors.Is(err, tt.wantErrs[i]) {
+					t.Errorf("delivery %d: Verify = %v, want %v", i+1, err, tt.wantErrs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyRotation(t *testing.T) {
+	body := []byte(`{}`)
+	v := &webhookverify.Verifier{Secrets: [][]byte{[]byte("new"), []byte("old")}}
+	for _, key := range []string{"new", "old"} {
+		if err := v.Verify(delivery([]byte(key), time.Now(), "n-"+key, body), body); err != nil {
+			t.Errorf("delivery signed with %s secret: %v", key, err)
+		}
+	}
+}
+
+func TestMemoryNoncesExpire(t *testing.T) {
+	m := webhookverify.NewMemoryNonces()
+	if m.Seen("n1", time.Now().Add(-time.Second)) {
+		t.Fatal("first sighting reported as seen")
+	}
+	if m.Seen("n1", time.Now().Add(time.Minute)) {
+		t.Error("expired nonce still reported as seen")
+	}
+	if !m.Seen("n1", time.Now().Add(time.Minute)) {
+		t.Error("live nonce not reported as seen")
+	}
+}
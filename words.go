@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"embed"
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+//go:embed words/*.txt
+var wordFiles embed.FS
+
+// Code styles selectable per request.
+const (
+	StyleRandom = "random"
+	StyleWords  = "words"
+)
+
+// wordCodes builds readable codes such as blue-tiger-42 from the bundled
+// word lists.
+type wordCodes struct {
+	adjectives, nouns []string
+}
+
+// newWordCodes loads the bundled lists. Combinations are screened by the
+// Store's CodeFilter like any other generated code.
+func newWordCodes() *wordCodes {
+	return &wordCodes{
+		adjectives: loadWords("words/adjectives.txt"),
+		nouns:      loadWords("words/nouns.txt"),
+	}
+}
+
+func (g *wordCodes) Next(context.Context) (string, error) {
+	adj := g.adjectives[rand.Intn(len(g.adjectives))]
+	noun := g.nouns[rand.Intn(len(g.nouns))]
+	return fmt.Sprintf("%s-%s-%d", adj, noun, 10+rand.Intn(90)), nil
+}
+
+// loadWords reads one lower-case word per line, skipping blanks and
+// #-comments.
+func loadWords(name string) []string {
+	f, err := wordFiles.Open(name)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	var words []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.ToLower(strings.TrimSpace(sc.Text()))
+		if line != "" && !strings.HasPrefix(line, "#") {
+			words = append(words, line)
+		}
+	}
+	return words
+}